@@ -2,15 +2,20 @@ package main
 
 import (
 	"flag"
+	"fmt"
 	"log"
+	"os"
 
 	"github.com/joho/godotenv"
 
 	"github.com/sudeeya/key-exchange/internal/agent"
+	"github.com/sudeeya/key-exchange/internal/pkg/rng"
 )
 
 func main() {
 	envFile := flag.String("e", ".env", "Path to the file storing environment variables")
+	seed := flag.String("seed", "", "Seed of the deterministic RNG, for builds with the deterministic tag only")
+	headless := flag.Bool("headless", false, "Run the agent as a daemon without the TUI")
 
 	flag.Parse()
 
@@ -18,6 +23,23 @@ func main() {
 		log.Fatal(err)
 	}
 
-	a := agent.NewAgent()
+	if flag.NArg() > 0 {
+		if err := agent.RunCommand(flag.Args(), os.Stdout); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	random, err := rng.New(*seed)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	a := agent.NewAgent(random)
+	if *headless {
+		a.RunHeadless()
+		return
+	}
 	a.Run()
 }
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"crypto/mlkem"
 	"crypto/rand"
 	"crypto/rsa"
 	"flag"
@@ -12,20 +13,38 @@ import (
 const keySize = 2048
 
 func main() {
+	keyType := flag.String("type", "rsa", "Type of the key pair: rsa, or mlkem768 for post-quantum cipher suites")
 	privatePath := flag.String("private", "private.pem", "Path to the file that will store the private key")
 	publicPath := flag.String("public", "public.pem", "Path to the file that will store the public key")
 
 	flag.Parse()
 
-	privateKey, err := rsa.GenerateKey(rand.Reader, keySize)
-	if err != nil {
-		log.Fatal(err)
-	}
+	switch *keyType {
+	case "rsa":
+		privateKey, err := rsa.GenerateKey(rand.Reader, keySize)
+		if err != nil {
+			log.Fatal(err)
+		}
 
-	if err := pem.SaveRSAPrivateKey(privateKey, *privatePath); err != nil {
-		log.Fatal(err)
-	}
-	if err := pem.SaveRSAPublicKey(&privateKey.PublicKey, *publicPath); err != nil {
-		log.Fatal(err)
+		if err := pem.SaveRSAPrivateKey(privateKey, *privatePath); err != nil {
+			log.Fatal(err)
+		}
+		if err := pem.SaveRSAPublicKey(&privateKey.PublicKey, *publicPath); err != nil {
+			log.Fatal(err)
+		}
+	case "mlkem768":
+		privateKey, err := mlkem.GenerateKey768()
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		if err := pem.SaveMLKEMPrivateKey(privateKey, *privatePath); err != nil {
+			log.Fatal(err)
+		}
+		if err := pem.SaveMLKEMPublicKey(privateKey.EncapsulationKey(), *publicPath); err != nil {
+			log.Fatal(err)
+		}
+	default:
+		log.Fatalf("unknown key type %q", *keyType)
 	}
 }
@@ -2,15 +2,19 @@ package main
 
 import (
 	"flag"
+	"fmt"
 	"log"
+	"os"
 
 	"github.com/joho/godotenv"
 
+	"github.com/sudeeya/key-exchange/internal/pkg/rng"
 	"github.com/sudeeya/key-exchange/internal/trent"
 )
 
 func main() {
 	envFile := flag.String("e", ".env", "Path to the file storing environment variables")
+	seed := flag.String("seed", "", "Seed of the deterministic RNG, for builds with the deterministic tag only")
 
 	flag.Parse()
 
@@ -18,6 +22,19 @@ func main() {
 		log.Fatal(err)
 	}
 
-	t := trent.NewTrent()
+	if flag.NArg() > 0 {
+		if err := trent.RunCommand(flag.Args(), os.Stdout); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	random, err := rng.New(*seed)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	t := trent.NewTrent(random)
 	t.Run()
 }
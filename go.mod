@@ -1,6 +1,6 @@
 module github.com/sudeeya/key-exchange
 
-go 1.23.0
+go 1.24.0
 
 require (
 	github.com/caarlos0/env v3.5.0+incompatible
@@ -10,8 +10,11 @@ require (
 	github.com/go-chi/chi/v5 v5.1.0
 	github.com/go-resty/resty/v2 v2.15.3
 	github.com/golang-module/dongle v0.2.8
+	github.com/gorilla/websocket v1.5.3
 	github.com/joho/godotenv v1.5.1
 	go.uber.org/zap v1.27.0
+	golang.org/x/crypto v0.27.0
+	golang.org/x/time v0.6.0
 )
 
 require (
@@ -31,7 +34,6 @@ require (
 	github.com/rivo/uniseg v0.4.7 // indirect
 	github.com/stretchr/testify v1.9.0 // indirect
 	go.uber.org/multierr v1.11.0 // indirect
-	golang.org/x/crypto v0.27.0 // indirect
 	golang.org/x/net v0.29.0 // indirect
 	golang.org/x/sync v0.8.0 // indirect
 	golang.org/x/sys v0.25.0 // indirect
@@ -1,88 +1,97 @@
 package agent
 
 import (
-	"encoding/json"
-	"fmt"
+	"context"
+	"crypto/mlkem"
+	"crypto/rsa"
+	"errors"
 	"log"
+	"net"
 	"net/http"
-	"os"
 	"os/signal"
-	"strings"
+	"sync"
+	"sync/atomic"
 	"syscall"
 
-	"github.com/charmbracelet/bubbles/textinput"
 	tea "github.com/charmbracelet/bubbletea"
-	lip "github.com/charmbracelet/lipgloss"
 	"github.com/go-chi/chi/v5"
 	"github.com/go-resty/resty/v2"
 	"go.uber.org/zap"
 
 	"github.com/sudeeya/key-exchange/internal/pkg/api"
-	"github.com/sudeeya/key-exchange/internal/pkg/crypto"
+	"github.com/sudeeya/key-exchange/internal/pkg/health"
 	"github.com/sudeeya/key-exchange/internal/pkg/middleware"
 	"github.com/sudeeya/key-exchange/internal/pkg/pem"
 	"github.com/sudeeya/key-exchange/internal/pkg/rng"
+	"github.com/sudeeya/key-exchange/internal/pkg/tracing"
 )
 
 const (
-	menuMode = iota
-	requestMode
-	mailMode
-	messageMode
-)
-
-const (
-	requestSessionKeyItem = iota
-	mailboxItem
-	writeMessageItem
-)
-
-const httpPrefix = "http://"
-
-var _ tea.Model = (*Agent)(nil)
-
-var (
-	activeStyle   = lip.NewStyle().Foreground(lip.Color("255"))
-	inactiveStyle = lip.NewStyle().Foreground(lip.Color("240"))
-	errorStyle    = lip.NewStyle().Foreground(lip.Color("160"))
+	httpPrefix  = "http://"
+	serviceName = "agent"
 )
 
 type Agent struct {
-	cfg    *config
-	logger *zap.Logger
-	tui    *tui
-	keys   *keys
-	client *resty.Client
-	mux    *chi.Mux
-	rng    *rng.RNG
-}
-
-type tui struct {
-	mode     int
-	items    []string
-	active   map[int]struct{}
-	cursor   int
-	input    textinput.Model
-	session  string
-	messages []string
-	unread   bool
-	err      string
+	cfg       *config
+	logger    *zap.Logger
+	tui       *tui
+	stepper   *stepper
+	consents  *consents
+	keys      *keys
+	suites    []string
+	peers     map[string]string
+	sessions  *sessionTable
+	tunnels   *tunnels
+	streams   *streams
+	mailbox   *mailbox
+	events    *broker
+	transfers *transfers
+	downloads *downloads
+	client    *resty.Client
+	// transferClient carries file chunks and tunnel upgrades, whose bodies
+	// are not logged.
+	transferClient *resty.Client
+	mux            *chi.Mux
+	controlMux     *chi.Mux
+	controlToken   string
+	rng            rng.RNG
+	metrics        *agentMetrics
+	tracer         *tracing.Tracer
+	traces         *tracing.Collector
+	server         *http.Server
+	controlServers []*http.Server
+	draining       *atomic.Bool
 }
 
+// keys holds the agent's RSA keys both as read from disk and parsed, so that
+// they are parsed once rather than on every operation.
 type keys struct {
 	privateKey []byte
 	trentKey   []byte
-	agentKey   []byte
-	sessionKey []byte
-	nonce      []byte
+	rsaKey     *rsa.PrivateKey
+	trentRSA   *rsa.PublicKey
+	// kemKey is set if the agent has an ML-KEM key pair for post-quantum
+	// cipher suites.
+	kemKey *mlkem.DecapsulationKey768
+	// cache is false if the PEM keys are to be parsed on every use.
+	cache bool
+
+	mu       sync.Mutex
+	peersRSA map[string]*rsa.PublicKey
 }
 
-func NewAgent() *Agent {
+// NewAgent sets up the agent from the environment. random is where its
+// nonces, IVs and keys come from.
+func NewAgent(random rng.RNG) *Agent {
 	cfg, err := newConfig()
 	if err != nil {
 		log.Fatal(err)
 	}
 
+	return newAgent(cfg, random)
+}
+
+func newAgent(cfg *config, random rng.RNG) *Agent {
 	loggerCfg := zap.NewDevelopmentConfig()
 	loggerCfg.OutputPaths = []string{
 		cfg.LogFile,
@@ -98,49 +107,122 @@ func NewAgent() *Agent {
 		logger.Fatal(err.Error())
 	}
 
+	logger.Info("Forming peer list")
+	peers, err := newPeers(cfg.AgentIDs, cfg.AgentAddrs)
+	if err != nil {
+		logger.Fatal(err.Error())
+	}
+
+	logger.Info("Initializing consent policy")
+	consentPolicy, err := newConsentPolicy(cfg)
+	if err != nil {
+		logger.Fatal(err.Error())
+	}
+
+	logger.Info("Initializing cipher suites")
+	suites, err := cipherSuites(cfg)
+	if err != nil {
+		logger.Fatal(err.Error())
+	}
+
+	logger.Info("Initializing tunnels")
+	tunnels, err := newTunnels(cfg, peers)
+	if err != nil {
+		logger.Fatal(err.Error())
+	}
+
+	logger.Info("Initializing download directory")
+	downloads, err := newDownloads(cfg.DownloadDir, cfg.MaxFileSize)
+	if err != nil {
+		logger.Fatal(err.Error())
+	}
+
+	logger.Info("Initializing session table")
+	sessions := newSessionTable()
+
+	logger.Info("Initializing metrics")
+	metrics := newAgentMetrics(sessions, tunnels)
+
+	logger.Info("Initializing tracer")
+	traces := tracing.NewCollector(0)
+	exporters := []tracing.Exporter{traces}
+	if cfg.TraceFile != "" {
+		fileExporter, err := tracing.NewFileExporter(cfg.TraceFile)
+		if err != nil {
+			logger.Fatal(err.Error())
+		}
+		exporters = append(exporters, fileExporter)
+	}
+	tracer := tracing.NewTracer(serviceName+"/"+cfg.ID, exporters...)
+
 	logger.Info("Initializing router")
 	mux := chi.NewRouter()
 
 	logger.Info("Initializing middleware")
-	mux.Use(middleware.WithLogging(logger))
+	mux.Use(middleware.WithTracing(tracer))
+	mux.Use(middleware.WithMetrics(metrics.http))
+
+	logger.Info("Initializing control router")
+	if err := checkControlConfig(cfg); err != nil {
+		logger.Fatal(err.Error())
+	}
+	var controlToken string
+	if cfg.ControlAddr != "" {
+		controlToken, err = loadControlToken(cfg.ControlTokenFile, random)
+		if err != nil {
+			logger.Fatal(err.Error())
+		}
+	}
+	controlMux := chi.NewRouter()
 
 	logger.Info("Initializing http client")
 	client := resty.New()
 	client.SetLogger(logger.Sugar())
 	client.SetDebug(true)
+	tracing.InstrumentClient(client)
+	transferClient := resty.New()
+	transferClient.SetLogger(logger.Sugar())
+	tracing.InstrumentClient(transferClient)
 
-	logger.Info("Initializing RNG")
-	rng := rng.NewRNG()
+	if rng.IsDeterministic(random) {
+		logger.Warn("Using a deterministic RNG: nonces and keys are predictable from the seed")
+	}
 
-	return &Agent{
-		cfg:    cfg,
-		logger: logger,
-		tui:    initialTUI(),
-		keys:   keys,
-		client: client,
-		mux:    mux,
-		rng:    rng,
+	logger.Info("Loading message history")
+	mailbox, err := newMailbox(cfg, keys.privateKey, random)
+	if err != nil {
+		logger.Fatal(err.Error())
+	}
+	if mailbox.skipped > 0 {
+		logger.Warn("Skipped damaged history records", zap.Int("records", mailbox.skipped))
 	}
-}
 
-func initialTUI() *tui {
-	return &tui{
-		mode: menuMode,
-		items: []string{
-			"Request session key",
-			"Mailbox",
-			"Write a message",
-		},
-		active: map[int]struct{}{
-			requestSessionKeyItem: {},
-			mailboxItem:           {},
-		},
-		cursor:   requestSessionKeyItem,
-		input:    textinput.New(),
-		session:  "",
-		messages: make([]string, 0),
-		unread:   false,
-		err:      "",
+	return &Agent{
+		cfg:            cfg,
+		logger:         logger,
+		tui:            initialTUI(peers),
+		stepper:        newStepper(),
+		consents:       newConsents(consentPolicy),
+		keys:           keys,
+		suites:         suites,
+		peers:          peers,
+		sessions:       sessions,
+		tunnels:        tunnels,
+		streams:        newStreams(),
+		mailbox:        mailbox,
+		events:         newBroker(),
+		transfers:      newTransfers(),
+		downloads:      downloads,
+		client:         client,
+		transferClient: transferClient,
+		mux:            mux,
+		controlMux:     controlMux,
+		controlToken:   controlToken,
+		rng:            random,
+		metrics:        metrics,
+		tracer:         tracer,
+		traces:         traces,
+		draining:       &atomic.Bool{},
 	}
 }
 
@@ -155,365 +237,281 @@ func initialKeys(cfg *config) (*keys, error) {
 		return nil, err
 	}
 
+	rsaKey, err := pem.ParseRSAPrivateKey(privateKey)
+	if err != nil {
+		return nil, err
+	}
+	trentRSA, err := pem.ParseRSAPublicKey(trentKey)
+	if err != nil {
+		return nil, err
+	}
+
+	var kemKey *mlkem.DecapsulationKey768
+	if cfg.MLKEMPrivateKey != "" {
+		kemPrivateKey, err := pem.ExtractMLKEMPrivateKey(cfg.MLKEMPrivateKey)
+		if err != nil {
+			return nil, err
+		}
+		kemKey, err = pem.ParseMLKEMPrivateKey(kemPrivateKey)
+		if err != nil {
+			return nil, err
+		}
+	}
+
 	return &keys{
 		privateKey: privateKey,
 		trentKey:   trentKey,
-		agentKey:   make([]byte, 0),
-		sessionKey: make([]byte, 0),
+		rsaKey:     rsaKey,
+		trentRSA:   trentRSA,
+		kemKey:     kemKey,
+		cache:      cfg.CacheKeys,
+		peersRSA:   make(map[string]*rsa.PublicKey),
 	}, nil
 }
 
-func (a Agent) Init() tea.Cmd {
-	return nil
-}
-
-func (a Agent) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
-	switch msg := msg.(type) {
-	case tea.KeyMsg:
-		switch msg.String() {
-		case "ctrl+c":
-			a.tuiShutdown()
-			return a, tea.Quit
-		case "q":
-			switch a.tui.mode {
-			case menuMode:
-				a.tuiShutdown()
-				return a, tea.Quit
-			}
-		case "esc":
-			switch a.tui.mode {
-			case requestMode, messageMode:
-				a.tui.mode = menuMode
-				a.tui.input.Reset()
-				a.tui.input.Blur()
-				return a, nil
-			case mailMode:
-				a.tui.unread = false
-				a.tui.mode = menuMode
-				return a, nil
-			}
-		case "up":
-			switch a.tui.mode {
-			case menuMode:
-				if a.tui.cursor > 0 {
-					a.tui.cursor--
-				}
-				return a, nil
-			}
-		case "down":
-			switch a.tui.mode {
-			case menuMode:
-				_, ok := a.tui.active[a.tui.cursor+1]
-				if a.tui.cursor < len(a.tui.items)-1 && ok {
-					a.tui.cursor++
-				}
-				return a, nil
-			}
-		case "enter":
-			switch a.tui.mode {
-			case menuMode:
-				a.tui.input.Focus()
-				return a, selectItemCmd(a.tui)
-			case requestMode:
-				agentID := a.tui.input.Value()
-				a.tui.input.Reset()
-
-				if agentID != a.cfg.AgentID {
-					a.tui.input.Placeholder = "Agent with such ID does not exist. Try again"
-					return a, nil
-				}
-
-				a.tui.input.Blur()
-				a.tui.mode = menuMode
-
-				return a, requestSessionKeyCmd(&a, agentID)
-			case messageMode:
-				msg := a.tui.input.Value()
-				a.tui.input.Reset()
-				a.tui.input.Blur()
-				a.tui.mode = menuMode
-
-				return a, sendMessageCmd(&a, msg)
-			}
-		}
-	case ModeChangedMsg:
-		a.tui.mode = int(msg)
-	case ErrorMsg:
-		if error(msg) != nil {
-			a.tui.err = error(msg).Error()
-		}
+// private returns the agent's private key, parsed again unless keys are
+// cached. It returns nil if the key cannot be parsed.
+func (k *keys) private() *rsa.PrivateKey {
+	if k.cache {
+		return k.rsaKey
 	}
 
-	switch a.tui.mode {
-	case requestMode, messageMode:
-		var cmd tea.Cmd
-		a.tui.input, cmd = a.tui.input.Update(msg)
-		return a, cmd
-	case menuMode:
-		return a, nil
+	key, err := pem.ParseRSAPrivateKey(k.privateKey)
+	if err != nil {
+		return nil
 	}
 
-	return a, nil
+	return key
 }
 
-func (a Agent) View() string {
-	var s strings.Builder
-	s.WriteString("\n")
-
-	switch a.tui.mode {
-	case menuMode:
-		for i, item := range a.tui.items {
-			cursor := " "
-			if a.tui.cursor == i {
-				cursor = ">"
-			}
-
-			style := inactiveStyle
-			if _, ok := a.tui.active[i]; ok {
-				style = activeStyle
-			}
-
-			switch {
-			case i == mailboxItem && a.tui.unread:
-				s.WriteString(fmt.Sprintf(" %s [!] %s\n", activeStyle.Render(cursor), style.Render(item)))
-			default:
-				s.WriteString(fmt.Sprintf(" %s     %s\n", activeStyle.Render(cursor), style.Render(item)))
-			}
-
-		}
+// trent returns Trent's public key, parsed again unless keys are cached. It
+// returns nil if the key cannot be parsed.
+func (k *keys) trent() *rsa.PublicKey {
+	if k.cache {
+		return k.trentRSA
+	}
 
-		if a.tui.err != "" {
-			s.WriteString(errorStyle.Render(fmt.Sprintf("\n %s\n", a.tui.err)))
-		}
+	key, err := pem.ParseRSAPublicKey(k.trentKey)
+	if err != nil {
+		return nil
+	}
 
-		if a.tui.session != "" {
-			s.WriteString(inactiveStyle.Render(fmt.Sprintf("\n Session with %s established\n", a.tui.session)))
-		}
+	return key
+}
 
-		s.WriteString(inactiveStyle.Render("\n Press q to quit\n"))
-	case requestMode, messageMode:
-		s.WriteString(" " + a.tui.input.View() + "\n")
+// maxPeerKeys bounds the cache of parsed peer keys. Keys are cached by their
+// PEM encoding, so a rotated key simply becomes a new entry.
+const maxPeerKeys = 64
 
-		s.WriteString(inactiveStyle.Render("\n Press esc to return to the menu\n"))
-	case mailMode:
-		if len(a.tui.messages) == 0 {
-			s.WriteString(inactiveStyle.Render(" Mailbox is empty\n"))
+// publicKey parses a peer's PEM public key, as found in Trent's
+// certificates, or returns it from the cache. It returns nil if the key is
+// invalid.
+func (k *keys) publicKey(data []byte) *rsa.PublicKey {
+	if !k.cache {
+		key, err := pem.ParseRSAPublicKey(data)
+		if err != nil {
+			return nil
 		}
+		return key
+	}
 
-		for _, message := range a.tui.messages {
-			point := "*"
-			s.WriteString(fmt.Sprintf(" %s %s\n", activeStyle.Render(point), activeStyle.Render(message)))
-		}
+	k.mu.Lock()
+	defer k.mu.Unlock()
 
-		s.WriteString(inactiveStyle.Render("\n Press esc to return to the menu\n"))
+	if key, ok := k.peersRSA[string(data)]; ok {
+		return key
 	}
 
-	return s.String()
+	key, err := pem.ParseRSAPublicKey(data)
+	if err != nil {
+		return nil
+	}
+	if len(k.peersRSA) >= maxPeerKeys {
+		clear(k.peersRSA)
+	}
+	k.peersRSA[string(data)] = key
+
+	return key
 }
 
-func (a Agent) Run() {
-	a.logger.Info("Initializing endpoints")
-	a.addRoutes()
+// Run serves peer and control requests and starts the TUI.
+func (a *Agent) Run() {
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, syscall.SIGINT, syscall.SIGQUIT)
+	defer stop()
 
-	sigCh := make(chan os.Signal, 1)
-	signal.Notify(sigCh, syscall.SIGTERM, syscall.SIGINT, syscall.SIGQUIT)
+	prog := tea.NewProgram(a, tea.WithAltScreen(), tea.WithContext(ctx))
 
-	prog := tea.NewProgram(a, tea.WithAltScreen())
+	// Step mode needs someone at the TUI to let messages go, so it is never
+	// turned on in headless mode.
+	a.stepper.enabled.Store(a.cfg.StepMode)
 
-	a.logger.Info("Agent is running")
-	go func() {
-		<-sigCh
-		a.logger.Info("Agent is shutting down")
-		a.Shutdown()
-	}()
+	events, unsubscribe := a.events.subscribe()
+	go forwardEvents(prog, events)
 
+	errCh := a.serve()
 	go func() {
-		if err := http.ListenAndServe(a.cfg.Addr, a.mux); err != nil {
-			a.logger.Fatal(err.Error())
+		if err := <-errCh; err != nil {
+			prog.Quit()
 		}
 	}()
 
-	if _, err := prog.Run(); err != nil {
-		a.logger.Fatal(err.Error())
-	}
-}
-
-func (a Agent) Shutdown() {
-	if err := a.logger.Sync(); err != nil {
-		a.logger.Sugar().Fatalf("failed to sync logger: %v", err)
+	a.logger.Info("Agent is running")
+	if _, err := prog.Run(); err != nil && !errors.Is(err, tea.ErrProgramKilled) {
+		a.logger.Error("TUI failed", zap.Error(err))
 	}
+	unsubscribe()
 
-	os.Exit(0)
+	a.logger.Info("Agent is shutting down")
+	a.Shutdown()
 }
 
-func (a *Agent) addRoutes() {
-	a.mux.Post(api.Step4Endpoint, step4Handler(a))
-	a.mux.Post(api.Step7Endpoint, step7Handler(a))
-	a.mux.Post(api.MessageEndpoint, messageHandler(a))
-}
+// RunHeadless serves peer and control requests without the TUI until a signal arrives.
+func (a *Agent) RunHeadless() {
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, syscall.SIGINT, syscall.SIGQUIT)
+	defer stop()
 
-func (a *Agent) tuiShutdown() {
-	a.logger.Info("Agent is shutting down")
+	errCh := a.serve()
 
-	if err := a.logger.Sync(); err != nil {
-		a.logger.Sugar().Fatalf("failed to sync logger: %v", err)
+	a.logger.Info("Agent is running in headless mode")
+	select {
+	case <-ctx.Done():
+	case <-errCh:
 	}
+
+	a.logger.Info("Agent is shutting down")
+	a.Shutdown()
 }
 
-// Cmd
-
-func selectItemCmd(tui *tui) tea.Cmd {
-	return func() tea.Msg {
-		tui.err = ""
-
-		switch tui.cursor {
-		case requestSessionKeyItem:
-			tui.input.Placeholder = "Enter agent ID"
-			return ModeChangedMsg(requestMode)
-		case mailboxItem:
-			return ModeChangedMsg(mailMode)
-		case writeMessageItem:
-			tui.input.Placeholder = "Enter your message"
-			return ModeChangedMsg(messageMode)
+// serve starts the peer and control servers. The returned channel receives
+// the first error that stops any of them.
+func (a *Agent) serve() <-chan error {
+	a.logger.Info("Initializing endpoints")
+	a.addRoutes()
+	a.addControlRoutes()
+
+	errCh := make(chan error, 4)
+	listen := func(server *http.Server, serve func() error) {
+		if err := serve(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			a.logger.Error("Server failed", zap.String("addr", server.Addr), zap.Error(err))
+			errCh <- err
 		}
+	}
 
-		return ModeChangedMsg(menuMode)
+	a.server = &http.Server{
+		Addr:              a.cfg.Addr,
+		Handler:           a.mux,
+		ReadHeaderTimeout: a.cfg.ReadHeaderTimeout,
+		ReadTimeout:       a.cfg.ReadTimeout,
+		WriteTimeout:      a.cfg.WriteTimeout,
+		IdleTimeout:       a.cfg.IdleTimeout,
 	}
-}
+	go listen(a.server, a.server.ListenAndServe)
 
-func requestSessionKeyCmd(a *Agent, acceptor string) tea.Cmd {
-	return func() tea.Msg {
-		// Step 1
-		req1 := api.Request{
-			Initiator: a.cfg.ID,
-			Acceptor:  acceptor,
-		}
-		var resp2 api.Response
-		rawResp2, err := a.client.R().
-			SetHeader("Content-Type", "application/json").
-			SetBody(req1).
-			SetResult(&resp2).
-			Post(httpPrefix + a.cfg.TrentAddr + api.Step2Endpoint)
-		if err != nil {
-			return ErrorMsg(err)
-		}
-		if rawResp2.StatusCode() != http.StatusOK {
-			return ErrorMsg(fmt.Errorf("step 2 status code is %d", rawResp2.StatusCode()))
-		}
+	if err := a.listenForwards(); err != nil {
+		a.logger.Error("Failed to listen for tunnel connections", zap.Error(err))
+		errCh <- err
+	}
 
-		info2JSON, err := json.Marshal(resp2.Certificate.Information)
-		if err != nil {
-			return ErrorMsg(err)
-		}
-		ok := crypto.VerifyRSA(info2JSON, resp2.Certificate.Signature, a.keys.trentKey)
-		if !ok {
-			return ErrorMsg(fmt.Errorf("signature verification failed"))
+	// Streaming control requests never finish on their own, so they are
+	// cancelled as soon as the shutdown begins.
+	controlCtx, cancel := context.WithCancel(context.Background())
+	newControlServer := func(addr string, handler http.Handler) *http.Server {
+		server := &http.Server{
+			Addr:    addr,
+			Handler: handler,
+			BaseContext: func(net.Listener) context.Context {
+				return controlCtx
+			},
 		}
+		server.RegisterOnShutdown(cancel)
+		a.controlServers = append(a.controlServers, server)
 
-		a.keys.agentKey = resp2.Certificate.Information.AcceptorKey
+		return server
+	}
 
-		// Step 3
-		initiatorNonce, err := a.rng.GenerateNonce()
-		if err != nil {
-			return ErrorMsg(err)
-		}
-		a.keys.nonce = initiatorNonce
-		info3 := api.Info{
-			Initiator:      a.cfg.ID,
-			InitiatorNonce: initiatorNonce,
-		}
-		info3JSON, err := json.Marshal(info3)
-		if err != nil {
-			return ErrorMsg(err)
-		}
-		ciphertext3 := crypto.EncryptRSA(info3JSON, a.keys.agentKey)
+	if a.cfg.ControlAddr != "" {
+		server := newControlServer(a.cfg.ControlAddr, withControlToken(a.controlToken)(a.controlMux))
+		go listen(server, server.ListenAndServe)
+	}
 
-		req3 := api.Request{
-			Ciphertext: ciphertext3,
-		}
-		acceptorAddr := a.cfg.AgentAddr
-		var resp4 api.Response
-		rawResp4, err := a.client.R().
-			SetHeader("Content-Type", "application/json").
-			SetBody(req3).
-			SetResult(&resp4).
-			Post(httpPrefix + acceptorAddr + api.Step4Endpoint)
+	if a.cfg.ControlSocket != "" {
+		server := newControlServer(a.cfg.ControlSocket, a.controlMux)
+		listener, err := listenControlSocket(a.cfg.ControlSocket)
 		if err != nil {
-			return ErrorMsg(err)
-		}
-		if rawResp4.StatusCode() != http.StatusOK {
-			return ErrorMsg(fmt.Errorf("step 4 status code is %d", rawResp4.StatusCode()))
+			a.logger.Error("Server failed", zap.String("addr", server.Addr), zap.Error(err))
+			errCh <- err
+		} else {
+			go listen(server, func() error { return server.Serve(listener) })
 		}
+	}
 
-		resp4JSON := crypto.DecryptRSA(resp4.Ciphertext, a.keys.privateKey)
+	return errCh
+}
 
-		var resp api.Response
-		if err := json.Unmarshal(resp4JSON, &resp); err != nil {
-			return ErrorMsg(err)
-		}
+// Shutdown stops accepting peer requests and waits for in-flight ones
+// to finish within the configured drain timeout.
+func (a *Agent) Shutdown() {
+	a.draining.Store(true)
+	a.tunnels.close()
+	a.streams.closeAll()
 
-		a.keys.sessionKey = resp.Certificate.Information.SessionKey
+	ctx, cancel := context.WithTimeout(context.Background(), a.cfg.ShutdownTimeout)
+	defer cancel()
 
-		// Step 7
-		iv, err := a.rng.GenerateIV()
-		if err != nil {
-			return ErrorMsg(err)
-		}
-		ciphertext7 := crypto.EncryptAES(resp.AcceptorNonce, a.keys.sessionKey, iv)
-		msg := api.Message{
-			IV:         iv,
-			Ciphertext: ciphertext7,
-		}
-		rawResp, err := a.client.R().
-			SetHeader("Content-Type", "application/json").
-			SetBody(msg).
-			Post(httpPrefix + acceptorAddr + api.Step7Endpoint)
-		if err != nil {
-			return ErrorMsg(err)
+	for _, server := range append(a.controlServers, a.server) {
+		if server == nil {
+			continue
 		}
-		if rawResp.StatusCode() != http.StatusOK {
-			return ErrorMsg(fmt.Errorf("step 7 status code is %d", rawResp.StatusCode()))
+		if err := server.Shutdown(ctx); err != nil {
+			a.logger.Error("Failed to drain connections", zap.String("addr", server.Addr), zap.Error(err))
 		}
-
-		a.tui.session = acceptor
-		a.tui.active[writeMessageItem] = struct{}{}
-
-		return ErrorMsg(nil)
 	}
-}
 
-func sendMessageCmd(a *Agent, msg string) tea.Cmd {
-	return func() tea.Msg {
-		if msg == "" {
-			return ErrorMsg(nil)
-		}
+	if err := a.mailbox.close(); err != nil {
+		a.logger.Error("Failed to close message history", zap.Error(err))
+	}
 
-		iv, err := a.rng.GenerateIV()
-		if err != nil {
-			return ErrorMsg(err)
-		}
-		ciphertext := crypto.EncryptAES([]byte(msg), a.keys.sessionKey, iv)
-		msg := api.Message{
-			IV:         iv,
-			Ciphertext: ciphertext,
-		}
-		rawResp, err := a.client.R().
-			SetHeader("Content-Type", "application/json").
-			SetBody(msg).
-			Post(httpPrefix + a.cfg.AgentAddr + api.MessageEndpoint)
-		if err != nil {
-			return ErrorMsg(err)
-		}
-		if rawResp.StatusCode() != http.StatusOK {
-			return ErrorMsg(fmt.Errorf("error sending message: status code is %d", rawResp.StatusCode()))
-		}
+	if err := a.tracer.Close(); err != nil {
+		a.logger.Error("Failed to close tracer", zap.Error(err))
+	}
 
-		return ErrorMsg(nil)
+	a.logger.Info("Agent stopped")
+	if err := a.logger.Sync(); err != nil {
+		a.logger.Sugar().Fatalf("failed to sync logger: %v", err)
 	}
 }
 
-// Msg
-
-type ModeChangedMsg int
+func (a *Agent) addRoutes() {
+	a.mux.Group(func(r chi.Router) {
+		r.Use(middleware.WithLogging(a.logger))
+		r.Post(api.Step4Endpoint, step4Handler(a))
+		r.Post(api.Step7Endpoint, step7Handler(a))
+		r.Post(api.MessageEndpoint, messageHandler(a))
+	})
+	// The bodies of file transfers, streams and tunnels are not logged:
+	// they would fill the log with file contents, and streams and tunnels
+	// never finish.
+	a.mux.Get(api.TunnelEndpoint, tunnelHandler(a))
+	a.mux.Get(api.StreamEndpoint, streamHandler(a))
+	a.mux.Post(api.FilesEndpoint+"{transfer}", fileOfferHandler(a))
+	a.mux.Post(api.FilesEndpoint+"{transfer}/{chunk}", fileChunkHandler(a))
+	a.mux.Method(http.MethodGet, api.MetricsEndpoint, a.metrics.registry.Handler())
+	a.mux.Method(http.MethodGet, api.HealthEndpoint, health.LivenessHandler())
+	a.mux.Method(http.MethodGet, api.ReadyEndpoint, health.ReadinessHandler(readinessTimeout, a.readinessChecks()...))
+}
 
-type ErrorMsg error
+func (a *Agent) addControlRoutes() {
+	a.controlMux.Post(api.ControlSessionsEndpoint, openSessionHandler(a))
+	a.controlMux.Get(api.ControlSessionsEndpoint, listSessionsHandler(a))
+	a.controlMux.Delete(api.ControlSessionsEndpoint+"/{peer}", closeSessionHandler(a))
+	a.controlMux.Get(api.ControlRequestsEndpoint, listRequestsHandler(a))
+	a.controlMux.Post(api.ControlRequestsEndpoint+"/{id}", answerRequestHandler(a))
+	a.controlMux.Post(api.ControlMessagesEndpoint, sendMessageHandler(a))
+	a.controlMux.Get(api.ControlInboxEndpoint, inboxHandler(a))
+	a.controlMux.Get(api.ControlHistoryEndpoint, historyHandler(a))
+	a.controlMux.Get(api.ControlEventsEndpoint, eventsHandler(a))
+	a.controlMux.Post(api.ControlKeysEndpoint, exportKeyHandler(a))
+	a.controlMux.Post(api.ControlFilesEndpoint, sendFileHandler(a))
+	a.controlMux.Get(api.ControlFilesEndpoint, listTransfersHandler(a))
+	a.controlMux.Method(http.MethodGet, api.ControlTracesEndpoint, a.traces.Handler())
+}
@@ -0,0 +1,39 @@
+package agent
+
+import (
+	"encoding/hex"
+	"fmt"
+
+	"github.com/sudeeya/key-exchange/internal/pkg/crypto"
+	"github.com/sudeeya/key-exchange/internal/pkg/rng"
+)
+
+// channelKeys derives one key per direction for a channel between two agents
+// from the session's exporter secret and the nonces both sides chose when it
+// was opened, so that keys are never reused across connections.
+func channelKeys(exporter []byte, channel string, clientNonce, serverNonce []byte, size int) (clientKey, serverKey []byte, err error) {
+	context := append(append([]byte{}, clientNonce...), serverNonce...)
+
+	clientKey, err = crypto.ExportKey(exporter, internalLabelPrefix+channel+" client", context, size)
+	if err != nil {
+		return nil, nil, err
+	}
+	serverKey, err = crypto.ExportKey(exporter, internalLabelPrefix+channel+" server", context, size)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return clientKey, serverKey, nil
+}
+
+func decodeNonce(value string) ([]byte, error) {
+	nonce, err := hex.DecodeString(value)
+	if err != nil {
+		return nil, err
+	}
+	if len(nonce) != rng.NonceSize {
+		return nil, fmt.Errorf("nonce must be %d bytes", rng.NonceSize)
+	}
+
+	return nonce, nil
+}
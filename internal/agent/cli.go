@@ -0,0 +1,639 @@
+package agent
+
+import (
+	"bufio"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/caarlos0/env"
+	"github.com/go-resty/resty/v2"
+
+	"github.com/sudeeya/key-exchange/internal/pkg/api"
+)
+
+const cliUsage = `usage:
+  agent [-e env] [-headless]            run the agent
+  agent [-e env] session open <peer>    open a session with a peer
+  agent [-e env] session close <peer>   close the session with a peer
+  agent [-e env] sessions [-json]       list established sessions
+  agent [-e env] requests [-json]       list session requests waiting for consent
+  agent [-e env] accept <id>            accept a session request
+  agent [-e env] reject <id>            reject a session request
+  agent [-e env] send <peer> <text>     send a message to a peer
+  agent [-e env] inbox [-follow] [-json] [-peer id] [-since id]
+                                        print received messages
+  agent [-e env] history [-peer id] [-direction d] [-search text] [-from time]
+                         [-to time] [-limit n] [-json] [-o file]
+                                        search and export message history
+  agent [-e env] events [-json] [-types list]
+                                        stream session and message events
+  agent [-e env] send-file [-wait] <peer> <path>
+                                        send a file to a peer
+  agent [-e env] files [-json]          list file transfers
+  agent [-e env] export [-context text] [-length n] [-json] <peer> <label>
+                                        export a key derived from a session`
+
+var (
+	errUsage      = errors.New(cliUsage)
+	errStreamDone = errors.New("stream done")
+)
+
+type cliConfig struct {
+	ControlAddr      string `env:"CONTROL_ADDR"`
+	ControlSocket    string `env:"CONTROL_SOCKET"`
+	ControlTokenFile string `env:"CONTROL_TOKEN_FILE"`
+}
+
+// RunCommand executes a CLI command against the control API of a running agent.
+func RunCommand(args []string, out io.Writer) error {
+	var cfg cliConfig
+	if err := env.Parse(&cfg); err != nil {
+		return err
+	}
+
+	client, err := newControlClient(&cfg)
+	if err != nil {
+		return err
+	}
+
+	switch args[0] {
+	case "session":
+		if len(args) != 3 {
+			return errUsage
+		}
+		switch args[1] {
+		case "open":
+			return openSessionCommand(client, args[2], out)
+		case "close":
+			return closeSessionCommand(client, args[2], out)
+		}
+	case "sessions":
+		return sessionsCommand(client, args[1:], out)
+	case "requests":
+		return requestsCommand(client, args[1:], out)
+	case "accept", "reject":
+		if len(args) != 2 {
+			return errUsage
+		}
+		return answerRequestCommand(client, args[1], args[0] == "accept", out)
+	case "send":
+		if len(args) < 3 {
+			return errUsage
+		}
+		return sendCommand(client, args[1], strings.Join(args[2:], " "))
+	case "inbox":
+		return inboxCommand(client, args[1:], out)
+	case "history":
+		return historyCommand(client, args[1:], out)
+	case "events":
+		return eventsCommand(client, args[1:], out)
+	case "export":
+		return exportCommand(client, args[1:], out)
+	case "send-file":
+		return sendFileCommand(client, args[1:], out)
+	case "files":
+		return filesCommand(client, args[1:], out)
+	}
+
+	return errUsage
+}
+
+// newControlClient prefers the Unix socket, which needs no token, and falls
+// back to the loopback address authenticated with the shared token.
+func newControlClient(cfg *cliConfig) (*resty.Client, error) {
+	if cfg.ControlSocket != "" {
+		transport := &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, "unix", cfg.ControlSocket)
+			},
+		}
+		return resty.New().SetTransport(transport).SetBaseURL("http://unix"), nil
+	}
+
+	if cfg.ControlAddr == "" {
+		return nil, errors.New("either CONTROL_ADDR or CONTROL_SOCKET must be set")
+	}
+	token, err := os.ReadFile(cfg.ControlTokenFile)
+	if err != nil {
+		return nil, err
+	}
+
+	return resty.New().
+		SetBaseURL(httpPrefix + cfg.ControlAddr).
+		SetAuthToken(strings.TrimSpace(string(token))), nil
+}
+
+func openSessionCommand(client *resty.Client, peer string, out io.Writer) error {
+	var info api.SessionInfo
+	resp, err := client.R().
+		SetHeader("Content-Type", "application/json").
+		SetBody(api.OpenSessionRequest{Peer: peer}).
+		SetResult(&info).
+		Post(api.ControlSessionsEndpoint)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode() != http.StatusCreated {
+		return controlError(resp)
+	}
+
+	fmt.Fprintf(out, "Session with %s established (id %s)\n", info.Peer, info.ID)
+
+	return nil
+}
+
+func closeSessionCommand(client *resty.Client, peer string, out io.Writer) error {
+	var info api.SessionInfo
+	resp, err := client.R().
+		SetResult(&info).
+		SetPathParam("peer", peer).
+		Delete(api.ControlSessionsEndpoint + "/{peer}")
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode() != http.StatusOK {
+		return controlError(resp)
+	}
+
+	fmt.Fprintf(out, "Session with %s closed (id %s)\n", info.Peer, info.ID)
+
+	return nil
+}
+
+func sessionsCommand(client *resty.Client, args []string, out io.Writer) error {
+	fs := flag.NewFlagSet("sessions", flag.ContinueOnError)
+	asJSON := fs.Bool("json", false, "Print sessions as JSON")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	var sessions []api.SessionInfo
+	resp, err := client.R().
+		SetResult(&sessions).
+		Get(api.ControlSessionsEndpoint)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode() != http.StatusOK {
+		return controlError(resp)
+	}
+
+	if *asJSON {
+		return json.NewEncoder(out).Encode(sessions)
+	}
+
+	if len(sessions) == 0 {
+		fmt.Fprintln(out, "No sessions")
+	}
+	for _, s := range sessions {
+		fmt.Fprintf(out, "%-16s %-10s %s  %-19s  established %s\n", s.Peer, s.Role, s.ID, s.Suite, s.Established.Format(time.RFC3339))
+	}
+
+	return nil
+}
+
+func requestsCommand(client *resty.Client, args []string, out io.Writer) error {
+	fs := flag.NewFlagSet("requests", flag.ContinueOnError)
+	asJSON := fs.Bool("json", false, "Print requests as JSON")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	var requests []api.SessionRequest
+	resp, err := client.R().
+		SetResult(&requests).
+		Get(api.ControlRequestsEndpoint)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode() != http.StatusOK {
+		return controlError(resp)
+	}
+
+	if *asJSON {
+		return json.NewEncoder(out).Encode(requests)
+	}
+
+	if len(requests) == 0 {
+		fmt.Fprintln(out, "No session requests")
+	}
+	for _, req := range requests {
+		fingerprint := req.Fingerprint
+		if fingerprint == "" {
+			fingerprint = "-"
+		}
+		fmt.Fprintf(out, "%s %-16s %s  expires %s\n", req.ID, req.Initiator, fingerprint, req.Expires.Format(time.TimeOnly))
+	}
+
+	return nil
+}
+
+func answerRequestCommand(client *resty.Client, id string, accept bool, out io.Writer) error {
+	resp, err := client.R().
+		SetHeader("Content-Type", "application/json").
+		SetBody(api.ConsentDecision{Accept: accept}).
+		SetPathParam("id", id).
+		Post(api.ControlRequestsEndpoint + "/{id}")
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode() != http.StatusNoContent {
+		return controlError(resp)
+	}
+
+	if accept {
+		fmt.Fprintf(out, "Session request %s accepted\n", id)
+	} else {
+		fmt.Fprintf(out, "Session request %s rejected\n", id)
+	}
+
+	return nil
+}
+
+func sendCommand(client *resty.Client, peer, text string) error {
+	resp, err := client.R().
+		SetHeader("Content-Type", "application/json").
+		SetBody(api.SendMessageRequest{Peer: peer, Text: text}).
+		Post(api.ControlMessagesEndpoint)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode() != http.StatusOK {
+		return controlError(resp)
+	}
+
+	return nil
+}
+
+func exportCommand(client *resty.Client, args []string, out io.Writer) error {
+	fs := flag.NewFlagSet("export", flag.ContinueOnError)
+	keyContext := fs.String("context", "", "Context the key is bound to")
+	length := fs.Int("length", 0, "Key length in bytes")
+	asJSON := fs.Bool("json", false, "Print the key as JSON")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 2 {
+		return errUsage
+	}
+
+	req := api.ExportKeyRequest{
+		Peer:   fs.Arg(0),
+		Label:  fs.Arg(1),
+		Length: *length,
+	}
+	if *keyContext != "" {
+		req.Context = []byte(*keyContext)
+	}
+
+	var key api.ExportedKey
+	resp, err := client.R().
+		SetHeader("Content-Type", "application/json").
+		SetBody(req).
+		SetResult(&key).
+		Post(api.ControlKeysEndpoint)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode() != http.StatusOK {
+		return controlError(resp)
+	}
+
+	if *asJSON {
+		return json.NewEncoder(out).Encode(key)
+	}
+
+	fmt.Fprintf(out, "id       %s\nsession  %s\nexpires  %s\nkey      %s\n",
+		key.ID, key.Session, key.Expires.Format(time.RFC3339), hex.EncodeToString(key.Key))
+
+	return nil
+}
+
+func sendFileCommand(client *resty.Client, args []string, out io.Writer) error {
+	fs := flag.NewFlagSet("send-file", flag.ContinueOnError)
+	wait := fs.Bool("wait", false, "Print progress until the transfer finishes")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 2 {
+		return errUsage
+	}
+
+	// The agent may run in another directory.
+	path, err := filepath.Abs(fs.Arg(1))
+	if err != nil {
+		return err
+	}
+
+	// Subscribe before starting the transfer, so that no event is missed.
+	var events io.ReadCloser
+	if *wait {
+		req := client.R().SetQueryParam("types", strings.Join([]string{
+			api.TransferProgressEvent, api.TransferCompletedEvent, api.TransferFailedEvent,
+		}, ","))
+		events, err = openStream(req, api.ControlEventsEndpoint)
+		if err != nil {
+			return err
+		}
+		defer events.Close()
+	}
+
+	var transfer api.TransferInfo
+	resp, err := client.R().
+		SetHeader("Content-Type", "application/json").
+		SetBody(api.SendFileRequest{Peer: fs.Arg(0), Path: path}).
+		SetResult(&transfer).
+		Post(api.ControlFilesEndpoint)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode() != http.StatusAccepted {
+		return controlError(resp)
+	}
+
+	fmt.Fprintf(out, "Sending %s to %s (transfer %s)\n", transfer.Name, transfer.Peer, transfer.ID)
+	if !*wait {
+		return nil
+	}
+
+	err = scanLines(events, func(line []byte) error {
+		var event api.Event
+		if err := json.Unmarshal(line, &event); err != nil {
+			return err
+		}
+		if event.Transfer == nil || event.Transfer.ID != transfer.ID || event.Transfer.Direction != outgoingTransfer {
+			return nil
+		}
+
+		switch event.Type {
+		case api.TransferProgressEvent:
+			fmt.Fprintf(out, "\r%s", transferProgress(*event.Transfer))
+		case api.TransferCompletedEvent:
+			fmt.Fprintf(out, "\r%s\nDone\n", transferProgress(*event.Transfer))
+			return errStreamDone
+		case api.TransferFailedEvent:
+			fmt.Fprintln(out)
+			return fmt.Errorf("transfer failed: %s", event.Transfer.Error)
+		}
+
+		return nil
+	})
+	if errors.Is(err, errStreamDone) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	return errors.New("control API closed the event stream")
+}
+
+func filesCommand(client *resty.Client, args []string, out io.Writer) error {
+	fs := flag.NewFlagSet("files", flag.ContinueOnError)
+	asJSON := fs.Bool("json", false, "Print transfers as JSON")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	var transfers []api.TransferInfo
+	resp, err := client.R().
+		SetResult(&transfers).
+		Get(api.ControlFilesEndpoint)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode() != http.StatusOK {
+		return controlError(resp)
+	}
+
+	if *asJSON {
+		return json.NewEncoder(out).Encode(transfers)
+	}
+
+	if len(transfers) == 0 {
+		fmt.Fprintln(out, "No transfers")
+	}
+	for _, t := range transfers {
+		fmt.Fprintf(out, "%-8s %-16s %-10s %s  %s\n", t.Direction, t.Peer, t.Status, transferProgress(t), t.Name)
+	}
+
+	return nil
+}
+
+func transferProgress(t api.TransferInfo) string {
+	percent := 100.0
+	if t.Size > 0 {
+		percent = float64(t.Transferred) / float64(t.Size) * 100
+	}
+
+	return fmt.Sprintf("%5.1f%% %d/%d bytes", percent, t.Transferred, t.Size)
+}
+
+func inboxCommand(client *resty.Client, args []string, out io.Writer) error {
+	fs := flag.NewFlagSet("inbox", flag.ContinueOnError)
+	follow := fs.Bool("follow", false, "Keep printing messages as they arrive")
+	asJSON := fs.Bool("json", false, "Print messages as JSON lines")
+	peer := fs.String("peer", "", "Only print messages from this peer")
+	since := fs.Int("since", 0, "Only print messages with a greater ID")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	req := client.R().
+		SetQueryParam("follow", fmt.Sprint(*follow)).
+		SetQueryParam("since", strconv.Itoa(*since))
+	if *peer != "" {
+		req.SetQueryParam("peer", *peer)
+	}
+
+	return streamLines(req, api.ControlInboxEndpoint, func(line []byte) error {
+		if *asJSON {
+			fmt.Fprintln(out, string(line))
+			return nil
+		}
+
+		var message api.MailboxMessage
+		if err := json.Unmarshal(line, &message); err != nil {
+			return err
+		}
+		fmt.Fprintf(out, "[%s] %s: %s\n", message.Time.Format(time.TimeOnly), message.Peer, message.Text)
+
+		return nil
+	})
+}
+
+func historyCommand(client *resty.Client, args []string, out io.Writer) error {
+	fs := flag.NewFlagSet("history", flag.ContinueOnError)
+	peer := fs.String("peer", "", "Only print messages with this peer")
+	direction := fs.String("direction", "", "Only print incoming or outgoing messages")
+	search := fs.String("search", "", "Only print messages containing this text")
+	from := fs.String("from", "", "Only print messages since this RFC 3339 time")
+	to := fs.String("to", "", "Only print messages until this RFC 3339 time")
+	limit := fs.Int("limit", 0, "Only print this many most recent messages")
+	asJSON := fs.Bool("json", false, "Print messages as JSON")
+	output := fs.String("o", "", "Write messages to this file instead")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	params := map[string]string{
+		"peer":      *peer,
+		"direction": *direction,
+		"q":         *search,
+		"from":      *from,
+		"to":        *to,
+		"limit":     strconv.Itoa(*limit),
+	}
+	for name, value := range params {
+		if value == "" {
+			delete(params, name)
+		}
+	}
+
+	var messages []api.MailboxMessage
+	resp, err := client.R().
+		SetQueryParams(params).
+		SetResult(&messages).
+		Get(api.ControlHistoryEndpoint)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode() != http.StatusOK {
+		return controlError(resp)
+	}
+
+	if *output != "" {
+		file, err := os.OpenFile(*output, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		out = file
+	}
+
+	if *asJSON {
+		return json.NewEncoder(out).Encode(messages)
+	}
+
+	if len(messages) == 0 && *output == "" {
+		fmt.Fprintln(out, "No messages")
+	}
+	for _, message := range messages {
+		arrow := "->"
+		if message.Direction == incomingMessage {
+			arrow = "<-"
+		}
+		fmt.Fprintf(out, "[%s] %s %s: %s (%s)\n", message.Time.Format(time.DateTime), arrow, message.Peer, message.Text, message.Status)
+	}
+
+	return nil
+}
+
+func eventsCommand(client *resty.Client, args []string, out io.Writer) error {
+	fs := flag.NewFlagSet("events", flag.ContinueOnError)
+	asJSON := fs.Bool("json", false, "Print events as JSON lines")
+	types := fs.String("types", "", "Comma-separated list of event types to print")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	req := client.R()
+	if *types != "" {
+		req.SetQueryParam("types", *types)
+	}
+
+	return streamLines(req, api.ControlEventsEndpoint, func(line []byte) error {
+		if *asJSON {
+			fmt.Fprintln(out, string(line))
+			return nil
+		}
+
+		var event api.Event
+		if err := json.Unmarshal(line, &event); err != nil {
+			return err
+		}
+		fmt.Fprintf(out, "[%s] %s", event.Time.Format(time.TimeOnly), event.Type)
+		switch {
+		case event.Previous != nil:
+			fmt.Fprintf(out, " peer=%s id=%s keys=%s", event.Previous.Peer, event.Previous.ID, strings.Join(event.KeyIDs, ","))
+		case event.Session != nil:
+			fmt.Fprintf(out, " peer=%s role=%s id=%s", event.Session.Peer, event.Session.Role, event.Session.ID)
+		case event.Message != nil:
+			fmt.Fprintf(out, " peer=%s id=%d", event.Message.Peer, event.Message.ID)
+		case event.Failure != nil:
+			fmt.Fprintf(out, " peer=%s role=%s step=%d error=%q", event.Failure.Peer, event.Failure.Role, event.Failure.Step, event.Failure.Error)
+		case event.Request != nil:
+			fmt.Fprintf(out, " initiator=%s id=%s fingerprint=%s", event.Request.Initiator, event.Request.ID, event.Request.Fingerprint)
+			if event.Request.Decision != "" {
+				fmt.Fprintf(out, " decision=%s", event.Request.Decision)
+			}
+		case event.Step != nil:
+			fmt.Fprintf(out, " handshake=%s role=%s step=%d phase=%s", event.Step.Handshake, event.Step.Role, event.Step.Step, event.Step.Phase)
+			if event.Step.Check != "" {
+				fmt.Fprintf(out, " check=%q ok=%t", event.Step.Check, event.Step.OK)
+			}
+		}
+		fmt.Fprintln(out)
+
+		return nil
+	})
+}
+
+// streamLines issues a GET request for a JSON lines endpoint and hands every
+// line to handle until the agent closes the stream.
+func streamLines(req *resty.Request, endpoint string, handle func([]byte) error) error {
+	body, err := openStream(req, endpoint)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+
+	return scanLines(body, handle)
+}
+
+func openStream(req *resty.Request, endpoint string) (io.ReadCloser, error) {
+	resp, err := req.
+		SetDoNotParseResponse(true).
+		Get(endpoint)
+	if err != nil {
+		return nil, err
+	}
+	body := resp.RawBody()
+
+	if resp.StatusCode() != http.StatusOK {
+		defer body.Close()
+		text, _ := io.ReadAll(body)
+		return nil, fmt.Errorf("control API status code is %d: %s", resp.StatusCode(), strings.TrimSpace(string(text)))
+	}
+
+	return body, nil
+}
+
+// scanLines hands every line of r to handle. It stops early if handle fails.
+func scanLines(r io.Reader, handle func([]byte) error) error {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		if err := handle(scanner.Bytes()); err != nil {
+			return err
+		}
+	}
+
+	return scanner.Err()
+}
+
+func controlError(resp *resty.Response) error {
+	return fmt.Errorf("control API status code is %d: %s", resp.StatusCode(), strings.TrimSpace(resp.String()))
+}
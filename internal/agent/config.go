@@ -1,6 +1,8 @@
 package agent
 
 import (
+	"time"
+
 	"github.com/caarlos0/env"
 )
 
@@ -13,10 +15,59 @@ type config struct {
 	TrentAddr      string `env:"TRENT_ADDR,required"`
 	TrentPublicKey string `env:"TRENT_PUBLIC_KEY,required"`
 
-	AgentID   string `env:"AGENT_ID,required"`
-	AgentAddr string `env:"AGENT_ADDR,required"`
+	AgentIDs   []string `env:"AGENT_IDS,required"`
+	AgentAddrs []string `env:"AGENT_ADDRS,required"`
+
+	ControlAddr      string `env:"CONTROL_ADDR"`
+	ControlSocket    string `env:"CONTROL_SOCKET"`
+	ControlTokenFile string `env:"CONTROL_TOKEN_FILE"`
+
+	ExportLabels   []string      `env:"EXPORT_LABELS"`
+	ExportLifetime time.Duration `env:"EXPORT_LIFETIME" envDefault:"1h"`
+
+	TunnelListenAddrs  []string `env:"TUNNEL_LISTEN_ADDRS"`
+	TunnelPeers        []string `env:"TUNNEL_PEERS"`
+	TunnelServices     []string `env:"TUNNEL_SERVICES"`
+	TunnelServiceNames []string `env:"TUNNEL_SERVICE_NAMES"`
+	TunnelServiceAddrs []string `env:"TUNNEL_SERVICE_ADDRS"`
+
+	DownloadDir string `env:"DOWNLOAD_DIR" envDefault:"downloads"`
+	// SendDir, if set, is the only directory files may be sent from.
+	SendDir string `env:"SEND_DIR"`
+	// MaxFileSize is the largest file, in bytes, a peer may send.
+	MaxFileSize int64 `env:"MAX_FILE_SIZE" envDefault:"1073741824"`
+
+	HistoryFile           string        `env:"HISTORY_FILE"`
+	HistoryPassphraseFile string        `env:"HISTORY_PASSPHRASE_FILE"`
+	HistoryMaxMessages    int           `env:"HISTORY_MAX_MESSAGES"`
+	HistoryMaxAge         time.Duration `env:"HISTORY_MAX_AGE"`
+
+	StepMode bool `env:"STEP_MODE"`
+
+	CipherSuites    []string `env:"CIPHER_SUITES"`
+	ForwardSecrecy  string   `env:"FORWARD_SECRECY"`
+	MLKEMPrivateKey string   `env:"MLKEM_PRIVATE_KEY"`
+	// AllowLegacyPeers lets sessions with agents that predate key
+	// confirmation go ahead without it.
+	AllowLegacyPeers bool `env:"ALLOW_LEGACY_PEERS"`
+
+	SessionConsent        string        `env:"SESSION_CONSENT" envDefault:"accept"`
+	SessionAllow          []string      `env:"SESSION_ALLOW"`
+	SessionBlock          []string      `env:"SESSION_BLOCK"`
+	SessionConsentTimeout time.Duration `env:"SESSION_CONSENT_TIMEOUT" envDefault:"30s"`
+
+	// CacheKeys can be turned off to parse keys from PEM on every use, as
+	// agents once did, so that benchmarks can show what the cache saves.
+	CacheKeys bool `env:"CACHE_KEYS" envDefault:"true"`
+
+	LogFile   string `env:"LOG_FILE,required"`
+	TraceFile string `env:"TRACE_FILE"`
 
-	LogFile string `env:"LOG_FILE,required"`
+	ReadHeaderTimeout time.Duration `env:"READ_HEADER_TIMEOUT" envDefault:"5s"`
+	ReadTimeout       time.Duration `env:"READ_TIMEOUT" envDefault:"10s"`
+	WriteTimeout      time.Duration `env:"WRITE_TIMEOUT" envDefault:"30s"`
+	IdleTimeout       time.Duration `env:"IDLE_TIMEOUT" envDefault:"2m"`
+	ShutdownTimeout   time.Duration `env:"SHUTDOWN_TIMEOUT" envDefault:"10s"`
 }
 
 func newConfig() (*config, error) {
@@ -0,0 +1,253 @@
+package agent
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/sudeeya/key-exchange/internal/pkg/api"
+)
+
+const (
+	consentAccept = "accept"
+	consentReject = "reject"
+	consentPrompt = "prompt"
+
+	requestAccepted = "accepted"
+	requestRejected = "rejected"
+	requestExpired  = "expired"
+
+	requestIDSize = 8
+)
+
+var (
+	errSessionRejected = errors.New("session request rejected")
+	errConsentTimeout  = errors.New("session request was not answered in time")
+	errUnknownRequest  = errors.New("no pending session request with such ID")
+	errKeyChanged      = errors.New("initiator's key is not the one the session request was accepted for")
+)
+
+// consentPolicy decides which incoming session requests are accepted without
+// asking: blocked initiators are always rejected, allowed ones always
+// accepted, and everyone else gets the default decision.
+type consentPolicy struct {
+	mode    string
+	allow   map[string]struct{}
+	block   map[string]struct{}
+	timeout time.Duration
+}
+
+func newConsentPolicy(cfg *config) (*consentPolicy, error) {
+	switch cfg.SessionConsent {
+	case consentAccept, consentReject, consentPrompt:
+	default:
+		return nil, fmt.Errorf("SESSION_CONSENT must be %s, %s or %s, got %q",
+			consentAccept, consentReject, consentPrompt, cfg.SessionConsent)
+	}
+
+	p := &consentPolicy{
+		mode:    cfg.SessionConsent,
+		allow:   make(map[string]struct{}, len(cfg.SessionAllow)),
+		block:   make(map[string]struct{}, len(cfg.SessionBlock)),
+		timeout: cfg.SessionConsentTimeout,
+	}
+	for _, id := range cfg.SessionAllow {
+		p.allow[id] = struct{}{}
+	}
+	for _, id := range cfg.SessionBlock {
+		p.block[id] = struct{}{}
+	}
+
+	return p, nil
+}
+
+func (p *consentPolicy) decide(initiator string) string {
+	if _, ok := p.block[initiator]; ok {
+		return consentReject
+	}
+	if _, ok := p.allow[initiator]; ok {
+		return consentAccept
+	}
+
+	return p.mode
+}
+
+type pendingRequest struct {
+	info     api.SessionRequest
+	decision chan bool
+}
+
+// consents holds the session requests waiting for the user.
+type consents struct {
+	policy *consentPolicy
+
+	mu      sync.Mutex
+	pending map[string]*pendingRequest
+	// vouched holds the fingerprint of the key Trent last vouched for by
+	// initiator. Requests are answered before Trent is asked about the
+	// initiator again, so this is the key the user is shown.
+	vouched map[string]string
+}
+
+func newConsents(policy *consentPolicy) *consents {
+	return &consents{
+		policy:  policy,
+		pending: make(map[string]*pendingRequest),
+		vouched: make(map[string]string),
+	}
+}
+
+func (c *consents) vouch(initiator, fingerprint string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.vouched[initiator] = fingerprint
+}
+
+func (c *consents) lastVouched(initiator string) string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.vouched[initiator]
+}
+
+func (c *consents) add(req *pendingRequest) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.pending[req.info.ID] = req
+}
+
+func (c *consents) remove(id string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	delete(c.pending, id)
+}
+
+func (c *consents) resolve(id string, accept bool) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	req, ok := c.pending[id]
+	if !ok {
+		return fmt.Errorf("%w: %s", errUnknownRequest, id)
+	}
+	delete(c.pending, id)
+	req.decision <- accept
+
+	return nil
+}
+
+func (c *consents) list() []api.SessionRequest {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	requests := make([]api.SessionRequest, 0, len(c.pending))
+	for _, req := range c.pending {
+		requests = append(requests, req.info)
+	}
+	slices.SortFunc(requests, func(a, b api.SessionRequest) int {
+		return a.Received.Compare(b.Received)
+	})
+
+	return requests
+}
+
+// AnswerRequest accepts or rejects a pending session request.
+func (a *Agent) AnswerRequest(id string, accept bool) error {
+	return a.consents.resolve(id, accept)
+}
+
+// askConsent holds the session request from initiator until the policy or
+// the user decides on it. It returns nil if the request is accepted, along
+// with the fingerprint the user was shown, if any: the key Trent vouched for
+// in the last session with initiator, which Trent must vouch for again.
+func (a *Agent) askConsent(ctx context.Context, initiator string) (string, error) {
+	switch a.consents.policy.decide(initiator) {
+	case consentAccept:
+		return "", nil
+	case consentReject:
+		return "", errSessionRejected
+	}
+
+	fingerprint := a.consents.lastVouched(initiator)
+	rawID, err := a.rng.GenerateKey(requestIDSize)
+	if err != nil {
+		return "", err
+	}
+	now := time.Now()
+	req := &pendingRequest{
+		info: api.SessionRequest{
+			ID:          hex.EncodeToString(rawID),
+			Initiator:   initiator,
+			Fingerprint: fingerprint,
+			Received:    now,
+			Expires:     now.Add(a.consents.policy.timeout),
+		},
+		decision: make(chan bool, 1),
+	}
+	a.consents.add(req)
+
+	a.logger.Info("Session request waiting for consent",
+		zap.String("initiator", initiator),
+		zap.String("fingerprint", fingerprint),
+		zap.String("request_id", req.info.ID),
+	)
+	info := req.info
+	a.events.publish(api.Event{
+		Type:    api.SessionRequestedEvent,
+		Request: &info,
+	})
+
+	timer := time.NewTimer(a.consents.policy.timeout)
+	defer timer.Stop()
+
+	select {
+	case accept := <-req.decision:
+		info.Decision = requestAccepted
+		if !accept {
+			info.Decision = requestRejected
+			err = errSessionRejected
+		}
+	case <-timer.C:
+		info.Decision = requestExpired
+		err = errConsentTimeout
+	case <-ctx.Done():
+		info.Decision = requestExpired
+		err = ctx.Err()
+	}
+	a.consents.remove(info.ID)
+
+	a.logger.Info("Session request resolved",
+		zap.String("initiator", initiator),
+		zap.String("request_id", info.ID),
+		zap.String("decision", info.Decision),
+	)
+	a.events.publish(api.Event{
+		Type:    api.RequestResolvedEvent,
+		Request: &info,
+	})
+
+	return fingerprint, err
+}
+
+// consentStatus is the status a session request that was not accepted is
+// answered with.
+func consentStatus(err error) int {
+	switch {
+	case errors.Is(err, errSessionRejected):
+		return http.StatusForbidden
+	case errors.Is(err, errConsentTimeout):
+		return http.StatusGatewayTimeout
+	}
+
+	return http.StatusInternalServerError
+}
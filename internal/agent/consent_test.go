@@ -0,0 +1,128 @@
+package agent
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sudeeya/key-exchange/internal/pkg/api"
+)
+
+func TestSessionConsent(t *testing.T) {
+	accept, reject := true, false
+
+	tests := []struct {
+		name    string
+		consent string
+		block   []string
+		// answer is given to a prompt; without one the request expires.
+		answer *bool
+		// prepare runs after a first session has been accepted.
+		prepare func(acceptor *Agent)
+		// want is what the handshake error mentions, or "" if the
+		// session should be established.
+		want string
+		// issued is the number of session keys Trent must have issued.
+		issued int
+	}{
+		{name: "accepted by policy", consent: consentAccept, issued: 1},
+		{name: "accepted by the user", consent: consentPrompt, answer: &accept, issued: 1},
+		{name: "rejected by policy", consent: consentReject, want: "status code is 403"},
+		{name: "blocked", consent: consentAccept, block: []string{"rsa-a"}, want: "status code is 403"},
+		{name: "rejected by the user", consent: consentPrompt, answer: &reject, want: "status code is 403"},
+		{name: "not answered", consent: consentPrompt, want: "status code is 504"},
+		{
+			// A key that has changed is only noticed once Trent has
+			// vouched for it.
+			name:    "key changed",
+			consent: consentPrompt,
+			answer:  &accept,
+			prepare: func(acceptor *Agent) {
+				acceptor.consents.vouch("rsa-a", "a key Trent does not know")
+			},
+			want:   errKeyChanged.Error(),
+			issued: 2,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			n := newInteropNetwork(t, interopConfigs[:1], func(cfg *config) {
+				cfg.SessionConsent = tt.consent
+				cfg.SessionBlock = tt.block
+				cfg.SessionConsentTimeout = 200 * time.Millisecond
+			})
+			initiator, acceptor := n.agents["rsa-a"], n.agents["rsa-b"]
+			if tt.answer != nil {
+				go answerRequests(t.Context(), acceptor, *tt.answer)
+			}
+			if tt.prepare != nil {
+				if _, err := initiator.OpenSession(context.Background(), "rsa-b"); err != nil {
+					t.Fatal(err)
+				}
+				tt.prepare(acceptor)
+			}
+
+			_, err := initiator.OpenSession(context.Background(), "rsa-b")
+			if tt.want == "" && err != nil {
+				t.Fatalf("handshake failed: %v", err)
+			}
+			if tt.want != "" && (err == nil || !strings.Contains(err.Error(), tt.want)) {
+				t.Fatalf("handshake returned %v, want an error mentioning %q", err, tt.want)
+			}
+
+			// Trent is only asked for a session key once the request
+			// is accepted.
+			if got := issuedSessionKeys(t, n.trentAddr); got != tt.issued {
+				t.Fatalf("Trent issued %d session keys, want %d", got, tt.issued)
+			}
+		})
+	}
+}
+
+// answerRequests answers every session request acceptor receives until ctx
+// ends.
+func answerRequests(ctx context.Context, acceptor *Agent, accept bool) {
+	for {
+		for _, req := range acceptor.consents.list() {
+			acceptor.AnswerRequest(req.ID, accept)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(5 * time.Millisecond):
+		}
+	}
+}
+
+func issuedSessionKeys(t *testing.T, trentAddr string) int {
+	t.Helper()
+
+	resp, err := http.Get(httpPrefix + trentAddr + api.MetricsEndpoint)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const series = `trent_certificates_issued_total{step="5",kind="session_key"} `
+	for _, line := range strings.Split(string(body), "\n") {
+		if count, ok := strings.CutPrefix(line, series); ok {
+			var n int
+			if _, err := fmt.Sscan(count, &n); err != nil {
+				t.Fatal(err)
+			}
+			return n
+		}
+	}
+
+	return 0
+}
@@ -0,0 +1,467 @@
+package agent
+
+import (
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+
+	"github.com/sudeeya/key-exchange/internal/pkg/api"
+	"github.com/sudeeya/key-exchange/internal/pkg/crypto"
+	"github.com/sudeeya/key-exchange/internal/pkg/rng"
+)
+
+const (
+	controlTokenSize   = 32
+	controlSocketPerms = 0600
+)
+
+var (
+	errNotSocket   = errors.New("control socket path exists and is not a socket")
+	errSocketInUse = errors.New("control socket is in use by another process")
+)
+
+func checkControlConfig(cfg *config) error {
+	if cfg.ControlAddr == "" && cfg.ControlSocket == "" {
+		return errors.New("either CONTROL_ADDR or CONTROL_SOCKET must be set")
+	}
+	if cfg.ControlAddr == "" {
+		return nil
+	}
+	if cfg.ControlTokenFile == "" {
+		return errors.New("CONTROL_TOKEN_FILE is required when CONTROL_ADDR is set")
+	}
+
+	return api.CheckLoopback(cfg.ControlAddr)
+}
+
+// loadControlToken reads the control token from file, generating and storing
+// a new one readable only by the owner if the file does not exist yet.
+func loadControlToken(file string, random rng.RNG) (string, error) {
+	token, err := os.ReadFile(file)
+	if err == nil {
+		return strings.TrimSpace(string(token)), nil
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		return "", err
+	}
+
+	raw, err := random.GenerateKey(controlTokenSize)
+	if err != nil {
+		return "", err
+	}
+	encoded := hex.EncodeToString(raw)
+	if err := os.WriteFile(file, []byte(encoded+"\n"), 0600); err != nil {
+		return "", err
+	}
+
+	return encoded, nil
+}
+
+// listenControlSocket listens on a Unix socket that only the agent's user may
+// connect to, so socket permissions take the place of the control token.
+//
+// The socket is bound inside a directory only the agent's user can enter and
+// linked to path once its permissions are restricted, so there is no moment at
+// which others can connect to it.
+func listenControlSocket(path string) (net.Listener, error) {
+	if err := removeStaleSocket(path); err != nil {
+		return nil, err
+	}
+
+	dir, err := os.MkdirTemp(filepath.Dir(path), ".control-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+
+	bound := filepath.Join(dir, "socket")
+	listener, err := net.ListenUnix("unix", &net.UnixAddr{Name: bound, Net: "unix"})
+	if err != nil {
+		return nil, err
+	}
+	listener.SetUnlinkOnClose(false)
+	if err := os.Chmod(bound, controlSocketPerms); err != nil {
+		listener.Close()
+		return nil, err
+	}
+	// Unlike a rename, a link fails rather than replace whatever was created
+	// at path in the meantime.
+	if err := os.Link(bound, path); err != nil {
+		listener.Close()
+		return nil, err
+	}
+
+	return &controlSocketListener{UnixListener: listener, path: path}, nil
+}
+
+// removeStaleSocket removes the socket left at path by an agent that did not
+// shut down cleanly. Anything else at path is left alone and reported.
+func removeStaleSocket(path string) error {
+	info, err := os.Lstat(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if info.Mode()&os.ModeSocket == 0 {
+		return fmt.Errorf("%w: %s", errNotSocket, path)
+	}
+
+	if conn, err := net.Dial("unix", path); err == nil {
+		conn.Close()
+		return fmt.Errorf("%w: %s", errSocketInUse, path)
+	}
+
+	return os.Remove(path)
+}
+
+// controlSocketListener removes the socket file on Close, which the listener
+// itself no longer does once the socket has been moved.
+type controlSocketListener struct {
+	*net.UnixListener
+	path string
+}
+
+func (l *controlSocketListener) Close() error {
+	err := l.UnixListener.Close()
+	if removeErr := os.Remove(l.path); err == nil && !errors.Is(removeErr, os.ErrNotExist) {
+		err = removeErr
+	}
+
+	return err
+}
+
+func withControlToken(token string) func(http.Handler) http.Handler {
+	expected := []byte(api.ControlTokenScheme + token)
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			provided := []byte(r.Header.Get(api.ControlTokenHeader))
+			if subtle.ConstantTimeCompare(provided, expected) != 1 {
+				http.Error(w, "invalid control token", http.StatusUnauthorized)
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+func openSessionHandler(a *Agent) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req api.OpenSessionRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		info, err := a.OpenSession(r.Context(), req.Peer)
+		if err != nil {
+			http.Error(w, err.Error(), controlStatus(err))
+			return
+		}
+
+		writeJSON(w, http.StatusCreated, info)
+	}
+}
+
+func listSessionsHandler(a *Agent) http.HandlerFunc {
+	return func(w http.ResponseWriter, _ *http.Request) {
+		writeJSON(w, http.StatusOK, a.Sessions())
+	}
+}
+
+func sendMessageHandler(a *Agent) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req api.SendMessageRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		if err := a.SendMessage(r.Context(), req.Peer, req.Text); err != nil {
+			http.Error(w, err.Error(), controlStatus(err))
+			return
+		}
+
+		w.WriteHeader(http.StatusOK)
+	}
+}
+
+func closeSessionHandler(a *Agent) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		info, err := a.CloseSession(chi.URLParam(r, "peer"))
+		if err != nil {
+			http.Error(w, err.Error(), controlStatus(err))
+			return
+		}
+
+		writeJSON(w, http.StatusOK, info)
+	}
+}
+
+func listRequestsHandler(a *Agent) http.HandlerFunc {
+	return func(w http.ResponseWriter, _ *http.Request) {
+		writeJSON(w, http.StatusOK, a.consents.list())
+	}
+}
+
+func answerRequestHandler(a *Agent) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var decision api.ConsentDecision
+		if err := json.NewDecoder(r.Body).Decode(&decision); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		if err := a.AnswerRequest(chi.URLParam(r, "id"), decision.Accept); err != nil {
+			http.Error(w, err.Error(), controlStatus(err))
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func exportKeyHandler(a *Agent) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req api.ExportKeyRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		key, err := a.ExportKey(r.Context(), req)
+		if err != nil {
+			http.Error(w, err.Error(), controlStatus(err))
+			return
+		}
+
+		w.Header().Set("Cache-Control", "no-store")
+		writeJSON(w, http.StatusOK, key)
+	}
+}
+
+func sendFileHandler(a *Agent) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req api.SendFileRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		transfer, err := a.SendFile(req.Peer, req.Path)
+		if err != nil {
+			http.Error(w, err.Error(), controlStatus(err))
+			return
+		}
+
+		writeJSON(w, http.StatusAccepted, transfer)
+	}
+}
+
+func listTransfersHandler(a *Agent) http.HandlerFunc {
+	return func(w http.ResponseWriter, _ *http.Request) {
+		writeJSON(w, http.StatusOK, a.transfers.list())
+	}
+}
+
+// inboxHandler writes received messages as JSON lines, optionally only those
+// from peer or newer than since. With follow=true it keeps the response open
+// and streams new messages as they arrive.
+func inboxHandler(a *Agent) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		follow := query.Get("follow") == "true"
+		peer := query.Get("peer")
+		lastID := 0
+		if since := query.Get("since"); since != "" {
+			id, err := strconv.Atoi(since)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			lastID = id
+		}
+		matches := func(message *api.MailboxMessage) bool {
+			return message.ID > lastID && message.Direction == incomingMessage && (peer == "" || message.Peer == peer)
+		}
+
+		var events <-chan api.Event
+		if follow {
+			var unsubscribe func()
+			events, unsubscribe = a.events.subscribe()
+			defer unsubscribe()
+		}
+
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		w.WriteHeader(http.StatusOK)
+
+		enc := json.NewEncoder(w)
+		for _, message := range a.mailbox.list() {
+			if !matches(&message) {
+				continue
+			}
+			if err := enc.Encode(message); err != nil {
+				return
+			}
+			lastID = message.ID
+		}
+
+		if !follow {
+			return
+		}
+
+		flusher, _ := w.(http.Flusher)
+		for {
+			if flusher != nil {
+				flusher.Flush()
+			}
+
+			select {
+			case <-r.Context().Done():
+				return
+			case event, ok := <-events:
+				if !ok {
+					return
+				}
+				if event.Type != api.MessageReceivedEvent || !matches(event.Message) {
+					continue
+				}
+				if err := enc.Encode(event.Message); err != nil {
+					return
+				}
+				lastID = event.Message.ID
+			}
+		}
+	}
+}
+
+// historyHandler writes the messages that match the query: peer, direction,
+// q (text, case-insensitive), since (ID), from and to (RFC 3339) and limit
+// (most recent matches).
+func historyHandler(a *Agent) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		query, err := parseHistoryQuery(r.URL.Query())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		writeJSON(w, http.StatusOK, a.mailbox.search(query))
+	}
+}
+
+func parseHistoryQuery(values url.Values) (historyQuery, error) {
+	query := historyQuery{
+		Peer:      values.Get("peer"),
+		Direction: values.Get("direction"),
+		Text:      values.Get("q"),
+	}
+
+	var err error
+	if since := values.Get("since"); since != "" {
+		if query.Since, err = strconv.Atoi(since); err != nil {
+			return query, err
+		}
+	}
+	if limit := values.Get("limit"); limit != "" {
+		if query.Limit, err = strconv.Atoi(limit); err != nil {
+			return query, err
+		}
+	}
+	if from := values.Get("from"); from != "" {
+		if query.From, err = time.Parse(time.RFC3339, from); err != nil {
+			return query, err
+		}
+	}
+	if to := values.Get("to"); to != "" {
+		if query.To, err = time.Parse(time.RFC3339, to); err != nil {
+			return query, err
+		}
+	}
+
+	return query, nil
+}
+
+// eventsHandler streams session, handshake and mailbox events as JSON lines
+// until the client disconnects. types limits the stream to a comma-separated
+// list of event types.
+func eventsHandler(a *Agent) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		types := make(map[string]struct{})
+		if filter := r.URL.Query().Get("types"); filter != "" {
+			for _, t := range strings.Split(filter, ",") {
+				types[t] = struct{}{}
+			}
+		}
+
+		events, unsubscribe := a.events.subscribe()
+		defer unsubscribe()
+
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		w.WriteHeader(http.StatusOK)
+
+		enc := json.NewEncoder(w)
+		flusher, _ := w.(http.Flusher)
+		for {
+			if flusher != nil {
+				flusher.Flush()
+			}
+
+			select {
+			case <-r.Context().Done():
+				return
+			case event, ok := <-events:
+				if !ok {
+					return
+				}
+				if _, ok := types[event.Type]; len(types) > 0 && !ok {
+					continue
+				}
+				if err := enc.Encode(event); err != nil {
+					return
+				}
+			}
+		}
+	}
+}
+
+func controlStatus(err error) int {
+	switch {
+	case errors.Is(err, errUnknownPeer), errors.Is(err, errUnknownRequest):
+		return http.StatusNotFound
+	case errors.Is(err, errNoSession), errors.Is(err, errExportExpired):
+		return http.StatusConflict
+	case errors.Is(err, errLabelNotAllowed), errors.Is(err, errOutsideSendDir):
+		return http.StatusForbidden
+	case errors.Is(err, crypto.ErrExport):
+		return http.StatusBadRequest
+	case errors.Is(err, os.ErrNotExist), errors.Is(err, errNotRegularFile):
+		return http.StatusBadRequest
+	}
+
+	return http.StatusBadGateway
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+}
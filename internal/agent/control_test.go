@@ -0,0 +1,125 @@
+package agent
+
+import (
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestListenControlSocket(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "agent.sock")
+
+	listener, err := listenControlSocket(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode()&os.ModeSocket == 0 || info.Mode().Perm() != controlSocketPerms {
+		t.Fatalf("socket mode is %v, want socket with %o", info.Mode(), controlSocketPerms)
+	}
+
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+
+	entries, err := os.ReadDir(filepath.Dir(path))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Fatalf("directory holds %d entries, want only the socket", len(entries))
+	}
+
+	if err := listener.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Fatalf("socket still exists after Close: %v", err)
+	}
+}
+
+func TestListenControlSocketExistingPath(t *testing.T) {
+	tests := []struct {
+		name    string
+		prepare func(t *testing.T, path string)
+		wantErr error
+	}{
+		{
+			name:    "nothing",
+			prepare: func(*testing.T, string) {},
+		},
+		{
+			name: "stale socket",
+			prepare: func(t *testing.T, path string) {
+				listener, err := net.ListenUnix("unix", &net.UnixAddr{Name: path, Net: "unix"})
+				if err != nil {
+					t.Fatal(err)
+				}
+				listener.SetUnlinkOnClose(false)
+				listener.Close()
+			},
+		},
+		{
+			name: "socket in use",
+			prepare: func(t *testing.T, path string) {
+				listener, err := net.Listen("unix", path)
+				if err != nil {
+					t.Fatal(err)
+				}
+				t.Cleanup(func() { listener.Close() })
+			},
+			wantErr: errSocketInUse,
+		},
+		{
+			name: "regular file",
+			prepare: func(t *testing.T, path string) {
+				if err := os.WriteFile(path, []byte("keep"), 0600); err != nil {
+					t.Fatal(err)
+				}
+			},
+			wantErr: errNotSocket,
+		},
+		{
+			name: "symlink",
+			prepare: func(t *testing.T, path string) {
+				if err := os.Symlink(filepath.Join(filepath.Dir(path), "target"), path); err != nil {
+					t.Fatal(err)
+				}
+			},
+			wantErr: errNotSocket,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "agent.sock")
+			tt.prepare(t, path)
+			before, _ := os.Lstat(path)
+
+			listener, err := listenControlSocket(path)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("listenControlSocket returned %v, want %v", err, tt.wantErr)
+			}
+			if err == nil {
+				listener.Close()
+				return
+			}
+
+			after, err := os.Lstat(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !os.SameFile(before, after) {
+				t.Fatal("the existing file was replaced")
+			}
+		})
+	}
+}
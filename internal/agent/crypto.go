@@ -0,0 +1,78 @@
+package agent
+
+import (
+	"context"
+	"time"
+
+	"github.com/sudeeya/key-exchange/internal/pkg/api"
+	"github.com/sudeeya/key-exchange/internal/pkg/crypto"
+)
+
+func (a *Agent) encryptRSA(ctx context.Context, plaintext, publicKey []byte) []byte {
+	_, span := a.tracer.Start(ctx, "rsa.encrypt")
+	defer span.End()
+
+	return crypto.EncryptRSAKey(plaintext, a.keys.publicKey(publicKey), a.rng)
+}
+
+func (a *Agent) decryptRSA(ctx context.Context, ciphertext []byte) []byte {
+	_, span := a.tracer.Start(ctx, "rsa.decrypt")
+	defer span.End()
+
+	return crypto.DecryptRSAKey(ciphertext, a.keys.private())
+}
+
+// decryptHybrid decrypts what Trent encrypted under both the agent's RSA and
+// ML-KEM keys.
+func (a *Agent) decryptHybrid(ctx context.Context, ciphertext []byte) ([]byte, error) {
+	_, span := a.tracer.Start(ctx, "hybrid.decrypt")
+	defer span.End()
+
+	return crypto.DecryptHybrid(ciphertext, a.keys.private(), a.keys.kemKey)
+}
+
+func (a *Agent) verifyRSA(ctx context.Context, message, signature []byte) bool {
+	_, span := a.tracer.Start(ctx, "rsa.verify")
+	defer span.End()
+
+	ok := crypto.VerifyRSAKey(message, signature, a.keys.trent())
+	span.SetAttribute("valid", ok)
+
+	return ok
+}
+
+// signRequest authenticates req to Trent as this agent.
+func (a *Agent) signRequest(ctx context.Context, req *api.Request, endpoint string) error {
+	_, span := a.tracer.Start(ctx, "rsa.sign")
+	defer span.End()
+
+	nonce, err := a.rng.GenerateNonce()
+	if err != nil {
+		return err
+	}
+	req.Requester = a.cfg.ID
+	req.Timestamp = time.Now().UnixMilli()
+	req.Nonce = nonce
+
+	data, err := req.SignedData(endpoint)
+	if err != nil {
+		return err
+	}
+	req.Signature = crypto.SignRSAKey(data, a.keys.private())
+
+	return nil
+}
+
+func (a *Agent) encryptAES(ctx context.Context, plaintext, key, iv []byte) []byte {
+	_, span := a.tracer.Start(ctx, "aes.encrypt")
+	defer span.End()
+
+	return crypto.EncryptAES(plaintext, key, iv)
+}
+
+func (a *Agent) decryptAES(ctx context.Context, ciphertext, key, iv []byte) []byte {
+	_, span := a.tracer.Start(ctx, "aes.decrypt")
+	defer span.End()
+
+	return crypto.DecryptAES(ciphertext, key, iv)
+}
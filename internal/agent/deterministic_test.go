@@ -0,0 +1,93 @@
+//go:build deterministic && go1.26
+
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"slices"
+	"strings"
+	"testing"
+	"testing/cryptotest"
+	"time"
+
+	"github.com/go-resty/resty/v2"
+
+	"github.com/sudeeya/key-exchange/internal/pkg/api"
+	"github.com/sudeeya/key-exchange/internal/pkg/rng"
+)
+
+// TestSeededHandshakesRepeat runs the same handshake in two networks with
+// the same keys and seeds and checks that everything the initiator and the
+// acceptor exchange at steps 3 to 8 is the same, while crypto/rand gives
+// different output in each.
+func TestSeededHandshakesRepeat(t *testing.T) {
+	for _, cfg := range []interopConfig{interopConfigs[0], interopConfigs[2], interopConfigs[4]} {
+		t.Run(cfg.suites[0], func(t *testing.T) {
+			var transcripts [2][]string
+			for run := range transcripts {
+				// Each run is a subtest, so that the first network is shut
+				// down before the second one draws from crypto/rand.
+				t.Run(fmt.Sprint("run ", run), func(t *testing.T) {
+					transcripts[run] = seededHandshake(t, cfg, uint64(run)+2)
+				})
+			}
+
+			if len(transcripts[0]) != 4 {
+				t.Fatalf("%d messages were recorded, want 4", len(transcripts[0]))
+			}
+			if !slices.Equal(transcripts[0], transcripts[1]) {
+				t.Fatalf("handshakes with the same seed differ:\n%q\n%q", transcripts[0], transcripts[1])
+			}
+		})
+	}
+}
+
+// seededHandshake runs a handshake between two agents with cfg, seeding
+// crypto/rand with randomSeed once their keys are generated, and returns the
+// step 4 and 7 requests and responses.
+func seededHandshake(t *testing.T, cfg interopConfig, randomSeed uint64) []string {
+	t.Helper()
+
+	// The same keys are generated for every network.
+	cryptotest.SetGlobalRandom(t, 1)
+	n := newSeededInteropNetwork(t, []interopConfig{cfg}, nil, func(id string) rng.RNG {
+		return rng.NewDeterministicRNG("lesson/" + id)
+	})
+	cryptotest.SetGlobalRandom(t, randomSeed)
+
+	var transcript []string
+	initiator := n.agents[cfg.id+"-a"]
+	initiator.client.OnAfterResponse(func(_ *resty.Client, r *resty.Response) error {
+		if !strings.HasSuffix(r.Request.URL, api.Step4Endpoint) && !strings.HasSuffix(r.Request.URL, api.Step7Endpoint) {
+			return nil
+		}
+		request, err := json.Marshal(r.Request.Body)
+		if err != nil {
+			return err
+		}
+		transcript = append(transcript, string(request), string(r.Body()))
+		return nil
+	})
+
+	info, err := initiator.OpenSession(context.Background(), cfg.id+"-b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Suite != cfg.suites[0] {
+		t.Fatalf("handshake settled on %s, want %s", info.Suite, cfg.suites[0])
+	}
+
+	// The stream opened after the handshake must not be dialling when the
+	// next network generates its keys.
+	deadline := time.Now().Add(5 * time.Second)
+	for !initiator.streams.connected(cfg.id + "-b") {
+		if time.Now().After(deadline) {
+			t.Fatal("stream did not connect")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	return transcript
+}
@@ -0,0 +1,59 @@
+package agent
+
+import (
+	"sync"
+	"time"
+
+	"github.com/sudeeya/key-exchange/internal/pkg/api"
+)
+
+const subscriberBuffer = 64
+
+// broker fans agent events out to the TUI and control API subscribers.
+// Slow subscribers miss events instead of blocking the protocol.
+type broker struct {
+	mu          sync.Mutex
+	subscribers map[chan api.Event]struct{}
+}
+
+func newBroker() *broker {
+	return &broker{
+		subscribers: make(map[chan api.Event]struct{}),
+	}
+}
+
+func (b *broker) subscribe() (<-chan api.Event, func()) {
+	ch := make(chan api.Event, subscriberBuffer)
+
+	b.mu.Lock()
+	b.subscribers[ch] = struct{}{}
+	b.mu.Unlock()
+
+	unsubscribe := func() {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+
+		if _, ok := b.subscribers[ch]; ok {
+			delete(b.subscribers, ch)
+			close(ch)
+		}
+	}
+
+	return ch, unsubscribe
+}
+
+func (b *broker) publish(event api.Event) {
+	if event.Time.IsZero() {
+		event.Time = time.Now()
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for ch := range b.subscribers {
+		select {
+		case ch <- event:
+		default:
+		}
+	}
+}
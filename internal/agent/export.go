@@ -0,0 +1,110 @@
+package agent
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/sudeeya/key-exchange/internal/pkg/api"
+	"github.com/sudeeya/key-exchange/internal/pkg/crypto"
+)
+
+const (
+	defaultExportLength = 32
+	keyIDSize           = 16
+
+	// Labels with this prefix are used by the agent itself and are never
+	// exported to local applications.
+	internalLabelPrefix = "agent/"
+)
+
+var (
+	errLabelNotAllowed = errors.New("export label is not allowed")
+	errExportExpired   = errors.New("session is too old to export keys from")
+)
+
+// ExportKey derives keying material for a local application from the session
+// with peer. The session key itself never leaves the agent; both peers derive
+// the same key and key ID for the same label and context.
+//
+// Exported keys expire EXPORT_LIFETIME after the session was established, and
+// no keys are exported from it after that; a new handshake starts the
+// lifetime over.
+func (a *Agent) ExportKey(ctx context.Context, req api.ExportKeyRequest) (api.ExportedKey, error) {
+	if _, ok := a.peers[req.Peer]; !ok {
+		return api.ExportedKey{}, fmt.Errorf("%w: %s", errUnknownPeer, req.Peer)
+	}
+	if strings.HasPrefix(req.Label, internalLabelPrefix) ||
+		len(a.cfg.ExportLabels) > 0 && !slices.Contains(a.cfg.ExportLabels, req.Label) {
+		return api.ExportedKey{}, fmt.Errorf("%w: %q", errLabelNotAllowed, req.Label)
+	}
+	s, ok := a.sessions.get(req.Peer)
+	if !ok {
+		return api.ExportedKey{}, fmt.Errorf("%w: %s", errNoSession, req.Peer)
+	}
+	expires := s.established.Add(a.cfg.ExportLifetime)
+	if !time.Now().Before(expires) {
+		return api.ExportedKey{}, fmt.Errorf("%w: %s", errExportExpired, req.Peer)
+	}
+
+	_, span := a.tracer.Start(ctx, "export key")
+	defer span.End()
+	span.SetAttribute("peer", req.Peer)
+	span.SetAttribute("session_id", s.id)
+	span.SetAttribute("label", req.Label)
+
+	length := req.Length
+	if length == 0 {
+		length = defaultExportLength
+	}
+	key, err := crypto.ExportKey(s.keys.Exporter, req.Label, req.Context, length)
+	if err != nil {
+		span.RecordError(err)
+		return api.ExportedKey{}, err
+	}
+
+	keyID := exportedKeyID(s.id, req.Label, req.Context)
+	if !a.sessions.recordExport(s, keyID) {
+		// The session was replaced or closed in the meantime, and its
+		// users have already been told which keys to drop.
+		err := fmt.Errorf("%w: %s", errNoSession, req.Peer)
+		span.RecordError(err)
+		return api.ExportedKey{}, err
+	}
+	a.metrics.keysExported.Inc(req.Peer)
+
+	a.logger.Info("Key exported",
+		zap.String("peer", req.Peer),
+		zap.String("session_id", s.id),
+		zap.String("key_id", keyID),
+		zap.String("label", req.Label),
+	)
+
+	return api.ExportedKey{
+		ID:      keyID,
+		Session: s.id,
+		Peer:    req.Peer,
+		Label:   req.Label,
+		Key:     key,
+		Expires: expires,
+	}, nil
+}
+
+// exportedKeyID names an exported key without depending on its value.
+func exportedKeyID(sessionID, label string, context []byte) string {
+	h := sha256.New()
+	h.Write([]byte(sessionID))
+	h.Write([]byte{0})
+	h.Write([]byte(label))
+	h.Write([]byte{0})
+	h.Write(context)
+
+	return hex.EncodeToString(h.Sum(nil)[:keyIDSize])
+}
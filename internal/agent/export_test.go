@@ -0,0 +1,68 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/sudeeya/key-exchange/internal/pkg/api"
+)
+
+func TestExportKeyExpiresWithSession(t *testing.T) {
+	const lifetime = time.Hour
+
+	tests := []struct {
+		name    string
+		prepare func(a *Agent)
+		wantErr error
+	}{
+		{
+			name:    "fresh session",
+			prepare: func(*Agent) {},
+		},
+		{
+			name: "old session",
+			prepare: func(a *Agent) {
+				s, _ := a.sessions.get("rsa-b")
+				s.established = time.Now().Add(-lifetime)
+			},
+			wantErr: errExportExpired,
+		},
+		{
+			name: "closed session",
+			prepare: func(a *Agent) {
+				if _, err := a.CloseSession("rsa-b"); err != nil {
+					t.Fatal(err)
+				}
+			},
+			wantErr: errNoSession,
+		},
+	}
+
+	n := newInteropNetwork(t, interopConfigs[:1], func(cfg *config) {
+		cfg.ExportLifetime = lifetime
+	})
+	initiator := n.agents["rsa-a"]
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := initiator.OpenSession(context.Background(), "rsa-b"); err != nil {
+				t.Fatal(err)
+			}
+			s, _ := initiator.sessions.get("rsa-b")
+			tt.prepare(initiator)
+
+			key, err := initiator.ExportKey(context.Background(), api.ExportKeyRequest{Peer: "rsa-b", Label: "test"})
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("ExportKey returned %v, want %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if want := s.established.Add(lifetime); !key.Expires.Equal(want) {
+				t.Fatalf("key expires at %v, want %v", key.Expires, want)
+			}
+		})
+	}
+}
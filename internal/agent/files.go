@@ -0,0 +1,739 @@
+package agent
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"go.uber.org/zap"
+
+	"github.com/sudeeya/key-exchange/internal/pkg/api"
+	"github.com/sudeeya/key-exchange/internal/pkg/crypto"
+)
+
+const (
+	fileChunkSize    = 64 * 1024
+	maxFileChunkSize = 1024 * 1024
+	fileLabel        = internalLabelPrefix + "file transfer"
+	fileOfferData    = "offer"
+	transferIDSize   = 16
+	fileRetries      = 5
+	fileRetryDelay   = time.Second
+	partialDir       = ".partial"
+)
+
+var (
+	errUnknownTransfer = errors.New("unknown transfer")
+	errFileCorrupted   = errors.New("file checksum mismatch")
+	errNotRegularFile  = errors.New("not a regular file")
+	errFileTooLarge    = errors.New("file too large")
+	errOutsideSendDir  = errors.New("file is outside SEND_DIR")
+)
+
+// incomingFile is a file being received. Chunks are appended in order to a
+// partial file in the download directory, so that an interrupted transfer
+// can continue from the last stored chunk, even after a restart.
+type incomingFile struct {
+	mu     sync.Mutex
+	id     string
+	peer   string
+	info   api.FileInfo
+	next   int
+	chunks int
+}
+
+type partialFile struct {
+	Peer string       `json:"peer"`
+	Info api.FileInfo `json:"info"`
+}
+
+type downloads struct {
+	dir     string
+	maxSize int64
+
+	mu    sync.Mutex
+	files map[string]*incomingFile
+	// completed remembers the chunk count of finished transfers, so that a
+	// sender that missed the last response is not made to start over.
+	completed map[string]int
+}
+
+func newDownloads(dir string, maxSize int64) (*downloads, error) {
+	if err := os.MkdirAll(filepath.Join(dir, partialDir), 0700); err != nil {
+		return nil, err
+	}
+
+	return &downloads{
+		dir:       dir,
+		maxSize:   maxSize,
+		files:     make(map[string]*incomingFile),
+		completed: make(map[string]int),
+	}, nil
+}
+
+func (d *downloads) partPath(id string) string {
+	return filepath.Join(d.dir, partialDir, id+".part")
+}
+
+func (d *downloads) metaPath(id string) string {
+	return filepath.Join(d.dir, partialDir, id+".json")
+}
+
+// open returns the state of transfer id, resuming it from disk or starting
+// it if it is new.
+func (d *downloads) open(id, peer string, info api.FileInfo) (*incomingFile, error) {
+	if info.Size > d.maxSize {
+		return nil, fmt.Errorf("%w: %d bytes, at most %d allowed", errFileTooLarge, info.Size, d.maxSize)
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	f, ok := d.files[id]
+	if !ok {
+		var err error
+		f, err = d.load(id, peer, info)
+		if err != nil {
+			return nil, err
+		}
+		d.files[id] = f
+	}
+
+	if f.peer != peer || f.info.Size != info.Size || f.info.ChunkSize != info.ChunkSize ||
+		!bytes.Equal(f.info.SHA256, info.SHA256) {
+		return nil, fmt.Errorf("transfer %s does not match the earlier offer", id)
+	}
+
+	return f, nil
+}
+
+func (d *downloads) load(id, peer string, info api.FileInfo) (*incomingFile, error) {
+	f := &incomingFile{
+		id:     id,
+		peer:   peer,
+		info:   info,
+		chunks: int((info.Size + int64(info.ChunkSize) - 1) / int64(info.ChunkSize)),
+	}
+
+	raw, err := os.ReadFile(d.metaPath(id))
+	switch {
+	case err == nil:
+		var partial partialFile
+		if err := json.Unmarshal(raw, &partial); err != nil {
+			return nil, err
+		}
+		f.peer, f.info = partial.Peer, partial.Info
+	case errors.Is(err, os.ErrNotExist):
+		raw, err := json.Marshal(partialFile{Peer: peer, Info: info})
+		if err != nil {
+			return nil, err
+		}
+		if err := os.WriteFile(d.metaPath(id), raw, 0600); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, err
+	}
+
+	part, err := os.OpenFile(d.partPath(id), os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, err
+	}
+	defer part.Close()
+
+	stat, err := part.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	// A chunk cut short by a crash is dropped and received again.
+	f.next = int(stat.Size() / int64(f.info.ChunkSize))
+	if err := part.Truncate(int64(f.next) * int64(f.info.ChunkSize)); err != nil {
+		return nil, err
+	}
+
+	return f, nil
+}
+
+// write stores chunk index of f. It reports whether the file is complete.
+func (d *downloads) write(f *incomingFile, index int, chunk []byte) (bool, error) {
+	if index >= f.chunks {
+		return false, fmt.Errorf("chunk %d is past the end of the file", index)
+	}
+	expected := f.info.ChunkSize
+	if index == f.chunks-1 {
+		expected = int(f.info.Size - int64(index)*int64(f.info.ChunkSize))
+	}
+	if len(chunk) != expected {
+		return false, fmt.Errorf("chunk %d is %d bytes, expected %d", index, len(chunk), expected)
+	}
+
+	part, err := os.OpenFile(d.partPath(f.id), os.O_WRONLY, 0600)
+	if err != nil {
+		return false, err
+	}
+	defer part.Close()
+
+	if _, err := part.WriteAt(chunk, int64(index)*int64(f.info.ChunkSize)); err != nil {
+		return false, err
+	}
+	if err := part.Sync(); err != nil {
+		return false, err
+	}
+	f.next++
+
+	return f.next == f.chunks, nil
+}
+
+// finish checks the whole-file checksum and moves the file into the download
+// directory, returning its final path.
+func (d *downloads) finish(f *incomingFile) (string, error) {
+	sum, err := fileChecksum(d.partPath(f.id))
+	if err != nil {
+		d.forget(f, false)
+		return "", err
+	}
+	if !bytes.Equal(sum, f.info.SHA256) {
+		os.Remove(d.partPath(f.id))
+		d.forget(f, false)
+		return "", errFileCorrupted
+	}
+
+	path, err := claimPath(d.dir, f.info.Name)
+	if err != nil {
+		d.forget(f, false)
+		return "", err
+	}
+	if err := os.Rename(d.partPath(f.id), path); err != nil {
+		os.Remove(path)
+		d.forget(f, false)
+		return "", err
+	}
+	d.forget(f, true)
+
+	return path, nil
+}
+
+func (d *downloads) forget(f *incomingFile, completed bool) {
+	os.Remove(d.metaPath(f.id))
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	delete(d.files, f.id)
+	if completed {
+		d.completed[f.id] = f.chunks
+	}
+}
+
+func (d *downloads) completedChunks(id string) (int, bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	chunks, ok := d.completed[id]
+	return chunks, ok
+}
+
+func (d *downloads) get(id string) (*incomingFile, bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	f, ok := d.files[id]
+	return f, ok
+}
+
+// claimPath picks a name for a received file that does not overwrite an
+// existing one. The name is claimed by creating an empty file exclusively,
+// which the received file then replaces, so that nothing created in the
+// meantime can be overwritten either.
+func claimPath(dir, name string) (string, error) {
+	path := filepath.Join(dir, name)
+	ext := filepath.Ext(name)
+	base := strings.TrimSuffix(name, ext)
+	for i := 1; ; i++ {
+		file, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+		if err == nil {
+			return path, file.Close()
+		}
+		if !errors.Is(err, os.ErrExist) {
+			return "", err
+		}
+		path = filepath.Join(dir, fmt.Sprintf("%s (%d)%s", base, i, ext))
+	}
+}
+
+// openSendFile opens a regular file to be sent. If dir is set, the file must
+// be inside it, and symbolic links may not lead out of it.
+func openSendFile(dir, path string) (*os.File, error) {
+	if dir == "" {
+		return openRegularFile(os.Stat, os.Open, path)
+	}
+
+	absDir, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, err
+	}
+	absPath, err := filepath.Abs(path)
+	if err != nil {
+		return nil, err
+	}
+	rel, err := filepath.Rel(absDir, absPath)
+	if err != nil || !filepath.IsLocal(rel) {
+		return nil, fmt.Errorf("%w: %s", errOutsideSendDir, path)
+	}
+
+	root, err := os.OpenRoot(absDir)
+	if err != nil {
+		return nil, err
+	}
+	defer root.Close()
+
+	file, err := openRegularFile(root.Stat, root.Open, rel)
+	if err != nil && !errors.Is(err, os.ErrNotExist) && !errors.Is(err, errNotRegularFile) {
+		// The root refuses links that lead out of it.
+		return nil, fmt.Errorf("%w: %w", errOutsideSendDir, err)
+	}
+
+	return file, err
+}
+
+// openRegularFile opens path only if it is a regular file, so that opening
+// a named pipe, for one, cannot block.
+func openRegularFile(stat func(string) (os.FileInfo, error), open func(string) (*os.File, error), path string) (*os.File, error) {
+	info, err := stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if !info.Mode().IsRegular() {
+		return nil, fmt.Errorf("%w: %s", errNotRegularFile, path)
+	}
+
+	return open(path)
+}
+
+func fileChecksum(path string) ([]byte, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, file); err != nil {
+		return nil, err
+	}
+
+	return h.Sum(nil), nil
+}
+
+func fileKey(exporter []byte, transferID string) ([]byte, error) {
+	return crypto.ExportKey(exporter, fileLabel, []byte(transferID), crypto.AEADKeySize)
+}
+
+func chunkData(index int) []byte {
+	return binary.BigEndian.AppendUint32(nil, uint32(index))
+}
+
+func validTransferID(id string) bool {
+	raw, err := hex.DecodeString(id)
+	return err == nil && len(raw) == transferIDSize
+}
+
+func validFileInfo(info api.FileInfo) error {
+	name := filepath.Base(info.Name)
+	switch {
+	case name != info.Name || name == "." || name == ".." || strings.HasPrefix(name, "."):
+		return fmt.Errorf("invalid file name %q", info.Name)
+	case info.Size < 0:
+		return errors.New("invalid file size")
+	case info.ChunkSize <= 0 || info.ChunkSize > maxFileChunkSize:
+		return errors.New("invalid chunk size")
+	case len(info.SHA256) != sha256.Size:
+		return errors.New("invalid file checksum")
+	}
+
+	return nil
+}
+
+// SendFile starts sending the file at path to peer in the background and
+// returns right away. Progress is reported with transfer events.
+func (a *Agent) SendFile(peer, path string) (api.TransferInfo, error) {
+	if _, ok := a.peers[peer]; !ok {
+		return api.TransferInfo{}, fmt.Errorf("%w: %s", errUnknownPeer, peer)
+	}
+	if _, ok := a.sessions.get(peer); !ok {
+		return api.TransferInfo{}, fmt.Errorf("%w: %s", errNoSession, peer)
+	}
+
+	file, err := openSendFile(a.cfg.SendDir, path)
+	if err != nil {
+		return api.TransferInfo{}, err
+	}
+	defer file.Close()
+
+	stat, err := file.Stat()
+	if err != nil {
+		return api.TransferInfo{}, err
+	}
+	h := sha256.New()
+	if _, err := io.Copy(h, file); err != nil {
+		return api.TransferInfo{}, err
+	}
+	sum := h.Sum(nil)
+
+	rawID, err := a.rng.GenerateKey(transferIDSize)
+	if err != nil {
+		return api.TransferInfo{}, err
+	}
+
+	info := api.FileInfo{
+		Name:      filepath.Base(path),
+		Size:      stat.Size(),
+		ChunkSize: fileChunkSize,
+		SHA256:    sum,
+	}
+	transfer := api.TransferInfo{
+		ID:        hex.EncodeToString(rawID),
+		Peer:      peer,
+		Direction: outgoingTransfer,
+		Name:      info.Name,
+		Path:      path,
+		Size:      info.Size,
+		Status:    transferActive,
+	}
+	a.updateTransfer(transfer)
+
+	go a.sendFile(transfer, info)
+
+	return transfer, nil
+}
+
+// sendFile uploads the file, resuming from the chunk the peer asks for after
+// every failure, until it is complete or no progress is made for several
+// attempts in a row.
+func (a *Agent) sendFile(transfer api.TransferInfo, info api.FileInfo) {
+	failures := 0
+	for {
+		before := transfer.Transferred
+		err := a.uploadFile(&transfer, info)
+		if err == nil {
+			transfer.Status = transferCompleted
+			a.updateTransfer(transfer)
+			a.logger.Info("File sent", zap.String("peer", transfer.Peer), zap.String("transfer", transfer.ID))
+			return
+		}
+
+		a.logger.Error("File transfer interrupted",
+			zap.String("peer", transfer.Peer),
+			zap.String("transfer", transfer.ID),
+			zap.Error(err),
+		)
+
+		if transfer.Transferred > before {
+			failures = 0
+		}
+		failures++
+		if failures > fileRetries || errors.Is(err, errFileCorrupted) || errors.Is(err, errFileTooLarge) {
+			transfer.Status = transferFailed
+			transfer.Error = err.Error()
+			a.updateTransfer(transfer)
+			return
+		}
+
+		time.Sleep(fileRetryDelay << (failures - 1))
+	}
+}
+
+func (a *Agent) uploadFile(transfer *api.TransferInfo, info api.FileInfo) error {
+	ctx, span := a.tracer.Start(context.Background(), "send file")
+	defer span.End()
+	span.SetAttribute("peer", transfer.Peer)
+	span.SetAttribute("transfer", transfer.ID)
+
+	s, ok := a.sessions.get(transfer.Peer)
+	if !ok {
+		err := fmt.Errorf("%w: %s", errNoSession, transfer.Peer)
+		span.RecordError(err)
+		return err
+	}
+	key, err := fileKey(s.keys.Exporter, transfer.ID)
+	if err != nil {
+		span.RecordError(err)
+		return err
+	}
+
+	infoJSON, err := json.Marshal(info)
+	if err != nil {
+		span.RecordError(err)
+		return err
+	}
+	status, err := a.postFilePart(ctx, transfer, api.FilesEndpoint+transfer.ID, infoJSON, key, []byte(fileOfferData))
+	if err != nil {
+		span.RecordError(err)
+		return err
+	}
+
+	file, err := openSendFile(a.cfg.SendDir, transfer.Path)
+	if err != nil {
+		span.RecordError(err)
+		return err
+	}
+	defer file.Close()
+
+	chunks := int((info.Size + int64(info.ChunkSize) - 1) / int64(info.ChunkSize))
+	chunk := make([]byte, info.ChunkSize)
+	for index := status.NextChunk; index < chunks; index = status.NextChunk {
+		n, err := file.ReadAt(chunk, int64(index)*int64(info.ChunkSize))
+		if err != nil && !errors.Is(err, io.EOF) {
+			span.RecordError(err)
+			return err
+		}
+
+		endpoint := api.FilesEndpoint + transfer.ID + "/" + strconv.Itoa(index)
+		status, err = a.postFilePart(ctx, transfer, endpoint, chunk[:n], key, chunkData(index))
+		if err != nil {
+			span.RecordError(err)
+			return err
+		}
+
+		transfer.Transferred = min(int64(status.NextChunk)*int64(info.ChunkSize), info.Size)
+		a.updateTransfer(*transfer)
+	}
+
+	return nil
+}
+
+func (a *Agent) postFilePart(ctx context.Context, transfer *api.TransferInfo, endpoint string, plaintext, key, additionalData []byte) (api.FileStatus, error) {
+	nonce, err := a.rng.GenerateKey(crypto.AEADNonceSize)
+	if err != nil {
+		return api.FileStatus{}, err
+	}
+	ciphertext, err := crypto.EncryptAEAD(plaintext, key, nonce, additionalData)
+	if err != nil {
+		return api.FileStatus{}, err
+	}
+
+	msg := api.Message{
+		Sender:     a.cfg.ID,
+		IV:         nonce,
+		Ciphertext: ciphertext,
+	}
+	var status api.FileStatus
+	rawResp, err := a.transferClient.R().
+		SetContext(ctx).
+		SetHeader("Content-Type", "application/json").
+		SetBody(msg).
+		SetResult(&status).
+		SetError(&status).
+		Post(httpPrefix + a.peers[transfer.Peer] + endpoint)
+	if err != nil {
+		return api.FileStatus{}, err
+	}
+
+	switch rawResp.StatusCode() {
+	case http.StatusOK:
+		return status, nil
+	case http.StatusConflict:
+		// The peer expects another chunk, for example after a lost response.
+		return status, nil
+	case http.StatusUnprocessableEntity:
+		return api.FileStatus{}, errFileCorrupted
+	case http.StatusRequestEntityTooLarge:
+		return api.FileStatus{}, errFileTooLarge
+	}
+
+	return api.FileStatus{}, fmt.Errorf("file transfer status code is %d", rawResp.StatusCode())
+}
+
+func (a *Agent) updateTransfer(transfer api.TransferInfo) {
+	a.transfers.update(transfer)
+
+	eventType := api.TransferProgressEvent
+	switch transfer.Status {
+	case transferCompleted:
+		eventType = api.TransferCompletedEvent
+	case transferFailed:
+		eventType = api.TransferFailedEvent
+	}
+	a.events.publish(api.Event{
+		Type:     eventType,
+		Transfer: &transfer,
+	})
+}
+
+func incomingTransferInfo(f *incomingFile) api.TransferInfo {
+	return api.TransferInfo{
+		ID:          f.id,
+		Peer:        f.peer,
+		Direction:   incomingTransfer,
+		Name:        f.info.Name,
+		Size:        f.info.Size,
+		Transferred: min(int64(f.next)*int64(f.info.ChunkSize), f.info.Size),
+		Status:      transferActive,
+	}
+}
+
+// openFileMessage decrypts the body of a file transfer request with the key
+// of the sender's session.
+func openFileMessage(a *Agent, r *http.Request, transferID string, additionalData []byte) (string, []byte, int, error) {
+	var msg api.Message
+	if err := json.NewDecoder(r.Body).Decode(&msg); err != nil {
+		return "", nil, http.StatusBadRequest, err
+	}
+
+	s, ok := a.sessions.get(msg.Sender)
+	if !ok {
+		return "", nil, http.StatusBadRequest, errNoSession
+	}
+	key, err := fileKey(s.keys.Exporter, transferID)
+	if err != nil {
+		return "", nil, http.StatusInternalServerError, err
+	}
+
+	plaintext, err := crypto.DecryptAEAD(msg.Ciphertext, key, msg.IV, additionalData)
+	if err != nil {
+		return "", nil, http.StatusBadRequest, err
+	}
+
+	return msg.Sender, plaintext, http.StatusOK, nil
+}
+
+func fileOfferHandler(a *Agent) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := chi.URLParam(r, "transfer")
+		if !validTransferID(id) {
+			http.Error(w, errUnknownTransfer.Error(), http.StatusBadRequest)
+			return
+		}
+
+		peer, plaintext, status, err := openFileMessage(a, r, id, []byte(fileOfferData))
+		if err != nil {
+			http.Error(w, err.Error(), status)
+			return
+		}
+
+		var info api.FileInfo
+		if err := json.Unmarshal(plaintext, &info); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := validFileInfo(info); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		if chunks, ok := a.downloads.completedChunks(id); ok {
+			writeJSON(w, http.StatusOK, api.FileStatus{NextChunk: chunks})
+			return
+		}
+
+		f, err := a.downloads.open(id, peer, info)
+		if errors.Is(err, errFileTooLarge) {
+			http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		f.mu.Lock()
+		defer f.mu.Unlock()
+
+		a.updateTransfer(incomingTransferInfo(f))
+		if f.chunks == 0 && !a.finishDownload(f) {
+			http.Error(w, errFileCorrupted.Error(), http.StatusUnprocessableEntity)
+			return
+		}
+
+		writeJSON(w, http.StatusOK, api.FileStatus{NextChunk: f.next})
+	}
+}
+
+func fileChunkHandler(a *Agent) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := chi.URLParam(r, "transfer")
+		index, err := strconv.Atoi(chi.URLParam(r, "chunk"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		f, ok := a.downloads.get(id)
+		if !ok {
+			http.Error(w, errUnknownTransfer.Error(), http.StatusNotFound)
+			return
+		}
+
+		peer, chunk, status, err := openFileMessage(a, r, id, chunkData(index))
+		if err != nil {
+			http.Error(w, err.Error(), status)
+			return
+		}
+		if peer != f.peer {
+			http.Error(w, errUnknownTransfer.Error(), http.StatusNotFound)
+			return
+		}
+
+		f.mu.Lock()
+		defer f.mu.Unlock()
+
+		if index != f.next {
+			writeJSON(w, http.StatusConflict, api.FileStatus{NextChunk: f.next})
+			return
+		}
+
+		done, err := a.downloads.write(f, index, chunk)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		a.logger.Debug("File chunk received",
+			zap.String("transfer", f.id),
+			zap.Int("chunk", index),
+			zap.Int("size", len(chunk)),
+		)
+		a.updateTransfer(incomingTransferInfo(f))
+
+		if done && !a.finishDownload(f) {
+			http.Error(w, errFileCorrupted.Error(), http.StatusUnprocessableEntity)
+			return
+		}
+
+		writeJSON(w, http.StatusOK, api.FileStatus{NextChunk: f.next})
+	}
+}
+
+func (a *Agent) finishDownload(f *incomingFile) bool {
+	transfer := incomingTransferInfo(f)
+
+	path, err := a.downloads.finish(f)
+	if err != nil {
+		a.logger.Error("Failed to receive file", zap.String("peer", f.peer), zap.String("transfer", f.id), zap.Error(err))
+		transfer.Status = transferFailed
+		transfer.Error = err.Error()
+		a.updateTransfer(transfer)
+		return false
+	}
+
+	a.logger.Info("File received", zap.String("peer", f.peer), zap.String("transfer", f.id), zap.String("path", path))
+	transfer.Status = transferCompleted
+	transfer.Path = path
+	a.updateTransfer(transfer)
+
+	return true
+}
@@ -0,0 +1,109 @@
+package agent
+
+import (
+	"crypto/sha256"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/sudeeya/key-exchange/internal/pkg/api"
+)
+
+func TestClaimPathDoesNotOverwrite(t *testing.T) {
+	dir := t.TempDir()
+	existing := filepath.Join(dir, "report.txt")
+	if err := os.WriteFile(existing, []byte("keep"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	path, err := claimPath(dir, "report.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := filepath.Join(dir, "report (1).txt"); path != want {
+		t.Fatalf("claimed %s, want %s", path, want)
+	}
+
+	again, err := claimPath(dir, "report.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again == path {
+		t.Fatalf("%s was claimed twice", path)
+	}
+
+	content, err := os.ReadFile(existing)
+	if err != nil || string(content) != "keep" {
+		t.Fatalf("existing file was changed: %q, %v", content, err)
+	}
+}
+
+func TestDownloadsRefuseLargeFiles(t *testing.T) {
+	d, err := newDownloads(t.TempDir(), 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	info := api.FileInfo{
+		Name:      "large.bin",
+		Size:      1025,
+		ChunkSize: fileChunkSize,
+		SHA256:    make([]byte, sha256.Size),
+	}
+	if _, err := d.open("transfer", "alice", info); !errors.Is(err, errFileTooLarge) {
+		t.Fatalf("open returned %v, want %v", err, errFileTooLarge)
+	}
+
+	info.Size = 1024
+	f, err := d.open("transfer", "alice", info)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.write(f, 1, make([]byte, 1)); err == nil {
+		t.Fatal("chunk past the end of the file was stored")
+	}
+}
+
+func TestOpenSendFile(t *testing.T) {
+	dir := t.TempDir()
+	sendDir := filepath.Join(dir, "send")
+	if err := os.MkdirAll(filepath.Join(sendDir, "reports"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"send/reports/report.txt", "secret.txt"} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(name), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Symlink(filepath.Join(dir, "secret.txt"), filepath.Join(sendDir, "link.txt")); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		dir     string
+		path    string
+		wantErr error
+	}{
+		{name: "any file without SEND_DIR", path: filepath.Join(dir, "secret.txt")},
+		{name: "file inside", dir: sendDir, path: filepath.Join(sendDir, "reports", "report.txt")},
+		{name: "file outside", dir: sendDir, path: filepath.Join(dir, "secret.txt"), wantErr: errOutsideSendDir},
+		{name: "parent reference", dir: sendDir, path: sendDir + "/reports/../../secret.txt", wantErr: errOutsideSendDir},
+		{name: "link leading outside", dir: sendDir, path: filepath.Join(sendDir, "link.txt"), wantErr: errOutsideSendDir},
+		{name: "directory", dir: sendDir, path: filepath.Join(sendDir, "reports"), wantErr: errNotRegularFile},
+		{name: "missing file", dir: sendDir, path: filepath.Join(sendDir, "missing.txt"), wantErr: os.ErrNotExist},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			file, err := openSendFile(tt.dir, tt.path)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("openSendFile returned %v, want %v", err, tt.wantErr)
+			}
+			if err == nil {
+				file.Close()
+			}
+		})
+	}
+}
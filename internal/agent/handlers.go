@@ -3,105 +3,222 @@ package agent
 import (
 	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
 
 	"github.com/sudeeya/key-exchange/internal/pkg/api"
 	"github.com/sudeeya/key-exchange/internal/pkg/crypto"
+	"github.com/sudeeya/key-exchange/internal/pkg/pem"
+	"github.com/sudeeya/key-exchange/internal/pkg/suite"
+	"github.com/sudeeya/key-exchange/internal/pkg/tracing"
 )
 
 func step4Handler(a *Agent) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
+		waitForUser(w)
+
 		// Step 4
+		a.metrics.handshakeStarted(acceptorRole)
+
+		var initiator string
+		fail := func(step, status int, err error) {
+			a.handshakeFailed(r.Context(), acceptorRole, initiator, step, err)
+			http.Error(w, err.Error(), status)
+		}
+
 		var req api.Request
 		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-			http.Error(w, err.Error(), http.StatusBadRequest)
+			fail(4, http.StatusBadRequest, err)
 			return
 		}
 
-		info4JSON := crypto.DecryptRSA(req.Ciphertext, a.keys.privateKey)
+		info4JSON := a.decryptRSA(r.Context(), req.Ciphertext)
 
 		info4 := api.Info{}
 		err := json.Unmarshal(info4JSON, &info4)
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			fail(4, http.StatusInternalServerError, err)
 			return
 		}
 
-		initiator := info4.Initiator
+		initiator = info4.Initiator
+		tracing.SpanFromContext(r.Context()).SetAttribute("initiator", initiator)
+		a.publishStep(r.Context(), acceptorRole, initiator, 3, stepReceived, "", false)
+
+		// Initiators that predate suite negotiation do not confirm the key.
+		legacy := len(info4.Suites) == 0
+		if legacy {
+			if err := a.acceptLegacy(r.Context(), acceptorRole, initiator, 3); err != nil {
+				fail(4, http.StatusForbidden, err)
+				return
+			}
+		}
+		cipherSuite, err := suite.Choose(info4, a.suites)
+		if !a.checkStep(r.Context(), acceptorRole, initiator, 3, "cipher suite in common with "+initiator, err == nil) {
+			fail(4, http.StatusForbidden, err)
+			return
+		}
 
-		ciphertext4 := crypto.EncryptRSA(info4.InitiatorNonce, a.keys.trentKey)
+		// The request is accepted before Trent is asked for anything on
+		// the initiator's behalf, so that a rejected request leaves no
+		// session key issued and audited.
+		consented, err := a.askConsent(r.Context(), initiator)
+		if !a.checkStep(r.Context(), acceptorRole, initiator, 4, a.cfg.ID+" accepted the session request", err == nil) {
+			fail(4, consentStatus(err), err)
+			return
+		}
+
+		ciphertext4 := a.encryptRSA(r.Context(), info4.InitiatorNonce, a.keys.trentKey)
+		if err := a.sendStep(r.Context(), acceptorRole, initiator, 4); err != nil {
+			fail(4, http.StatusServiceUnavailable, err)
+			return
+		}
 		req4 := api.Request{
 			Initiator:  initiator,
 			Acceptor:   a.cfg.ID,
 			Ciphertext: ciphertext4,
+			Suite:      cipherSuite,
+		}
+		if err := a.signRequest(r.Context(), &req4, api.Step5Endpoint); err != nil {
+			fail(4, http.StatusInternalServerError, err)
+			return
 		}
 		var resp5 api.Response
 		rawResp5, err := a.client.R().
+			SetContext(r.Context()).
 			SetHeader("Content-Type", "application/json").
 			SetBody(req4).
 			SetResult(&resp5).
 			Post(httpPrefix + a.cfg.TrentAddr + api.Step5Endpoint)
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			fail(5, http.StatusInternalServerError, err)
 			return
 		}
 		if rawResp5.StatusCode() != http.StatusOK {
-			http.Error(w, fmt.Sprintf("step 5 status code is %d", rawResp5.StatusCode()), http.StatusInternalServerError)
+			// Trent's refusals are passed on, so that the initiator
+			// learns why the session was not established.
+			status := http.StatusInternalServerError
+			switch rawResp5.StatusCode() {
+			case http.StatusForbidden, http.StatusNotFound, http.StatusTooManyRequests, http.StatusServiceUnavailable:
+				status = rawResp5.StatusCode()
+				if retryAfter := rawResp5.Header().Get("Retry-After"); retryAfter != "" {
+					w.Header().Set("Retry-After", retryAfter)
+				}
+			}
+			fail(5, status, fmt.Errorf("step 5 status code is %d: %s", rawResp5.StatusCode(), strings.TrimSpace(rawResp5.String())))
 			return
 		}
+		a.publishStep(r.Context(), acceptorRole, initiator, 5, stepReceived, "", false)
 
 		info5JSON, err := json.Marshal(resp5.Certificate.Information)
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			fail(5, http.StatusInternalServerError, err)
 			return
 		}
-		ok := crypto.VerifyRSA(info5JSON, resp5.Certificate.Signature, a.keys.trentKey)
+		ok := a.checkStep(r.Context(), acceptorRole, initiator, 5, "Trent's signature on "+initiator+"'s public key",
+			a.verifyRSA(r.Context(), info5JSON, resp5.Certificate.Signature))
 		if !ok {
-			http.Error(w, "signature verification failed", http.StatusInternalServerError)
+			fail(5, http.StatusInternalServerError, errors.New("signature verification failed"))
 			return
 		}
 
-		a.keys.agentKey = resp5.Certificate.Information.InitiatorKey
+		initiatorKey := resp5.Certificate.Information.InitiatorKey
+		fingerprint, err := pem.Fingerprint(initiatorKey)
+		if err != nil {
+			fail(5, http.StatusInternalServerError, err)
+			return
+		}
+		ok = a.checkStep(r.Context(), acceptorRole, initiator, 5, initiator+"'s key is the one the request was accepted for",
+			consented == "" || consented == fingerprint)
+		if !ok {
+			fail(5, http.StatusForbidden, errKeyChanged)
+			return
+		}
+		a.consents.vouch(initiator, fingerprint)
 
-		cert5JSON := crypto.DecryptRSA(resp5.Ciphertext, a.keys.privateKey)
+		var cert5JSON []byte
+		if suite.PostQuantum(cipherSuite) {
+			cert5JSON, err = a.decryptHybrid(r.Context(), resp5.Ciphertext)
+			if err != nil {
+				fail(5, http.StatusInternalServerError, err)
+				return
+			}
+		} else {
+			cert5JSON = a.decryptRSA(r.Context(), resp5.Ciphertext)
+		}
 		var cert5 api.Cert
 		if err = json.Unmarshal(cert5JSON, &cert5); err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			fail(5, http.StatusInternalServerError, err)
 			return
 		}
 
 		certInfo5JSON, err := json.Marshal(cert5.Information)
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			fail(5, http.StatusInternalServerError, err)
 			return
 		}
-		ok = crypto.VerifyRSA(certInfo5JSON, cert5.Signature, a.keys.trentKey)
+		ok = a.checkStep(r.Context(), acceptorRole, initiator, 5, "Trent's signature on the session certificate",
+			a.verifyRSA(r.Context(), certInfo5JSON, cert5.Signature))
 		if !ok {
-			http.Error(w, "signature verification failed", http.StatusInternalServerError)
+			fail(5, http.StatusInternalServerError, errors.New("signature verification failed"))
+			return
+		}
+		ok = a.checkStep(r.Context(), acceptorRole, initiator, 5, "cipher suite in the session certificate",
+			suite.Name(cert5.Information.Suite) == cipherSuite)
+		if !ok {
+			fail(5, http.StatusInternalServerError, errSuiteMismatch)
 			return
 		}
-
-		a.keys.sessionKey = cert5.Information.SessionKey
 
 		// Step 6
 		acceptorNonce, err := a.rng.GenerateNonce()
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			fail(6, http.StatusInternalServerError, err)
 			return
 		}
-		a.keys.nonce = acceptorNonce
 
 		resp6 := api.Response{
 			Certificate:   cert5,
 			AcceptorNonce: acceptorNonce,
 		}
+		sessionKey, err := suite.Accept(cipherSuite, info4, &resp6, cert5.Information.SessionKey, cert5.Information.SessionID, a.rng)
+		if err != nil {
+			fail(6, http.StatusBadRequest, err)
+			return
+		}
 		resp6JSON, err := json.Marshal(resp6)
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			fail(6, http.StatusInternalServerError, err)
+			return
+		}
+		ciphertext6 := a.encryptRSA(r.Context(), resp6JSON, initiatorKey)
+		if err := a.sendStep(r.Context(), acceptorRole, initiator, 6); err != nil {
+			fail(6, http.StatusServiceUnavailable, err)
 			return
 		}
-		ciphertext6 := crypto.EncryptRSA(resp6JSON, a.keys.agentKey)
+
+		var transcript *crypto.Transcript
+		if !legacy {
+			transcript = crypto.NewTranscript()
+			transcript.Add([]byte(initiator), []byte(a.cfg.ID), info4JSON, resp6JSON)
+		}
+		keys, err := sessionKeys(sessionKey, cert5.Information.SessionID, initiator, a.cfg.ID, transcript != nil)
+		if err != nil {
+			fail(6, http.StatusInternalServerError, err)
+			return
+		}
+		a.sessions.startHandshake(initiator, &handshake{
+			sessionID:     cert5.Information.SessionID,
+			keys:          keys,
+			acceptorNonce: acceptorNonce,
+			suite:         cipherSuite,
+			transcript:    transcript,
+		})
 
 		resp7 := api.Response{
 			Ciphertext: ciphertext6,
@@ -109,7 +226,7 @@ func step4Handler(a *Agent) http.HandlerFunc {
 		w.Header().Set("Content-Type", "application/json")
 		w.WriteHeader(http.StatusOK)
 		if err := json.NewEncoder(w).Encode(resp7); err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			fail(6, http.StatusInternalServerError, err)
 			return
 		}
 	}
@@ -118,23 +235,85 @@ func step4Handler(a *Agent) http.HandlerFunc {
 // Step 7
 func step7Handler(a *Agent) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
+		waitForUser(w)
+
+		fail := func(peer string, status int, err error) {
+			a.handshakeFailed(r.Context(), acceptorRole, peer, 7, err)
+			http.Error(w, err.Error(), status)
+		}
+
 		var msg api.Message
 		if err := json.NewDecoder(r.Body).Decode(&msg); err != nil {
-			http.Error(w, err.Error(), http.StatusBadRequest)
+			fail("", http.StatusBadRequest, err)
 			return
 		}
 
-		acceptorNonce := crypto.DecryptAES(msg.Ciphertext, a.keys.sessionKey, msg.IV)
+		h, ok := a.sessions.handshake(msg.Sender)
+		if !ok {
+			fail(msg.Sender, http.StatusBadRequest, errNoHandshake)
+			return
+		}
 
-		if !bytes.Equal(acceptorNonce, a.keys.nonce) {
-			http.Error(w, "nonce verification failed", http.StatusBadRequest)
+		a.publishStep(r.Context(), acceptorRole, msg.Sender, 7, stepReceived, "", false)
+		acceptorNonce := a.decryptAES(r.Context(), msg.Ciphertext, h.keys.Confirmation, msg.IV)
+
+		if !a.checkStep(r.Context(), acceptorRole, msg.Sender, 7, "N_B decrypted with the session key",
+			bytes.Equal(acceptorNonce, h.acceptorNonce)) {
+			fail(msg.Sender, http.StatusBadRequest, errors.New("nonce verification failed"))
 			return
 		}
 
-		a.tui.session = a.cfg.AgentID
-		a.tui.active[writeMessageItem] = struct{}{}
+		if h.transcript == nil {
+			if !a.sessions.finishHandshake(msg.Sender, h) {
+				fail(msg.Sender, http.StatusBadRequest, errNoHandshake)
+				return
+			}
+			a.establish(msg.Sender, acceptorRole, h.sessionID, h.keys, h.suite)
+			a.publishStep(r.Context(), acceptorRole, msg.Sender, 7, stepEstablished, "", false)
 
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+
+		transcript, err := h.transcript.Clone()
+		if err != nil {
+			fail(msg.Sender, http.StatusInternalServerError, err)
+			return
+		}
+		transcript.Add(msg.IV, msg.Ciphertext)
+		ok = a.checkStep(r.Context(), acceptorRole, msg.Sender, 7, msg.Sender+"'s confirmation of the session key and transcript",
+			crypto.VerifyConfirmation(h.keys.Confirmation, crypto.InitiatorFinished, transcript.Sum(), msg.Confirmation))
+		if !ok {
+			fail(msg.Sender, http.StatusBadRequest, errNotConfirmed)
+			return
+		}
+		if !a.sessions.finishHandshake(msg.Sender, h) {
+			fail(msg.Sender, http.StatusBadRequest, errNoHandshake)
+			return
+		}
+
+		// Step 8
+		transcript.Add(msg.Confirmation)
+		confirmation, err := crypto.Confirmation(h.keys.Confirmation, crypto.AcceptorFinished, transcript.Sum())
+		if err != nil {
+			a.handshakeFailed(r.Context(), acceptorRole, msg.Sender, 8, err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if err := a.sendStep(r.Context(), acceptorRole, msg.Sender, 8); err != nil {
+			a.handshakeFailed(r.Context(), acceptorRole, msg.Sender, 8, err)
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+
+		a.establish(msg.Sender, acceptorRole, h.sessionID, h.keys, h.suite)
+		a.publishStep(r.Context(), acceptorRole, msg.Sender, 8, stepEstablished, "", false)
+
+		w.Header().Set("Content-Type", "application/json")
 		w.WriteHeader(http.StatusOK)
+		if err := json.NewEncoder(w).Encode(api.Message{Sender: a.cfg.ID, Confirmation: confirmation}); err != nil {
+			a.logger.Error("Failed to send key confirmation", zap.String("peer", msg.Sender), zap.Error(err))
+		}
 	}
 }
 
@@ -146,10 +325,25 @@ func messageHandler(a *Agent) http.HandlerFunc {
 			return
 		}
 
-		message := crypto.DecryptAES(msg.Ciphertext, a.keys.sessionKey, msg.IV)
-		a.tui.messages = append(a.tui.messages, string(message))
-		a.tui.unread = true
+		s, ok := a.sessions.get(msg.Sender)
+		if !ok {
+			http.Error(w, errNoSession.Error(), http.StatusBadRequest)
+			return
+		}
+
+		message := a.decryptAES(r.Context(), msg.Ciphertext, s.receiveKey(), msg.IV)
+		if msg.ID == 0 || a.firstStreamDelivery(s, msg.ID) {
+			a.receive(msg.Sender, s.id, string(message))
+		}
 
 		w.WriteHeader(http.StatusOK)
 	}
 }
+
+// waitForUser lifts the write timeout of a handshake request, which may wait
+// for the user to consent or, in step mode, to advance each step. The request
+// is still bounded by the initiator, which gives up on it when its context
+// ends.
+func waitForUser(w http.ResponseWriter) {
+	http.NewResponseController(w).SetWriteDeadline(time.Time{})
+}
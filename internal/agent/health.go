@@ -0,0 +1,61 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/sudeeya/key-exchange/internal/pkg/api"
+	"github.com/sudeeya/key-exchange/internal/pkg/health"
+	"github.com/sudeeya/key-exchange/internal/pkg/pem"
+)
+
+const readinessTimeout = 2 * time.Second
+
+func (a *Agent) readinessChecks() []health.Check {
+	return []health.Check{
+		{Name: "keys", Run: a.checkKeys},
+		{Name: "rng", Run: a.checkRNG},
+		{Name: "trent", Run: a.checkTrent},
+		{Name: "shutdown", Run: a.checkDraining},
+	}
+}
+
+func (a *Agent) checkKeys(_ context.Context) error {
+	if err := a.keys.rsaKey.Validate(); err != nil {
+		return fmt.Errorf("private key: %w", err)
+	}
+	if _, err := pem.ParseRSAPublicKey(a.keys.trentKey); err != nil {
+		return fmt.Errorf("trent public key: %w", err)
+	}
+
+	return nil
+}
+
+func (a *Agent) checkRNG(_ context.Context) error {
+	return a.rng.Err()
+}
+
+func (a *Agent) checkTrent(ctx context.Context) error {
+	resp, err := a.client.R().
+		SetContext(ctx).
+		Get(httpPrefix + a.cfg.TrentAddr + api.HealthEndpoint)
+	if err != nil {
+		return fmt.Errorf("unreachable: %w", err)
+	}
+	if resp.StatusCode() != http.StatusOK {
+		return fmt.Errorf("health status code is %d", resp.StatusCode())
+	}
+
+	return nil
+}
+
+func (a *Agent) checkDraining(_ context.Context) error {
+	if a.draining.Load() {
+		return errors.New("draining connections")
+	}
+
+	return nil
+}
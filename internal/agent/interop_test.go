@@ -0,0 +1,360 @@
+package agent
+
+import (
+	"bytes"
+	"context"
+	"crypto/mlkem"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/sudeeya/key-exchange/internal/pkg/api"
+	"github.com/sudeeya/key-exchange/internal/pkg/crypto"
+	"github.com/sudeeya/key-exchange/internal/pkg/pem"
+	"github.com/sudeeya/key-exchange/internal/pkg/rng"
+	"github.com/sudeeya/key-exchange/internal/pkg/suite"
+	"github.com/sudeeya/key-exchange/internal/trent"
+)
+
+// interopConfig is how an agent is set up for cipher suites.
+type interopConfig struct {
+	id     string
+	suites []string
+	// unregistered agents have an ML-KEM key that Trent does not know.
+	unregistered bool
+}
+
+var interopConfigs = []interopConfig{
+	{id: "rsa", suites: []string{suite.RSA}},
+	{id: "x25519-preferred", suites: []string{suite.X25519, suite.RSA}},
+	{id: "x25519-required", suites: []string{suite.X25519}},
+	{id: "hybrid-preferred", suites: []string{suite.Hybrid, suite.X25519, suite.RSA}},
+	{id: "hybrid-required", suites: []string{suite.Hybrid}},
+	{id: "hybrid-unregistered", suites: []string{suite.Hybrid}, unregistered: true},
+}
+
+// expectedSuite returns the suite a handshake between initiator and acceptor
+// should settle on, or "" if it should fail.
+func expectedSuite(initiator, acceptor interopConfig) string {
+	for _, s := range initiator.suites {
+		if !slices.Contains(acceptor.suites, s) {
+			continue
+		}
+		if suite.PostQuantum(s) && acceptor.unregistered {
+			return ""
+		}
+		return s
+	}
+
+	return ""
+}
+
+// interopNetwork is a real Trent and real agents, each on its own test
+// server. Every configuration is run by an initiator, with the suffix "-a",
+// and an acceptor, with the suffix "-b".
+type interopNetwork struct {
+	agents    map[string]*Agent
+	trentAddr string
+}
+
+func newInteropNetwork(t testing.TB, configs []interopConfig, adjust func(*config)) *interopNetwork {
+	t.Helper()
+
+	return newSeededInteropNetwork(t, configs, adjust, func(string) rng.RNG { return newTestRNG(t) })
+}
+
+// newSeededInteropNetwork is newInteropNetwork with Trent and each agent
+// taking their RNG from newRNG, which is given "trent" or the agent's ID.
+func newSeededInteropNetwork(t testing.TB, configs []interopConfig, adjust func(*config), newRNG func(id string) rng.RNG) *interopNetwork {
+	t.Helper()
+
+	dir := t.TempDir()
+	savePath := func(name string) string { return filepath.Join(dir, name) }
+
+	type member struct {
+		cfg    interopConfig
+		id     string
+		server *httptest.Server
+		rsaKey string
+		kemKey string
+	}
+	var members []*member
+	for _, cfg := range configs {
+		for _, suffix := range []string{"-a", "-b"} {
+			members = append(members, &member{
+				cfg:    cfg,
+				id:     cfg.id + suffix,
+				server: httptest.NewUnstartedServer(nil),
+			})
+		}
+	}
+
+	trentPublic := saveTestRSAKey(t, savePath("trent"))
+	var ids, addrs, publicKeys, kemKeys []string
+	for _, m := range members {
+		m.rsaKey = savePath(m.id)
+		publicKeys = append(publicKeys, saveTestRSAKey(t, m.rsaKey))
+
+		registered := ""
+		if slices.ContainsFunc(m.cfg.suites, suite.PostQuantum) {
+			m.kemKey = savePath(m.id + ".mlkem")
+			registered = saveTestMLKEMKey(t, m.kemKey)
+		}
+		if m.cfg.unregistered {
+			registered = ""
+		}
+
+		ids = append(ids, m.id)
+		addrs = append(addrs, m.server.Listener.Addr().String())
+		kemKeys = append(kemKeys, registered)
+	}
+
+	for name, value := range map[string]string{
+		"ADDR":              "localhost:0",
+		"PUBLIC_KEY":        trentPublic,
+		"PRIVATE_KEY":       savePath("trent"),
+		"AGENT_IDS":         strings.Join(ids, ","),
+		"AGENT_PUBLIC_KEYS": strings.Join(publicKeys, ","),
+		"AGENT_MLKEM_KEYS":  strings.Join(kemKeys, ","),
+		"LOG_FILE":          savePath("trent.log"),
+		"IP_RATE_LIMIT":     "1000000",
+		"IP_RATE_BURST":     "1000000",
+		"AGENT_RATE_LIMIT":  "1000000",
+		"AGENT_RATE_BURST":  "1000000",
+	} {
+		t.Setenv(name, value)
+	}
+	tr := trent.NewTrent(newRNG("trent"))
+	trentServer := httptest.NewServer(tr.Handler())
+	t.Cleanup(func() {
+		trentServer.Close()
+		tr.Shutdown()
+	})
+
+	// The variables the agents require are set so that defaults are
+	// filled in, and then replaced for each agent.
+	for name, value := range map[string]string{
+		"ID":               "placeholder",
+		"TRENT_ADDR":       strings.TrimPrefix(trentServer.URL, httpPrefix),
+		"TRENT_PUBLIC_KEY": trentPublic,
+		"AGENT_IDS":        strings.Join(ids, ","),
+		"AGENT_ADDRS":      strings.Join(addrs, ","),
+		"LOG_FILE":         savePath("placeholder.log"),
+	} {
+		t.Setenv(name, value)
+	}
+	base, err := newConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	n := &interopNetwork{
+		agents:    make(map[string]*Agent),
+		trentAddr: strings.TrimPrefix(trentServer.URL, httpPrefix),
+	}
+	for _, m := range members {
+		cfg := *base
+		cfg.ID = m.id
+		cfg.Addr = m.server.Listener.Addr().String()
+		cfg.PrivateKey = m.rsaKey
+		cfg.PublicKey = m.rsaKey + ".pub"
+		cfg.MLKEMPrivateKey = m.kemKey
+		cfg.CipherSuites = m.cfg.suites
+		cfg.ControlSocket = savePath(m.id + ".sock")
+		cfg.DownloadDir = savePath(m.id + ".downloads")
+		cfg.LogFile = savePath(m.id + ".log")
+		if adjust != nil {
+			adjust(&cfg)
+		}
+
+		a := newAgent(&cfg, newRNG(m.id))
+		a.addRoutes()
+		m.server.Config.Handler = a.mux
+		m.server.Start()
+		t.Cleanup(func() {
+			m.server.Close()
+			a.Shutdown()
+		})
+		n.agents[m.id] = a
+	}
+
+	return n
+}
+
+// TestCipherSuiteInterop runs a handshake between every pair of initiator and
+// acceptor configurations and checks that both agents settle on the suite the
+// negotiation should give, or that the handshake fails where and how it
+// should.
+func TestCipherSuiteInterop(t *testing.T) {
+	n := newInteropNetwork(t, interopConfigs, nil)
+
+	for _, initiatorCfg := range interopConfigs {
+		for _, acceptorCfg := range interopConfigs {
+			t.Run(initiatorCfg.id+" to "+acceptorCfg.id, func(t *testing.T) {
+				initiatorID, acceptorID := initiatorCfg.id+"-a", acceptorCfg.id+"-b"
+				initiator, acceptor := n.agents[initiatorID], n.agents[acceptorID]
+				want := expectedSuite(initiatorCfg, acceptorCfg)
+
+				info, err := initiator.OpenSession(context.Background(), acceptorID)
+				if want == "" {
+					checkHandshakeFailure(t, err, initiatorCfg, acceptorCfg)
+					if _, ok := acceptor.sessions.get(initiatorID); ok {
+						t.Fatal("acceptor established a session after a failed handshake")
+					}
+					return
+				}
+				if err != nil {
+					t.Fatalf("handshake failed: %v", err)
+				}
+
+				if info.Suite != want {
+					t.Fatalf("initiator settled on %s, want %s", info.Suite, want)
+				}
+				accepted, ok := acceptor.sessions.get(initiatorID)
+				if !ok {
+					t.Fatal("acceptor has no session")
+				}
+				if accepted.suite != want || accepted.id != info.ID {
+					t.Fatalf("acceptor has session %s with %s, initiator %s with %s", accepted.id, accepted.suite, info.ID, want)
+				}
+
+				// Both agents derived the same keys.
+				initiated, _ := initiator.sessions.get(acceptorID)
+				if string(initiated.sendKey()) != string(accepted.receiveKey()) {
+					t.Fatal("agents derived different keys")
+				}
+			})
+		}
+	}
+}
+
+// checkHandshakeFailure checks that a handshake without a usable suite in
+// common fails at step 4 with the status the acceptor should answer with.
+func checkHandshakeFailure(t *testing.T, err error, initiator, acceptor interopConfig) {
+	t.Helper()
+
+	var handshakeErr *HandshakeError
+	if !errors.As(err, &handshakeErr) {
+		t.Fatalf("handshake returned %v, want a handshake error", err)
+	}
+	if handshakeErr.Step != 4 {
+		t.Fatalf("handshake failed at step %d, want 4: %v", handshakeErr.Step, err)
+	}
+
+	// Without a suite in common the acceptor refuses the offer itself.
+	// Otherwise it chose a post-quantum suite, and Trent refused to issue a
+	// key for it without the acceptor's ML-KEM key.
+	want := "status code is 403"
+	if acceptor.unregistered && slices.ContainsFunc(initiator.suites, suite.PostQuantum) {
+		want = "no ML-KEM key is registered for " + acceptor.id + "-b"
+	}
+	if !strings.Contains(err.Error(), want) {
+		t.Fatalf("handshake failed with %q, want it to mention %q", err, want)
+	}
+}
+
+// TestLegacyInitiatorRefused sends step 3 without a cipher suite offer, as
+// agents that predate key confirmation do, and as an attacker stripping the
+// offer would, and checks that it is only accepted when legacy peers are
+// allowed.
+func TestLegacyInitiatorRefused(t *testing.T) {
+	for _, allow := range []bool{false, true} {
+		n := newInteropNetwork(t, interopConfigs[:1], func(cfg *config) {
+			cfg.AllowLegacyPeers = allow
+		})
+		acceptor := n.agents["rsa-b"]
+
+		nonce, err := acceptor.rng.GenerateNonce()
+		if err != nil {
+			t.Fatal(err)
+		}
+		info3, err := json.Marshal(api.Info{Initiator: "rsa-a", InitiatorNonce: nonce})
+		if err != nil {
+			t.Fatal(err)
+		}
+		req := api.Request{
+			Ciphertext: crypto.EncryptRSAKey(info3, &acceptor.keys.rsaKey.PublicKey, acceptor.rng),
+		}
+
+		status := postJSON(t, acceptor.peers["rsa-b"]+api.Step4Endpoint, req)
+		want := http.StatusForbidden
+		if allow {
+			want = http.StatusOK
+		}
+		if status != want {
+			t.Fatalf("with legacy peers allowed %t, step 4 status code is %d, want %d", allow, status, want)
+		}
+	}
+}
+
+func postJSON(t *testing.T, addr string, body any) int {
+	t.Helper()
+
+	data, err := json.Marshal(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.Post(httpPrefix+addr, "application/json", bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	return resp.StatusCode
+}
+
+// saveTestRSAKey writes a new key pair to path and path+".pub", returning
+// the latter.
+func saveTestRSAKey(t testing.TB, path string) string {
+	t.Helper()
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := pem.SaveRSAPrivateKey(key, path); err != nil {
+		t.Fatal(err)
+	}
+	if err := pem.SaveRSAPublicKey(&key.PublicKey, path+".pub"); err != nil {
+		t.Fatal(err)
+	}
+
+	return path + ".pub"
+}
+
+// saveTestMLKEMKey writes a new ML-KEM key pair to path and path+".pub",
+// returning the latter.
+func saveTestMLKEMKey(t testing.TB, path string) string {
+	t.Helper()
+
+	key, err := mlkem.GenerateKey768()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := pem.SaveMLKEMPrivateKey(key, path); err != nil {
+		t.Fatal(err)
+	}
+	if err := pem.SaveMLKEMPublicKey(key.EncapsulationKey(), path+".pub"); err != nil {
+		t.Fatal(err)
+	}
+
+	return path + ".pub"
+}
+
+func newTestRNG(t testing.TB) rng.RNG {
+	t.Helper()
+
+	random, err := rng.NewRNG()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return random
+}
@@ -0,0 +1,464 @@
+package agent
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sudeeya/key-exchange/internal/pkg/api"
+	"github.com/sudeeya/key-exchange/internal/pkg/crypto"
+	"github.com/sudeeya/key-exchange/internal/pkg/rng"
+)
+
+const (
+	incomingMessage = "incoming"
+	outgoingMessage = "outgoing"
+
+	messagePending   = "pending"
+	messageDelivered = "delivered"
+	messageFailed    = "failed"
+	messageReceived  = "received"
+)
+
+const (
+	// Records of version 1 histories are all sealed with the same
+	// additional data. They are rewritten as version 2 on load.
+	historyVersion1 = 1
+	historyVersion  = 2
+	historyLabel    = internalLabelPrefix + "history"
+	historySaltSize = 16
+	historyAAD      = "history"
+	privateKeyKDF   = "private-key"
+	passphraseKDF   = "scrypt"
+
+	// The history file is rewritten once it holds this many more records
+	// than there are messages, so status updates and expired messages do
+	// not pile up on disk.
+	compactSlack = 64
+)
+
+var errHistoryKey = errors.New("history cannot be decrypted with this key")
+
+// historyHeader is the first, unencrypted line of the history file. Check is
+// an empty record sealed under the history key, so that a wrong key is
+// detected before anything is appended with it.
+//
+// Every record is sealed with its sequence number in the file and the salt
+// as additional data, with 0 for Check, so that records cannot be reordered
+// or moved from one history file to another.
+type historyHeader struct {
+	Version int    `json:"version"`
+	KDF     string `json:"kdf"`
+	Salt    []byte `json:"salt"`
+	Check   []byte `json:"check"`
+}
+
+// historyQuery selects messages from the mailbox. Zero fields match every
+// message; Limit keeps the most recent matches.
+type historyQuery struct {
+	Peer      string
+	Direction string
+	Text      string
+	Since     int
+	From      time.Time
+	To        time.Time
+	Limit     int
+}
+
+func (q *historyQuery) matches(message *api.MailboxMessage) bool {
+	switch {
+	case message.ID <= q.Since:
+		return false
+	case q.Peer != "" && message.Peer != q.Peer:
+		return false
+	case q.Direction != "" && message.Direction != q.Direction:
+		return false
+	case !q.From.IsZero() && message.Time.Before(q.From):
+		return false
+	case !q.To.IsZero() && message.Time.After(q.To):
+		return false
+	case q.Text != "" && !strings.Contains(strings.ToLower(message.Text), strings.ToLower(q.Text)):
+		return false
+	}
+
+	return true
+}
+
+// mailbox holds the messages sent to and received from peers. If a history
+// file is configured, every change is appended to it as an encrypted record
+// and the messages are loaded from it on startup.
+type mailbox struct {
+	path        string
+	maxMessages int
+	maxAge      time.Duration
+	rng         rng.RNG
+
+	mu       sync.RWMutex
+	header   historyHeader
+	key      []byte
+	file     *os.File
+	records  int
+	nextID   int
+	messages []api.MailboxMessage
+	// skipped is the number of damaged records passed over on load.
+	skipped int
+}
+
+func newMailbox(cfg *config, privateKey []byte, rng rng.RNG) (*mailbox, error) {
+	m := &mailbox{
+		path:        cfg.HistoryFile,
+		maxMessages: cfg.HistoryMaxMessages,
+		maxAge:      cfg.HistoryMaxAge,
+		rng:         rng,
+		nextID:      1,
+		messages:    make([]api.MailboxMessage, 0),
+	}
+	if m.path == "" {
+		return m, nil
+	}
+
+	if cfg.HistoryPassphraseFile == "" {
+		return m, m.load(privateKeyKDF, func(salt []byte) ([]byte, error) {
+			return crypto.ExportKey(privateKey, historyLabel, salt, crypto.AEADKeySize)
+		})
+	}
+
+	passphrase, err := readPassphrase(cfg.HistoryPassphraseFile)
+	if err != nil {
+		return nil, err
+	}
+
+	return m, m.load(passphraseKDF, func(salt []byte) ([]byte, error) {
+		return crypto.PassphraseKey(passphrase, salt)
+	})
+}
+
+func readPassphrase(file string) ([]byte, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	passphrase := bytes.TrimRight(data, "\r\n")
+	if len(passphrase) == 0 {
+		return nil, fmt.Errorf("history passphrase file %s is empty", file)
+	}
+
+	return passphrase, nil
+}
+
+// load reads the history file, creating it if it does not exist yet, and
+// rewrites it without stale records.
+func (m *mailbox) load(kdf string, deriveKey func(salt []byte) ([]byte, error)) error {
+	data, err := os.ReadFile(m.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return m.create(kdf, deriveKey)
+	}
+	if err != nil {
+		return err
+	}
+
+	lines := bytes.Split(data, []byte("\n"))
+	if err := json.Unmarshal(lines[0], &m.header); err != nil {
+		return fmt.Errorf("invalid history header: %w", err)
+	}
+	if m.header.Version != historyVersion && m.header.Version != historyVersion1 {
+		return fmt.Errorf("unsupported history version %d", m.header.Version)
+	}
+	if m.header.KDF != kdf {
+		return fmt.Errorf("history %s is encrypted with a %s key, not a %s key", m.path, m.header.KDF, kdf)
+	}
+
+	m.key, err = deriveKey(m.header.Salt)
+	if err != nil {
+		return err
+	}
+	if _, err := m.open(m.header.Check, 0); err != nil {
+		return errHistoryKey
+	}
+
+	index := make(map[int]int)
+	for i, line := range lines[1:] {
+		if len(line) == 0 {
+			continue
+		}
+
+		// A torn record is left by a crash or a failed write in the
+		// middle of appending it, and only that record is lost. A write
+		// that failed without incrementing the record count is
+		// followed on the same line by the next record, which takes its
+		// sequence number.
+		message, err := m.decode(line, i+1)
+		if err != nil {
+			m.skipped++
+			continue
+		}
+
+		if j, ok := index[message.ID]; ok {
+			m.messages[j] = message
+		} else {
+			index[message.ID] = len(m.messages)
+			m.messages = append(m.messages, message)
+		}
+		m.nextID = max(m.nextID, message.ID+1)
+	}
+
+	m.prune(time.Now())
+
+	if m.header.Version == historyVersion1 {
+		m.header.Version = historyVersion
+		m.header.Check, err = m.seal(nil, 0)
+		if err != nil {
+			return err
+		}
+	}
+
+	return m.compact()
+}
+
+func (m *mailbox) create(kdf string, deriveKey func(salt []byte) ([]byte, error)) error {
+	if err := os.MkdirAll(filepath.Dir(m.path), 0700); err != nil {
+		return err
+	}
+
+	salt, err := m.rng.GenerateKey(historySaltSize)
+	if err != nil {
+		return err
+	}
+	m.key, err = deriveKey(salt)
+	if err != nil {
+		return err
+	}
+
+	m.header = historyHeader{
+		Version: historyVersion,
+		KDF:     kdf,
+		Salt:    salt,
+	}
+	m.header.Check, err = m.seal(nil, 0)
+	if err != nil {
+		return err
+	}
+
+	return m.compact()
+}
+
+// additionalData is what the record with sequence number seq is bound to.
+func (m *mailbox) additionalData(seq int) []byte {
+	ad := []byte(historyAAD)
+	if m.header.Version == historyVersion1 {
+		return ad
+	}
+
+	ad = append(ad, m.header.Salt...)
+	return binary.BigEndian.AppendUint64(ad, uint64(seq))
+}
+
+func (m *mailbox) seal(plaintext []byte, seq int) ([]byte, error) {
+	nonce, err := m.rng.GenerateKey(crypto.AEADNonceSize)
+	if err != nil {
+		return nil, err
+	}
+	ciphertext, err := crypto.EncryptAEAD(plaintext, m.key, nonce, m.additionalData(seq))
+	if err != nil {
+		return nil, err
+	}
+
+	return append(nonce, ciphertext...), nil
+}
+
+func (m *mailbox) open(sealed []byte, seq int) ([]byte, error) {
+	if len(sealed) < crypto.AEADNonceSize {
+		return nil, errHistoryKey
+	}
+
+	return crypto.DecryptAEAD(sealed[crypto.AEADNonceSize:], m.key, sealed[:crypto.AEADNonceSize], m.additionalData(seq))
+}
+
+func (m *mailbox) encode(message api.MailboxMessage, seq int) ([]byte, error) {
+	plaintext, err := json.Marshal(message)
+	if err != nil {
+		return nil, err
+	}
+	sealed, err := m.seal(plaintext, seq)
+	if err != nil {
+		return nil, err
+	}
+
+	return base64.StdEncoding.AppendEncode(nil, sealed), nil
+}
+
+func (m *mailbox) decode(line []byte, seq int) (api.MailboxMessage, error) {
+	var message api.MailboxMessage
+
+	sealed, err := base64.StdEncoding.AppendDecode(nil, line)
+	if err != nil {
+		return message, err
+	}
+	plaintext, err := m.open(sealed, seq)
+	if err != nil {
+		return message, err
+	}
+
+	return message, json.Unmarshal(plaintext, &message)
+}
+
+// compact replaces the history file with one that holds a single record per
+// message.
+func (m *mailbox) compact() error {
+	tmp := m.path + ".tmp"
+	file, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+
+	w := bufio.NewWriter(file)
+	enc := json.NewEncoder(w)
+	err = enc.Encode(m.header)
+	for i, message := range m.messages {
+		if err != nil {
+			break
+		}
+		var line []byte
+		line, err = m.encode(message, i+1)
+		if err == nil {
+			w.Write(line)
+			err = w.WriteByte('\n')
+		}
+	}
+	if err == nil {
+		err = w.Flush()
+	}
+	if err == nil {
+		err = file.Sync()
+	}
+	file.Close()
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	if err := os.Rename(tmp, m.path); err != nil {
+		return err
+	}
+
+	if m.file != nil {
+		m.file.Close()
+	}
+	m.file, err = os.OpenFile(m.path, os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	m.records = len(m.messages)
+
+	return nil
+}
+
+func (m *mailbox) write(message api.MailboxMessage) error {
+	if m.file == nil {
+		return nil
+	}
+
+	line, err := m.encode(message, m.records+1)
+	if err != nil {
+		return err
+	}
+	if _, err := m.file.Write(append(line, '\n')); err != nil {
+		return err
+	}
+	m.records++
+
+	if m.records > 2*len(m.messages)+compactSlack {
+		return m.compact()
+	}
+
+	return nil
+}
+
+// prune drops the messages that are past the retention limits.
+func (m *mailbox) prune(now time.Time) {
+	drop := 0
+	if m.maxAge > 0 {
+		for drop < len(m.messages) && now.Sub(m.messages[drop].Time) > m.maxAge {
+			drop++
+		}
+	}
+	if m.maxMessages > 0 {
+		drop = max(drop, len(m.messages)-m.maxMessages)
+	}
+
+	m.messages = append(m.messages[:0], m.messages[drop:]...)
+}
+
+// add stores a new message and returns it with its ID and time set. The
+// message is kept even if it could not be written to the history file.
+func (m *mailbox) add(message api.MailboxMessage) (api.MailboxMessage, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	message.ID = m.nextID
+	message.Time = time.Now()
+	m.nextID++
+	m.messages = append(m.messages, message)
+	m.prune(message.Time)
+
+	return message, m.write(message)
+}
+
+func (m *mailbox) setStatus(id int, status string) (api.MailboxMessage, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for i := len(m.messages) - 1; i >= 0; i-- {
+		if m.messages[i].ID == id {
+			m.messages[i].Status = status
+			return m.messages[i], m.write(m.messages[i])
+		}
+	}
+
+	return api.MailboxMessage{}, nil
+}
+
+func (m *mailbox) list() []api.MailboxMessage {
+	return m.search(historyQuery{})
+}
+
+func (m *mailbox) search(query historyQuery) []api.MailboxMessage {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	messages := make([]api.MailboxMessage, 0)
+	for _, message := range m.messages {
+		if query.matches(&message) {
+			messages = append(messages, message)
+		}
+	}
+	if query.Limit > 0 && len(messages) > query.Limit {
+		messages = messages[len(messages)-query.Limit:]
+	}
+
+	return messages
+}
+
+func (m *mailbox) close() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.file == nil {
+		return nil
+	}
+
+	err := m.file.Close()
+	m.file = nil
+
+	return err
+}
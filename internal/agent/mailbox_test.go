@@ -0,0 +1,170 @@
+package agent
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"github.com/sudeeya/key-exchange/internal/pkg/api"
+)
+
+var testHistoryKey = []byte("history test private key")
+
+func TestHistoryRecordsAreBoundToTheirPlace(t *testing.T) {
+	tests := []struct {
+		name string
+		// damage changes the records of a history with the messages
+		// one to four.
+		damage func(t *testing.T, records [][]byte) [][]byte
+		want   []string
+		// skipped is the number of records that must be passed over.
+		skipped int
+	}{
+		{
+			name:   "intact",
+			damage: func(_ *testing.T, records [][]byte) [][]byte { return records },
+			want:   []string{"one", "two", "three", "four"},
+		},
+		{
+			name: "reordered",
+			damage: func(_ *testing.T, records [][]byte) [][]byte {
+				records[1], records[2] = records[2], records[1]
+				return records
+			},
+			want:    []string{"one", "four"},
+			skipped: 2,
+		},
+		{
+			name: "from another history",
+			damage: func(t *testing.T, records [][]byte) [][]byte {
+				_, other := writeTestHistory(t, []string{"one", "other"})
+				records[1] = other[1]
+				return records
+			},
+			want:    []string{"one", "three", "four"},
+			skipped: 1,
+		},
+		{
+			name: "torn in the middle",
+			damage: func(_ *testing.T, records [][]byte) [][]byte {
+				records[1] = records[1][:len(records[1])/2]
+				return records
+			},
+			want:    []string{"one", "three", "four"},
+			skipped: 1,
+		},
+		{
+			name: "torn at the end",
+			damage: func(_ *testing.T, records [][]byte) [][]byte {
+				records[3] = records[3][:len(records[3])/2]
+				return records
+			},
+			want:    []string{"one", "two", "three"},
+			skipped: 1,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := &config{HistoryFile: filepath.Join(t.TempDir(), "history")}
+			texts := []string{"one", "two", "three", "four"}
+			header, records := writeTestHistory(t, texts)
+			saveTestHistory(t, cfg.HistoryFile, header, tt.damage(t, records))
+
+			m, err := newMailbox(cfg, testHistoryKey, newTestRNG(t))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer m.close()
+
+			if got := mailboxTexts(m); !slices.Equal(got, tt.want) {
+				t.Fatalf("history holds %q, want %q", got, tt.want)
+			}
+			if m.skipped != tt.skipped {
+				t.Fatalf("%d records were skipped, want %d", m.skipped, tt.skipped)
+			}
+		})
+	}
+}
+
+func TestVersion1HistoryIsRewritten(t *testing.T) {
+	cfg := &config{HistoryFile: filepath.Join(t.TempDir(), "history")}
+	m, err := newMailbox(cfg, testHistoryKey, newTestRNG(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Rewrite the new history as a version 1 one would have been written.
+	m.header.Version = historyVersion1
+	if m.header.Check, err = m.seal(nil, 0); err != nil {
+		t.Fatal(err)
+	}
+	for _, text := range []string{"one", "two"} {
+		if _, err := m.add(api.MailboxMessage{Text: text}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := m.compact(); err != nil {
+		t.Fatal(err)
+	}
+	m.close()
+
+	m, err = newMailbox(cfg, testHistoryKey, newTestRNG(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.close()
+
+	if got, want := mailboxTexts(m), []string{"one", "two"}; !slices.Equal(got, want) {
+		t.Fatalf("history holds %q, want %q", got, want)
+	}
+	if m.header.Version != historyVersion {
+		t.Fatalf("history was left at version %d", m.header.Version)
+	}
+}
+
+// writeTestHistory creates a history with a message for each of texts and
+// returns its header line and records.
+func writeTestHistory(t *testing.T, texts []string) ([]byte, [][]byte) {
+	t.Helper()
+
+	cfg := &config{HistoryFile: filepath.Join(t.TempDir(), "history")}
+	m, err := newMailbox(cfg, testHistoryKey, newTestRNG(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, text := range texts {
+		if _, err := m.add(api.MailboxMessage{Text: text}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	m.close()
+
+	data, err := os.ReadFile(cfg.HistoryFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := bytes.Split(bytes.TrimSuffix(data, []byte("\n")), []byte("\n"))
+
+	return lines[0], lines[1:]
+}
+
+func saveTestHistory(t *testing.T, path string, header []byte, records [][]byte) {
+	t.Helper()
+
+	lines := append([][]byte{header}, records...)
+	if err := os.WriteFile(path, bytes.Join(lines, []byte("\n")), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func mailboxTexts(m *mailbox) []string {
+	texts := make([]string, 0)
+	for _, message := range m.list() {
+		texts = append(texts, message.Text)
+	}
+
+	return texts
+}
@@ -0,0 +1,122 @@
+package agent
+
+import (
+	"strconv"
+
+	"github.com/sudeeya/key-exchange/internal/pkg/metrics"
+	"github.com/sudeeya/key-exchange/internal/pkg/middleware"
+)
+
+const metricsNamespace = "agent"
+
+const (
+	initiatorRole = "initiator"
+	acceptorRole  = "acceptor"
+)
+
+type agentMetrics struct {
+	registry           *metrics.Registry
+	http               *middleware.HTTPMetrics
+	handshakesStarted  *metrics.Counter
+	handshakesComplete *metrics.Counter
+	handshakesFailed   *metrics.Counter
+	messagesSent       *metrics.Counter
+	messagesReceived   *metrics.Counter
+	keysExported       *metrics.Counter
+	tunnelStreams      *metrics.Counter
+	tunnelBytes        *metrics.Counter
+	streamConnections  *metrics.Counter
+	messagesFallback   *metrics.Counter
+	legacyHandshakes   *metrics.Counter
+}
+
+func newAgentMetrics(sessions *sessionTable, tunnels *tunnels) *agentMetrics {
+	registry := metrics.NewRegistry()
+
+	m := &agentMetrics{
+		registry: registry,
+		http:     middleware.NewHTTPMetrics(registry, metricsNamespace),
+		handshakesStarted: registry.NewCounter(
+			"agent_handshakes_started_total",
+			"Total number of Wu-Lam handshakes started by role.",
+			"role",
+		),
+		handshakesComplete: registry.NewCounter(
+			"agent_handshakes_completed_total",
+			"Total number of Wu-Lam handshakes completed by role.",
+			"role",
+		),
+		handshakesFailed: registry.NewCounter(
+			"agent_handshakes_failed_total",
+			"Total number of failed Wu-Lam handshakes by role and failing step.",
+			"role", "step",
+		),
+		messagesSent: registry.NewCounter(
+			"agent_messages_sent_total",
+			"Total number of messages sent to peers.",
+			"peer",
+		),
+		messagesReceived: registry.NewCounter(
+			"agent_messages_received_total",
+			"Total number of messages received from peers.",
+			"peer",
+		),
+		keysExported: registry.NewCounter(
+			"agent_keys_exported_total",
+			"Total number of keys exported to local applications by peer.",
+			"peer",
+		),
+		tunnelStreams: registry.NewCounter(
+			"agent_tunnel_streams_total",
+			"Total number of forwarded connections by peer and role.",
+			"peer", "role",
+		),
+		tunnelBytes: registry.NewCounter(
+			"agent_tunnel_bytes_total",
+			"Total number of bytes relayed through tunnels by peer and direction.",
+			"peer", "direction",
+		),
+		streamConnections: registry.NewCounter(
+			"agent_stream_connections_total",
+			"Total number of message stream connections by peer and role.",
+			"peer", "role",
+		),
+		messagesFallback: registry.NewCounter(
+			"agent_messages_fallback_total",
+			"Total number of messages sent with a POST because no stream was connected.",
+			"peer",
+		),
+		legacyHandshakes: registry.NewCounter(
+			"agent_legacy_handshakes_total",
+			"Total number of handshakes accepted without key confirmation by peer and role.",
+			"peer", "role",
+		),
+	}
+
+	registry.NewGaugeFunc(
+		"agent_session_age_seconds",
+		"Time since the session with a peer was established.",
+		sessions.ages,
+		"peer",
+	)
+	registry.NewGaugeFunc(
+		"agent_tunnel_streams_active",
+		"Number of forwarded connections currently open by peer.",
+		tunnels.streams,
+		"peer",
+	)
+
+	return m
+}
+
+func (m *agentMetrics) handshakeStarted(role string) {
+	m.handshakesStarted.Inc(role)
+}
+
+func (m *agentMetrics) handshakeFailed(role string, step int) {
+	m.handshakesFailed.Inc(role, strconv.Itoa(step))
+}
+
+func (m *agentMetrics) handshakeCompleted(role string) {
+	m.handshakesComplete.Inc(role)
+}
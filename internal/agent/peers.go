@@ -0,0 +1,18 @@
+package agent
+
+import (
+	"fmt"
+)
+
+func newPeers(ids, addrs []string) (map[string]string, error) {
+	if len(ids) != len(addrs) {
+		return nil, fmt.Errorf("got %d agent IDs but %d agent addresses", len(ids), len(addrs))
+	}
+
+	peers := make(map[string]string, len(ids))
+	for i, id := range ids {
+		peers[id] = addrs[i]
+	}
+
+	return peers, nil
+}
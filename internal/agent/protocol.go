@@ -0,0 +1,498 @@
+package agent
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/sudeeya/key-exchange/internal/pkg/api"
+	"github.com/sudeeya/key-exchange/internal/pkg/crypto"
+	"github.com/sudeeya/key-exchange/internal/pkg/suite"
+	"github.com/sudeeya/key-exchange/internal/pkg/tracing"
+)
+
+var (
+	errUnknownPeer  = errors.New("agent with such ID does not exist")
+	errNoSession    = errors.New("no session with agent")
+	errNotConfirmed = errors.New("key confirmation failed")
+	errNoHandshake  = errors.New("no handshake in progress")
+	errLegacyPeer   = errors.New("peer does not support key confirmation")
+)
+
+type HandshakeError struct {
+	Step int
+	Err  error
+}
+
+func (e *HandshakeError) Error() string {
+	return fmt.Sprintf("step %d: %v", e.Step, e.Err)
+}
+
+func (e *HandshakeError) Unwrap() error {
+	return e.Err
+}
+
+// OpenSession runs the initiator side of the Wu-Lam protocol with peer.
+func (a *Agent) OpenSession(ctx context.Context, peer string) (api.SessionInfo, error) {
+	acceptorAddr, ok := a.peers[peer]
+	if !ok {
+		return api.SessionInfo{}, fmt.Errorf("%w: %s", errUnknownPeer, peer)
+	}
+
+	ctx, span := a.tracer.Start(ctx, "handshake")
+	defer span.End()
+	span.SetAttribute("role", initiatorRole)
+	span.SetAttribute("initiator", a.cfg.ID)
+	span.SetAttribute("acceptor", peer)
+
+	a.metrics.handshakeStarted(initiatorRole)
+	fail := func(step int, err error) (api.SessionInfo, error) {
+		a.handshakeFailed(ctx, initiatorRole, peer, step, err)
+		return api.SessionInfo{}, &HandshakeError{Step: step, Err: err}
+	}
+
+	// Step 1
+	if err := a.sendStep(ctx, initiatorRole, peer, 1); err != nil {
+		return fail(1, err)
+	}
+	stepCtx, stepSpan := a.tracer.Start(ctx, "step 1-2: request acceptor certificate")
+	req1 := api.Request{
+		Initiator: a.cfg.ID,
+		Acceptor:  peer,
+	}
+	if err := a.signRequest(stepCtx, &req1, api.Step2Endpoint); err != nil {
+		stepSpan.End()
+		return fail(1, err)
+	}
+	var resp2 api.Response
+	rawResp2, err := a.client.R().
+		SetContext(stepCtx).
+		SetHeader("Content-Type", "application/json").
+		SetBody(req1).
+		SetResult(&resp2).
+		Post(httpPrefix + a.cfg.TrentAddr + api.Step2Endpoint)
+	if err != nil {
+		stepSpan.End()
+		return fail(2, err)
+	}
+	if rawResp2.StatusCode() != http.StatusOK {
+		stepSpan.End()
+		return fail(2, fmt.Errorf("step 2 status code is %d: %s", rawResp2.StatusCode(), strings.TrimSpace(rawResp2.String())))
+	}
+	a.publishStep(ctx, initiatorRole, peer, 2, stepReceived, "", false)
+
+	info2JSON, err := json.Marshal(resp2.Certificate.Information)
+	if err != nil {
+		stepSpan.End()
+		return fail(2, err)
+	}
+	ok = a.checkStep(ctx, initiatorRole, peer, 2, "Trent's signature on "+peer+"'s public key",
+		a.verifyRSA(stepCtx, info2JSON, resp2.Certificate.Signature))
+	stepSpan.End()
+	if !ok {
+		return fail(2, fmt.Errorf("signature verification failed"))
+	}
+
+	acceptorKey := resp2.Certificate.Information.AcceptorKey
+
+	// Step 3
+	stepCtx, stepSpan = a.tracer.Start(ctx, "step 3-6: exchange with acceptor")
+	defer stepSpan.End()
+	initiatorNonce, err := a.rng.GenerateNonce()
+	if err != nil {
+		return fail(3, err)
+	}
+	info3 := api.Info{
+		Initiator:      a.cfg.ID,
+		InitiatorNonce: initiatorNonce,
+	}
+	offer, err := suite.NewOffer(a.suites, a.rng)
+	if err != nil {
+		return fail(3, err)
+	}
+	if err := offer.Fill(&info3); err != nil {
+		return fail(3, err)
+	}
+	info3JSON, err := json.Marshal(info3)
+	if err != nil {
+		return fail(3, err)
+	}
+	ciphertext3 := a.encryptRSA(stepCtx, info3JSON, acceptorKey)
+	if err := a.sendStep(ctx, initiatorRole, peer, 3); err != nil {
+		return fail(3, err)
+	}
+
+	req3 := api.Request{
+		Ciphertext: ciphertext3,
+	}
+	var resp4 api.Response
+	rawResp4, err := a.client.R().
+		SetContext(stepCtx).
+		SetHeader("Content-Type", "application/json").
+		SetBody(req3).
+		SetResult(&resp4).
+		Post(httpPrefix + acceptorAddr + api.Step4Endpoint)
+	if err != nil {
+		return fail(4, err)
+	}
+	if rawResp4.StatusCode() != http.StatusOK {
+		return fail(4, fmt.Errorf("step 4 status code is %d: %s", rawResp4.StatusCode(), strings.TrimSpace(rawResp4.String())))
+	}
+	a.publishStep(ctx, initiatorRole, peer, 6, stepReceived, "", false)
+
+	resp4JSON := a.decryptRSA(stepCtx, resp4.Ciphertext)
+
+	var resp api.Response
+	if err := json.Unmarshal(resp4JSON, &resp); err != nil {
+		return fail(6, err)
+	}
+
+	// Acceptors that predate suite negotiation do not confirm the key.
+	var transcript *crypto.Transcript
+	if resp.Suite == "" {
+		if err := a.acceptLegacy(ctx, initiatorRole, peer, 6); err != nil {
+			return fail(6, err)
+		}
+	} else {
+		// Trent's answers at steps 2 and 5 are not added: each is seen by
+		// one agent only, and what they vouch for is signed by Trent and
+		// checked, or is in the session certificate of step 6.
+		transcript = crypto.NewTranscript()
+		transcript.Add([]byte(a.cfg.ID), []byte(peer), info3JSON, resp4JSON)
+	}
+
+	info6JSON, err := json.Marshal(resp.Certificate.Information)
+	if err != nil {
+		return fail(6, err)
+	}
+	ok = a.checkStep(ctx, initiatorRole, peer, 6, "Trent's signature on the session certificate",
+		a.verifyRSA(stepCtx, info6JSON, resp.Certificate.Signature))
+	if !ok {
+		return fail(6, errors.New("signature verification failed"))
+	}
+	ok = a.checkStep(ctx, initiatorRole, peer, 6, "N_A in the session certificate",
+		bytes.Equal(resp.Certificate.Information.InitiatorNonce, initiatorNonce))
+	if !ok {
+		return fail(6, errors.New("nonce verification failed"))
+	}
+
+	sessionKey := resp.Certificate.Information.SessionKey
+	sessionID := resp.Certificate.Information.SessionID
+	cipherSuite, sessionKey, err := offer.Finish(resp, sessionKey, sessionID)
+	if !a.checkStep(ctx, initiatorRole, peer, 6, "cipher suite "+suite.Name(resp.Suite)+" offered", err == nil) {
+		return fail(6, err)
+	}
+	ok = a.checkStep(ctx, initiatorRole, peer, 6, "cipher suite in the session certificate",
+		suite.Name(resp.Certificate.Information.Suite) == cipherSuite)
+	if !ok {
+		return fail(6, errSuiteMismatch)
+	}
+	keys, err := sessionKeys(sessionKey, sessionID, a.cfg.ID, peer, transcript != nil)
+	if err != nil {
+		return fail(6, err)
+	}
+	stepSpan.End()
+
+	// Step 7
+	stepCtx, stepSpan = a.tracer.Start(ctx, "step 7-8: confirm the session key")
+	defer stepSpan.End()
+	iv, err := a.rng.GenerateIV()
+	if err != nil {
+		return fail(7, err)
+	}
+	ciphertext7 := a.encryptAES(stepCtx, resp.AcceptorNonce, keys.Confirmation, iv)
+	msg := api.Message{
+		Sender:     a.cfg.ID,
+		IV:         iv,
+		Ciphertext: ciphertext7,
+	}
+	if transcript != nil {
+		transcript.Add(iv, ciphertext7)
+		msg.Confirmation, err = crypto.Confirmation(keys.Confirmation, crypto.InitiatorFinished, transcript.Sum())
+		if err != nil {
+			return fail(7, err)
+		}
+	}
+	if err := a.sendStep(ctx, initiatorRole, peer, 7); err != nil {
+		return fail(7, err)
+	}
+	var msg8 api.Message
+	rawResp, err := a.client.R().
+		SetContext(stepCtx).
+		SetHeader("Content-Type", "application/json").
+		SetBody(msg).
+		SetResult(&msg8).
+		Post(httpPrefix + acceptorAddr + api.Step7Endpoint)
+	if err != nil {
+		return fail(7, err)
+	}
+	if rawResp.StatusCode() != http.StatusOK {
+		return fail(7, fmt.Errorf("step 7 status code is %d: %s", rawResp.StatusCode(), strings.TrimSpace(rawResp.String())))
+	}
+
+	// Step 8
+	lastStep := 7
+	if transcript != nil {
+		lastStep = 8
+		a.publishStep(ctx, initiatorRole, peer, 8, stepReceived, "", false)
+		transcript.Add(msg.Confirmation)
+		ok = a.checkStep(ctx, initiatorRole, peer, 8, peer+"'s confirmation of the session key and transcript",
+			crypto.VerifyConfirmation(keys.Confirmation, crypto.AcceptorFinished, transcript.Sum(), msg8.Confirmation))
+		if !ok {
+			return fail(8, errNotConfirmed)
+		}
+	}
+
+	s := a.establish(peer, initiatorRole, sessionID, keys, cipherSuite)
+	span.SetAttribute("session_id", s.id)
+	a.publishStep(ctx, initiatorRole, peer, lastStep, stepEstablished, "", false)
+
+	return s.info(), nil
+}
+
+// acceptLegacy decides whether a handshake with a peer that predates key
+// confirmation may go on. Such a peer looks the same as an attacker who
+// strips the suite negotiation to skip the confirmation, so it is refused
+// unless ALLOW_LEGACY_PEERS is set, and counted and logged when it is.
+func (a *Agent) acceptLegacy(ctx context.Context, role, peer string, step int) error {
+	if !a.checkStep(ctx, role, peer, step, "key confirmation skipped for "+peer+", which predates it", a.cfg.AllowLegacyPeers) {
+		return errLegacyPeer
+	}
+
+	a.metrics.legacyHandshakes.Inc(peer, role)
+	a.logger.Warn("Accepting a handshake without key confirmation", zap.String("peer", peer), zap.String("role", role))
+
+	return nil
+}
+
+// SendMessage encrypts text under the session key shared with peer and delivers it.
+func (a *Agent) SendMessage(ctx context.Context, peer, text string) error {
+	if _, ok := a.peers[peer]; !ok {
+		return fmt.Errorf("%w: %s", errUnknownPeer, peer)
+	}
+	s, ok := a.sessions.get(peer)
+	if !ok {
+		return fmt.Errorf("%w: %s", errNoSession, peer)
+	}
+
+	ctx, span := a.tracer.Start(ctx, "send message")
+	defer span.End()
+	span.SetAttribute("peer", peer)
+	span.SetAttribute("session_id", s.id)
+
+	message := a.storeMessage(api.MailboxMessage{
+		Peer:      peer,
+		Direction: outgoingMessage,
+		Session:   s.id,
+		Status:    messagePending,
+		Text:      text,
+	})
+
+	err := a.deliver(ctx, s, text)
+	status := messageDelivered
+	if err != nil {
+		span.RecordError(err)
+		status = messageFailed
+	}
+	message, storeErr := a.mailbox.setStatus(message.ID, status)
+	if storeErr != nil {
+		a.logger.Error("Failed to store message", zap.String("peer", peer), zap.Error(storeErr))
+	}
+
+	a.events.publish(api.Event{
+		Type:    api.MessageSentEvent,
+		Message: &message,
+	})
+
+	return err
+}
+
+func (a *Agent) deliver(ctx context.Context, s *session, text string) error {
+	var id uint64
+	if ps, ok := a.streams.get(s.peer); ok {
+		var err error
+		id, err = ps.send(ctx, text)
+		if err == nil {
+			a.metrics.messagesSent.Inc(s.peer)
+			return nil
+		}
+		if !errors.Is(err, errNoStream) && !errors.Is(err, errNotAcknowledged) {
+			return err
+		}
+	}
+
+	// Without a connected stream the message is sent with a single POST. A
+	// message the stream did not get acknowledged keeps its ID, so that the
+	// peer drops it if it did arrive after all.
+	a.metrics.messagesFallback.Inc(s.peer)
+	iv, err := a.rng.GenerateIV()
+	if err != nil {
+		return err
+	}
+	ciphertext := a.encryptAES(ctx, []byte(text), s.sendKey(), iv)
+	msg := api.Message{
+		ID:         id,
+		Sender:     a.cfg.ID,
+		IV:         iv,
+		Ciphertext: ciphertext,
+	}
+	rawResp, err := a.client.R().
+		SetContext(ctx).
+		SetHeader("Content-Type", "application/json").
+		SetBody(msg).
+		Post(httpPrefix + a.peers[s.peer] + api.MessageEndpoint)
+	if err != nil {
+		return err
+	}
+	if rawResp.StatusCode() != http.StatusOK {
+		return fmt.Errorf("error sending message: status code is %d", rawResp.StatusCode())
+	}
+
+	a.metrics.messagesSent.Inc(s.peer)
+
+	return nil
+}
+
+func (a *Agent) Sessions() []api.SessionInfo {
+	sessions := a.sessions.list()
+
+	infos := make([]api.SessionInfo, 0, len(sessions))
+	for _, s := range sessions {
+		info := s.info()
+		info.Stream = a.streams.connected(s.peer)
+		infos = append(infos, info)
+	}
+
+	return infos
+}
+
+func (a *Agent) establish(peer, role, id string, keys crypto.SessionKeys, cipherSuite string) *session {
+	s := &session{
+		id:          id,
+		peer:        peer,
+		role:        role,
+		keys:        keys,
+		established: time.Now(),
+		suite:       cipherSuite,
+	}
+	previous := a.sessions.put(s)
+	a.metrics.handshakeCompleted(role)
+
+	ps := a.streams.reset(s)
+	if role == initiatorRole {
+		go a.maintainStream(ps)
+	}
+
+	a.logger.Info("Session established",
+		zap.String("peer", peer),
+		zap.String("role", role),
+		zap.String("session_id", id),
+		zap.String("suite", cipherSuite),
+	)
+
+	info := s.info()
+	a.events.publish(api.Event{
+		Type:    api.SessionEstablishedEvent,
+		Session: &info,
+	})
+
+	if previous != nil {
+		a.tunnels.closePeer(peer, id)
+
+		previousInfo := previous.info()
+		a.events.publish(api.Event{
+			Type:     api.SessionRekeyedEvent,
+			Session:  &info,
+			Previous: &previousInfo,
+			KeyIDs:   a.sessions.exports(previous),
+		})
+	}
+
+	return s
+}
+
+// CloseSession forgets the session with peer. Messages from peer are rejected
+// until a new session is established.
+func (a *Agent) CloseSession(peer string) (api.SessionInfo, error) {
+	s, ok := a.sessions.remove(peer)
+	if !ok {
+		return api.SessionInfo{}, fmt.Errorf("%w: %s", errNoSession, peer)
+	}
+
+	a.tunnels.closePeer(peer, "")
+	a.streams.close(peer)
+
+	a.logger.Info("Session closed",
+		zap.String("peer", peer),
+		zap.String("session_id", s.id),
+	)
+
+	info := s.info()
+	a.events.publish(api.Event{
+		Type:     api.SessionClosedEvent,
+		Previous: &info,
+		KeyIDs:   a.sessions.exports(s),
+	})
+
+	return info, nil
+}
+
+func (a *Agent) handshakeFailed(ctx context.Context, role, peer string, step int, err error) {
+	span := tracing.SpanFromContext(ctx)
+	span.SetAttribute("failed_step", step)
+	span.RecordError(err)
+
+	a.metrics.handshakeFailed(role, step)
+	a.logger.Error("Handshake failed",
+		zap.String("peer", peer),
+		zap.String("role", role),
+		zap.Int("step", step),
+		zap.String("trace_id", span.Context().TraceID.String()),
+		zap.Error(err),
+	)
+
+	a.publishStep(ctx, role, peer, step, stepFailed, err.Error(), false)
+	a.events.publish(api.Event{
+		Type: api.HandshakeFailedEvent,
+		Failure: &api.HandshakeFailure{
+			Peer:  peer,
+			Role:  role,
+			Step:  step,
+			Error: err.Error(),
+		},
+	})
+}
+
+func (a *Agent) receive(peer, sessionID, text string) {
+	message := a.storeMessage(api.MailboxMessage{
+		Peer:      peer,
+		Direction: incomingMessage,
+		Session:   sessionID,
+		Status:    messageReceived,
+		Text:      text,
+	})
+	a.metrics.messagesReceived.Inc(peer)
+
+	a.events.publish(api.Event{
+		Type:    api.MessageReceivedEvent,
+		Message: &message,
+	})
+}
+
+// storeMessage adds message to the mailbox. A message that cannot be written
+// to the history file is still kept in memory for this run.
+func (a *Agent) storeMessage(message api.MailboxMessage) api.MailboxMessage {
+	message, err := a.mailbox.add(message)
+	if err != nil {
+		a.logger.Error("Failed to store message", zap.String("peer", message.Peer), zap.Error(err))
+	}
+
+	return message
+}
@@ -0,0 +1,36 @@
+package agent
+
+import (
+	"context"
+	"testing"
+)
+
+// BenchmarkHandshake runs whole handshakes, steps 1 to 8, between agents
+// and Trent on test servers for each suite: "before" with keys parsed from
+// PEM and public key certificates signed on every use, as before they were
+// cached, and "after" with the caches.
+func BenchmarkHandshake(b *testing.B) {
+	for _, variant := range []struct {
+		name      string
+		cacheKeys string
+	}{
+		{"before", "false"},
+		{"after", "true"},
+	} {
+		for _, cfg := range []interopConfig{interopConfigs[0], interopConfigs[2], interopConfigs[4]} {
+			b.Run(variant.name+"/"+cfg.suites[0], func(b *testing.B) {
+				// Trent and the agents both read CACHE_KEYS.
+				b.Setenv("CACHE_KEYS", variant.cacheKeys)
+				n := newInteropNetwork(b, []interopConfig{cfg}, nil)
+				initiator := n.agents[cfg.id+"-a"]
+
+				for b.Loop() {
+					if _, err := initiator.OpenSession(context.Background(), cfg.id+"-b"); err != nil {
+						b.Fatal(err)
+					}
+				}
+				b.ReportMetric(float64(b.N)/b.Elapsed().Seconds(), "handshakes/s")
+			})
+		}
+	}
+}
@@ -0,0 +1,195 @@
+package agent
+
+import (
+	"slices"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/sudeeya/key-exchange/internal/pkg/api"
+	"github.com/sudeeya/key-exchange/internal/pkg/crypto"
+	"github.com/sudeeya/key-exchange/internal/pkg/metrics"
+	"github.com/sudeeya/key-exchange/internal/pkg/suite"
+)
+
+type session struct {
+	id          string
+	peer        string
+	role        string
+	keys        crypto.SessionKeys
+	established time.Time
+	exports     []string
+	suite       string
+}
+
+// sendKey encrypts messages to the peer and receiveKey decrypts those from
+// it.
+func (s *session) sendKey() []byte {
+	if s.role == initiatorRole {
+		return s.keys.InitiatorToAcceptor
+	}
+
+	return s.keys.AcceptorToInitiator
+}
+
+func (s *session) receiveKey() []byte {
+	if s.role == initiatorRole {
+		return s.keys.AcceptorToInitiator
+	}
+
+	return s.keys.InitiatorToAcceptor
+}
+
+// sessionKeys splits the session key. Sessions with agents that predate key
+// confirmation use it for everything, as those agents do.
+func sessionKeys(key []byte, id, initiator, acceptor string, confirmed bool) (crypto.SessionKeys, error) {
+	if !confirmed {
+		return crypto.LegacySessionKeys(key), nil
+	}
+
+	return crypto.DeriveSessionKeys(key, id, initiator, acceptor)
+}
+
+func (s *session) info() api.SessionInfo {
+	return api.SessionInfo{
+		ID:             s.id,
+		Peer:           s.peer,
+		Role:           s.role,
+		Established:    s.established,
+		Suite:          s.suite,
+		ForwardSecrecy: suite.ForwardSecret(s.suite),
+	}
+}
+
+// handshake is the acceptor's state kept between steps 6 and 7.
+type handshake struct {
+	sessionID     string
+	keys          crypto.SessionKeys
+	acceptorNonce []byte
+	suite         string
+	// transcript is nil if the initiator predates key confirmation.
+	transcript *crypto.Transcript
+}
+
+type sessionTable struct {
+	mu         sync.RWMutex
+	sessions   map[string]*session
+	handshakes map[string]*handshake
+}
+
+func newSessionTable() *sessionTable {
+	return &sessionTable{
+		sessions:   make(map[string]*session),
+		handshakes: make(map[string]*handshake),
+	}
+}
+
+func (t *sessionTable) get(peer string) (*session, bool) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	s, ok := t.sessions[peer]
+	return s, ok
+}
+
+// put stores s and returns the session with the same peer it replaces, if any.
+func (t *sessionTable) put(s *session) *session {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	previous := t.sessions[s.peer]
+	t.sessions[s.peer] = s
+	return previous
+}
+
+func (t *sessionTable) remove(peer string) (*session, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	s, ok := t.sessions[peer]
+	delete(t.sessions, peer)
+	return s, ok
+}
+
+// recordExport remembers the ID of a key exported from s so that its users
+// can be told to drop it once s is replaced or closed. It reports false if s
+// is no longer the session with its peer.
+func (t *sessionTable) recordExport(s *session, keyID string) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.sessions[s.peer] != s {
+		return false
+	}
+	if !slices.Contains(s.exports, keyID) {
+		s.exports = append(s.exports, keyID)
+	}
+
+	return true
+}
+
+func (t *sessionTable) exports(s *session) []string {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	return slices.Clone(s.exports)
+}
+
+func (t *sessionTable) list() []*session {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	sessions := make([]*session, 0, len(t.sessions))
+	for _, s := range t.sessions {
+		sessions = append(sessions, s)
+	}
+	sort.Slice(sessions, func(i, j int) bool {
+		return sessions[i].peer < sessions[j].peer
+	})
+
+	return sessions
+}
+
+func (t *sessionTable) startHandshake(peer string, h *handshake) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.handshakes[peer] = h
+}
+
+// handshake returns the handshake in progress with peer. It stays in progress
+// until finishHandshake, so that a forged step 7 cannot abort it.
+func (t *sessionTable) handshake(peer string) (*handshake, bool) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	h, ok := t.handshakes[peer]
+	return h, ok
+}
+
+// finishHandshake removes h, the handshake in progress with peer. It reports
+// false if h has already been finished or replaced by a new one.
+func (t *sessionTable) finishHandshake(peer string, h *handshake) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.handshakes[peer] != h {
+		return false
+	}
+	delete(t.handshakes, peer)
+	return true
+}
+
+func (t *sessionTable) ages() []metrics.Sample {
+	sessions := t.list()
+
+	samples := make([]metrics.Sample, 0, len(sessions))
+	for _, s := range sessions {
+		samples = append(samples, metrics.Sample{
+			LabelValues: []string{s.peer},
+			Value:       time.Since(s.established).Seconds(),
+		})
+	}
+
+	return samples
+}
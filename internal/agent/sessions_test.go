@@ -0,0 +1,52 @@
+package agent
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestHandshakeStaysUntilFinished(t *testing.T) {
+	table := newSessionTable()
+	h := &handshake{sessionID: "first"}
+	table.startHandshake("alice", h)
+
+	// A step 7 that fails verification only looks the handshake up.
+	if got, ok := table.handshake("alice"); !ok || got != h {
+		t.Fatal("handshake in progress was not found")
+	}
+	if _, ok := table.handshake("alice"); !ok {
+		t.Fatal("looking the handshake up removed it")
+	}
+
+	replacement := &handshake{sessionID: "second"}
+	table.startHandshake("alice", replacement)
+	if table.finishHandshake("alice", h) {
+		t.Fatal("a replaced handshake was finished")
+	}
+	if !table.finishHandshake("alice", replacement) {
+		t.Fatal("the current handshake was not finished")
+	}
+	if table.finishHandshake("alice", replacement) {
+		t.Fatal("a handshake was finished twice")
+	}
+}
+
+func TestSessionKeysPairUp(t *testing.T) {
+	key := []byte("0123456789abcdef0123456789abcdef")
+
+	for _, confirmed := range []bool{true, false} {
+		keys, err := sessionKeys(key, "session", "alice", "bob", confirmed)
+		if err != nil {
+			t.Fatal(err)
+		}
+		initiator := &session{role: initiatorRole, keys: keys}
+		acceptor := &session{role: acceptorRole, keys: keys}
+
+		if !bytes.Equal(initiator.sendKey(), acceptor.receiveKey()) || !bytes.Equal(acceptor.sendKey(), initiator.receiveKey()) {
+			t.Fatalf("confirmed %t: the keys of the two directions do not pair up", confirmed)
+		}
+		if directional := !bytes.Equal(initiator.sendKey(), initiator.receiveKey()); directional != confirmed {
+			t.Fatalf("confirmed %t: each direction has its own key: %t", confirmed, directional)
+		}
+	}
+}
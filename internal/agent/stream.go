@@ -0,0 +1,545 @@
+package agent
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"go.uber.org/zap"
+
+	"github.com/sudeeya/key-exchange/internal/pkg/api"
+	"github.com/sudeeya/key-exchange/internal/pkg/crypto"
+	"github.com/sudeeya/key-exchange/internal/pkg/tracing"
+)
+
+const (
+	streamChannel      = "stream"
+	streamPrefix       = "ws://"
+	streamPingInterval = 15 * time.Second
+	streamReadTimeout  = 3 * streamPingInterval
+	streamWriteTimeout = 10 * time.Second
+	streamAckTimeout   = 10 * time.Second
+	streamMinBackoff   = time.Second
+	streamMaxBackoff   = 30 * time.Second
+	streamSeenWindow   = 1024
+)
+
+var (
+	errNoStream        = errors.New("no stream with agent")
+	errNotAcknowledged = errors.New("message was not acknowledged")
+	errStreamClosed    = errors.New("stream closed")
+)
+
+var streamUpgrader = websocket.Upgrader{
+	HandshakeTimeout: streamWriteTimeout,
+}
+
+// streamConn is one WebSocket connection of a stream. Every frame is sealed
+// with the key of its direction and a sequence-number nonce.
+type streamConn struct {
+	ws      *websocket.Conn
+	sendKey []byte
+	recvKey []byte
+
+	writeMu sync.Mutex
+	sendSeq uint64
+	recvSeq uint64
+}
+
+func newStreamConn(ws *websocket.Conn, sendKey, recvKey []byte) *streamConn {
+	ws.SetReadDeadline(time.Now().Add(streamReadTimeout))
+	ws.SetPongHandler(func(string) error {
+		return ws.SetReadDeadline(time.Now().Add(streamReadTimeout))
+	})
+
+	return &streamConn{
+		ws:      ws,
+		sendKey: sendKey,
+		recvKey: recvKey,
+	}
+}
+
+func (c *streamConn) writeFrame(f api.StreamFrame) error {
+	plaintext, err := json.Marshal(f)
+	if err != nil {
+		return err
+	}
+
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	ciphertext, err := crypto.EncryptAEAD(plaintext, c.sendKey, sequenceNonce(c.sendSeq), nil)
+	if err != nil {
+		return err
+	}
+	c.sendSeq++
+
+	c.ws.SetWriteDeadline(time.Now().Add(streamWriteTimeout))
+	return c.ws.WriteMessage(websocket.BinaryMessage, ciphertext)
+}
+
+func (c *streamConn) readFrame() (api.StreamFrame, error) {
+	kind, ciphertext, err := c.ws.ReadMessage()
+	if err != nil {
+		return api.StreamFrame{}, err
+	}
+	if kind != websocket.BinaryMessage {
+		return api.StreamFrame{}, errors.New("unexpected stream message type")
+	}
+	c.ws.SetReadDeadline(time.Now().Add(streamReadTimeout))
+
+	plaintext, err := crypto.DecryptAEAD(ciphertext, c.recvKey, sequenceNonce(c.recvSeq), nil)
+	if err != nil {
+		return api.StreamFrame{}, err
+	}
+	c.recvSeq++
+
+	var f api.StreamFrame
+	if err := json.Unmarshal(plaintext, &f); err != nil {
+		return api.StreamFrame{}, err
+	}
+
+	return f, nil
+}
+
+func (c *streamConn) keepalive(done <-chan struct{}) {
+	ticker := time.NewTicker(streamPingInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			c.writeMu.Lock()
+			err := c.ws.WriteControl(websocket.PingMessage, nil, time.Now().Add(streamWriteTimeout))
+			c.writeMu.Unlock()
+			if err != nil {
+				return
+			}
+		}
+	}
+}
+
+func sequenceNonce(seq uint64) []byte {
+	nonce := make([]byte, crypto.AEADNonceSize)
+	binary.BigEndian.PutUint64(nonce[crypto.AEADNonceSize-8:], seq)
+
+	return nonce
+}
+
+// peerStream carries the messages of one session. Its connection may drop and
+// be replaced; messages waiting for an ack are sent again on the new one, and
+// the receiver drops the ones it has already seen.
+type peerStream struct {
+	peer       string
+	session    *session
+	done       chan struct{}
+	ackTimeout time.Duration
+
+	mu      sync.Mutex
+	conn    *streamConn
+	nextID  uint64
+	pending map[uint64]*pendingMessage
+	seen    map[uint64]struct{}
+	maxSeen uint64
+	closed  bool
+}
+
+type pendingMessage struct {
+	text  string
+	acked chan struct{}
+}
+
+func newPeerStream(s *session) *peerStream {
+	return &peerStream{
+		peer:       s.peer,
+		session:    s,
+		done:       make(chan struct{}),
+		ackTimeout: streamAckTimeout,
+		pending:    make(map[uint64]*pendingMessage),
+		seen:       make(map[uint64]struct{}),
+	}
+}
+
+func (ps *peerStream) attach(conn *streamConn) bool {
+	ps.mu.Lock()
+	if ps.closed {
+		ps.mu.Unlock()
+		return false
+	}
+	previous := ps.conn
+	ps.conn = conn
+
+	ids := make([]uint64, 0, len(ps.pending))
+	for id := range ps.pending {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	frames := make([]api.StreamFrame, 0, len(ids))
+	for _, id := range ids {
+		frames = append(frames, api.StreamFrame{Type: api.StreamMessageFrame, ID: id, Text: ps.pending[id].text})
+	}
+	ps.mu.Unlock()
+
+	if previous != nil {
+		previous.ws.Close()
+	}
+	for _, f := range frames {
+		if err := conn.writeFrame(f); err != nil {
+			break
+		}
+	}
+
+	return true
+}
+
+func (ps *peerStream) detach(conn *streamConn) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	if ps.conn == conn {
+		ps.conn = nil
+	}
+}
+
+func (ps *peerStream) connected() bool {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	return ps.conn != nil
+}
+
+func (ps *peerStream) close() {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	if ps.closed {
+		return
+	}
+	ps.closed = true
+	close(ps.done)
+	if ps.conn != nil {
+		ps.conn.ws.Close()
+	}
+}
+
+// send delivers text and waits for the peer to acknowledge it. It returns
+// the ID the message was sent with, so that a message that is not
+// acknowledged can be sent another way under the same ID.
+func (ps *peerStream) send(ctx context.Context, text string) (uint64, error) {
+	ps.mu.Lock()
+	if ps.conn == nil {
+		ps.mu.Unlock()
+		return 0, errNoStream
+	}
+	ps.nextID++
+	id := ps.nextID
+	p := &pendingMessage{
+		text:  text,
+		acked: make(chan struct{}),
+	}
+	ps.pending[id] = p
+	conn := ps.conn
+	ps.mu.Unlock()
+
+	defer func() {
+		ps.mu.Lock()
+		defer ps.mu.Unlock()
+
+		delete(ps.pending, id)
+	}()
+
+	// A failed write is retried when the stream reconnects.
+	conn.writeFrame(api.StreamFrame{Type: api.StreamMessageFrame, ID: id, Text: text})
+
+	timer := time.NewTimer(ps.ackTimeout)
+	defer timer.Stop()
+
+	select {
+	case <-p.acked:
+		return id, nil
+	case <-ctx.Done():
+		return id, ctx.Err()
+	case <-ps.done:
+		return id, errStreamClosed
+	case <-timer.C:
+		return id, errNotAcknowledged
+	}
+}
+
+func (ps *peerStream) ack(id uint64) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	if p, ok := ps.pending[id]; ok {
+		close(p.acked)
+		delete(ps.pending, id)
+	}
+}
+
+// firstDelivery reports whether message id has not been received before.
+func (ps *peerStream) firstDelivery(id uint64) bool {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	if _, ok := ps.seen[id]; ok || id+streamSeenWindow <= ps.maxSeen {
+		return false
+	}
+	ps.seen[id] = struct{}{}
+	if id > ps.maxSeen {
+		ps.maxSeen = id
+	}
+	for seen := range ps.seen {
+		if seen+streamSeenWindow <= ps.maxSeen {
+			delete(ps.seen, seen)
+		}
+	}
+
+	return true
+}
+
+// firstStreamDelivery reports whether the message with stream ID id, sent
+// outside the stream of session s, has not been received over it before.
+func (a *Agent) firstStreamDelivery(s *session, id uint64) bool {
+	ps, ok := a.streams.get(s.peer)
+	if !ok || ps.session != s {
+		return true
+	}
+
+	return ps.firstDelivery(id)
+}
+
+// streams holds the stream of every established session.
+type streams struct {
+	mu    sync.Mutex
+	peers map[string]*peerStream
+}
+
+func newStreams() *streams {
+	return &streams{
+		peers: make(map[string]*peerStream),
+	}
+}
+
+// reset replaces the stream with s.peer by a new one for session s.
+func (t *streams) reset(s *session) *peerStream {
+	ps := newPeerStream(s)
+
+	t.mu.Lock()
+	previous := t.peers[s.peer]
+	t.peers[s.peer] = ps
+	t.mu.Unlock()
+
+	if previous != nil {
+		previous.close()
+	}
+
+	return ps
+}
+
+func (t *streams) get(peer string) (*peerStream, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	ps, ok := t.peers[peer]
+	return ps, ok
+}
+
+func (t *streams) connected(peer string) bool {
+	ps, ok := t.get(peer)
+	return ok && ps.connected()
+}
+
+func (t *streams) close(peer string) {
+	t.mu.Lock()
+	ps, ok := t.peers[peer]
+	delete(t.peers, peer)
+	t.mu.Unlock()
+
+	if ok {
+		ps.close()
+	}
+}
+
+func (t *streams) closeAll() {
+	t.mu.Lock()
+	peers := t.peers
+	t.peers = make(map[string]*peerStream)
+	t.mu.Unlock()
+
+	for _, ps := range peers {
+		ps.close()
+	}
+}
+
+// maintainStream keeps the initiator's stream connected until the session
+// goes away, reconnecting with exponential backoff.
+func (a *Agent) maintainStream(ps *peerStream) {
+	backoff := streamMinBackoff
+	for {
+		conn, err := a.dialStream(ps)
+		if err == nil {
+			backoff = streamMinBackoff
+			err = a.serveStream(ps, conn, initiatorRole)
+		}
+
+		select {
+		case <-ps.done:
+			return
+		default:
+		}
+
+		a.logger.Error("Stream disconnected",
+			zap.String("peer", ps.peer),
+			zap.Duration("retry_in", backoff),
+			zap.Error(err),
+		)
+
+		select {
+		case <-ps.done:
+			return
+		case <-time.After(backoff):
+		}
+		backoff = min(2*backoff, streamMaxBackoff)
+	}
+}
+
+func (a *Agent) dialStream(ps *peerStream) (*streamConn, error) {
+	ctx, span := a.tracer.Start(context.Background(), "open stream")
+	defer span.End()
+	span.SetAttribute("peer", ps.peer)
+	span.SetAttribute("session_id", ps.session.id)
+
+	clientNonce, err := a.rng.GenerateNonce()
+	if err != nil {
+		span.RecordError(err)
+		return nil, err
+	}
+
+	header := http.Header{}
+	header.Set(api.SenderHeader, a.cfg.ID)
+	header.Set(api.NonceHeader, hex.EncodeToString(clientNonce))
+	tracing.Inject(ctx, header)
+
+	dialer := websocket.Dialer{HandshakeTimeout: streamWriteTimeout}
+	ws, resp, err := dialer.DialContext(ctx, streamPrefix+a.peers[ps.peer]+api.StreamEndpoint, header)
+	if err != nil {
+		if resp != nil {
+			err = fmt.Errorf("stream status code is %d: %w", resp.StatusCode, err)
+		}
+		span.RecordError(err)
+		return nil, err
+	}
+
+	serverNonce, err := decodeNonce(resp.Header.Get(api.NonceHeader))
+	if err != nil {
+		ws.Close()
+		span.RecordError(err)
+		return nil, err
+	}
+	clientKey, serverKey, err := channelKeys(ps.session.keys.Exporter, streamChannel, clientNonce, serverNonce, crypto.AEADKeySize)
+	if err != nil {
+		ws.Close()
+		span.RecordError(err)
+		return nil, err
+	}
+
+	return newStreamConn(ws, clientKey, serverKey), nil
+}
+
+// serveStream reads frames from conn until it fails or the stream is closed.
+// Both sides first exchange a hello frame, so that a connection is only used
+// once it has proved to hold the session key.
+func (a *Agent) serveStream(ps *peerStream, conn *streamConn, role string) error {
+	defer conn.ws.Close()
+
+	if err := conn.writeFrame(api.StreamFrame{Type: api.StreamHelloFrame}); err != nil {
+		return err
+	}
+	hello, err := conn.readFrame()
+	if err != nil {
+		return err
+	}
+	if hello.Type != api.StreamHelloFrame {
+		return fmt.Errorf("unexpected %s frame before hello", hello.Type)
+	}
+
+	if !ps.attach(conn) {
+		return errStreamClosed
+	}
+	defer ps.detach(conn)
+
+	a.metrics.streamConnections.Inc(ps.peer, role)
+	a.logger.Info("Stream connected", zap.String("peer", ps.peer), zap.String("session_id", ps.session.id))
+
+	done := make(chan struct{})
+	defer close(done)
+	go conn.keepalive(done)
+
+	for {
+		f, err := conn.readFrame()
+		if err != nil {
+			return err
+		}
+
+		switch f.Type {
+		case api.StreamMessageFrame:
+			if ps.firstDelivery(f.ID) {
+				a.receive(ps.peer, ps.session.id, f.Text)
+			}
+			if err := conn.writeFrame(api.StreamFrame{Type: api.StreamAckFrame, ID: f.ID}); err != nil {
+				return err
+			}
+		case api.StreamAckFrame:
+			ps.ack(f.ID)
+		}
+	}
+}
+
+// streamHandler accepts the stream of a session from the peer that initiated
+// it and serves it until the connection drops.
+func streamHandler(a *Agent) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		peer := r.Header.Get(api.SenderHeader)
+		ps, ok := a.streams.get(peer)
+		if !ok {
+			http.Error(w, errNoSession.Error(), http.StatusBadRequest)
+			return
+		}
+
+		clientNonce, err := decodeNonce(r.Header.Get(api.NonceHeader))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		serverNonce, err := a.rng.GenerateNonce()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		clientKey, serverKey, err := channelKeys(ps.session.keys.Exporter, streamChannel, clientNonce, serverNonce, crypto.AEADKeySize)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		header := http.Header{}
+		header.Set(api.NonceHeader, hex.EncodeToString(serverNonce))
+		ws, err := streamUpgrader.Upgrade(w, r, header)
+		if err != nil {
+			return
+		}
+
+		err = a.serveStream(ps, newStreamConn(ws, serverKey, clientKey), acceptorRole)
+		a.logger.Info("Stream disconnected", zap.String("peer", peer), zap.Error(err))
+	}
+}
@@ -0,0 +1,193 @@
+package agent
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"github.com/sudeeya/key-exchange/internal/pkg/api"
+	"github.com/sudeeya/key-exchange/internal/pkg/crypto"
+)
+
+func TestFirstDelivery(t *testing.T) {
+	tests := []struct {
+		name  string
+		ids   []uint64
+		first []bool
+	}{
+		{name: "in order", ids: []uint64{1, 2, 3}, first: []bool{true, true, true}},
+		{name: "repeated", ids: []uint64{1, 2, 1, 2}, first: []bool{true, true, false, false}},
+		{name: "out of order", ids: []uint64{3, 1, 2, 3}, first: []bool{true, true, true, false}},
+		{
+			name:  "older than the window",
+			ids:   []uint64{1, streamSeenWindow + 1, 1, 2},
+			first: []bool{true, true, false, true},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ps := newPeerStream(&session{peer: "alice"})
+			for i, id := range tt.ids {
+				if got := ps.firstDelivery(id); got != tt.first[i] {
+					t.Fatalf("message %d (ID %d): first delivery is %t, want %t", i, id, got, tt.first[i])
+				}
+			}
+		})
+	}
+}
+
+func TestPendingMessagesResentOnReconnect(t *testing.T) {
+	ps := newPeerStream(&session{peer: "bob"})
+	first, firstFrames := newTestStreamConn(t)
+	ps.attach(first)
+
+	result := make(chan error, 1)
+	go func() {
+		_, err := ps.send(context.Background(), "hello")
+		result <- err
+	}()
+	sent := receiveFrame(t, firstFrames)
+
+	// The message was not acknowledged on the first connection, so it is
+	// sent again on the next one under the same ID.
+	second, secondFrames := newTestStreamConn(t)
+	ps.attach(second)
+	resent := receiveFrame(t, secondFrames)
+	if resent.ID != sent.ID || resent.Text != "hello" {
+		t.Fatalf("resent frame is %+v, want message %d", resent, sent.ID)
+	}
+
+	ps.ack(resent.ID)
+	if err := <-result; err != nil {
+		t.Fatalf("send returned %v after the ack", err)
+	}
+}
+
+func TestUnacknowledgedMessageTimesOut(t *testing.T) {
+	ps := newPeerStream(&session{peer: "bob"})
+	ps.ackTimeout = 10 * time.Millisecond
+	conn, frames := newTestStreamConn(t)
+	ps.attach(conn)
+
+	id, err := ps.send(context.Background(), "hello")
+	if !errors.Is(err, errNotAcknowledged) {
+		t.Fatalf("send returned %v, want %v", err, errNotAcknowledged)
+	}
+	if f := receiveFrame(t, frames); f.ID != id {
+		t.Fatalf("message was sent as %d, send returned %d", f.ID, id)
+	}
+	if len(ps.pending) != 0 {
+		t.Fatal("message is still pending after the timeout")
+	}
+}
+
+// TestUnacknowledgedMessageFallsBack sends a message whose ack cannot arrive
+// in time, so that it goes out over the stream and again with POST, and
+// checks that the acceptor receives it once.
+func TestUnacknowledgedMessageFallsBack(t *testing.T) {
+	n := newInteropNetwork(t, interopConfigs[:1], nil)
+	initiator, acceptor := n.agents["rsa-a"], n.agents["rsa-b"]
+
+	if _, err := initiator.OpenSession(context.Background(), "rsa-b"); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for !initiator.streams.connected("rsa-b") || !acceptor.streams.connected("rsa-a") {
+		if time.Now().After(deadline) {
+			t.Fatal("stream did not connect")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	ps, _ := initiator.streams.get("rsa-b")
+	ps.ackTimeout = 0
+
+	if err := initiator.SendMessage(context.Background(), "rsa-b", "over the stream"); err != nil {
+		t.Fatal(err)
+	}
+
+	// A message posted twice under the same ID is received once as well.
+	s, _ := initiator.sessions.get("rsa-b")
+	iv, err := initiator.rng.GenerateIV()
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg := api.Message{
+		ID:         1 << 32,
+		Sender:     "rsa-a",
+		IV:         iv,
+		Ciphertext: initiator.encryptAES(context.Background(), []byte("posted"), s.sendKey(), iv),
+	}
+	for range 2 {
+		if status := postJSON(t, initiator.peers["rsa-b"]+api.MessageEndpoint, msg); status != http.StatusOK {
+			t.Fatalf("status code is %d", status)
+		}
+	}
+
+	// Give a late stream frame time to arrive.
+	time.Sleep(100 * time.Millisecond)
+	received := make(map[string]int)
+	for _, m := range acceptor.mailbox.list() {
+		if m.Direction == incomingMessage {
+			received[m.Text]++
+		}
+	}
+	for _, text := range []string{"over the stream", "posted"} {
+		if received[text] != 1 {
+			t.Errorf("%q was received %d times, want once", text, received[text])
+		}
+	}
+}
+
+// newTestStreamConn connects a stream to a server that passes on the frames
+// it receives and never answers them.
+func newTestStreamConn(t *testing.T) (*streamConn, <-chan api.StreamFrame) {
+	t.Helper()
+
+	sendKey := bytes.Repeat([]byte{1}, crypto.AEADKeySize)
+	recvKey := bytes.Repeat([]byte{2}, crypto.AEADKeySize)
+
+	frames := make(chan api.StreamFrame, 16)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ws, err := streamUpgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		conn := newStreamConn(ws, recvKey, sendKey)
+		for {
+			f, err := conn.readFrame()
+			if err != nil {
+				return
+			}
+			frames <- f
+		}
+	}))
+	t.Cleanup(server.Close)
+
+	ws, _, err := websocket.DefaultDialer.Dial(streamPrefix+strings.TrimPrefix(server.URL, httpPrefix), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ws.Close() })
+
+	return newStreamConn(ws, sendKey, recvKey), frames
+}
+
+func receiveFrame(t *testing.T, frames <-chan api.StreamFrame) api.StreamFrame {
+	t.Helper()
+
+	select {
+	case f := <-frames:
+		return f
+	case <-time.After(5 * time.Second):
+		t.Fatal("no frame was received")
+		return api.StreamFrame{}
+	}
+}
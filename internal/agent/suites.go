@@ -0,0 +1,53 @@
+package agent
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+
+	"github.com/sudeeya/key-exchange/internal/pkg/suite"
+)
+
+// FORWARD_SECRECY is a shorthand for the cipher suites without post-quantum
+// protection.
+const (
+	secrecyOff     = "off"
+	secrecyPrefer  = "prefer"
+	secrecyRequire = "require"
+)
+
+var secrecySuites = map[string][]string{
+	secrecyOff:     {suite.RSA},
+	secrecyPrefer:  {suite.X25519, suite.RSA},
+	secrecyRequire: {suite.X25519},
+}
+
+var errSuiteMismatch = errors.New("cipher suite in the session certificate differs from the one chosen")
+
+// cipherSuites returns the suites the agent offers and accepts, in order of
+// preference.
+func cipherSuites(cfg *config) ([]string, error) {
+	suites := cfg.CipherSuites
+	switch {
+	case len(suites) > 0 && cfg.ForwardSecrecy != "":
+		return nil, errors.New("set either CIPHER_SUITES or FORWARD_SECRECY, not both")
+	case len(suites) == 0 && cfg.ForwardSecrecy == "":
+		suites = secrecySuites[secrecyOff]
+	case len(suites) == 0:
+		var ok bool
+		suites, ok = secrecySuites[cfg.ForwardSecrecy]
+		if !ok {
+			return nil, fmt.Errorf("FORWARD_SECRECY must be %s, %s or %s, got %q",
+				secrecyOff, secrecyPrefer, secrecyRequire, cfg.ForwardSecrecy)
+		}
+	}
+
+	if err := suite.Check(suites); err != nil {
+		return nil, fmt.Errorf("CIPHER_SUITES: %w", err)
+	}
+	if slices.ContainsFunc(suites, suite.PostQuantum) && cfg.MLKEMPrivateKey == "" {
+		return nil, errors.New("MLKEM_PRIVATE_KEY is required for post-quantum cipher suites")
+	}
+
+	return suites, nil
+}
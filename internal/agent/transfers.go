@@ -0,0 +1,54 @@
+package agent
+
+import (
+	"sync"
+
+	"github.com/sudeeya/key-exchange/internal/pkg/api"
+)
+
+const (
+	outgoingTransfer = "outgoing"
+	incomingTransfer = "incoming"
+
+	transferActive    = "active"
+	transferCompleted = "completed"
+	transferFailed    = "failed"
+)
+
+// transfers records the progress of file transfers in both directions for
+// the TUI and the control API.
+type transfers struct {
+	mu    sync.RWMutex
+	order []string
+	infos map[string]api.TransferInfo
+}
+
+func newTransfers() *transfers {
+	return &transfers{
+		order: make([]string, 0),
+		infos: make(map[string]api.TransferInfo),
+	}
+}
+
+func (t *transfers) update(info api.TransferInfo) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	key := info.Direction + "/" + info.ID
+	if _, ok := t.infos[key]; !ok {
+		t.order = append(t.order, key)
+	}
+	t.infos[key] = info
+}
+
+func (t *transfers) list() []api.TransferInfo {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	infos := make([]api.TransferInfo, 0, len(t.order))
+	for _, key := range t.order {
+		infos = append(infos, t.infos[key])
+	}
+
+	return infos
+}
@@ -0,0 +1,718 @@
+package agent
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/charmbracelet/bubbles/key"
+	"github.com/charmbracelet/bubbles/spinner"
+	"github.com/charmbracelet/bubbles/textarea"
+	"github.com/charmbracelet/bubbles/textinput"
+	"github.com/charmbracelet/bubbles/viewport"
+	tea "github.com/charmbracelet/bubbletea"
+	lip "github.com/charmbracelet/lipgloss"
+
+	"github.com/sudeeya/key-exchange/internal/pkg/api"
+)
+
+const (
+	menuMode = iota
+	requestMode
+	conversationMode
+	protocolMode
+	consentMode
+	fileMode
+)
+
+const (
+	requestSessionKeyItem = iota
+	conversationsItem
+	protocolItem
+	sendFileItem
+)
+
+const (
+	progressWidth = 30
+	sidebarWidth  = 24
+	inputHeight   = 3
+
+	// Lines of the conversation view around the messages: the title, the
+	// input, the error and the help line.
+	conversationChrome = inputHeight + 8
+
+	defaultWidth  = 80
+	defaultHeight = 24
+)
+
+var _ tea.Model = (*Agent)(nil)
+
+var (
+	activeStyle   = lip.NewStyle().Foreground(lip.Color("255"))
+	inactiveStyle = lip.NewStyle().Foreground(lip.Color("240"))
+	errorStyle    = lip.NewStyle().Foreground(lip.Color("160"))
+	successStyle  = lip.NewStyle().Foreground(lip.Color("34"))
+	outgoingStyle = lip.NewStyle().Foreground(lip.Color("69"))
+	sidebarStyle  = lip.NewStyle().
+			Width(sidebarWidth).
+			PaddingLeft(1).
+			BorderStyle(lip.NormalBorder()).
+			BorderRight(true).
+			BorderForeground(lip.Color("240"))
+)
+
+type tui struct {
+	mode      int
+	items     []string
+	active    map[int]struct{}
+	cursor    int
+	input     textinput.Model
+	peers     []string
+	peer      string
+	unread    map[string]int
+	viewport  viewport.Model
+	textarea  textarea.Model
+	handshake *handshakeView
+	spinner   spinner.Model
+	requests  []api.SessionRequest
+	previous  int
+	width     int
+	height    int
+	err       string
+}
+
+func initialTUI(peers map[string]string) *tui {
+	ids := make([]string, 0, len(peers))
+	for id := range peers {
+		ids = append(ids, id)
+	}
+	slices.Sort(ids)
+
+	// The input takes the arrow keys, so the messages only scroll by page.
+	vp := viewport.New(0, 0)
+	vp.KeyMap = viewport.KeyMap{
+		PageDown: key.NewBinding(key.WithKeys("pgdown")),
+		PageUp:   key.NewBinding(key.WithKeys("pgup")),
+	}
+
+	ta := textarea.New()
+	ta.Placeholder = "Write a message"
+	ta.ShowLineNumbers = false
+	ta.CharLimit = 0
+	ta.SetHeight(inputHeight)
+	ta.KeyMap.InsertNewline = key.NewBinding(key.WithKeys("alt+enter", "ctrl+j"))
+
+	t := &tui{
+		mode: menuMode,
+		items: []string{
+			"Request session key",
+			"Conversations",
+			"Protocol visualizer",
+			"Send a file",
+		},
+		active: map[int]struct{}{
+			requestSessionKeyItem: {},
+			conversationsItem:     {},
+			protocolItem:          {},
+		},
+		cursor:   requestSessionKeyItem,
+		input:    textinput.New(),
+		peers:    ids,
+		peer:     "",
+		unread:   make(map[string]int),
+		viewport: vp,
+		textarea: ta,
+		spinner:  spinner.New(spinner.WithSpinner(spinner.Dot)),
+		width:    defaultWidth,
+		height:   defaultHeight,
+		err:      "",
+	}
+	t.resize()
+
+	return t
+}
+
+func (t *tui) resize() {
+	width := max(t.width-sidebarWidth-3, 20)
+	t.viewport.Width = width
+	t.viewport.Height = max(t.height-conversationChrome, 3)
+	t.textarea.SetWidth(width)
+}
+
+func (t *tui) totalUnread() int {
+	total := 0
+	for _, n := range t.unread {
+		total += n
+	}
+
+	return total
+}
+
+func (a Agent) Init() tea.Cmd {
+	return nil
+}
+
+func (a Agent) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
+	switch msg := msg.(type) {
+	case tea.WindowSizeMsg:
+		a.tui.width, a.tui.height = msg.Width, msg.Height
+		a.tui.resize()
+		a.refreshConversation(false)
+		return a, nil
+	case tea.KeyMsg:
+		switch msg.String() {
+		case "ctrl+c":
+			return a, tea.Quit
+		case "q":
+			switch a.tui.mode {
+			case menuMode:
+				return a, tea.Quit
+			}
+		case "esc":
+			switch a.tui.mode {
+			case requestMode, fileMode:
+				a.tui.mode = menuMode
+				a.tui.input.Reset()
+				a.tui.input.Blur()
+				return a, nil
+			case conversationMode:
+				a.tui.mode = menuMode
+				a.tui.input.Blur()
+				a.tui.textarea.Blur()
+				return a, nil
+			case protocolMode:
+				a.tui.mode = menuMode
+				a.tui.input.Blur()
+				return a, nil
+			case consentMode:
+				return a, a.leaveConsent()
+			}
+		case "y", "n":
+			switch a.tui.mode {
+			case consentMode:
+				if len(a.tui.requests) > 0 {
+					if err := a.AnswerRequest(a.tui.requests[0].ID, msg.String() == "y"); err != nil {
+						a.tui.err = err.Error()
+					}
+				}
+				return a, nil
+			}
+		case "r":
+			switch a.tui.mode {
+			case menuMode:
+				if len(a.tui.requests) > 0 {
+					a.tui.previous = menuMode
+					a.tui.mode = consentMode
+				}
+				return a, nil
+			}
+		case " ":
+			switch a.tui.mode {
+			case protocolMode:
+				a.stepper.next()
+				return a, nil
+			}
+		case "s":
+			switch a.tui.mode {
+			case protocolMode:
+				a.stepper.toggle()
+				return a, nil
+			}
+		case "up":
+			switch a.tui.mode {
+			case menuMode:
+				if a.tui.cursor > 0 {
+					a.tui.cursor--
+				}
+				return a, nil
+			}
+		case "down":
+			switch a.tui.mode {
+			case menuMode:
+				_, ok := a.tui.active[a.tui.cursor+1]
+				if a.tui.cursor < len(a.tui.items)-1 && ok {
+					a.tui.cursor++
+				}
+				return a, nil
+			}
+		case "tab", "shift+tab":
+			switch a.tui.mode {
+			case conversationMode:
+				if len(a.tui.peers) == 0 {
+					return a, nil
+				}
+				step := 1
+				if msg.String() == "shift+tab" {
+					step = len(a.tui.peers) - 1
+				}
+				i := slices.Index(a.tui.peers, a.tui.peer)
+				a.selectPeer(a.tui.peers[(i+step)%len(a.tui.peers)])
+				a.refreshConversation(true)
+				return a, nil
+			}
+		case "enter":
+			switch a.tui.mode {
+			case menuMode:
+				a.tui.input.Focus()
+				return a, selectItemCmd(a.tui)
+			case requestMode:
+				agentID := a.tui.input.Value()
+				a.tui.input.Reset()
+
+				if _, ok := a.peers[agentID]; !ok {
+					a.tui.input.Placeholder = "Agent with such ID does not exist. Try again"
+					return a, nil
+				}
+
+				a.tui.input.Blur()
+				a.tui.mode = protocolMode
+
+				return a, tea.Batch(requestSessionKeyCmd(&a, agentID), a.tui.spinner.Tick)
+			case conversationMode:
+				text := strings.TrimSpace(a.tui.textarea.Value())
+				if text == "" {
+					return a, nil
+				}
+				if _, ok := a.sessions.get(a.tui.peer); !ok {
+					a.tui.err = fmt.Sprintf("%s: %s", errNoSession, a.tui.peer)
+					return a, nil
+				}
+
+				a.tui.textarea.Reset()
+				a.tui.err = ""
+
+				return a, sendMessageCmd(&a, a.tui.peer, text)
+			case fileMode:
+				path := a.tui.input.Value()
+				a.tui.input.Reset()
+				a.tui.input.Blur()
+				a.tui.mode = menuMode
+
+				return a, sendFileCmd(&a, a.tui.peer, path)
+			}
+		}
+	case ModeChangedMsg:
+		a.tui.mode = int(msg)
+		if a.tui.mode == conversationMode {
+			peer := a.tui.peer
+			if peer == "" && len(a.tui.peers) > 0 {
+				peer = a.tui.peers[0]
+			}
+			a.selectPeer(peer)
+			a.refreshConversation(true)
+			return a, a.tui.textarea.Focus()
+		}
+		if a.tui.mode == protocolMode {
+			return a, a.tui.spinner.Tick
+		}
+	case EventMsg:
+		switch msg.Type {
+		case api.SessionEstablishedEvent:
+			if a.tui.mode != conversationMode {
+				a.tui.peer = msg.Session.Peer
+			}
+			if msg.Session.Peer == a.tui.peer {
+				a.tui.active[sendFileItem] = struct{}{}
+			}
+		case api.SessionClosedEvent:
+			if msg.Previous.Peer == a.tui.peer {
+				delete(a.tui.active, sendFileItem)
+			}
+		case api.ProtocolStepEvent:
+			if a.tui.handshake == nil || a.tui.handshake.id != msg.Step.Handshake {
+				a.tui.handshake = newHandshakeView(msg.Step)
+			}
+			a.tui.handshake.update(msg.Step)
+
+			// A message held in step mode waits for a keypress, so the
+			// visualizer is brought up unless the user is typing a command.
+			if msg.Step.Phase == stepWaiting && (a.tui.mode == menuMode || a.tui.mode == conversationMode) {
+				a.tui.mode = protocolMode
+				a.tui.textarea.Blur()
+				return a, a.tui.spinner.Tick
+			}
+		case api.SessionRequestedEvent:
+			a.tui.requests = append(a.tui.requests, *msg.Request)
+
+			switch a.tui.mode {
+			case menuMode, conversationMode, protocolMode:
+				a.tui.previous = a.tui.mode
+				a.tui.mode = consentMode
+				a.tui.textarea.Blur()
+			}
+		case api.RequestResolvedEvent:
+			a.tui.requests = slices.DeleteFunc(a.tui.requests, func(req api.SessionRequest) bool {
+				return req.ID == msg.Request.ID
+			})
+
+			if a.tui.mode == consentMode && len(a.tui.requests) == 0 {
+				return a, a.leaveConsent()
+			}
+		case api.MessageSentEvent:
+			if a.tui.mode == conversationMode && msg.Message.Peer == a.tui.peer {
+				a.refreshConversation(true)
+			}
+		case api.MessageReceivedEvent:
+			if a.tui.mode == conversationMode && msg.Message.Peer == a.tui.peer {
+				a.refreshConversation(false)
+			} else {
+				a.tui.unread[msg.Message.Peer]++
+			}
+		}
+	case ErrorMsg:
+		if error(msg) != nil {
+			a.tui.err = error(msg).Error()
+		}
+	}
+
+	switch a.tui.mode {
+	case requestMode, fileMode:
+		var cmd tea.Cmd
+		a.tui.input, cmd = a.tui.input.Update(msg)
+		return a, cmd
+	case conversationMode:
+		var cmds [2]tea.Cmd
+		a.tui.textarea, cmds[0] = a.tui.textarea.Update(msg)
+		a.tui.viewport, cmds[1] = a.tui.viewport.Update(msg)
+		return a, tea.Batch(cmds[:]...)
+	case protocolMode:
+		var cmd tea.Cmd
+		a.tui.spinner, cmd = a.tui.spinner.Update(msg)
+		return a, cmd
+	case menuMode:
+		return a, nil
+	}
+
+	return a, nil
+}
+
+// leaveConsent returns to the view that a session request interrupted.
+func (a *Agent) leaveConsent() tea.Cmd {
+	a.tui.mode = a.tui.previous
+	switch a.tui.mode {
+	case conversationMode:
+		return a.tui.textarea.Focus()
+	case protocolMode:
+		return a.tui.spinner.Tick
+	}
+
+	return nil
+}
+
+// selectPeer opens the conversation with peer and marks it as read.
+func (a *Agent) selectPeer(peer string) {
+	a.tui.peer = peer
+	delete(a.tui.unread, peer)
+
+	if _, ok := a.sessions.get(peer); ok {
+		a.tui.active[sendFileItem] = struct{}{}
+	} else {
+		delete(a.tui.active, sendFileItem)
+	}
+}
+
+// refreshConversation reloads the messages of the selected conversation. The
+// view keeps following new messages unless it was scrolled up.
+func (a *Agent) refreshConversation(bottom bool) {
+	follow := bottom || a.tui.viewport.AtBottom()
+	a.tui.viewport.SetContent(a.conversation())
+	if follow {
+		a.tui.viewport.GotoBottom()
+	}
+}
+
+func (a *Agent) conversation() string {
+	messages := a.mailbox.search(historyQuery{Peer: a.tui.peer})
+	if len(messages) == 0 {
+		return inactiveStyle.Render("No messages yet")
+	}
+
+	textStyle := lip.NewStyle().Width(a.tui.viewport.Width)
+
+	var s strings.Builder
+	for i, message := range messages {
+		if i > 0 {
+			s.WriteString("\n")
+		}
+
+		sender := activeStyle.Render(message.Peer)
+		if message.Direction == outgoingMessage {
+			sender = outgoingStyle.Render(a.cfg.ID)
+		}
+
+		s.WriteString(fmt.Sprintf("%s %s %s\n", sender, inactiveStyle.Render(messageTime(message.Time)), deliveryMark(message)))
+		s.WriteString(textStyle.Render(message.Text) + "\n")
+	}
+
+	return s.String()
+}
+
+func messageTime(t time.Time) string {
+	now := time.Now()
+	if t.YearDay() == now.YearDay() && t.Year() == now.Year() {
+		return t.Format(time.TimeOnly)
+	}
+
+	return t.Format(time.DateTime)
+}
+
+func deliveryMark(message api.MailboxMessage) string {
+	switch message.Status {
+	case messagePending:
+		return inactiveStyle.Render("…")
+	case messageDelivered:
+		return successStyle.Render("✓")
+	case messageFailed:
+		return errorStyle.Render("✗ not delivered")
+	}
+
+	return ""
+}
+
+func (a Agent) View() string {
+	var s strings.Builder
+	s.WriteString("\n")
+
+	switch a.tui.mode {
+	case menuMode:
+		for i, item := range a.tui.items {
+			cursor := " "
+			if a.tui.cursor == i {
+				cursor = ">"
+			}
+
+			style := inactiveStyle
+			if _, ok := a.tui.active[i]; ok {
+				style = activeStyle
+			}
+
+			switch {
+			case i == conversationsItem && a.tui.totalUnread() > 0:
+				s.WriteString(fmt.Sprintf(" %s [!] %s\n", activeStyle.Render(cursor), style.Render(item)))
+			default:
+				s.WriteString(fmt.Sprintf(" %s     %s\n", activeStyle.Render(cursor), style.Render(item)))
+			}
+
+		}
+
+		if a.tui.err != "" {
+			s.WriteString(errorStyle.Render(fmt.Sprintf("\n %s\n", a.tui.err)))
+		}
+
+		if _, ok := a.sessions.get(a.tui.peer); ok {
+			s.WriteString(inactiveStyle.Render(fmt.Sprintf("\n Session with %s established\n", a.tui.peer)))
+		}
+
+		if n := len(a.tui.requests); n > 0 {
+			s.WriteString(activeStyle.Render(fmt.Sprintf("\n %d session request(s) waiting, press r to answer", n)) + "\n")
+		}
+
+		if transfers := a.transfers.list(); len(transfers) > 0 {
+			s.WriteString("\n")
+			for _, t := range transfers {
+				s.WriteString(fmt.Sprintf(" %s %s\n", progressBar(t), activeStyle.Render(transferLabel(t))))
+			}
+		}
+
+		s.WriteString(inactiveStyle.Render("\n Press q to quit\n"))
+	case requestMode, fileMode:
+		s.WriteString(" " + a.tui.input.View() + "\n")
+
+		s.WriteString(inactiveStyle.Render("\n Press esc to return to the menu\n"))
+	case conversationMode:
+		s.WriteString(activeStyle.Render(" Conversation with "+a.tui.peer) + "\n\n")
+
+		chat := lip.JoinVertical(lip.Left, a.tui.viewport.View(), "", a.tui.textarea.View())
+		s.WriteString(lip.JoinHorizontal(lip.Top, a.sidebar(), " ", chat) + "\n")
+
+		if a.tui.err != "" {
+			s.WriteString(errorStyle.Render(fmt.Sprintf("\n %s\n", a.tui.err)))
+		}
+
+		s.WriteString(inactiveStyle.Render("\n tab: next peer • enter: send • alt+enter: new line • pgup/pgdown: scroll • esc: menu\n"))
+	case protocolMode:
+		stepMode := "off"
+		if a.stepper.enabled.Load() {
+			stepMode = "on"
+		}
+
+		h := a.tui.handshake
+		if h == nil {
+			s.WriteString(activeStyle.Render(" Wu-Lam handshake") + inactiveStyle.Render("  step mode "+stepMode) + "\n\n")
+			s.WriteString(inactiveStyle.Render(" No handshake yet. Request a session key to start one.\n"))
+		} else {
+			title := fmt.Sprintf(" Wu-Lam handshake: %s → %s (%s)", h.initiator, h.acceptor, h.role)
+			s.WriteString(activeStyle.Render(title) + inactiveStyle.Render("  step mode "+stepMode) + "\n\n")
+			s.WriteString(h.render(a.tui.spinner.View(), a.tui.width))
+
+			if h.established {
+				s.WriteString(successStyle.Render("\n Session established") + "\n")
+			}
+		}
+
+		if a.tui.err != "" {
+			s.WriteString(errorStyle.Render(fmt.Sprintf("\n %s\n", a.tui.err)))
+		}
+
+		s.WriteString(inactiveStyle.Render("\n space: send the next message • s: toggle step mode • esc: menu\n"))
+	case consentMode:
+		if len(a.tui.requests) == 0 {
+			s.WriteString(inactiveStyle.Render(" No session requests\n"))
+			s.WriteString(inactiveStyle.Render("\n esc: back\n"))
+			break
+		}
+
+		req := a.tui.requests[0]
+		s.WriteString(activeStyle.Render(" Incoming session request") + "\n\n")
+		s.WriteString(fmt.Sprintf(" %s wants to establish a session with you.\n\n", activeStyle.Render(req.Initiator)))
+		fingerprint := req.Fingerprint
+		if fingerprint == "" {
+			fingerprint = "no earlier session, Trent is asked once you accept"
+		}
+		s.WriteString(fmt.Sprintf(" %s %s\n", inactiveStyle.Render("Key fingerprint"), fingerprint))
+		s.WriteString(fmt.Sprintf(" %s %s\n", inactiveStyle.Render("Received       "), req.Received.Format(time.TimeOnly)))
+		s.WriteString(fmt.Sprintf(" %s %s\n", inactiveStyle.Render("Expires        "), req.Expires.Format(time.TimeOnly)))
+
+		if n := len(a.tui.requests) - 1; n > 0 {
+			s.WriteString(inactiveStyle.Render(fmt.Sprintf("\n %d more request(s) waiting\n", n)))
+		}
+
+		if a.tui.err != "" {
+			s.WriteString(errorStyle.Render(fmt.Sprintf("\n %s\n", a.tui.err)))
+		}
+
+		s.WriteString(inactiveStyle.Render("\n y: accept • n: reject • esc: decide later\n"))
+	}
+
+	return s.String()
+}
+
+// sidebar lists the peers with their session state and unread messages.
+func (a Agent) sidebar() string {
+	var s strings.Builder
+	for i, peer := range a.tui.peers {
+		if i > 0 {
+			s.WriteString("\n")
+		}
+
+		cursor := " "
+		style := inactiveStyle
+		if peer == a.tui.peer {
+			cursor = ">"
+			style = activeStyle
+		}
+
+		state := inactiveStyle.Render("○")
+		if _, ok := a.sessions.get(peer); ok {
+			state = successStyle.Render("●")
+		}
+
+		label := peer
+		if n := a.tui.unread[peer]; n > 0 {
+			label += fmt.Sprintf(" (%d)", n)
+		}
+
+		s.WriteString(fmt.Sprintf("%s %s %s", activeStyle.Render(cursor), state, style.Render(label)))
+	}
+
+	return sidebarStyle.Height(a.tui.viewport.Height + inputHeight + 1).Render(s.String())
+}
+
+func progressBar(t api.TransferInfo) string {
+	filled := progressWidth
+	if t.Size > 0 {
+		filled = int(t.Transferred * progressWidth / t.Size)
+	}
+
+	style := activeStyle
+	switch t.Status {
+	case transferCompleted:
+		style = successStyle
+	case transferFailed:
+		style = errorStyle
+	}
+
+	return style.Render(strings.Repeat("█", filled)) + inactiveStyle.Render(strings.Repeat("░", progressWidth-filled))
+}
+
+func transferLabel(t api.TransferInfo) string {
+	arrow := "->"
+	if t.Direction == incomingTransfer {
+		arrow = "<-"
+	}
+
+	label := fmt.Sprintf("%s %s %s", arrow, t.Peer, t.Name)
+	if t.Status == transferFailed {
+		label += ": " + t.Error
+	}
+
+	return label
+}
+
+// Cmd
+
+func selectItemCmd(tui *tui) tea.Cmd {
+	return func() tea.Msg {
+		tui.err = ""
+
+		switch tui.cursor {
+		case requestSessionKeyItem:
+			tui.input.Placeholder = "Enter agent ID"
+			return ModeChangedMsg(requestMode)
+		case conversationsItem:
+			return ModeChangedMsg(conversationMode)
+		case protocolItem:
+			return ModeChangedMsg(protocolMode)
+		case sendFileItem:
+			tui.input.Placeholder = "Enter the path to a file"
+			return ModeChangedMsg(fileMode)
+		}
+
+		return ModeChangedMsg(menuMode)
+	}
+}
+
+func requestSessionKeyCmd(a *Agent, acceptor string) tea.Cmd {
+	return func() tea.Msg {
+		_, err := a.OpenSession(context.Background(), acceptor)
+		return ErrorMsg(err)
+	}
+}
+
+func sendMessageCmd(a *Agent, peer, msg string) tea.Cmd {
+	return func() tea.Msg {
+		if msg == "" {
+			return ErrorMsg(nil)
+		}
+
+		return ErrorMsg(a.SendMessage(context.Background(), peer, msg))
+	}
+}
+
+func sendFileCmd(a *Agent, peer, path string) tea.Cmd {
+	return func() tea.Msg {
+		if path == "" {
+			return ErrorMsg(nil)
+		}
+
+		_, err := a.SendFile(peer, path)
+		return ErrorMsg(err)
+	}
+}
+
+// forwardEvents delivers agent events to the TUI until the subscription is closed.
+func forwardEvents(prog *tea.Program, events <-chan api.Event) {
+	for event := range events {
+		prog.Send(EventMsg(event))
+	}
+}
+
+// Msg
+
+type ModeChangedMsg int
+
+type ErrorMsg error
+
+type EventMsg api.Event
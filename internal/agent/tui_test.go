@@ -0,0 +1,194 @@
+package agent
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	tea "github.com/charmbracelet/bubbletea"
+
+	"github.com/sudeeya/key-exchange/internal/pkg/api"
+)
+
+func TestConversationView(t *testing.T) {
+	open := ModeChangedMsg(conversationMode)
+	tab := tea.KeyMsg{Type: tea.KeyTab}
+	enter := tea.KeyMsg{Type: tea.KeyEnter}
+
+	tests := []struct {
+		name string
+		// setup runs before the messages are sent to an agent alice, with
+		// the peers bob, carol and dave and a session with carol.
+		setup func(t *testing.T, a *Agent)
+		msgs  []tea.Msg
+		check func(t *testing.T, a *Agent, cmd tea.Cmd)
+	}{
+		{
+			name: "opens the first peer",
+			msgs: []tea.Msg{open},
+			check: func(t *testing.T, a *Agent, _ tea.Cmd) {
+				if a.tui.peer != "bob" || !a.tui.textarea.Focused() {
+					t.Fatalf("conversation with %q opened, want bob with the input focused", a.tui.peer)
+				}
+				if _, ok := a.tui.active[sendFileItem]; ok {
+					t.Fatal("files can be sent to bob without a session")
+				}
+			},
+		},
+		{
+			name: "tab wraps around the peers",
+			msgs: []tea.Msg{open, tab, tab, tab, tea.KeyMsg{Type: tea.KeyShiftTab}},
+			check: func(t *testing.T, a *Agent, _ tea.Cmd) {
+				if a.tui.peer != "dave" {
+					t.Fatalf("conversation with %q selected, want dave", a.tui.peer)
+				}
+			},
+		},
+		{
+			name: "unread until selected",
+			msgs: []tea.Msg{open},
+			check: func(t *testing.T, a *Agent, _ tea.Cmd) {
+				update(a, receivedEvent(t, a, "carol", "hello"))
+				if n := a.tui.unread["carol"]; n != 1 {
+					t.Fatalf("%d unread messages from carol, want 1", n)
+				}
+				if !strings.Contains(a.sidebar(), "carol (1)") {
+					t.Fatalf("sidebar does not show the unread message:\n%s", a.sidebar())
+				}
+
+				update(a, tab)
+				if n := a.tui.unread["carol"]; n != 0 {
+					t.Fatalf("%d unread messages from carol after selecting the conversation", n)
+				}
+				if !strings.Contains(a.conversation(), "hello") {
+					t.Fatalf("conversation does not show the message:\n%s", a.conversation())
+				}
+			},
+		},
+		{
+			name: "message without a session refused",
+			msgs: []tea.Msg{open, typed("hi"), enter},
+			check: func(t *testing.T, a *Agent, cmd tea.Cmd) {
+				if cmd != nil || !strings.Contains(a.tui.err, errNoSession.Error()) {
+					t.Fatalf("message to bob was not refused: %q", a.tui.err)
+				}
+				if got := a.tui.textarea.Value(); got != "hi" {
+					t.Fatalf("input holds %q after the refusal, want the message kept", got)
+				}
+			},
+		},
+		{
+			name: "blank message ignored",
+			msgs: []tea.Msg{open, tab, typed("  "), enter},
+			check: func(t *testing.T, a *Agent, cmd tea.Cmd) {
+				if cmd != nil || a.tui.err != "" {
+					t.Fatalf("blank message was handled: %q", a.tui.err)
+				}
+			},
+		},
+		{
+			name: "message sent over the session",
+			msgs: []tea.Msg{open, tab, typed("hi"), enter},
+			check: func(t *testing.T, a *Agent, cmd tea.Cmd) {
+				if cmd == nil || a.tui.err != "" {
+					t.Fatalf("message to carol was not sent: %q", a.tui.err)
+				}
+				if got := a.tui.textarea.Value(); got != "" {
+					t.Fatalf("input holds %q after sending", got)
+				}
+			},
+		},
+		{
+			name: "scrolled up view stays",
+			setup: func(t *testing.T, a *Agent) {
+				for i := range 50 {
+					addMessage(t, a, "bob", fmt.Sprintf("message %d", i))
+				}
+			},
+			msgs: []tea.Msg{open},
+			check: func(t *testing.T, a *Agent, _ tea.Cmd) {
+				if !a.tui.viewport.AtBottom() {
+					t.Fatal("conversation did not open at the latest message")
+				}
+
+				update(a, tea.KeyMsg{Type: tea.KeyPgUp})
+				update(a, receivedEvent(t, a, "bob", "new"))
+				if a.tui.viewport.AtBottom() {
+					t.Fatal("received message scrolled the view to the bottom")
+				}
+
+				message := addMessage(t, a, "bob", "sent")
+				update(a, EventMsg{Type: api.MessageSentEvent, Message: &message})
+				if !a.tui.viewport.AtBottom() {
+					t.Fatal("sent message did not scroll the view to the bottom")
+				}
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := newTestTUIAgent(t)
+			if tt.setup != nil {
+				tt.setup(t, a)
+			}
+
+			var cmd tea.Cmd
+			for _, msg := range tt.msgs {
+				cmd = update(a, msg)
+			}
+			tt.check(t, a, cmd)
+		})
+	}
+}
+
+func newTestTUIAgent(t *testing.T) *Agent {
+	t.Helper()
+
+	cfg := &config{ID: "alice"}
+	m, err := newMailbox(cfg, nil, newTestRNG(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	peers := map[string]string{"bob": "", "carol": "", "dave": ""}
+
+	a := &Agent{
+		cfg:      cfg,
+		tui:      initialTUI(peers),
+		peers:    peers,
+		sessions: newSessionTable(),
+		mailbox:  m,
+	}
+	a.sessions.put(&session{peer: "carol"})
+
+	return a
+}
+
+func update(a *Agent, msg tea.Msg) tea.Cmd {
+	model, cmd := a.Update(msg)
+	*a = model.(Agent)
+
+	return cmd
+}
+
+func typed(text string) tea.KeyMsg {
+	return tea.KeyMsg{Type: tea.KeyRunes, Runes: []rune(text)}
+}
+
+func addMessage(t *testing.T, a *Agent, peer, text string) api.MailboxMessage {
+	t.Helper()
+
+	message, err := a.mailbox.add(api.MailboxMessage{Peer: peer, Direction: incomingMessage, Text: text})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return message
+}
+
+func receivedEvent(t *testing.T, a *Agent, peer, text string) EventMsg {
+	t.Helper()
+
+	message := addMessage(t, a, peer, text)
+	return EventMsg{Type: api.MessageReceivedEvent, Message: &message}
+}
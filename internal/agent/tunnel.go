@@ -0,0 +1,398 @@
+package agent
+
+import (
+	"bufio"
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/sudeeya/key-exchange/internal/pkg/api"
+	"github.com/sudeeya/key-exchange/internal/pkg/metrics"
+	"github.com/sudeeya/key-exchange/internal/pkg/tunnel"
+)
+
+const (
+	tunnelChannel     = "tunnel"
+	tunnelDialTimeout = 10 * time.Second
+)
+
+// forward is a local port whose connections are carried to a service
+// exposed by a peer.
+type forward struct {
+	listenAddr string
+	peer       string
+	service    string
+}
+
+type tunnelConn struct {
+	mux       *tunnel.Mux
+	peer      string
+	sessionID string
+}
+
+// tunnels keeps at most one outgoing tunnel per peer and every tunnel
+// accepted from peers, so that they can be torn down when the session they
+// were keyed from goes away.
+type tunnels struct {
+	forwards  []forward
+	services  map[string]string
+	listeners []net.Listener
+
+	mu       sync.Mutex
+	outgoing map[string]*tunnelConn
+	incoming map[*tunnelConn]struct{}
+}
+
+func newTunnels(cfg *config, peers map[string]string) (*tunnels, error) {
+	if len(cfg.TunnelListenAddrs) != len(cfg.TunnelPeers) || len(cfg.TunnelListenAddrs) != len(cfg.TunnelServices) {
+		return nil, fmt.Errorf("got %d tunnel listen addresses, %d tunnel peers and %d tunnel services",
+			len(cfg.TunnelListenAddrs), len(cfg.TunnelPeers), len(cfg.TunnelServices))
+	}
+	if len(cfg.TunnelServiceNames) != len(cfg.TunnelServiceAddrs) {
+		return nil, fmt.Errorf("got %d tunnel service names but %d tunnel service addresses",
+			len(cfg.TunnelServiceNames), len(cfg.TunnelServiceAddrs))
+	}
+
+	forwards := make([]forward, 0, len(cfg.TunnelListenAddrs))
+	for i, addr := range cfg.TunnelListenAddrs {
+		if _, ok := peers[cfg.TunnelPeers[i]]; !ok {
+			return nil, fmt.Errorf("%w: %s", errUnknownPeer, cfg.TunnelPeers[i])
+		}
+		forwards = append(forwards, forward{
+			listenAddr: addr,
+			peer:       cfg.TunnelPeers[i],
+			service:    cfg.TunnelServices[i],
+		})
+	}
+
+	services := make(map[string]string, len(cfg.TunnelServiceNames))
+	for i, name := range cfg.TunnelServiceNames {
+		services[name] = cfg.TunnelServiceAddrs[i]
+	}
+
+	return &tunnels{
+		forwards: forwards,
+		services: services,
+		outgoing: make(map[string]*tunnelConn),
+		incoming: make(map[*tunnelConn]struct{}),
+	}, nil
+}
+
+func (t *tunnels) addIncoming(tc *tunnelConn) {
+	t.mu.Lock()
+	t.incoming[tc] = struct{}{}
+	t.mu.Unlock()
+
+	go func() {
+		<-tc.mux.Done()
+
+		t.mu.Lock()
+		defer t.mu.Unlock()
+
+		delete(t.incoming, tc)
+	}()
+}
+
+// closePeer closes every tunnel with peer that was not keyed from the
+// session sessionID.
+func (t *tunnels) closePeer(peer, sessionID string) {
+	t.mu.Lock()
+	var stale []*tunnelConn
+	if tc, ok := t.outgoing[peer]; ok && tc.sessionID != sessionID {
+		stale = append(stale, tc)
+		delete(t.outgoing, peer)
+	}
+	for tc := range t.incoming {
+		if tc.peer == peer && tc.sessionID != sessionID {
+			stale = append(stale, tc)
+		}
+	}
+	t.mu.Unlock()
+
+	for _, tc := range stale {
+		tc.mux.Close()
+	}
+}
+
+func (t *tunnels) close() {
+	for _, listener := range t.listeners {
+		listener.Close()
+	}
+
+	t.mu.Lock()
+	conns := make([]*tunnelConn, 0, len(t.outgoing)+len(t.incoming))
+	for _, tc := range t.outgoing {
+		conns = append(conns, tc)
+	}
+	for tc := range t.incoming {
+		conns = append(conns, tc)
+	}
+	t.mu.Unlock()
+
+	for _, tc := range conns {
+		tc.mux.Close()
+	}
+}
+
+func (t *tunnels) streams() []metrics.Sample {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	active := make(map[string]int)
+	for peer, tc := range t.outgoing {
+		active[peer] += tc.mux.Streams()
+	}
+	for tc := range t.incoming {
+		active[tc.peer] += tc.mux.Streams()
+	}
+
+	samples := make([]metrics.Sample, 0, len(active))
+	for peer, n := range active {
+		samples = append(samples, metrics.Sample{
+			LabelValues: []string{peer},
+			Value:       float64(n),
+		})
+	}
+
+	return samples
+}
+
+// listenForwards opens the local ports of all configured forwards.
+func (a *Agent) listenForwards() error {
+	for _, f := range a.tunnels.forwards {
+		listener, err := net.Listen("tcp", f.listenAddr)
+		if err != nil {
+			return err
+		}
+		a.tunnels.listeners = append(a.tunnels.listeners, listener)
+
+		go a.serveForward(listener, f)
+	}
+
+	return nil
+}
+
+func (a *Agent) serveForward(listener net.Listener, f forward) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+
+		go a.forwardConn(conn, f)
+	}
+}
+
+func (a *Agent) forwardConn(conn net.Conn, f forward) {
+	tc, err := a.tunnelTo(context.Background(), f.peer)
+	if err != nil {
+		a.logger.Error("Failed to open tunnel", zap.String("peer", f.peer), zap.Error(err))
+		conn.Close()
+		return
+	}
+
+	stream, err := tc.mux.Open(f.service)
+	if err != nil {
+		a.logger.Error("Failed to open tunnel stream", zap.String("peer", f.peer), zap.Error(err))
+		conn.Close()
+		return
+	}
+
+	a.relay(stream, conn, f.peer, initiatorRole)
+}
+
+func (a *Agent) relay(stream *tunnel.Stream, conn net.Conn, peer, role string) {
+	a.metrics.tunnelStreams.Inc(peer, role)
+	sent, received := tunnel.Relay(stream, conn)
+	a.metrics.tunnelBytes.Add(float64(sent), peer, "sent")
+	a.metrics.tunnelBytes.Add(float64(received), peer, "received")
+}
+
+// tunnelTo returns the tunnel to peer, dialing a new one keyed from the
+// current session if there is none yet.
+func (a *Agent) tunnelTo(ctx context.Context, peer string) (*tunnelConn, error) {
+	a.tunnels.mu.Lock()
+	defer a.tunnels.mu.Unlock()
+
+	if tc, ok := a.tunnels.outgoing[peer]; ok && tc.mux.Err() == nil {
+		return tc, nil
+	}
+
+	s, ok := a.sessions.get(peer)
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", errNoSession, peer)
+	}
+
+	ctx, span := a.tracer.Start(ctx, "open tunnel")
+	defer span.End()
+	span.SetAttribute("peer", peer)
+	span.SetAttribute("session_id", s.id)
+
+	clientNonce, err := a.rng.GenerateNonce()
+	if err != nil {
+		span.RecordError(err)
+		return nil, err
+	}
+
+	resp, err := a.transferClient.R().
+		SetContext(ctx).
+		SetDoNotParseResponse(true).
+		SetHeader("Connection", "Upgrade").
+		SetHeader("Upgrade", api.TunnelProtocol).
+		SetHeader(api.SenderHeader, a.cfg.ID).
+		SetHeader(api.NonceHeader, hex.EncodeToString(clientNonce)).
+		Get(httpPrefix + a.peers[peer] + api.TunnelEndpoint)
+	if err != nil {
+		span.RecordError(err)
+		return nil, err
+	}
+	body := resp.RawBody()
+	if resp.StatusCode() != http.StatusSwitchingProtocols {
+		text, _ := io.ReadAll(body)
+		body.Close()
+		err := fmt.Errorf("tunnel status code is %d: %s", resp.StatusCode(), strings.TrimSpace(string(text)))
+		span.RecordError(err)
+		return nil, err
+	}
+	conn, ok := body.(io.ReadWriteCloser)
+	if !ok {
+		body.Close()
+		return nil, errors.New("tunnel connection is not writable")
+	}
+
+	serverNonce, err := decodeNonce(resp.Header().Get(api.NonceHeader))
+	if err != nil {
+		conn.Close()
+		span.RecordError(err)
+		return nil, err
+	}
+	clientKey, serverKey, err := channelKeys(s.keys.Exporter, tunnelChannel, clientNonce, serverNonce, tunnel.KeySize)
+	if err != nil {
+		conn.Close()
+		span.RecordError(err)
+		return nil, err
+	}
+
+	mux, err := tunnel.NewMux(conn, clientKey, serverKey, nil)
+	if err != nil {
+		conn.Close()
+		span.RecordError(err)
+		return nil, err
+	}
+
+	tc := &tunnelConn{
+		mux:       mux,
+		peer:      peer,
+		sessionID: s.id,
+	}
+	a.tunnels.outgoing[peer] = tc
+
+	a.logger.Info("Tunnel opened", zap.String("peer", peer), zap.String("session_id", s.id))
+
+	return tc, nil
+}
+
+// tunnelHandler accepts a tunnel from a peer by taking over the HTTP
+// connection once the upgrade has been agreed.
+func tunnelHandler(a *Agent) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Upgrade") != api.TunnelProtocol {
+			http.Error(w, "unsupported upgrade protocol", http.StatusBadRequest)
+			return
+		}
+
+		peer := r.Header.Get(api.SenderHeader)
+		s, ok := a.sessions.get(peer)
+		if !ok {
+			http.Error(w, errNoSession.Error(), http.StatusBadRequest)
+			return
+		}
+
+		clientNonce, err := decodeNonce(r.Header.Get(api.NonceHeader))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		serverNonce, err := a.rng.GenerateNonce()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		clientKey, serverKey, err := channelKeys(s.keys.Exporter, tunnelChannel, clientNonce, serverNonce, tunnel.KeySize)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		netConn, brw, err := http.NewResponseController(w).Hijack()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		// The tunnel outlives the request, so the server's timeouts must
+		// not close it.
+		netConn.SetDeadline(time.Time{})
+
+		fmt.Fprintf(brw, "HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: %s\r\n%s: %s\r\n\r\n",
+			api.TunnelProtocol, api.NonceHeader, hex.EncodeToString(serverNonce))
+		if err := brw.Flush(); err != nil {
+			netConn.Close()
+			return
+		}
+
+		conn := &hijackedConn{Reader: brw.Reader, Conn: netConn}
+		mux, err := tunnel.NewMux(conn, serverKey, clientKey, a.acceptTunnelStream(peer))
+		if err != nil {
+			netConn.Close()
+			return
+		}
+
+		a.tunnels.addIncoming(&tunnelConn{
+			mux:       mux,
+			peer:      peer,
+			sessionID: s.id,
+		})
+
+		a.logger.Info("Tunnel accepted", zap.String("peer", peer), zap.String("session_id", s.id))
+	}
+}
+
+func (a *Agent) acceptTunnelStream(peer string) tunnel.AcceptFunc {
+	return func(stream *tunnel.Stream, service string) {
+		addr, ok := a.tunnels.services[service]
+		if !ok {
+			a.logger.Error("Unknown tunnel service", zap.String("peer", peer), zap.String("service", service))
+			stream.Close()
+			return
+		}
+
+		conn, err := net.DialTimeout("tcp", addr, tunnelDialTimeout)
+		if err != nil {
+			a.logger.Error("Failed to reach tunnel service", zap.String("service", service), zap.Error(err))
+			stream.Close()
+			return
+		}
+
+		a.relay(stream, conn, peer, acceptorRole)
+	}
+}
+
+// hijackedConn reads through the buffered reader left over from the HTTP
+// server, in case the peer sent tunnel data right after its request.
+type hijackedConn struct {
+	*bufio.Reader
+	net.Conn
+}
+
+func (c *hijackedConn) Read(p []byte) (int, error) {
+	return c.Reader.Read(p)
+}
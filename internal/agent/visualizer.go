@@ -0,0 +1,292 @@
+package agent
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	lip "github.com/charmbracelet/lipgloss"
+
+	"github.com/sudeeya/key-exchange/internal/pkg/api"
+	"github.com/sudeeya/key-exchange/internal/pkg/tracing"
+)
+
+const (
+	stepWaiting     = "waiting"
+	stepSent        = "sent"
+	stepReceived    = "received"
+	stepChecked     = "checked"
+	stepFailed      = "failed"
+	stepEstablished = "established"
+)
+
+const (
+	initiatorParty = iota
+	acceptorParty
+	trentParty
+)
+
+// protocolStepInfo describes a Wu-Lam message for the visualizer. {A} and {B}
+// in message and detail stand for the initiator and acceptor IDs.
+type protocolStepInfo struct {
+	from    int
+	to      int
+	message string
+	detail  string
+}
+
+var protocolSteps = [...]protocolStepInfo{
+	1: {initiatorParty, trentParty, "{A}, {B}",
+		"sent in the clear: who wants to talk to whom"},
+	2: {trentParty, initiatorParty, "Sig_T({B}, K_{B})",
+		"{B}'s public key, signed by Trent"},
+	3: {initiatorParty, acceptorParty, "E_K_{B}({A}, N_A)",
+		"initiator nonce N_A, encrypted under {B}'s public key (RSA)"},
+	4: {acceptorParty, trentParty, "{A}, {B}, E_K_T(N_A)",
+		"N_A, encrypted again under Trent's public key (RSA)"},
+	5: {trentParty, acceptorParty, "Sig_T({A}, K_{A}), E_K_{B}(Sig_T({A}, {B}, K, N_A, sid))",
+		"{A}'s public key and the session certificate with key K, signed by Trent; the certificate is encrypted under {B}'s public key (RSA)"},
+	6: {acceptorParty, initiatorParty, "E_K_{A}(Sig_T({A}, {B}, K, N_A, sid), N_B)",
+		"session certificate and acceptor nonce N_B, encrypted under {A}'s public key (RSA)"},
+	7: {initiatorParty, acceptorParty, "E_K(N_B), MAC_K(transcript)",
+		"N_B, encrypted under the session key K (AES), and {A}'s confirmation that it holds K and saw the same messages"},
+	8: {acceptorParty, initiatorParty, "MAC_K(transcript)",
+		"{B}'s confirmation that it holds K and saw the same messages, including {A}'s confirmation"},
+}
+
+// stepper holds outgoing handshake messages until the user lets them go,
+// one keypress per message, while step mode is on.
+type stepper struct {
+	enabled atomic.Bool
+
+	mu      sync.Mutex
+	waiting []chan struct{}
+}
+
+func newStepper() *stepper {
+	return &stepper{
+		waiting: make([]chan struct{}, 0),
+	}
+}
+
+// wait blocks until next is called or step mode is turned off.
+func (s *stepper) wait(ctx context.Context) error {
+	if !s.enabled.Load() {
+		return nil
+	}
+
+	ch := make(chan struct{})
+	s.mu.Lock()
+	s.waiting = append(s.waiting, ch)
+	s.mu.Unlock()
+
+	select {
+	case <-ch:
+		return nil
+	case <-ctx.Done():
+		s.mu.Lock()
+		if i := slices.Index(s.waiting, ch); i >= 0 {
+			s.waiting = slices.Delete(s.waiting, i, i+1)
+		}
+		s.mu.Unlock()
+		return ctx.Err()
+	}
+}
+
+// next releases the message that has been waiting the longest.
+func (s *stepper) next() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if len(s.waiting) > 0 {
+		close(s.waiting[0])
+		s.waiting = s.waiting[1:]
+	}
+}
+
+// toggle switches step mode and returns whether it is now on. Turning it off
+// releases every waiting message.
+func (s *stepper) toggle() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	enabled := !s.enabled.Load()
+	s.enabled.Store(enabled)
+	if !enabled {
+		for _, ch := range s.waiting {
+			close(ch)
+		}
+		s.waiting = s.waiting[:0]
+	}
+
+	return enabled
+}
+
+// publishStep reports the progress of the handshake in ctx with peer.
+func (a *Agent) publishStep(ctx context.Context, role, peer string, step int, phase, check string, ok bool) {
+	initiator, acceptor := a.cfg.ID, peer
+	if role == acceptorRole {
+		initiator, acceptor = peer, a.cfg.ID
+	}
+
+	a.events.publish(api.Event{
+		Type: api.ProtocolStepEvent,
+		Step: &api.ProtocolStep{
+			Handshake: tracing.SpanFromContext(ctx).Context().TraceID.String(),
+			Initiator: initiator,
+			Acceptor:  acceptor,
+			Role:      role,
+			Step:      step,
+			Phase:     phase,
+			Check:     check,
+			OK:        ok,
+		},
+	})
+}
+
+// sendStep is called before a handshake message is sent. In step mode it
+// waits for the user first.
+func (a *Agent) sendStep(ctx context.Context, role, peer string, step int) error {
+	if a.stepper.enabled.Load() {
+		a.publishStep(ctx, role, peer, step, stepWaiting, "", false)
+		if err := a.stepper.wait(ctx); err != nil {
+			return err
+		}
+	}
+	a.publishStep(ctx, role, peer, step, stepSent, "", false)
+
+	return nil
+}
+
+// checkStep reports a verification made at step and returns its result.
+func (a *Agent) checkStep(ctx context.Context, role, peer string, step int, check string, ok bool) bool {
+	a.publishStep(ctx, role, peer, step, stepChecked, check, ok)
+	return ok
+}
+
+func describeStep(step int, initiator, acceptor string) (from, to, message, detail string) {
+	info := protocolSteps[step]
+	parties := [...]string{
+		initiatorParty: initiator,
+		acceptorParty:  acceptor,
+		trentParty:     "Trent",
+	}
+
+	names := strings.NewReplacer("{A}", initiator, "{B}", acceptor)
+
+	return parties[info.from], parties[info.to], names.Replace(info.message), names.Replace(info.detail)
+}
+
+// handshakeView is the TUI's picture of the latest handshake this agent took
+// part in.
+type handshakeView struct {
+	id          string
+	initiator   string
+	acceptor    string
+	role        string
+	phases      [len(protocolSteps)]string
+	checks      [len(protocolSteps)][]*api.ProtocolStep
+	failure     string
+	established bool
+}
+
+func newHandshakeView(step *api.ProtocolStep) *handshakeView {
+	return &handshakeView{
+		id:        step.Handshake,
+		initiator: step.Initiator,
+		acceptor:  step.Acceptor,
+		role:      step.Role,
+	}
+}
+
+func (h *handshakeView) update(step *api.ProtocolStep) {
+	switch step.Phase {
+	case stepChecked:
+		h.checks[step.Step] = append(h.checks[step.Step], step)
+	case stepFailed:
+		h.phases[step.Step] = stepFailed
+		h.failure = step.Check
+	case stepEstablished:
+		h.established = true
+	default:
+		h.phases[step.Step] = step.Phase
+	}
+}
+
+// last returns the latest step this agent has seen.
+func (h *handshakeView) last() int {
+	for step := len(h.phases) - 1; step > 0; step-- {
+		if h.phases[step] != "" {
+			return step
+		}
+	}
+
+	return 0
+}
+
+func (h *handshakeView) render(spinner string, width int) string {
+	var s strings.Builder
+	indent := strings.Repeat(" ", 4)
+	textStyle := lip.NewStyle().Width(max(width-len(indent)-1, 20))
+
+	last := h.last()
+	for step := 1; step < len(protocolSteps); step++ {
+		from, to, message, detail := describeStep(step, h.initiator, h.acceptor)
+
+		style := activeStyle
+		var status string
+		switch phase := h.phases[step]; {
+		case phase == stepFailed:
+			status = errorStyle.Render("✗ " + h.failure)
+		case phase == stepWaiting:
+			status = activeStyle.Render("⏸ press space to send")
+		case phase == stepSent && step == last && !h.established:
+			status = activeStyle.Render(spinner + " in flight")
+		case phase == stepSent:
+			status = successStyle.Render("✓ sent")
+		case phase == stepReceived:
+			status = successStyle.Render("✓ received")
+		case step < last:
+			style = inactiveStyle
+			status = inactiveStyle.Render("· not seen by " + h.self())
+		default:
+			style = inactiveStyle
+		}
+
+		s.WriteString(fmt.Sprintf(" %d  %s  %s\n", step, style.Render(fmt.Sprintf("%-16s", from+" → "+to)), status))
+		s.WriteString(indentLines(style.Inherit(textStyle).Render(message), indent))
+		// Only the latest message is explained, to keep the steps on one screen.
+		if step == max(last, 1) {
+			s.WriteString(indentLines(inactiveStyle.Inherit(textStyle).Render(detail), indent))
+		}
+		for _, check := range h.checks[step] {
+			if check.OK {
+				s.WriteString(indent + successStyle.Render("✓ "+check.Check) + "\n")
+			} else {
+				s.WriteString(indent + errorStyle.Render("✗ "+check.Check) + "\n")
+			}
+		}
+	}
+
+	return s.String()
+}
+
+func indentLines(text, indent string) string {
+	var s strings.Builder
+	for _, line := range strings.Split(text, "\n") {
+		s.WriteString(indent + line + "\n")
+	}
+
+	return s.String()
+}
+
+func (h *handshakeView) self() string {
+	if h.role == acceptorRole {
+		return h.acceptor
+	}
+
+	return h.initiator
+}
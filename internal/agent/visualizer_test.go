@@ -0,0 +1,159 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sudeeya/key-exchange/internal/pkg/api"
+)
+
+func TestStepper(t *testing.T) {
+	s := newStepper()
+	if err := s.wait(context.Background()); err != nil {
+		t.Fatalf("message was held with step mode off: %v", err)
+	}
+	if !s.toggle() {
+		t.Fatal("step mode was not turned on")
+	}
+
+	// Messages are released one per keypress, the oldest first.
+	released := make(chan int, 3)
+	for i := range 3 {
+		go func() {
+			s.wait(context.Background())
+			released <- i
+		}()
+		waitForWaiting(t, s, i+1)
+	}
+	s.next()
+	if i := <-released; i != 0 {
+		t.Fatalf("message %d was released first, want 0", i)
+	}
+	select {
+	case i := <-released:
+		t.Fatalf("message %d was released without a keypress", i)
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	// A message given up on is no longer waiting.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancelled := make(chan error, 1)
+	go func() { cancelled <- s.wait(ctx) }()
+	waitForWaiting(t, s, 3)
+	cancel()
+	if err := <-cancelled; !errors.Is(err, context.Canceled) {
+		t.Fatalf("cancelled wait returned %v", err)
+	}
+	waitForWaiting(t, s, 2)
+
+	// Turning step mode off releases the rest.
+	if s.toggle() {
+		t.Fatal("step mode was not turned off")
+	}
+	for range 2 {
+		<-released
+	}
+}
+
+func waitForWaiting(t *testing.T, s *stepper, n int) {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		s.mu.Lock()
+		waiting := len(s.waiting)
+		s.mu.Unlock()
+		if waiting == n {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%d messages waiting, want %d", waiting, n)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestHandshakeView(t *testing.T) {
+	step := func(n int, phase string) *api.ProtocolStep {
+		return &api.ProtocolStep{Handshake: "h", Initiator: "alice", Acceptor: "bob", Role: acceptorRole, Step: n, Phase: phase}
+	}
+	check := func(n int, check string, ok bool) *api.ProtocolStep {
+		s := step(n, stepChecked)
+		s.Check, s.OK = check, ok
+		return s
+	}
+
+	tests := []struct {
+		name  string
+		steps []*api.ProtocolStep
+		want  []string
+		// absent must not be in the view.
+		absent []string
+	}{
+		{
+			name:  "message in flight",
+			steps: []*api.ProtocolStep{step(3, stepReceived), step(4, stepSent)},
+			want: []string{
+				"· not seen by bob",
+				"alice, bob, E_K_T(N_A)",
+				"N_A, encrypted again under Trent's public key",
+				"in flight",
+			},
+			// Only the latest message is explained.
+			absent: []string{"initiator nonce N_A, encrypted under bob's public key"},
+		},
+		{
+			name:  "held in step mode",
+			steps: []*api.ProtocolStep{step(3, stepReceived), step(4, stepWaiting)},
+			want:  []string{"press space to send"},
+		},
+		{
+			name: "failed check",
+			steps: []*api.ProtocolStep{
+				step(5, stepReceived),
+				check(5, "Trent's signature", true),
+				check(5, "session certificate names bob", false),
+				{Handshake: "h", Step: 5, Phase: stepFailed, Check: "session certificate is not for bob"},
+			},
+			want: []string{
+				"✓ Trent's signature",
+				"✗ session certificate names bob",
+				"✗ session certificate is not for bob",
+			},
+		},
+		{
+			name: "established",
+			steps: []*api.ProtocolStep{
+				step(7, stepReceived),
+				step(8, stepSent),
+				{Handshake: "h", Step: 8, Phase: stepEstablished},
+			},
+			want:   []string{"✓ sent"},
+			absent: []string{"in flight"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := newHandshakeView(tt.steps[0])
+			for _, s := range tt.steps {
+				h.update(s)
+			}
+
+			view := h.render("*", 200)
+			for _, want := range tt.want {
+				if !strings.Contains(view, want) {
+					t.Errorf("view does not show %q:\n%s", want, view)
+				}
+			}
+			for _, absent := range tt.absent {
+				if strings.Contains(view, absent) {
+					t.Errorf("view shows %q:\n%s", absent, view)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,156 @@
+package loadgen
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/rsa"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+
+	"github.com/sudeeya/key-exchange/internal/pkg/pem"
+)
+
+const (
+	keySize        = 2048
+	privateKeyFile = "private.pem"
+	publicKeyFile  = "public.pem"
+	trentEnvFile   = "trent.env"
+)
+
+// Trent learns about the synthetic agents from these variables, which
+// replace those of the base environment. All agents connect from the load
+// generator's address, so the per-address limit would only measure itself.
+var enrollOverrides = []string{"AGENT_IDS", "AGENT_PUBLIC_KEYS", "AGENT_MLKEM_KEYS", "IP_RATE_LIMIT"}
+
+func enrollCommand(args []string, out io.Writer) error {
+	fs := flag.NewFlagSet("enroll", flag.ContinueOnError)
+	n := fs.Int("n", 100, "Number of agents to enroll")
+	dir := fs.String("dir", "loadgen", "Directory to store the agents' keys and Trent's environment in")
+	base := fs.String("base", "env/trent.env", "Trent environment to derive the load test environment from")
+	prefix := fs.String("prefix", "load", "Prefix of the agent IDs")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() > 0 {
+		return errUsage
+	}
+	if *n < 2 {
+		return fmt.Errorf("at least 2 agents are needed for a handshake, got %d", *n)
+	}
+
+	dirPath, err := filepath.Abs(*dir)
+	if err != nil {
+		return err
+	}
+
+	ids := make([]string, *n)
+	keys := make([]string, *n)
+	for i := range ids {
+		ids[i] = fmt.Sprintf("%s-%04d", *prefix, i+1)
+		keys[i] = filepath.Join(dirPath, ids[i], publicKeyFile)
+	}
+
+	fmt.Fprintf(out, "generating %d %d-bit RSA key pairs in %s\n", *n, keySize, dirPath)
+	if err := generateKeys(dirPath, ids); err != nil {
+		return err
+	}
+
+	envPath := filepath.Join(dirPath, trentEnvFile)
+	if err := writeTrentEnv(envPath, *base, ids, keys); err != nil {
+		return err
+	}
+
+	fmt.Fprintf(out, "enrolled %d agents, start Trent with:\n  go run cmd/trent/main.go -e %s\n", *n, envPath)
+
+	return nil
+}
+
+func generateKeys(dir string, ids []string) error {
+	var (
+		wg      sync.WaitGroup
+		mu      sync.Mutex
+		failure error
+	)
+
+	jobs := make(chan string)
+	for range runtime.GOMAXPROCS(0) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for id := range jobs {
+				if err := generateKey(filepath.Join(dir, id)); err != nil {
+					mu.Lock()
+					failure = fmt.Errorf("agent %s: %w", id, err)
+					mu.Unlock()
+				}
+			}
+		}()
+	}
+	for _, id := range ids {
+		jobs <- id
+	}
+	close(jobs)
+	wg.Wait()
+
+	return failure
+}
+
+func generateKey(dir string) error {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return err
+	}
+
+	privateKey, err := rsa.GenerateKey(rand.Reader, keySize)
+	if err != nil {
+		return err
+	}
+
+	if err := pem.SaveRSAPrivateKey(privateKey, filepath.Join(dir, privateKeyFile)); err != nil {
+		return err
+	}
+
+	return pem.SaveRSAPublicKey(&privateKey.PublicKey, filepath.Join(dir, publicKeyFile))
+}
+
+// writeTrentEnv copies the base environment to path with the agent list
+// replaced by ids and keys.
+func writeTrentEnv(path, base string, ids, keys []string) error {
+	var lines []string
+
+	if base != "" {
+		file, err := os.Open(base)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+
+		scanner := bufio.NewScanner(file)
+	lines:
+		for scanner.Scan() {
+			line := scanner.Text()
+			for _, name := range enrollOverrides {
+				if strings.HasPrefix(strings.TrimSpace(line), name+"=") {
+					continue lines
+				}
+			}
+			lines = append(lines, line)
+		}
+		if err := scanner.Err(); err != nil {
+			return err
+		}
+	}
+
+	lines = append(lines,
+		"AGENT_IDS="+strings.Join(ids, ","),
+		"AGENT_PUBLIC_KEYS="+strings.Join(keys, ","),
+		"IP_RATE_LIMIT=0",
+	)
+
+	return os.WriteFile(path, []byte(strings.Join(lines, "\n")+"\n"), 0o600)
+}
@@ -0,0 +1,284 @@
+package loadgen
+
+import (
+	"bytes"
+	"context"
+	"crypto/rsa"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/go-resty/resty/v2"
+
+	"github.com/sudeeya/key-exchange/internal/pkg/api"
+	"github.com/sudeeya/key-exchange/internal/pkg/crypto"
+	"github.com/sudeeya/key-exchange/internal/pkg/pem"
+	"github.com/sudeeya/key-exchange/internal/pkg/rng"
+)
+
+const httpPrefix = "http://"
+
+// The phases of a handshake that are timed. Steps 2 and 5 are requests to
+// Trent; the others are the work the two agents do between them.
+const (
+	phaseStep2     = "step 2"
+	phaseStep34    = "step 3-4"
+	phaseStep5     = "step 5"
+	phaseStep67    = "step 6-7"
+	phaseHandshake = "handshake"
+)
+
+var phases = []string{phaseStep2, phaseStep34, phaseStep5, phaseStep67, phaseHandshake}
+
+type agent struct {
+	id         string
+	publicPEM  []byte
+	privateKey *rsa.PrivateKey
+}
+
+func loadAgents(dir string) ([]*agent, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var agents []*agent
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+
+		privatePEM, err := pem.ExtractRSAPrivateKey(filepath.Join(dir, entry.Name(), privateKeyFile))
+		if err != nil {
+			return nil, err
+		}
+		privateKey, err := pem.ParseRSAPrivateKey(privatePEM)
+		if err != nil {
+			return nil, fmt.Errorf("agent %s: %w", entry.Name(), err)
+		}
+
+		agents = append(agents, &agent{
+			id:         entry.Name(),
+			publicPEM:  pem.EncodeRSAPublicKey(&privateKey.PublicKey),
+			privateKey: privateKey,
+		})
+	}
+
+	if len(agents) < 2 {
+		return nil, fmt.Errorf("%s holds %d agent(s), enroll at least 2", dir, len(agents))
+	}
+
+	return agents, nil
+}
+
+// stepError is a failed handshake, classified for the error breakdown.
+type stepError struct {
+	step   int
+	reason string
+}
+
+func (e *stepError) Error() string {
+	return fmt.Sprintf("step %d: %s", e.step, e.reason)
+}
+
+func failure(step int, reason string) error {
+	return &stepError{step: step, reason: reason}
+}
+
+func requestFailure(step int, err error) error {
+	var netErr net.Error
+	switch {
+	case errors.Is(err, context.Canceled):
+		return failure(step, "cancelled")
+	case errors.Is(err, context.DeadlineExceeded), errors.As(err, &netErr) && netErr.Timeout():
+		return failure(step, "timeout")
+	default:
+		return failure(step, "connection error")
+	}
+}
+
+func statusFailure(step int, resp *resty.Response) error {
+	return failure(step, fmt.Sprintf("%d %s", resp.StatusCode(), http.StatusText(resp.StatusCode())))
+}
+
+// handshaker runs handshakes the way the agents do, except that the
+// messages between the initiator and the acceptor (steps 3, 4, 6 and 7) are
+// passed in memory: only Trent is under test.
+type handshaker struct {
+	client    *resty.Client
+	trentAddr string
+	trentKey  *rsa.PublicKey
+	rng       rng.RNG
+}
+
+func (h *handshaker) post(ctx context.Context, endpoint string, req api.Request, resp *api.Response) (*resty.Response, error) {
+	return h.client.R().
+		SetContext(ctx).
+		SetHeader("Content-Type", "application/json").
+		SetBody(req).
+		SetResult(resp).
+		Post(httpPrefix + h.trentAddr + endpoint)
+}
+
+func (h *handshaker) signRequest(req *api.Request, endpoint string, by *agent) error {
+	nonce, err := h.rng.GenerateNonce()
+	if err != nil {
+		return err
+	}
+	req.Requester = by.id
+	req.Timestamp = time.Now().UnixMilli()
+	req.Nonce = nonce
+
+	data, err := req.SignedData(endpoint)
+	if err != nil {
+		return err
+	}
+	req.Signature = crypto.SignRSAKey(data, by.privateKey)
+
+	return nil
+}
+
+func (h *handshaker) verifyCert(cert api.Cert) bool {
+	infoJSON, err := json.Marshal(cert.Information)
+	if err != nil {
+		return false
+	}
+
+	return crypto.VerifyRSAKey(infoJSON, cert.Signature, h.trentKey)
+}
+
+// run performs a handshake between a and b and calls record with the
+// duration of each phase that completed.
+func (h *handshaker) run(ctx context.Context, a, b *agent, record func(phase string, d time.Duration)) error {
+	start := time.Now()
+	phaseStart := start
+	lap := func(phase string) {
+		now := time.Now()
+		record(phase, now.Sub(phaseStart))
+		phaseStart = now
+	}
+
+	// Steps 1-2
+	req1 := api.Request{
+		Initiator: a.id,
+		Acceptor:  b.id,
+	}
+	if err := h.signRequest(&req1, api.Step2Endpoint, a); err != nil {
+		return failure(1, err.Error())
+	}
+	var resp2 api.Response
+	rawResp2, err := h.post(ctx, api.Step2Endpoint, req1, &resp2)
+	if err != nil {
+		return requestFailure(2, err)
+	}
+	if rawResp2.StatusCode() != http.StatusOK {
+		return statusFailure(2, rawResp2)
+	}
+	if !h.verifyCert(resp2.Certificate) {
+		return failure(2, "certificate signature")
+	}
+	acceptorKey, err := pem.ParseRSAPublicKey(resp2.Certificate.Information.AcceptorKey)
+	if err != nil || !bytes.Equal(resp2.Certificate.Information.AcceptorKey, b.publicPEM) {
+		return failure(2, "wrong acceptor key")
+	}
+	lap(phaseStep2)
+
+	// Steps 3-4
+	initiatorNonce, err := h.rng.GenerateNonce()
+	if err != nil {
+		return failure(3, err.Error())
+	}
+	info3JSON, err := json.Marshal(api.Info{
+		Initiator:      a.id,
+		InitiatorNonce: initiatorNonce,
+	})
+	if err != nil {
+		return failure(3, err.Error())
+	}
+	ciphertext3 := crypto.EncryptRSAKey(info3JSON, acceptorKey, h.rng)
+
+	var info3 api.Info
+	if err := json.Unmarshal(crypto.DecryptRSAKey(ciphertext3, b.privateKey), &info3); err != nil {
+		return failure(4, "decryption")
+	}
+	req4 := api.Request{
+		Initiator:  info3.Initiator,
+		Acceptor:   b.id,
+		Ciphertext: crypto.EncryptRSAKey(info3.InitiatorNonce, h.trentKey, h.rng),
+	}
+	if err := h.signRequest(&req4, api.Step5Endpoint, b); err != nil {
+		return failure(4, err.Error())
+	}
+	lap(phaseStep34)
+
+	// Step 5
+	var resp5 api.Response
+	rawResp5, err := h.post(ctx, api.Step5Endpoint, req4, &resp5)
+	if err != nil {
+		return requestFailure(5, err)
+	}
+	if rawResp5.StatusCode() != http.StatusOK {
+		return statusFailure(5, rawResp5)
+	}
+	if !h.verifyCert(resp5.Certificate) {
+		return failure(5, "certificate signature")
+	}
+	initiatorKey, err := pem.ParseRSAPublicKey(resp5.Certificate.Information.InitiatorKey)
+	if err != nil || !bytes.Equal(resp5.Certificate.Information.InitiatorKey, a.publicPEM) {
+		return failure(5, "wrong initiator key")
+	}
+	var cert5 api.Cert
+	if err := json.Unmarshal(crypto.DecryptRSAKey(resp5.Ciphertext, b.privateKey), &cert5); err != nil {
+		return failure(5, "decryption")
+	}
+	if !h.verifyCert(cert5) {
+		return failure(5, "session certificate signature")
+	}
+	lap(phaseStep5)
+
+	// Step 6
+	acceptorNonce, err := h.rng.GenerateNonce()
+	if err != nil {
+		return failure(6, err.Error())
+	}
+	resp6JSON, err := json.Marshal(api.Response{
+		Certificate:   cert5,
+		AcceptorNonce: acceptorNonce,
+	})
+	if err != nil {
+		return failure(6, err.Error())
+	}
+	ciphertext6 := crypto.EncryptRSAKey(resp6JSON, initiatorKey, h.rng)
+
+	var resp6 api.Response
+	if err := json.Unmarshal(crypto.DecryptRSAKey(ciphertext6, a.privateKey), &resp6); err != nil {
+		return failure(6, "decryption")
+	}
+	if !h.verifyCert(resp6.Certificate) {
+		return failure(6, "session certificate signature")
+	}
+	if !bytes.Equal(resp6.Certificate.Information.InitiatorNonce, initiatorNonce) {
+		return failure(6, "nonce verification")
+	}
+
+	// Step 7
+	iv, err := h.rng.GenerateIV()
+	if err != nil {
+		return failure(7, err.Error())
+	}
+	sessionKey := resp6.Certificate.Information.SessionKey
+	ciphertext7 := crypto.EncryptAES(resp6.AcceptorNonce, sessionKey, iv)
+	if !bytes.Equal(crypto.DecryptAES(ciphertext7, cert5.Information.SessionKey, iv), acceptorNonce) {
+		return failure(7, "nonce verification")
+	}
+	lap(phaseStep67)
+
+	record(phaseHandshake, time.Since(start))
+
+	return nil
+}
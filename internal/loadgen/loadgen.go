@@ -0,0 +1,33 @@
+// Package loadgen enrolls synthetic agents with Trent and runs Wu-Lam
+// handshakes between them to measure how much load Trent can take.
+package loadgen
+
+import (
+	"errors"
+	"io"
+)
+
+const usage = `usage:
+  loadgen enroll [-n agents] [-dir dir] [-base env] [-prefix id]
+                 generate agent keys and an environment for Trent
+  loadgen run [-dir dir] [-trent addr] [-trent-key file] [-rate n]
+              [-concurrency n] [-duration d] [-timeout d] [-json]
+                 run handshakes between the enrolled agents`
+
+var errUsage = errors.New(usage)
+
+// RunCommand executes a loadgen command.
+func RunCommand(args []string, out io.Writer) error {
+	if len(args) == 0 {
+		return errUsage
+	}
+
+	switch args[0] {
+	case "enroll":
+		return enrollCommand(args[1:], out)
+	case "run":
+		return runCommand(args[1:], out)
+	default:
+		return errUsage
+	}
+}
@@ -0,0 +1,299 @@
+package loadgen
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-resty/resty/v2"
+
+	"github.com/sudeeya/key-exchange/internal/pkg/api"
+	"github.com/sudeeya/key-exchange/internal/pkg/crypto"
+	"github.com/sudeeya/key-exchange/internal/pkg/pem"
+	"github.com/sudeeya/key-exchange/internal/pkg/rng"
+)
+
+func TestRunCommandRejects(t *testing.T) {
+	oneAgent := t.TempDir()
+	if err := generateKey(filepath.Join(oneAgent, "load-0001")); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		args    []string
+		want    string
+		isUsage bool
+	}{
+		{name: "no command", isUsage: true},
+		{name: "unknown command", args: []string{"bench"}, isUsage: true},
+		{name: "enroll one agent", args: []string{"enroll", "-n", "1"}, want: "at least 2 agents"},
+		{name: "enroll with arguments", args: []string{"enroll", "extra"}, isUsage: true},
+		{name: "run with arguments", args: []string{"run", "extra"}, isUsage: true},
+		{name: "run without concurrency", args: []string{"run", "-concurrency", "0"}, want: "concurrency must be positive"},
+		{name: "run with one agent", args: []string{"run", "-dir", oneAgent}, want: "holds 1 agent(s)"},
+		{name: "run without agents", args: []string{"run", "-dir", filepath.Join(oneAgent, "missing")}, want: "no such file"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := RunCommand(tt.args, io.Discard)
+			switch {
+			case tt.isUsage:
+				if !errors.Is(err, errUsage) {
+					t.Fatalf("returned %v, want the usage", err)
+				}
+			case err == nil || !strings.Contains(err.Error(), tt.want):
+				t.Fatalf("returned %v, want an error with %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestWriteTrentEnv(t *testing.T) {
+	dir := t.TempDir()
+	base := filepath.Join(dir, "base.env")
+	baseEnv := "ADDR=localhost:8080\nAGENT_IDS=alice,bob\n  AGENT_PUBLIC_KEYS=a.pem,b.pem\nAGENT_MLKEM_KEYS=b.mlkem.pem\nIP_RATE_LIMIT=20\nAGENT_RATE_LIMIT=5\n"
+	if err := os.WriteFile(base, []byte(baseEnv), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(dir, trentEnvFile)
+	if err := writeTrentEnv(path, base, []string{"load-0001", "load-0002"}, []string{"1.pem", "2.pem"}); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{
+		"ADDR=localhost:8080",
+		"AGENT_RATE_LIMIT=5",
+		"AGENT_IDS=load-0001,load-0002",
+		"AGENT_PUBLIC_KEYS=1.pem,2.pem",
+		"IP_RATE_LIMIT=0",
+	}
+	if got := strings.Split(strings.TrimSuffix(string(data), "\n"), "\n"); !slices.Equal(got, want) {
+		t.Fatalf("environment is\n%s\nwant\n%s", data, strings.Join(want, "\n"))
+	}
+
+	if err := writeTrentEnv(path, filepath.Join(dir, "missing.env"), nil, nil); err == nil {
+		t.Fatal("missing base environment was accepted")
+	}
+}
+
+func TestHandshakeFailures(t *testing.T) {
+	trentKey := generateTestKey(t)
+	alice, bob := newTestAgent(t, "alice"), newTestAgent(t, "bob")
+
+	cert := func(info api.Info, key *rsa.PrivateKey) api.Cert {
+		data, err := json.Marshal(info)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return api.Cert{Information: info, Signature: crypto.SignRSAKey(data, key)}
+	}
+	// step2 answers step 2 as Trent would.
+	step2 := func(w http.ResponseWriter, r *http.Request) {
+		respond(w, api.Response{
+			Certificate: cert(api.Info{Acceptor: bob.id, AcceptorKey: bob.publicPEM}, trentKey),
+		})
+	}
+	status := func(code int) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			http.Error(w, http.StatusText(code), code)
+		}
+	}
+
+	tests := []struct {
+		name  string
+		step2 http.HandlerFunc
+		step5 http.HandlerFunc
+		want  string
+	}{
+		{
+			name:  "refused by the policy",
+			step2: status(http.StatusForbidden),
+			want:  "step 2: 403 Forbidden",
+		},
+		{
+			name: "certificate signed by another key",
+			step2: func(w http.ResponseWriter, r *http.Request) {
+				respond(w, api.Response{
+					Certificate: cert(api.Info{Acceptor: bob.id, AcceptorKey: bob.publicPEM}, alice.privateKey),
+				})
+			},
+			want: "step 2: certificate signature",
+		},
+		{
+			name: "another acceptor's key",
+			step2: func(w http.ResponseWriter, r *http.Request) {
+				respond(w, api.Response{
+					Certificate: cert(api.Info{Acceptor: bob.id, AcceptorKey: alice.publicPEM}, trentKey),
+				})
+			},
+			want: "step 2: wrong acceptor key",
+		},
+		{
+			name:  "rate limited",
+			step2: step2,
+			step5: status(http.StatusTooManyRequests),
+			want:  "step 5: 429 Too Many Requests",
+		},
+		{
+			name:  "timeout",
+			step2: step2,
+			step5: func(w http.ResponseWriter, r *http.Request) {
+				// The request is only cancelled once its body is read.
+				io.Copy(io.Discard, r.Body)
+				<-r.Context().Done()
+			},
+			want: "step 5: timeout",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mux := http.NewServeMux()
+			mux.HandleFunc(api.Step2Endpoint, tt.step2)
+			if tt.step5 != nil {
+				mux.HandleFunc(api.Step5Endpoint, tt.step5)
+			}
+			server := httptest.NewServer(mux)
+			defer server.Close()
+
+			h := newTestHandshaker(t, server.Listener.Addr().String(), &trentKey.PublicKey)
+			err := h.run(context.Background(), alice, bob, func(string, time.Duration) {})
+			if err == nil || err.Error() != tt.want {
+				t.Fatalf("handshake failed with %v, want %q", err, tt.want)
+			}
+		})
+	}
+
+	t.Run("Trent is down", func(t *testing.T) {
+		server := httptest.NewServer(http.NotFoundHandler())
+		addr := server.Listener.Addr().String()
+		server.Close()
+
+		h := newTestHandshaker(t, addr, &trentKey.PublicKey)
+		if err := h.run(context.Background(), alice, bob, func(string, time.Duration) {}); err == nil || err.Error() != "step 2: connection error" {
+			t.Fatalf("handshake failed with %v, want a connection error", err)
+		}
+	})
+}
+
+func TestStatsReport(t *testing.T) {
+	s := newStats()
+	for i := range 100 {
+		s.started()
+		s.record(phaseStep2, time.Duration(i+1)*time.Millisecond)
+	}
+	for range 97 {
+		s.finished(nil)
+	}
+	s.finished(failure(5, "429 Too Many Requests"))
+	s.finished(failure(2, "403 Forbidden"))
+	s.finished(failure(5, "429 Too Many Requests"))
+	s.skipped()
+
+	r := s.report(runConfig{agents: 2, concurrency: 1}, time.Second)
+
+	if r.Started != 100 || r.Succeeded != 97 || r.Failed != 3 || r.NotStarted != 1 || r.Throughput != 97 {
+		t.Fatalf("report counts %d started, %d succeeded, %d failed, %d not started at %g/s",
+			r.Started, r.Succeeded, r.Failed, r.NotStarted, r.Throughput)
+	}
+	want := []latency{{
+		Phase: phaseStep2,
+		Count: 100,
+		P50:   50 * time.Millisecond,
+		P90:   90 * time.Millisecond,
+		P99:   99 * time.Millisecond,
+		Max:   100 * time.Millisecond,
+	}}
+	if !slices.Equal(r.Latencies, want) {
+		t.Fatalf("latencies are %v, want %v", r.Latencies, want)
+	}
+	wantErrors := []errorCount{
+		{"step 5: 429 Too Many Requests", 2},
+		{"step 2: 403 Forbidden", 1},
+	}
+	if !slices.Equal(r.Errors, wantErrors) {
+		t.Fatalf("errors are %v, want %v", r.Errors, wantErrors)
+	}
+}
+
+func TestPercentile(t *testing.T) {
+	tests := []struct {
+		sorted []time.Duration
+		p      int
+		want   time.Duration
+	}{
+		{[]time.Duration{1}, 50, 1},
+		{[]time.Duration{1}, 99, 1},
+		{[]time.Duration{1, 2}, 50, 1},
+		{[]time.Duration{1, 2}, 90, 2},
+		{[]time.Duration{1, 2, 3, 4, 5, 6, 7, 8, 9, 10}, 90, 9},
+		{[]time.Duration{1, 2, 3, 4, 5, 6, 7, 8, 9, 10}, 99, 10},
+	}
+
+	for _, tt := range tests {
+		if got := percentile(tt.sorted, tt.p); got != tt.want {
+			t.Errorf("percentile %d of %v is %v, want %v", tt.p, tt.sorted, got, tt.want)
+		}
+	}
+}
+
+func respond(w http.ResponseWriter, resp api.Response) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+func newTestHandshaker(t *testing.T, trentAddr string, trentKey *rsa.PublicKey) *handshaker {
+	t.Helper()
+
+	random, err := rng.NewRNG()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &handshaker{
+		client:    resty.New().SetTimeout(time.Second),
+		trentAddr: trentAddr,
+		trentKey:  trentKey,
+		rng:       random,
+	}
+}
+
+func newTestAgent(t *testing.T, id string) *agent {
+	t.Helper()
+
+	key := generateTestKey(t)
+	return &agent{
+		id:         id,
+		publicPEM:  pem.EncodeRSAPublicKey(&key.PublicKey),
+		privateKey: key,
+	}
+}
+
+func generateTestKey(t *testing.T) *rsa.PrivateKey {
+	t.Helper()
+
+	key, err := rsa.GenerateKey(rand.Reader, keySize)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return key
+}
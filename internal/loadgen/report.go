@@ -0,0 +1,186 @@
+package loadgen
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+type stats struct {
+	mu        sync.Mutex
+	latencies map[string][]time.Duration
+	errors    map[string]int
+	attempts  int
+	succeeded int
+	notRun    int
+}
+
+func newStats() *stats {
+	return &stats{
+		latencies: make(map[string][]time.Duration),
+		errors:    make(map[string]int),
+	}
+}
+
+func (s *stats) record(phase string, d time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.latencies[phase] = append(s.latencies[phase], d)
+}
+
+func (s *stats) started() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.attempts++
+}
+
+func (s *stats) skipped() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.notRun++
+}
+
+func (s *stats) finished(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err == nil {
+		s.succeeded++
+		return
+	}
+
+	var stepErr *stepError
+	if !errors.As(err, &stepErr) {
+		stepErr = &stepError{reason: err.Error()}
+	}
+	s.errors[stepErr.Error()]++
+}
+
+type report struct {
+	TrentAddr   string        `json:"trent"`
+	Agents      int           `json:"agents"`
+	Rate        float64       `json:"rate"`
+	Concurrency int           `json:"concurrency"`
+	Elapsed     time.Duration `json:"elapsed_ns"`
+	Started     int           `json:"started"`
+	Succeeded   int           `json:"succeeded"`
+	Failed      int           `json:"failed"`
+	NotStarted  int           `json:"not_started"`
+	Throughput  float64       `json:"throughput"`
+	Latencies   []latency     `json:"latencies"`
+	Errors      []errorCount  `json:"errors"`
+}
+
+type latency struct {
+	Phase string        `json:"phase"`
+	Count int           `json:"count"`
+	P50   time.Duration `json:"p50_ns"`
+	P90   time.Duration `json:"p90_ns"`
+	P99   time.Duration `json:"p99_ns"`
+	Max   time.Duration `json:"max_ns"`
+}
+
+type errorCount struct {
+	Error string `json:"error"`
+	Count int    `json:"count"`
+}
+
+func (s *stats) report(cfg runConfig, elapsed time.Duration) report {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	r := report{
+		TrentAddr:   cfg.trentAddr,
+		Agents:      cfg.agents,
+		Rate:        cfg.rate,
+		Concurrency: cfg.concurrency,
+		Elapsed:     elapsed,
+		Started:     s.attempts,
+		Succeeded:   s.succeeded,
+		Failed:      s.attempts - s.succeeded,
+		NotStarted:  s.notRun,
+		Throughput:  float64(s.succeeded) / elapsed.Seconds(),
+		Latencies:   []latency{},
+		Errors:      []errorCount{},
+	}
+
+	for _, phase := range phases {
+		d := slices.Clone(s.latencies[phase])
+		if len(d) == 0 {
+			continue
+		}
+		slices.Sort(d)
+		r.Latencies = append(r.Latencies, latency{
+			Phase: phase,
+			Count: len(d),
+			P50:   percentile(d, 50),
+			P90:   percentile(d, 90),
+			P99:   percentile(d, 99),
+			Max:   d[len(d)-1],
+		})
+	}
+
+	for e, count := range s.errors {
+		r.Errors = append(r.Errors, errorCount{Error: e, Count: count})
+	}
+	slices.SortFunc(r.Errors, func(a, b errorCount) int {
+		if a.Count != b.Count {
+			return b.Count - a.Count
+		}
+		return strings.Compare(a.Error, b.Error)
+	})
+
+	return r
+}
+
+// percentile returns the nearest-rank percentile p of sorted.
+func percentile(sorted []time.Duration, p int) time.Duration {
+	rank := (p*len(sorted) + 99) / 100
+
+	return sorted[max(rank, 1)-1]
+}
+
+func (r report) print(out io.Writer) {
+	rate := "back to back"
+	if r.Rate > 0 {
+		rate = fmt.Sprintf("%g/s", r.Rate)
+	}
+	fmt.Fprintf(out, "Trent %s, %d agents, rate %s, concurrency %d, %s\n\n",
+		r.TrentAddr, r.Agents, rate, r.Concurrency, r.Elapsed.Round(time.Millisecond))
+
+	fmt.Fprintf(out, "handshakes  %d started, %d succeeded, %d failed", r.Started, r.Succeeded, r.Failed)
+	if r.NotStarted > 0 {
+		fmt.Fprintf(out, ", %d not started (concurrency limit reached)", r.NotStarted)
+	}
+	fmt.Fprintf(out, "\nthroughput  %.1f handshakes/s\n", r.Throughput)
+
+	if len(r.Latencies) > 0 {
+		fmt.Fprintf(out, "\n%-10s %8s %10s %10s %10s %10s\n", "latency", "count", "p50", "p90", "p99", "max")
+		for _, l := range r.Latencies {
+			fmt.Fprintf(out, "%-10s %8d %10s %10s %10s %10s\n",
+				l.Phase, l.Count, roundLatency(l.P50), roundLatency(l.P90), roundLatency(l.P99), roundLatency(l.Max))
+		}
+	}
+
+	if len(r.Errors) > 0 {
+		fmt.Fprintf(out, "\nerrors\n")
+		for _, e := range r.Errors {
+			fmt.Fprintf(out, "  %-40s %8d\n", e.Error, e.Count)
+		}
+	}
+}
+
+func roundLatency(d time.Duration) time.Duration {
+	if d < time.Millisecond {
+		return d.Round(time.Microsecond)
+	}
+
+	return d.Round(100 * time.Microsecond)
+}
@@ -0,0 +1,166 @@
+package loadgen
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"time"
+
+	"github.com/go-resty/resty/v2"
+
+	"github.com/sudeeya/key-exchange/internal/pkg/pem"
+	"github.com/sudeeya/key-exchange/internal/pkg/rng"
+)
+
+type runConfig struct {
+	trentAddr   string
+	rate        float64
+	concurrency int
+	duration    time.Duration
+	agents      int
+}
+
+func runCommand(args []string, out io.Writer) error {
+	fs := flag.NewFlagSet("run", flag.ContinueOnError)
+	dir := fs.String("dir", "loadgen", "Directory with the enrolled agents")
+	trentAddr := fs.String("trent", "localhost:8080", "Trent's address")
+	trentKey := fs.String("trent-key", "keys/trent/public.pem", "Trent's public key")
+	rate := fs.Float64("rate", 10, "Handshakes started per second; 0 runs them back to back")
+	concurrency := fs.Int("concurrency", 16, "Maximum number of handshakes in progress")
+	duration := fs.Duration("duration", 30*time.Second, "How long to start handshakes for")
+	timeout := fs.Duration("timeout", 10*time.Second, "Timeout of each request to Trent")
+	asJSON := fs.Bool("json", false, "Print the report as JSON")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() > 0 {
+		return errUsage
+	}
+	if *concurrency < 1 {
+		return fmt.Errorf("concurrency must be positive, got %d", *concurrency)
+	}
+
+	agents, err := loadAgents(*dir)
+	if err != nil {
+		return err
+	}
+
+	trentKeyPEM, err := pem.ExtractRSAPublicKey(*trentKey)
+	if err != nil {
+		return err
+	}
+	trentRSA, err := pem.ParseRSAPublicKey(trentKeyPEM)
+	if err != nil {
+		return err
+	}
+
+	random, err := rng.NewRNG()
+	if err != nil {
+		return err
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.MaxIdleConnsPerHost = *concurrency
+
+	h := &handshaker{
+		client:    resty.New().SetTransport(transport).SetTimeout(*timeout),
+		trentAddr: *trentAddr,
+		trentKey:  trentRSA,
+		rng:       random,
+	}
+	cfg := runConfig{
+		trentAddr:   *trentAddr,
+		rate:        *rate,
+		concurrency: *concurrency,
+		duration:    *duration,
+		agents:      len(agents),
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	stats := newStats()
+	elapsed := run(ctx, h, agents, cfg, stats)
+	r := stats.report(cfg, elapsed)
+
+	if *asJSON {
+		encoder := json.NewEncoder(out)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(r)
+	}
+	r.print(out)
+
+	return nil
+}
+
+// run starts handshakes between random pairs of agents at cfg.rate, or back
+// to back if the rate is zero, for cfg.duration or until ctx is done, and
+// waits for those in progress. It returns how long that took.
+func run(ctx context.Context, h *handshaker, agents []*agent, cfg runConfig, stats *stats) time.Duration {
+	var wg sync.WaitGroup
+	slots := make(chan struct{}, cfg.concurrency)
+
+	handshake := func() {
+		defer wg.Done()
+		defer func() { <-slots }()
+
+		i := rand.IntN(len(agents))
+		j := rand.IntN(len(agents) - 1)
+		if j >= i {
+			j++
+		}
+
+		err := h.run(ctx, agents[i], agents[j], stats.record)
+		stats.finished(err)
+	}
+
+	start := time.Now()
+	schedule, cancel := context.WithTimeout(ctx, cfg.duration)
+	defer cancel()
+
+	if cfg.rate <= 0 {
+	loop:
+		for {
+			select {
+			case <-schedule.Done():
+				break loop
+			case slots <- struct{}{}:
+				stats.started()
+				wg.Add(1)
+				go handshake()
+			}
+		}
+	} else {
+		ticker := time.NewTicker(time.Duration(float64(time.Second) / cfg.rate))
+		defer ticker.Stop()
+	ticks:
+		for {
+			select {
+			case <-schedule.Done():
+				break ticks
+			case <-ticker.C:
+				select {
+				case slots <- struct{}{}:
+					stats.started()
+					wg.Add(1)
+					go handshake()
+				default:
+					// Trent is not keeping up with the rate.
+					stats.skipped()
+				}
+			}
+		}
+	}
+
+	// Handshakes in progress are allowed to finish unless ctx is done.
+	wg.Wait()
+
+	return time.Since(start)
+}
@@ -1,23 +1,72 @@
 package api
 
+import (
+	"encoding/json"
+)
+
 const (
 	Step2Endpoint   = "/step2/"
 	Step4Endpoint   = "/step4/"
 	Step5Endpoint   = "/step5/"
 	Step7Endpoint   = "/step7/"
 	MessageEndpoint = "/msg/"
+	TunnelEndpoint  = "/tunnel"
+	FilesEndpoint   = "/files/"
+	StreamEndpoint  = "/stream"
+	MetricsEndpoint = "/metrics"
+	TracesEndpoint  = "/debug/traces"
+	HealthEndpoint  = "/healthz"
+	ReadyEndpoint   = "/readyz"
+)
+
+const (
+	StreamHelloFrame   = "hello"
+	StreamMessageFrame = "message"
+	StreamAckFrame     = "ack"
+)
+
+const (
+	TunnelProtocol = "wulam-tunnel"
+	SenderHeader   = "X-Agent-Sender"
+	NonceHeader    = "X-Agent-Nonce"
 )
 
 type Request struct {
 	Initiator  string `json:"initiator,omitempty"`
 	Acceptor   string `json:"acceptor,omitempty"`
 	Ciphertext []byte `json:"ciphertext,omitempty"`
+	// Suite is the cipher suite the acceptor chose, which decides how Trent
+	// encrypts the session certificate for it at step 5.
+	Suite string `json:"suite,omitempty"`
+
+	// Requests to Trent are signed by the requester. Timestamp is in Unix
+	// milliseconds.
+	Requester string `json:"requester,omitempty"`
+	Timestamp int64  `json:"timestamp,omitempty"`
+	Nonce     []byte `json:"nonce,omitempty"`
+	Signature []byte `json:"signature,omitempty"`
+}
+
+// SignedData returns what the requester signs to send r to endpoint, so that
+// a signed request cannot be replayed at another step.
+func (r Request) SignedData(endpoint string) ([]byte, error) {
+	r.Signature = nil
+
+	return json.Marshal(struct {
+		Endpoint string  `json:"endpoint"`
+		Request  Request `json:"request"`
+	}{endpoint, r})
 }
 
 type Response struct {
 	Certificate   Cert   `json:"certificate,omitempty"`
 	Ciphertext    []byte `json:"ciphertext,omitempty"`
 	AcceptorNonce []byte `json:"acceptor_nonce,omitempty"`
+
+	// The acceptor's answer to the initiator's cipher suite offer at step 6.
+	Suite                 string `json:"suite,omitempty"`
+	AcceptorShare         []byte `json:"acceptor_share,omitempty"`
+	AcceptorKEMCiphertext []byte `json:"acceptor_kem_ciphertext,omitempty"`
 }
 
 type Cert struct {
@@ -32,9 +81,42 @@ type Info struct {
 	InitiatorKey   []byte `json:"initiator_key,omitempty"`
 	AcceptorKey    []byte `json:"acceptor_key,omitempty"`
 	SessionKey     []byte `json:"session_key,omitempty"`
+	SessionID      string `json:"session_id,omitempty"`
+	Suite          string `json:"suite,omitempty"`
+
+	// The initiator's cipher suite offer at step 3: the suites in order of
+	// preference and its ephemeral X25519 and ML-KEM keys for those that
+	// need them.
+	Suites          []string `json:"suites,omitempty"`
+	InitiatorShare  []byte   `json:"initiator_share,omitempty"`
+	InitiatorKEMKey []byte   `json:"initiator_kem_key,omitempty"`
 }
 
 type Message struct {
+	// ID is set on messages first sent over the stream, whose IDs the
+	// receiver uses to drop messages it already has.
+	ID         uint64 `json:"id,omitempty"`
+	Sender     string `json:"sender"`
 	IV         []byte `json:"iv"`
 	Ciphertext []byte `json:"ciphertext"`
+	// Confirmation is a MAC of the handshake transcript under the session
+	// key, sent by the initiator at step 7 and by the acceptor at step 8.
+	Confirmation []byte `json:"confirmation,omitempty"`
+}
+
+type FileInfo struct {
+	Name      string `json:"name"`
+	Size      int64  `json:"size"`
+	ChunkSize int    `json:"chunk_size"`
+	SHA256    []byte `json:"sha256"`
+}
+
+type FileStatus struct {
+	NextChunk int `json:"next_chunk"`
+}
+
+type StreamFrame struct {
+	Type string `json:"type"`
+	ID   uint64 `json:"id"`
+	Text string `json:"text,omitempty"`
 }
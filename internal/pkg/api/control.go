@@ -0,0 +1,175 @@
+package api
+
+import (
+	"fmt"
+	"net"
+	"time"
+)
+
+const (
+	ControlSessionsEndpoint = "/control/sessions"
+	ControlMessagesEndpoint = "/control/messages"
+	ControlInboxEndpoint    = "/control/inbox"
+	ControlEventsEndpoint   = "/control/events"
+	ControlKeysEndpoint     = "/control/keys"
+	ControlFilesEndpoint    = "/control/files"
+	ControlHistoryEndpoint  = "/control/history"
+	ControlRequestsEndpoint = "/control/requests"
+	ControlTracesEndpoint   = "/control/traces"
+
+	ControlTokenHeader = "Authorization"
+	ControlTokenScheme = "Bearer "
+)
+
+const (
+	SessionEstablishedEvent = "session_established"
+	MessageReceivedEvent    = "message_received"
+	MessageSentEvent        = "message_sent"
+	HandshakeFailedEvent    = "handshake_failed"
+	ProtocolStepEvent       = "protocol_step"
+	SessionRequestedEvent   = "session_requested"
+	RequestResolvedEvent    = "session_request_resolved"
+	SessionRekeyedEvent     = "session_rekeyed"
+	SessionClosedEvent      = "session_closed"
+	TransferProgressEvent   = "transfer_progress"
+	TransferCompletedEvent  = "transfer_completed"
+	TransferFailedEvent     = "transfer_failed"
+)
+
+type OpenSessionRequest struct {
+	Peer string `json:"peer"`
+}
+
+type SessionInfo struct {
+	ID          string    `json:"id"`
+	Peer        string    `json:"peer"`
+	Role        string    `json:"role"`
+	Established time.Time `json:"established"`
+	Stream      bool      `json:"stream"`
+	Suite       string    `json:"suite"`
+	// ForwardSecrecy is set if the session key is mixed with an ephemeral
+	// Diffie-Hellman secret.
+	ForwardSecrecy bool `json:"forward_secrecy"`
+}
+
+type SendMessageRequest struct {
+	Peer string `json:"peer"`
+	Text string `json:"text"`
+}
+
+type MailboxMessage struct {
+	ID        int       `json:"id"`
+	Peer      string    `json:"peer"`
+	Direction string    `json:"direction"`
+	Session   string    `json:"session"`
+	Status    string    `json:"status"`
+	Text      string    `json:"text"`
+	Time      time.Time `json:"time"`
+}
+
+type ExportKeyRequest struct {
+	Peer    string `json:"peer"`
+	Label   string `json:"label"`
+	Context []byte `json:"context,omitempty"`
+	Length  int    `json:"length,omitempty"`
+}
+
+type ExportedKey struct {
+	ID      string    `json:"id"`
+	Session string    `json:"session"`
+	Peer    string    `json:"peer"`
+	Label   string    `json:"label"`
+	Key     []byte    `json:"key"`
+	Expires time.Time `json:"expires"`
+}
+
+type SendFileRequest struct {
+	Peer string `json:"peer"`
+	Path string `json:"path"`
+}
+
+type TransferInfo struct {
+	ID          string `json:"id"`
+	Peer        string `json:"peer"`
+	Direction   string `json:"direction"`
+	Name        string `json:"name"`
+	Path        string `json:"path,omitempty"`
+	Size        int64  `json:"size"`
+	Transferred int64  `json:"transferred"`
+	Status      string `json:"status"`
+	Error       string `json:"error,omitempty"`
+}
+
+type HandshakeFailure struct {
+	Peer  string `json:"peer,omitempty"`
+	Role  string `json:"role"`
+	Step  int    `json:"step"`
+	Error string `json:"error"`
+}
+
+// SessionRequest is an incoming handshake held until the user accepts or
+// rejects it. Fingerprint is that of the key Trent vouched for in the last
+// session with the initiator, and empty if there was none. Decision is set
+// once the request has been resolved.
+type SessionRequest struct {
+	ID          string    `json:"id"`
+	Initiator   string    `json:"initiator"`
+	Fingerprint string    `json:"fingerprint"`
+	Received    time.Time `json:"received"`
+	Expires     time.Time `json:"expires"`
+	Decision    string    `json:"decision,omitempty"`
+}
+
+type ConsentDecision struct {
+	Accept bool `json:"accept"`
+}
+
+// ProtocolStep reports the progress of one handshake step as seen by this
+// agent. Handshake is the trace ID shared by both agents. Check names the
+// verification of a checked step or the error of a failed one.
+type ProtocolStep struct {
+	Handshake string `json:"handshake"`
+	Initiator string `json:"initiator"`
+	Acceptor  string `json:"acceptor"`
+	Role      string `json:"role"`
+	Step      int    `json:"step"`
+	Phase     string `json:"phase"`
+	Check     string `json:"check,omitempty"`
+	OK        bool   `json:"ok,omitempty"`
+}
+
+// Event is published on session, handshake and mailbox changes. For
+// session_rekeyed and session_closed events, Previous is the replaced or
+// closed session and KeyIDs lists the keys exported from it, which must no
+// longer be used.
+type Event struct {
+	Type     string            `json:"type"`
+	Time     time.Time         `json:"time"`
+	Session  *SessionInfo      `json:"session,omitempty"`
+	Previous *SessionInfo      `json:"previous,omitempty"`
+	KeyIDs   []string          `json:"key_ids,omitempty"`
+	Message  *MailboxMessage   `json:"message,omitempty"`
+	Failure  *HandshakeFailure `json:"failure,omitempty"`
+	Step     *ProtocolStep     `json:"step,omitempty"`
+	Request  *SessionRequest   `json:"request,omitempty"`
+	Transfer *TransferInfo     `json:"transfer,omitempty"`
+}
+
+// CheckLoopback makes sure addr, which serves a local-only API, is never
+// exposed beyond the local host.
+func CheckLoopback(addr string) error {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	if host == "localhost" {
+		return nil
+	}
+
+	ip := net.ParseIP(host)
+	if ip == nil || !ip.IsLoopback() {
+		return fmt.Errorf("address %s is not a loopback address", addr)
+	}
+
+	return nil
+}
@@ -1,9 +1,20 @@
 package crypto
 
 import (
+	"crypto/aes"
+	"crypto/cipher"
+	"errors"
+
 	"github.com/golang-module/dongle"
 )
 
+const (
+	AEADKeySize   = 32
+	AEADNonceSize = 12
+)
+
+var errAEADNonce = errors.New("invalid AEAD nonce size")
+
 func EncryptRSA(plaintext, publicKey []byte) []byte {
 	ciphertext := dongle.Encrypt.
 		FromBytes(plaintext).
@@ -69,3 +80,40 @@ func DecryptAES(ciphertext, key, iv []byte) []byte {
 
 	return plaintext
 }
+
+// EncryptAEAD seals plaintext with AES-GCM, authenticating additionalData
+// along with it.
+func EncryptAEAD(plaintext, key, nonce, additionalData []byte) ([]byte, error) {
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(nonce) != aead.NonceSize() {
+		return nil, errAEADNonce
+	}
+
+	return aead.Seal(nil, nonce, plaintext, additionalData), nil
+}
+
+// DecryptAEAD opens a ciphertext sealed by EncryptAEAD and fails if it or
+// additionalData was modified.
+func DecryptAEAD(ciphertext, key, nonce, additionalData []byte) ([]byte, error) {
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(nonce) != aead.NonceSize() {
+		return nil, errAEADNonce
+	}
+
+	return aead.Open(nil, nonce, ciphertext, additionalData)
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
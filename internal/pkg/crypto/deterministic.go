@@ -0,0 +1,58 @@
+//go:build deterministic && go1.26
+
+package crypto
+
+import (
+	"crypto/mlkem"
+	"crypto/mlkem/mlkemtest"
+	"crypto/rsa"
+	"math/big"
+)
+
+// In deterministic builds, RSA padding and ML-KEM encapsulation take their
+// randomness from random too, so that a seeded RNG replays whole handshakes.
+// crypto/rsa ignores any source but crypto/rand, so the padding is done here,
+// and the derandomized encapsulation of FIPS 203 is only exposed by
+// crypto/mlkem for tests. Neither belongs in other builds.
+
+// encryptPKCS1v15 is RSAES-PKCS1-v1_5 encryption (RFC 8017, section 7.2.1).
+func encryptPKCS1v15(plaintext []byte, publicKey *rsa.PublicKey, random Random) ([]byte, error) {
+	k := publicKey.Size()
+	if len(plaintext) > k-pkcs1Overhead {
+		return nil, rsa.ErrMessageTooLong
+	}
+
+	// EM = 0x00 || 0x02 || PS || 0x00 || M, where PS is nonzero random bytes.
+	em := make([]byte, k)
+	em[1] = 2
+	ps := em[2 : k-len(plaintext)-1]
+	for i := 0; i < len(ps); {
+		b, err := random.GenerateKey(len(ps) - i)
+		if err != nil {
+			return nil, err
+		}
+		for _, c := range b {
+			if c != 0 {
+				ps[i] = c
+				i++
+			}
+		}
+	}
+	copy(em[k-len(plaintext):], plaintext)
+
+	m := new(big.Int).SetBytes(em)
+	c := m.Exp(m, big.NewInt(int64(publicKey.E)), publicKey.N)
+
+	return c.FillBytes(make([]byte, k)), nil
+}
+
+// Encapsulate768 returns a shared secret and the ciphertext that gives it to
+// the owner of key.
+func Encapsulate768(key *mlkem.EncapsulationKey768, random Random) (secret, ciphertext []byte, err error) {
+	m, err := random.GenerateKey(32)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return mlkemtest.Encapsulate768(key, m)
+}
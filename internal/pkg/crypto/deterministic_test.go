@@ -0,0 +1,53 @@
+//go:build deterministic && go1.26
+
+package crypto
+
+import (
+	"bytes"
+	"crypto/mlkem"
+	"crypto/rsa"
+	"testing"
+
+	"github.com/sudeeya/key-exchange/internal/pkg/rng"
+)
+
+// TestSeededEncryption checks that RSA and hybrid ciphertexts repeat with
+// the seed and still decrypt.
+func TestSeededEncryption(t *testing.T) {
+	k := loadTestKey(t)
+	kemKey, err := mlkem.GenerateKey768()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	encrypt := func(seed string) ([]byte, []byte) {
+		random := rng.NewDeterministicRNG(seed)
+		hybrid, err := EncryptHybrid(hybridMessage, &k.key.PublicKey, kemKey.EncapsulationKey(), random)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return EncryptRSAKey(rsaMessage, &k.key.PublicKey, random), hybrid
+	}
+	rsaCiphertext, hybridCiphertext := encrypt("seed")
+
+	if got := DecryptRSAKey(rsaCiphertext, k.key); !bytes.Equal(got, rsaMessage) {
+		t.Fatal("seeded RSA ciphertext does not decrypt")
+	}
+	// The padding is checked by crypto/rsa itself too, block by block.
+	if _, err := rsa.DecryptPKCS1v15(nil, k.key, rsaCiphertext[:k.key.Size()]); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := DecryptHybrid(hybridCiphertext, k.key, kemKey); err != nil || !bytes.Equal(got, hybridMessage) {
+		t.Fatalf("seeded hybrid ciphertext does not decrypt: %v", err)
+	}
+
+	rsaAgain, hybridAgain := encrypt("seed")
+	if !bytes.Equal(rsaAgain, rsaCiphertext) || !bytes.Equal(hybridAgain, hybridCiphertext) {
+		t.Fatal("ciphertexts differ with the same seed")
+	}
+	rsaOther, hybridOther := encrypt("other seed")
+	if bytes.Equal(rsaOther, rsaCiphertext) || bytes.Equal(hybridOther, hybridCiphertext) {
+		t.Fatal("ciphertexts are the same with another seed")
+	}
+}
@@ -0,0 +1,32 @@
+package crypto
+
+import (
+	"crypto/ecdh"
+)
+
+const X25519KeySize = 32
+
+// X25519PublicKey returns the key share to send for an X25519 private key.
+func X25519PublicKey(privateKey []byte) ([]byte, error) {
+	key, err := ecdh.X25519().NewPrivateKey(privateKey)
+	if err != nil {
+		return nil, err
+	}
+
+	return key.PublicKey().Bytes(), nil
+}
+
+// X25519 returns the secret shared between privateKey and the owner of
+// peerShare.
+func X25519(privateKey, peerShare []byte) ([]byte, error) {
+	key, err := ecdh.X25519().NewPrivateKey(privateKey)
+	if err != nil {
+		return nil, err
+	}
+	peerKey, err := ecdh.X25519().NewPublicKey(peerShare)
+	if err != nil {
+		return nil, err
+	}
+
+	return key.ECDH(peerKey)
+}
@@ -0,0 +1,80 @@
+package crypto
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	"golang.org/x/crypto/hkdf"
+)
+
+const (
+	exportLabelPrefix = "wulam "
+	maxExportLabel    = 255 - len(exportLabelPrefix)
+	MaxExportLength   = 255 * sha256.Size
+)
+
+var (
+	ErrExport       = errors.New("invalid export request")
+	errExportLabel  = fmt.Errorf("%w: label must be between 1 and %d bytes", ErrExport, maxExportLabel)
+	errExportLength = fmt.Errorf("%w: length must be between 1 and %d bytes", ErrExport, MaxExportLength)
+)
+
+// ExportKey derives keying material from secret the way TLS 1.3 exporters do
+// (RFC 8446, section 7.5): a label-specific secret is derived first and then
+// expanded under the hash of context, so the secret itself is never revealed
+// and different labels or contexts give independent keys.
+func ExportKey(secret []byte, label string, context []byte, length int) ([]byte, error) {
+	if len(label) == 0 || len(label) > maxExportLabel {
+		return nil, errExportLabel
+	}
+	if length <= 0 || length > MaxExportLength {
+		return nil, errExportLength
+	}
+
+	prk := hkdf.Extract(sha256.New, secret, nil)
+
+	emptyHash := sha256.Sum256(nil)
+	exporterSecret, err := expandLabel(prk, label, emptyHash[:], sha256.Size)
+	if err != nil {
+		return nil, err
+	}
+
+	contextHash := sha256.Sum256(context)
+	return expandLabel(exporterSecret, "exporter", contextHash[:], length)
+}
+
+// expandLabel is HKDF-Expand-Label with this protocol's label prefix.
+func expandLabel(secret []byte, label string, context []byte, length int) ([]byte, error) {
+	fullLabel := exportLabelPrefix + label
+
+	info := make([]byte, 0, 2+1+len(fullLabel)+1+len(context))
+	info = binary.BigEndian.AppendUint16(info, uint16(length))
+	info = append(info, byte(len(fullLabel)))
+	info = append(info, fullLabel...)
+	info = append(info, byte(len(context)))
+	info = append(info, context...)
+
+	out := make([]byte, length)
+	if _, err := io.ReadFull(hkdf.Expand(sha256.New, secret, info), out); err != nil {
+		return nil, err
+	}
+
+	return out, nil
+}
+
+// MixSecret derives a key as long as key from both key and secret, so that
+// the result stays unknown to anyone who lacks either of them. context binds
+// the result to where it is used.
+func MixSecret(key, secret []byte, label string, context []byte) ([]byte, error) {
+	if len(label) == 0 || len(label) > maxExportLabel {
+		return nil, errExportLabel
+	}
+
+	prk := hkdf.Extract(sha256.New, secret, key)
+
+	contextHash := sha256.Sum256(context)
+	return expandLabel(prk, label, contextHash[:], len(key))
+}
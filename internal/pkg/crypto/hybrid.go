@@ -0,0 +1,95 @@
+package crypto
+
+import (
+	"crypto/mlkem"
+	"crypto/rsa"
+	"crypto/sha256"
+	"errors"
+	"slices"
+
+	"golang.org/x/crypto/hkdf"
+)
+
+// hybridSecretSize is the size of the secret encrypted under the RSA key.
+const hybridSecretSize = 32
+
+var errHybridCiphertext = errors.New("invalid hybrid ciphertext")
+
+// EncryptHybrid encrypts plaintext so that both the recipient's RSA and
+// ML-KEM private keys are needed to decrypt it: a random secret is encrypted
+// under the RSA key, another one is encapsulated to the ML-KEM key, and
+// plaintext is sealed with AES-GCM under a key derived from both. The result
+// is the RSA ciphertext, the ML-KEM ciphertext, the AES-GCM nonce and the
+// sealed plaintext. The secrets and the nonce come from random.
+func EncryptHybrid(plaintext []byte, rsaKey *rsa.PublicKey, kemKey *mlkem.EncapsulationKey768, random Random) ([]byte, error) {
+	if rsaKey == nil || kemKey == nil {
+		return nil, errHybridCiphertext
+	}
+
+	rsaSecret, err := random.GenerateKey(hybridSecretSize)
+	if err != nil {
+		return nil, err
+	}
+	rsaCiphertext := EncryptRSAKey(rsaSecret, rsaKey, random)
+	if len(rsaCiphertext) == 0 {
+		return nil, errHybridCiphertext
+	}
+	kemSecret, kemCiphertext, err := Encapsulate768(kemKey, random)
+	if err != nil {
+		return nil, err
+	}
+
+	header := slices.Concat(rsaCiphertext, kemCiphertext)
+	key, err := hybridKey(rsaSecret, kemSecret, header)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce, err := random.GenerateKey(AEADNonceSize)
+	if err != nil {
+		return nil, err
+	}
+	sealed, err := EncryptAEAD(plaintext, key, nonce, header)
+	if err != nil {
+		return nil, err
+	}
+
+	return slices.Concat(header, nonce, sealed), nil
+}
+
+// DecryptHybrid opens a ciphertext made by EncryptHybrid.
+func DecryptHybrid(ciphertext []byte, rsaKey *rsa.PrivateKey, kemKey *mlkem.DecapsulationKey768) ([]byte, error) {
+	if rsaKey == nil || kemKey == nil {
+		return nil, errHybridCiphertext
+	}
+
+	headerSize := rsaKey.Size() + mlkem.CiphertextSize768
+	if len(ciphertext) < headerSize+AEADNonceSize {
+		return nil, errHybridCiphertext
+	}
+	header := ciphertext[:headerSize]
+
+	rsaSecret := DecryptRSAKey(header[:rsaKey.Size()], rsaKey)
+	if len(rsaSecret) != hybridSecretSize {
+		return nil, errHybridCiphertext
+	}
+	kemSecret, err := kemKey.Decapsulate(header[rsaKey.Size():])
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := hybridKey(rsaSecret, kemSecret, header)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := ciphertext[headerSize : headerSize+AEADNonceSize]
+	return DecryptAEAD(ciphertext[headerSize+AEADNonceSize:], key, nonce, header)
+}
+
+func hybridKey(rsaSecret, kemSecret, header []byte) ([]byte, error) {
+	prk := hkdf.Extract(sha256.New, slices.Concat(rsaSecret, kemSecret), nil)
+	headerHash := sha256.Sum256(header)
+
+	return expandLabel(prk, "hybrid", headerHash[:], AEADKeySize)
+}
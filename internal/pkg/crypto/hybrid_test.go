@@ -0,0 +1,116 @@
+package crypto
+
+import (
+	"bytes"
+	"crypto/mlkem"
+	"errors"
+	"testing"
+)
+
+var hybridMessage = []byte("session certificate")
+
+func TestHybridRoundTrip(t *testing.T) {
+	k := loadTestKey(t)
+	kemKey, err := mlkem.GenerateKey768()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ciphertext, err := EncryptHybrid(hybridMessage, &k.key.PublicKey, kemKey.EncapsulationKey(), newTestRNG(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	plaintext, err := DecryptHybrid(ciphertext, k.key, kemKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(plaintext, hybridMessage) {
+		t.Fatalf("decrypted %q, want %q", plaintext, hybridMessage)
+	}
+
+	// Both private keys are needed.
+	otherKEMKey, err := mlkem.GenerateKey768()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := DecryptHybrid(ciphertext, k.key, otherKEMKey); err == nil {
+		t.Fatal("ciphertext was decrypted with another ML-KEM key")
+	}
+}
+
+// TestHybridRejectsTampering changes one byte of each part of a ciphertext
+// and checks that it is no longer decrypted.
+func TestHybridRejectsTampering(t *testing.T) {
+	k := loadTestKey(t)
+	kemKey, err := mlkem.GenerateKey768()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ciphertext, err := EncryptHybrid(hybridMessage, &k.key.PublicKey, kemKey.EncapsulationKey(), newTestRNG(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rsaSize := k.key.Size()
+	tests := []struct {
+		name   string
+		tamper func(c []byte) []byte
+	}{
+		{"RSA ciphertext", flipByte(0)},
+		{"ML-KEM ciphertext", flipByte(rsaSize)},
+		{"nonce", flipByte(rsaSize + mlkem.CiphertextSize768)},
+		{"sealed plaintext", flipByte(rsaSize + mlkem.CiphertextSize768 + AEADNonceSize)},
+		{"tag", flipByte(len(ciphertext) - 1)},
+		{"truncated", func(c []byte) []byte { return c[:rsaSize+mlkem.CiphertextSize768] }},
+		{"empty", func([]byte) []byte { return nil }},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tampered := tt.tamper(bytes.Clone(ciphertext))
+			if plaintext, err := DecryptHybrid(tampered, k.key, kemKey); err == nil {
+				t.Fatalf("tampered ciphertext was decrypted to %q", plaintext)
+			}
+		})
+	}
+}
+
+// TestEncryptionFailsWithRandom checks that nothing is encrypted once the
+// RNG has failed, even where crypto/rand supplies the randomness.
+func TestEncryptionFailsWithRandom(t *testing.T) {
+	k := loadTestKey(t)
+	kemKey, err := mlkem.GenerateKey768()
+	if err != nil {
+		t.Fatal(err)
+	}
+	random := failedRandom{errors.New("rng failed")}
+
+	if c := EncryptRSAKey(rsaMessage, &k.key.PublicKey, random); len(c) != 0 {
+		t.Error("RSA encryption succeeded with a failed RNG")
+	}
+	if _, _, err := Encapsulate768(kemKey.EncapsulationKey(), random); err == nil {
+		t.Error("ML-KEM encapsulation succeeded with a failed RNG")
+	}
+	if _, err := EncryptHybrid(hybridMessage, &k.key.PublicKey, kemKey.EncapsulationKey(), random); err == nil {
+		t.Error("hybrid encryption succeeded with a failed RNG")
+	}
+}
+
+func flipByte(i int) func(c []byte) []byte {
+	return func(c []byte) []byte {
+		c[i] ^= 0x01
+		return c
+	}
+}
+
+type failedRandom struct {
+	err error
+}
+
+func (r failedRandom) GenerateKey(int) ([]byte, error) {
+	return nil, r.err
+}
+
+func (r failedRandom) Err() error {
+	return r.err
+}
@@ -0,0 +1,69 @@
+package crypto
+
+import (
+	"crypto/sha256"
+
+	"golang.org/x/crypto/hkdf"
+)
+
+// The labels the session keys are derived with.
+const (
+	confirmationLabel        = "confirmation"
+	initiatorToAcceptorLabel = "initiator to acceptor"
+	acceptorToInitiatorLabel = "acceptor to initiator"
+	exporterLabel            = "exporter"
+)
+
+// SessionKeys are the keys a session key is split into, so that no key is
+// used for more than one purpose or in more than one direction.
+type SessionKeys struct {
+	// Confirmation encrypts N_B at step 7 and keys the handshake
+	// confirmations.
+	Confirmation        []byte
+	InitiatorToAcceptor []byte
+	AcceptorToInitiator []byte
+	// Exporter is the secret keys for applications, streams, tunnels and
+	// file transfers are exported from.
+	Exporter []byte
+}
+
+// DeriveSessionKeys splits sessionKey with HKDF. Each key is bound to its
+// purpose, the session ID and both agent IDs, so keys of different sessions
+// or agents never coincide even if the session key does.
+func DeriveSessionKeys(sessionKey []byte, sessionID, initiator, acceptor string) (SessionKeys, error) {
+	prk := hkdf.Extract(sha256.New, sessionKey, nil)
+
+	t := NewTranscript()
+	t.Add([]byte(sessionID), []byte(initiator), []byte(acceptor))
+	context := t.Sum()
+
+	var keys SessionKeys
+	for _, k := range []struct {
+		key   *[]byte
+		label string
+	}{
+		{&keys.Confirmation, confirmationLabel},
+		{&keys.InitiatorToAcceptor, initiatorToAcceptorLabel},
+		{&keys.AcceptorToInitiator, acceptorToInitiatorLabel},
+		{&keys.Exporter, exporterLabel},
+	} {
+		key, err := expandLabel(prk, k.label, context, len(sessionKey))
+		if err != nil {
+			return SessionKeys{}, err
+		}
+		*k.key = key
+	}
+
+	return keys, nil
+}
+
+// LegacySessionKeys uses sessionKey for everything, the way agents that
+// predate DeriveSessionKeys do.
+func LegacySessionKeys(sessionKey []byte) SessionKeys {
+	return SessionKeys{
+		Confirmation:        sessionKey,
+		InitiatorToAcceptor: sessionKey,
+		AcceptorToInitiator: sessionKey,
+		Exporter:            sessionKey,
+	}
+}
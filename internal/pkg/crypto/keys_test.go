@@ -0,0 +1,82 @@
+package crypto
+
+import (
+	"bytes"
+	"slices"
+	"testing"
+)
+
+func TestDeriveSessionKeys(t *testing.T) {
+	sessionKey := bytes.Repeat([]byte{7}, AEADKeySize)
+	keys := deriveTestKeys(t, sessionKey, "session", "alice", "bob")
+
+	again := deriveTestKeys(t, sessionKey, "session", "alice", "bob")
+	if !slices.EqualFunc(keyList(keys), keyList(again), bytes.Equal) {
+		t.Fatal("the same session key was split differently")
+	}
+
+	// No key is used for two purposes, or is the session key itself.
+	seen := [][]byte{sessionKey}
+	for _, key := range keyList(keys) {
+		if len(key) != len(sessionKey) {
+			t.Fatalf("derived a %d-byte key from a %d-byte session key", len(key), len(sessionKey))
+		}
+		for _, other := range seen {
+			if bytes.Equal(key, other) {
+				t.Fatalf("key %x is derived twice", key)
+			}
+		}
+		seen = append(seen, key)
+	}
+
+	tests := []struct {
+		name       string
+		sessionKey []byte
+		sessionID  string
+		initiator  string
+		acceptor   string
+	}{
+		{"another session key", bytes.Repeat([]byte{8}, AEADKeySize), "session", "alice", "bob"},
+		{"another session", sessionKey, "session2", "alice", "bob"},
+		{"another initiator", sessionKey, "session", "carol", "bob"},
+		{"another acceptor", sessionKey, "session", "alice", "carol"},
+		{"roles swapped", sessionKey, "session", "bob", "alice"},
+		{"IDs shifted", sessionKey, "session", "alic", "ebob"},
+		{"ID moved into the session", sessionKey, "sessionalice", "", "bob"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			other := deriveTestKeys(t, tt.sessionKey, tt.sessionID, tt.initiator, tt.acceptor)
+			for i, key := range keyList(other) {
+				if bytes.Equal(key, keyList(keys)[i]) {
+					t.Fatalf("key %d is the same as for alice and bob in session", i)
+				}
+			}
+		})
+	}
+}
+
+func TestLegacySessionKeys(t *testing.T) {
+	sessionKey := bytes.Repeat([]byte{7}, AEADKeySize)
+	for i, key := range keyList(LegacySessionKeys(sessionKey)) {
+		if !bytes.Equal(key, sessionKey) {
+			t.Fatalf("legacy key %d is not the session key", i)
+		}
+	}
+}
+
+func deriveTestKeys(t *testing.T, sessionKey []byte, sessionID, initiator, acceptor string) SessionKeys {
+	t.Helper()
+
+	keys, err := DeriveSessionKeys(sessionKey, sessionID, initiator, acceptor)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return keys
+}
+
+func keyList(keys SessionKeys) [][]byte {
+	return [][]byte{keys.Confirmation, keys.InitiatorToAcceptor, keys.AcceptorToInitiator, keys.Exporter}
+}
@@ -0,0 +1,15 @@
+package crypto
+
+import "golang.org/x/crypto/scrypt"
+
+// Parameters recommended for interactive logins by the scrypt package.
+const (
+	scryptN = 1 << 15
+	scryptR = 8
+	scryptP = 1
+)
+
+// PassphraseKey stretches a passphrase into an AEAD key with scrypt.
+func PassphraseKey(passphrase, salt []byte) ([]byte, error) {
+	return scrypt.Key(passphrase, salt, scryptN, scryptR, scryptP, AEADKeySize)
+}
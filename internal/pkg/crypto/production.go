@@ -0,0 +1,33 @@
+//go:build !deterministic
+
+package crypto
+
+import (
+	"crypto/mlkem"
+	"crypto/rand"
+	"crypto/rsa"
+)
+
+// Outside deterministic builds, RSA padding and ML-KEM encapsulation take
+// their randomness from crypto/rand rather than from random: crypto/rsa
+// ignores any other source and crypto/mlkem takes none. They still refuse to
+// run once random has failed, as everything else drawing from it does.
+
+func encryptPKCS1v15(plaintext []byte, publicKey *rsa.PublicKey, random Random) ([]byte, error) {
+	if err := random.Err(); err != nil {
+		return nil, err
+	}
+
+	return rsa.EncryptPKCS1v15(rand.Reader, publicKey, plaintext)
+}
+
+// Encapsulate768 returns a shared secret and the ciphertext that gives it to
+// the owner of key.
+func Encapsulate768(key *mlkem.EncapsulationKey768, random Random) (secret, ciphertext []byte, err error) {
+	if err := random.Err(); err != nil {
+		return nil, nil, err
+	}
+	secret, ciphertext = key.Encapsulate()
+
+	return secret, ciphertext, nil
+}
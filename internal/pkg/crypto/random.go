@@ -0,0 +1,9 @@
+package crypto
+
+// Random is where the secrets, nonces and padding of the functions in this
+// package come from.
+type Random interface {
+	GenerateKey(bytes int) ([]byte, error)
+	// Err returns why Random stopped generating, or nil if it is healthy.
+	Err() error
+}
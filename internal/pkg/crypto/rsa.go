@@ -0,0 +1,76 @@
+package crypto
+
+import (
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	"slices"
+)
+
+// The functions below do what EncryptRSA, DecryptRSA, SignRSA and VerifyRSA
+// do, with keys that have already been parsed, so that hot paths do not
+// parse a PEM key on every call. Their output is interchangeable with
+// dongle's: long plaintexts are split into PKCS #1 v1.5 blocks the same way
+// and signatures are PKCS #1 v1.5 with SHA-256. EncryptRSAKey takes its
+// padding from random.
+
+// pkcs1Overhead is the padding PKCS #1 v1.5 encryption adds to each block.
+const pkcs1Overhead = 11
+
+func EncryptRSAKey(plaintext []byte, publicKey *rsa.PublicKey, random Random) []byte {
+	if publicKey == nil || len(plaintext) == 0 {
+		return []byte{}
+	}
+
+	ciphertext := make([]byte, 0, (len(plaintext)/(publicKey.Size()-pkcs1Overhead)+1)*publicKey.Size())
+	for chunk := range slices.Chunk(plaintext, publicKey.Size()-pkcs1Overhead) {
+		block, err := encryptPKCS1v15(chunk, publicKey, random)
+		if err != nil {
+			return []byte{}
+		}
+		ciphertext = append(ciphertext, block...)
+	}
+
+	return ciphertext
+}
+
+func DecryptRSAKey(ciphertext []byte, privateKey *rsa.PrivateKey) []byte {
+	if privateKey == nil || len(ciphertext) == 0 {
+		return []byte{}
+	}
+
+	plaintext := make([]byte, 0, len(ciphertext))
+	for chunk := range slices.Chunk(ciphertext, privateKey.Size()) {
+		block, err := rsa.DecryptPKCS1v15(nil, privateKey, chunk)
+		if err != nil {
+			return []byte{}
+		}
+		plaintext = append(plaintext, block...)
+	}
+
+	return plaintext
+}
+
+func SignRSAKey(message []byte, privateKey *rsa.PrivateKey) []byte {
+	if privateKey == nil || len(message) == 0 {
+		return []byte{}
+	}
+
+	hashed := sha256.Sum256(message)
+	signature, err := rsa.SignPKCS1v15(nil, privateKey, crypto.SHA256, hashed[:])
+	if err != nil {
+		return []byte{}
+	}
+
+	return signature
+}
+
+func VerifyRSAKey(message, signature []byte, publicKey *rsa.PublicKey) bool {
+	if publicKey == nil || len(message) == 0 {
+		return false
+	}
+
+	hashed := sha256.Sum256(message)
+
+	return rsa.VerifyPKCS1v15(publicKey, crypto.SHA256, hashed[:], signature) == nil
+}
@@ -0,0 +1,106 @@
+package crypto
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"sync"
+	"testing"
+
+	"github.com/sudeeya/key-exchange/internal/pkg/pem"
+	"github.com/sudeeya/key-exchange/internal/pkg/rng"
+)
+
+type testKey struct {
+	key        *rsa.PrivateKey
+	privatePEM []byte
+	publicPEM  []byte
+}
+
+var newTestKey = sync.OnceValues(func() (testKey, error) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return testKey{}, err
+	}
+
+	return testKey{
+		key:        key,
+		privatePEM: pem.EncodeRSAPrivateKey(key),
+		publicPEM:  pem.EncodeRSAPublicKey(&key.PublicKey),
+	}, nil
+})
+
+func loadTestKey(tb testing.TB) testKey {
+	tb.Helper()
+
+	k, err := newTestKey()
+	if err != nil {
+		tb.Fatal(err)
+	}
+
+	return k
+}
+
+func newTestRNG(tb testing.TB) rng.RNG {
+	tb.Helper()
+
+	random, err := rng.NewRNG()
+	if err != nil {
+		tb.Fatal(err)
+	}
+
+	return random
+}
+
+// A message long enough to be split into several blocks.
+var rsaMessage = bytes.Repeat([]byte("wu-lam"), 100)
+
+// TestRSAKeyInteroperatesWithPEM makes sure that the functions taking parsed
+// keys produce what the PEM ones accept and the other way round, so that
+// upgraded and older agents can talk to each other.
+func TestRSAKeyInteroperatesWithPEM(t *testing.T) {
+	k := loadTestKey(t)
+	random := newTestRNG(t)
+
+	if got := DecryptRSAKey(EncryptRSA(rsaMessage, k.publicPEM), k.key); !bytes.Equal(got, rsaMessage) {
+		t.Error("DecryptRSAKey cannot decrypt what EncryptRSA encrypts")
+	}
+	if got := DecryptRSA(EncryptRSAKey(rsaMessage, &k.key.PublicKey, random), k.privatePEM); !bytes.Equal(got, rsaMessage) {
+		t.Error("DecryptRSA cannot decrypt what EncryptRSAKey encrypts")
+	}
+	if !VerifyRSAKey(rsaMessage, SignRSA(rsaMessage, k.privatePEM), &k.key.PublicKey) {
+		t.Error("VerifyRSAKey cannot verify what SignRSA signs")
+	}
+	if !VerifyRSA(rsaMessage, SignRSAKey(rsaMessage, k.key), k.publicPEM) {
+		t.Error("VerifyRSA cannot verify what SignRSAKey signs")
+	}
+}
+
+// BenchmarkRSA compares the RSA operations with keys parsed from PEM on every
+// call to those with keys parsed once.
+func BenchmarkRSA(b *testing.B) {
+	k := loadTestKey(b)
+	random := newTestRNG(b)
+	ciphertext := EncryptRSAKey(rsaMessage, &k.key.PublicKey, random)
+	signature := SignRSAKey(rsaMessage, k.key)
+
+	for _, bench := range []struct {
+		name string
+		op   func()
+	}{
+		{"encrypt/pem", func() { EncryptRSA(rsaMessage, k.publicPEM) }},
+		{"encrypt/parsed", func() { EncryptRSAKey(rsaMessage, &k.key.PublicKey, random) }},
+		{"decrypt/pem", func() { DecryptRSA(ciphertext, k.privatePEM) }},
+		{"decrypt/parsed", func() { DecryptRSAKey(ciphertext, k.key) }},
+		{"sign/pem", func() { SignRSA(rsaMessage, k.privatePEM) }},
+		{"sign/parsed", func() { SignRSAKey(rsaMessage, k.key) }},
+		{"verify/pem", func() { VerifyRSA(rsaMessage, signature, k.publicPEM) }},
+		{"verify/parsed", func() { VerifyRSAKey(rsaMessage, signature, &k.key.PublicKey) }},
+	} {
+		b.Run(bench.name, func(b *testing.B) {
+			for range b.N {
+				bench.op()
+			}
+		})
+	}
+}
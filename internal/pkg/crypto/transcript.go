@@ -0,0 +1,80 @@
+package crypto
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding"
+	"encoding/binary"
+	"hash"
+
+	"golang.org/x/crypto/hkdf"
+)
+
+// The labels of the confirmations each side sends at the end of a handshake.
+const (
+	InitiatorFinished = "initiator finished"
+	AcceptorFinished  = "acceptor finished"
+)
+
+// Transcript is a running hash of the messages of a handshake. Each message
+// is prefixed with its length, so that different sequences of messages never
+// hash the same.
+type Transcript struct {
+	h hash.Hash
+}
+
+func NewTranscript() *Transcript {
+	return &Transcript{h: sha256.New()}
+}
+
+func (t *Transcript) Add(messages ...[]byte) {
+	for _, m := range messages {
+		t.h.Write(binary.BigEndian.AppendUint32(nil, uint32(len(m))))
+		t.h.Write(m)
+	}
+}
+
+func (t *Transcript) Sum() []byte {
+	return t.h.Sum(nil)
+}
+
+// Clone returns a copy of t, so that messages that may turn out to be forged
+// can be added without changing t.
+func (t *Transcript) Clone() (*Transcript, error) {
+	state, err := t.h.(encoding.BinaryMarshaler).MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+
+	h := sha256.New()
+	if err := h.(encoding.BinaryUnmarshaler).UnmarshalBinary(state); err != nil {
+		return nil, err
+	}
+
+	return &Transcript{h: h}, nil
+}
+
+// Confirmation proves knowledge of key and agreement on transcript the way
+// TLS 1.3 Finished messages do (RFC 8446, section 4.4.4). label tells the
+// side that sends it, so that one side's confirmation cannot be reflected as
+// the other's.
+func Confirmation(key []byte, label string, transcript []byte) ([]byte, error) {
+	finishedKey, err := expandLabel(hkdf.Extract(sha256.New, key, nil), label, nil, sha256.Size)
+	if err != nil {
+		return nil, err
+	}
+
+	mac := hmac.New(sha256.New, finishedKey)
+	mac.Write(transcript)
+
+	return mac.Sum(nil), nil
+}
+
+func VerifyConfirmation(key []byte, label string, transcript, confirmation []byte) bool {
+	expected, err := Confirmation(key, label, transcript)
+	if err != nil {
+		return false
+	}
+
+	return hmac.Equal(expected, confirmation)
+}
@@ -0,0 +1,53 @@
+package metrics
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestLabelValuesUseExpositionEscaping(t *testing.T) {
+	r := NewRegistry()
+	c := r.NewCounter("test_total", "Help with a \\ and a\nnew line.", "peer")
+	c.Inc("ünïcode \x01 \"quoted\" back\\slash\nline")
+
+	var out strings.Builder
+	r.Write(&out)
+
+	for _, want := range []string{
+		`# HELP test_total Help with a \\ and a\nnew line.`,
+		"test_total{peer=\"ünïcode \x01 \\\"quoted\\\" back\\\\slash\\nline\"} 1",
+	} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("output does not contain %q:\n%s", want, out.String())
+		}
+	}
+}
+
+func TestLabelValuesAreKeptApart(t *testing.T) {
+	r := NewRegistry()
+	c := r.NewCounter("test_total", "Help.", "from", "to")
+	h := r.NewHistogram("test_seconds", "Help.", []float64{1}, "from", "to")
+	for _, values := range [][]string{
+		{"a\xffb", "c"},
+		{"a", "b\xffc"},
+		{"a\",to=\"b", "c"},
+	} {
+		c.Inc(values...)
+		h.Observe(0.5, values...)
+	}
+
+	var out strings.Builder
+	r.Write(&out)
+
+	for _, want := range []string{
+		"test_total{from=\"a\xffb\",to=\"c\"} 1",
+		"test_total{from=\"a\",to=\"b\xffc\"} 1",
+		`test_total{from="a\",to=\"b",to="c"} 1`,
+		"test_seconds_bucket{from=\"a\xffb\",to=\"c\",le=\"1\"} 1",
+		"test_seconds_count{from=\"a\",to=\"b\xffc\"} 1",
+	} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("output does not contain %q:\n%s", want, out.String())
+		}
+	}
+}
@@ -0,0 +1,146 @@
+package middleware
+
+import (
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// pruneThreshold is the number of buckets a RateLimiter keeps before it
+// starts dropping idle ones.
+const pruneThreshold = 1024
+
+// RateLimiter keeps a token bucket for each key, such as a client address
+// or an agent ID. A nil RateLimiter allows everything.
+type RateLimiter struct {
+	limit rate.Limit
+	burst int
+	// Buckets idle for longer than this are full again and can be dropped.
+	idle time.Duration
+
+	mu      sync.Mutex
+	buckets map[string]*bucket
+}
+
+type bucket struct {
+	limiter *rate.Limiter
+	seen    time.Time
+}
+
+// NewRateLimiter allows perSecond requests per key on average and bursts of
+// up to burst requests. It returns nil if perSecond is not positive.
+func NewRateLimiter(perSecond float64, burst int) *RateLimiter {
+	if perSecond <= 0 {
+		return nil
+	}
+	burst = max(burst, 1)
+
+	return &RateLimiter{
+		limit:   rate.Limit(perSecond),
+		burst:   burst,
+		idle:    time.Duration(float64(burst) / perSecond * float64(time.Second)),
+		buckets: make(map[string]*bucket),
+	}
+}
+
+// Allow takes a token for key. If there is none, it returns how long the
+// caller should wait before trying again.
+func (l *RateLimiter) Allow(key string) (bool, time.Duration) {
+	if l == nil {
+		return true, 0
+	}
+
+	now := time.Now()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if len(l.buckets) >= pruneThreshold {
+		for k, b := range l.buckets {
+			if now.Sub(b.seen) > l.idle {
+				delete(l.buckets, k)
+			}
+		}
+	}
+
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &bucket{limiter: rate.NewLimiter(l.limit, l.burst)}
+		l.buckets[key] = b
+	}
+	b.seen = now
+
+	reservation := b.limiter.ReserveN(now, 1)
+	if delay := reservation.DelayFrom(now); delay > 0 {
+		reservation.CancelAt(now)
+		return false, delay
+	}
+
+	return true, 0
+}
+
+// Reject responds with status and a Retry-After header rounded up to whole
+// seconds.
+func Reject(w http.ResponseWriter, status int, retryAfter time.Duration, message string) {
+	seconds := max(int(math.Ceil(retryAfter.Seconds())), 1)
+	w.Header().Set("Retry-After", strconv.Itoa(seconds))
+	http.Error(w, message, status)
+}
+
+// WithRateLimit limits requests per client IP address.
+func WithRateLimit(limiter *RateLimiter) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			host, _, err := net.SplitHostPort(r.RemoteAddr)
+			if err != nil {
+				host = r.RemoteAddr
+			}
+
+			if ok, retryAfter := limiter.Allow(host); !ok {
+				Reject(w, http.StatusTooManyRequests, retryAfter, "too many requests from "+host)
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// WithConcurrencyLimit serves at most limit requests at a time and turns
+// away the rest with 503 Service Unavailable. A limit of zero disables it.
+func WithConcurrencyLimit(limit int, retryAfter time.Duration) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		if limit <= 0 {
+			return next
+		}
+
+		slots := make(chan struct{}, limit)
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			select {
+			case slots <- struct{}{}:
+				defer func() { <-slots }()
+			default:
+				Reject(w, http.StatusServiceUnavailable, retryAfter, "server is busy")
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// WithBodyLimit caps request bodies at limit bytes. Reading past it fails
+// with *http.MaxBytesError.
+func WithBodyLimit(limit int64) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			r.Body = http.MaxBytesReader(w, r.Body, limit)
+			next.ServeHTTP(w, r)
+		})
+	}
+}
@@ -0,0 +1,201 @@
+package middleware
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRateLimiter(t *testing.T) {
+	tests := []struct {
+		name      string
+		perSecond float64
+		burst     int
+		// allowed is how many requests in a row pass for one key.
+		allowed int
+	}{
+		{"disabled", 0, 5, 100},
+		{"burst", 1, 3, 3},
+		{"burst of zero", 1, 0, 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := NewRateLimiter(tt.perSecond, tt.burst)
+			for i := range tt.allowed {
+				if ok, _ := l.Allow("alice"); !ok {
+					t.Fatalf("request %d was refused", i+1)
+				}
+			}
+			if l == nil {
+				return
+			}
+
+			ok, retryAfter := l.Allow("alice")
+			if ok {
+				t.Fatalf("request %d past the burst was allowed", tt.allowed+1)
+			}
+			if retryAfter <= 0 || retryAfter > time.Second {
+				t.Fatalf("retry after %s, want at most a second", retryAfter)
+			}
+			// A refused request does not use up a token.
+			if _, again := l.Allow("alice"); again > retryAfter {
+				t.Fatalf("retry after %s following a refusal, want at most %s", again, retryAfter)
+			}
+			if ok, _ := l.Allow("bob"); !ok {
+				t.Fatal("another key was limited")
+			}
+		})
+	}
+}
+
+func TestRateLimiterDropsIdleBuckets(t *testing.T) {
+	l := NewRateLimiter(1000, 1)
+	for i := range pruneThreshold {
+		l.Allow(strings.Repeat("x", i))
+	}
+	time.Sleep(2 * l.idle)
+
+	l.Allow("alice")
+	if n := len(l.buckets); n != 1 {
+		t.Fatalf("%d buckets kept, want only the new one", n)
+	}
+}
+
+func TestWithRateLimit(t *testing.T) {
+	handler := WithRateLimit(NewRateLimiter(1, 1))(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}))
+
+	tests := []struct {
+		name       string
+		remoteAddr string
+		status     int
+	}{
+		{"first request", "192.0.2.1:1000", http.StatusOK},
+		{"same address, another port", "192.0.2.1:2000", http.StatusTooManyRequests},
+		{"another address", "192.0.2.2:1000", http.StatusOK},
+		{"address without a port", "192.0.2.3", http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPost, "/", nil)
+			r.RemoteAddr = tt.remoteAddr
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, r)
+
+			if w.Code != tt.status {
+				t.Fatalf("got status %d, want %d", w.Code, tt.status)
+			}
+			if retryAfter := w.Header().Get("Retry-After"); (tt.status == http.StatusOK) != (retryAfter == "") {
+				t.Fatalf("Retry-After is %q with status %d", retryAfter, w.Code)
+			}
+		})
+	}
+}
+
+func TestWithConcurrencyLimit(t *testing.T) {
+	tests := []struct {
+		name  string
+		limit int
+		// busy is how many requests are held in the handler.
+		busy   int
+		status int
+	}{
+		{"free slot", 2, 1, http.StatusOK},
+		{"all slots taken", 2, 2, http.StatusServiceUnavailable},
+		{"disabled", 0, 2, http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			entered := make(chan struct{})
+			release := make(chan struct{})
+			handler := WithConcurrencyLimit(tt.limit, 3*time.Second)(http.HandlerFunc(func(_ http.ResponseWriter, r *http.Request) {
+				if r.URL.Path == "/hold" {
+					entered <- struct{}{}
+					<-release
+				}
+			}))
+
+			done := make(chan struct{})
+			for range tt.busy {
+				go func() {
+					handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/hold", nil))
+					done <- struct{}{}
+				}()
+				<-entered
+			}
+
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+			if w.Code != tt.status {
+				t.Fatalf("got status %d, want %d", w.Code, tt.status)
+			}
+			if tt.status == http.StatusServiceUnavailable && w.Header().Get("Retry-After") != "3" {
+				t.Fatalf("Retry-After is %q, want 3", w.Header().Get("Retry-After"))
+			}
+
+			close(release)
+			for range tt.busy {
+				<-done
+			}
+
+			// The slots are given back.
+			w = httptest.NewRecorder()
+			handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+			if w.Code != http.StatusOK {
+				t.Fatalf("got status %d after the requests finished", w.Code)
+			}
+		})
+	}
+}
+
+func TestWithBodyLimit(t *testing.T) {
+	tests := []struct {
+		name    string
+		body    string
+		tooLong bool
+	}{
+		{"within the limit", "0123456789", false},
+		{"past the limit", "0123456789a", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var err error
+			handler := WithBodyLimit(10)(http.HandlerFunc(func(_ http.ResponseWriter, r *http.Request) {
+				_, err = io.ReadAll(r.Body)
+			}))
+			handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/", strings.NewReader(tt.body)))
+
+			var maxBytesErr *http.MaxBytesError
+			if errors.As(err, &maxBytesErr) != tt.tooLong {
+				t.Fatalf("reading %d bytes returned %v", len(tt.body), err)
+			}
+		})
+	}
+}
+
+func TestRejectRoundsUp(t *testing.T) {
+	tests := []struct {
+		retryAfter time.Duration
+		want       string
+	}{
+		{0, "1"},
+		{100 * time.Millisecond, "1"},
+		{time.Second, "1"},
+		{1500 * time.Millisecond, "2"},
+	}
+
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		Reject(w, http.StatusTooManyRequests, tt.retryAfter, "slow down")
+		if got := w.Header().Get("Retry-After"); got != tt.want {
+			t.Errorf("Retry-After for %s is %s, want %s", tt.retryAfter, got, tt.want)
+		}
+	}
+}
@@ -3,6 +3,7 @@ package middleware
 import (
 	"bytes"
 	"encoding/json"
+	"errors"
 	"io"
 	"net/http"
 	"time"
@@ -38,6 +39,11 @@ func WithLogging(logger *zap.Logger) func(http.Handler) http.Handler {
 
 			reqBody, err := io.ReadAll(r.Body)
 			if err != nil {
+				var maxBytesErr *http.MaxBytesError
+				if errors.As(err, &maxBytesErr) {
+					http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+					return
+				}
 				http.Error(w, err.Error(), http.StatusInternalServerError)
 				return
 			}
@@ -68,6 +74,10 @@ func WithLogging(logger *zap.Logger) func(http.Handler) http.Handler {
 }
 
 func formatWithIndent(raw []byte) ([]byte, error) {
+	if len(raw) == 0 {
+		return raw, nil
+	}
+
 	var data map[string]any
 	if err := json.Unmarshal(raw, &data); err != nil {
 		return nil, err
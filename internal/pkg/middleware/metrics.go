@@ -0,0 +1,60 @@
+package middleware
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/chi/v5/middleware"
+
+	"github.com/sudeeya/key-exchange/internal/pkg/metrics"
+)
+
+const unmatchedRoute = "unmatched"
+
+type HTTPMetrics struct {
+	requests *metrics.Counter
+	duration *metrics.Histogram
+}
+
+func NewHTTPMetrics(registry *metrics.Registry, namespace string) *HTTPMetrics {
+	return &HTTPMetrics{
+		requests: registry.NewCounter(
+			namespace+"_http_requests_total",
+			"Total number of HTTP requests by endpoint, method and status code.",
+			"endpoint", "method", "status",
+		),
+		duration: registry.NewHistogram(
+			namespace+"_http_request_duration_seconds",
+			"HTTP request latency by endpoint.",
+			metrics.DefaultBuckets,
+			"endpoint",
+		),
+	}
+}
+
+func WithMetrics(m *HTTPMetrics) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			start := time.Now()
+
+			rw := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+
+			next.ServeHTTP(rw, r)
+
+			endpoint := unmatchedRoute
+			if rctx := chi.RouteContext(r.Context()); rctx != nil && rctx.RoutePattern() != "" {
+				endpoint = rctx.RoutePattern()
+			}
+
+			status := rw.Status()
+			if status == 0 {
+				status = http.StatusOK
+			}
+
+			m.requests.Inc(endpoint, r.Method, strconv.Itoa(status))
+			m.duration.Observe(time.Since(start).Seconds(), endpoint)
+		})
+	}
+}
@@ -0,0 +1,87 @@
+package pem
+
+import (
+	"bytes"
+	"crypto/mlkem"
+	"encoding/pem"
+	"errors"
+	"os"
+)
+
+const (
+	MLKEMPrivateKeyBlockType = "ML-KEM-768 PRIVATE KEY"
+	MLKEMPublicKeyBlockType  = "ML-KEM-768 PUBLIC KEY"
+)
+
+// EncodeMLKEMPrivateKey encodes the 64-byte seed the key is generated from.
+func EncodeMLKEMPrivateKey(key *mlkem.DecapsulationKey768) []byte {
+	var privateKeyPEM bytes.Buffer
+	pem.Encode(&privateKeyPEM, &pem.Block{
+		Type:  MLKEMPrivateKeyBlockType,
+		Bytes: key.Bytes(),
+	})
+
+	return privateKeyPEM.Bytes()
+}
+
+func SaveMLKEMPrivateKey(key *mlkem.DecapsulationKey768, file string) error {
+	if err := os.WriteFile(file, EncodeMLKEMPrivateKey(key), 0666); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func ExtractMLKEMPrivateKey(file string) ([]byte, error) {
+	key, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	return key, nil
+}
+
+func EncodeMLKEMPublicKey(key *mlkem.EncapsulationKey768) []byte {
+	var publicKeyPEM bytes.Buffer
+	pem.Encode(&publicKeyPEM, &pem.Block{
+		Type:  MLKEMPublicKeyBlockType,
+		Bytes: key.Bytes(),
+	})
+
+	return publicKeyPEM.Bytes()
+}
+
+func SaveMLKEMPublicKey(key *mlkem.EncapsulationKey768, file string) error {
+	if err := os.WriteFile(file, EncodeMLKEMPublicKey(key), 0666); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func ExtractMLKEMPublicKey(file string) ([]byte, error) {
+	key, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	return key, nil
+}
+
+func ParseMLKEMPrivateKey(data []byte) (*mlkem.DecapsulationKey768, error) {
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != MLKEMPrivateKeyBlockType {
+		return nil, errors.New("failed to decode PEM block containing ML-KEM private key")
+	}
+
+	return mlkem.NewDecapsulationKey768(block.Bytes)
+}
+
+func ParseMLKEMPublicKey(data []byte) (*mlkem.EncapsulationKey768, error) {
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != MLKEMPublicKeyBlockType {
+		return nil, errors.New("failed to decode PEM block containing ML-KEM public key")
+	}
+
+	return mlkem.NewEncapsulationKey768(block.Bytes)
+}
@@ -0,0 +1,60 @@
+//go:build deterministic
+
+package rng
+
+import (
+	"crypto/sha256"
+	"math/rand/v2"
+	"sync"
+)
+
+// New returns an RNG that repeats the same output for the same seed, or the
+// DRBG if seed is empty.
+func New(seed string) (RNG, error) {
+	if seed == "" {
+		return NewRNG()
+	}
+
+	return NewDeterministicRNG(seed), nil
+}
+
+func IsDeterministic(rng RNG) bool {
+	_, ok := rng.(*deterministicRNG)
+	return ok
+}
+
+// deterministicRNG expands a seed with ChaCha8, so that handshakes can be
+// replayed with the same nonces and keys. Its output is as predictable as
+// its seed.
+type deterministicRNG struct {
+	mu     sync.Mutex
+	source *rand.ChaCha8
+}
+
+func NewDeterministicRNG(seed string) RNG {
+	return &deterministicRNG{source: rand.NewChaCha8(sha256.Sum256([]byte(seed)))}
+}
+
+func (rng *deterministicRNG) GenerateNonce() ([]byte, error) {
+	return rng.GenerateKey(NonceSize)
+}
+
+func (rng *deterministicRNG) GenerateIV() ([]byte, error) {
+	return rng.GenerateKey(IVSize)
+}
+
+func (rng *deterministicRNG) Err() error {
+	return nil
+}
+
+func (rng *deterministicRNG) GenerateKey(bytes int) ([]byte, error) {
+	rng.mu.Lock()
+	defer rng.mu.Unlock()
+
+	key := make([]byte, bytes)
+	if _, err := rng.source.Read(key); err != nil {
+		return nil, err
+	}
+
+	return key, nil
+}
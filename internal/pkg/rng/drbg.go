@@ -0,0 +1,102 @@
+package rng
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"errors"
+)
+
+const (
+	// securityStrength is the security strength of HMAC_DRBG with SHA-256,
+	// in bytes.
+	securityStrength = 32
+	// maxRequestSize is the most a single generate call may return
+	// (SP 800-90A, table 2: 2^19 bits).
+	maxRequestSize = 1 << 16
+	// reseedInterval is the number of generate calls after which the DRBG
+	// must be reseeded. SP 800-90A allows up to 2^48; fresh entropy is mixed
+	// in far more often.
+	reseedInterval = 1 << 14
+)
+
+var errReseedRequired = errors.New("reseed required")
+
+// hmacDRBG is HMAC_DRBG with SHA-256 without prediction resistance, as
+// specified in NIST SP 800-90A Rev. 1, section 10.1.2.
+type hmacDRBG struct {
+	k             []byte
+	v             []byte
+	reseedCounter uint64
+}
+
+// newHMACDRBG is the instantiate function (section 10.1.2.3).
+func newHMACDRBG(entropy, nonce, personalization []byte) *hmacDRBG {
+	d := &hmacDRBG{
+		k: make([]byte, sha256.Size),
+		v: make([]byte, sha256.Size),
+	}
+	for i := range d.v {
+		d.v[i] = 0x01
+	}
+	d.update(entropy, nonce, personalization)
+	d.reseedCounter = 1
+
+	return d
+}
+
+// update is the HMAC_DRBG_Update function (section 10.1.2.2). The provided
+// data is the concatenation of data.
+func (d *hmacDRBG) update(data ...[]byte) {
+	empty := true
+	for _, b := range data {
+		empty = empty && len(b) == 0
+	}
+
+	for _, round := range []byte{0x00, 0x01} {
+		mac := hmac.New(sha256.New, d.k)
+		mac.Write(d.v)
+		mac.Write([]byte{round})
+		for _, b := range data {
+			mac.Write(b)
+		}
+		d.k = mac.Sum(d.k[:0])
+		d.v = d.hmac(d.v)
+
+		if empty {
+			return
+		}
+	}
+}
+
+func (d *hmacDRBG) hmac(data []byte) []byte {
+	mac := hmac.New(sha256.New, d.k)
+	mac.Write(data)
+
+	return mac.Sum(nil)
+}
+
+// reseed is the reseed function (section 10.1.2.4).
+func (d *hmacDRBG) reseed(entropy, additional []byte) {
+	d.update(entropy, additional)
+	d.reseedCounter = 1
+}
+
+// generate is the generate function (section 10.1.2.5). It fills out, which
+// must not be longer than maxRequestSize.
+func (d *hmacDRBG) generate(out, additional []byte) error {
+	if d.reseedCounter > reseedInterval {
+		return errReseedRequired
+	}
+
+	if len(additional) > 0 {
+		d.update(additional)
+	}
+	for n := 0; n < len(out); {
+		d.v = d.hmac(d.v)
+		n += copy(out[n:], d.v)
+	}
+	d.update(additional)
+	d.reseedCounter++
+
+	return nil
+}
@@ -0,0 +1,117 @@
+package rng
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"testing"
+)
+
+func TestHMACDRBGKnownAnswer(t *testing.T) {
+	entropy, _ := hex.DecodeString(hmacDRBGVector.entropy)
+	nonce, _ := hex.DecodeString(hmacDRBGVector.nonce)
+	returned, _ := hex.DecodeString(hmacDRBGVector.returned)
+
+	d := newHMACDRBG(entropy, nonce, nil)
+	first := make([]byte, len(returned))
+	if err := d.generate(first, nil); err != nil {
+		t.Fatal(err)
+	}
+	second := make([]byte, len(returned))
+	if err := d.generate(second, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(second, returned) {
+		t.Fatalf("returned bits are %x, want %x", second, returned)
+	}
+	if bytes.Equal(first, second) {
+		t.Fatal("two generate calls returned the same bits")
+	}
+}
+
+func TestHMACDRBGRequiresReseed(t *testing.T) {
+	d := newHMACDRBG(make([]byte, securityStrength), nil, nil)
+	out := make([]byte, 1)
+	for i := range reseedInterval {
+		if err := d.generate(out, nil); err != nil {
+			t.Fatalf("generate %d: %v", i+1, err)
+		}
+	}
+
+	if err := d.generate(out, nil); !errors.Is(err, errReseedRequired) {
+		t.Fatalf("generate past the reseed interval returned %v, want %v", err, errReseedRequired)
+	}
+
+	d.reseed(make([]byte, securityStrength), nil)
+	if err := d.generate(out, nil); err != nil {
+		t.Fatalf("generate after reseed: %v", err)
+	}
+}
+
+func TestHMACDRBGReseedChangesOutput(t *testing.T) {
+	seed := bytes.Repeat([]byte{0x42}, securityStrength)
+	a := newHMACDRBG(seed, nil, []byte(personalization))
+	b := newHMACDRBG(seed, nil, []byte(personalization))
+
+	outA, outB := make([]byte, 32), make([]byte, 32)
+	a.generate(outA, nil)
+	b.generate(outB, nil)
+	if !bytes.Equal(outA, outB) {
+		t.Fatal("DRBGs instantiated alike returned different bits")
+	}
+
+	a.reseed(bytes.Repeat([]byte{0x43}, securityStrength), nil)
+	a.generate(outA, nil)
+	b.generate(outB, nil)
+	if bytes.Equal(outA, outB) {
+		t.Fatal("reseeding did not change the returned bits")
+	}
+}
+
+func TestGenerateKeySplitsLargeRequests(t *testing.T) {
+	rng := newTestRNG(t, &countingReader{})
+
+	key, err := rng.GenerateKey(2*maxRequestSize + 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(key) != 2*maxRequestSize+5 {
+		t.Fatalf("key is %d bytes, want %d", len(key), 2*maxRequestSize+5)
+	}
+	if bytes.Equal(key[:maxRequestSize], key[maxRequestSize:2*maxRequestSize]) {
+		t.Fatal("request was filled with the same bits twice")
+	}
+}
+
+func TestGenerateKeyReseeds(t *testing.T) {
+	rng := newTestRNG(t, &countingReader{})
+	rng.drbg.reseedCounter = reseedInterval + 1
+
+	if _, err := rng.GenerateKey(NonceSize); err != nil {
+		t.Fatal(err)
+	}
+	if rng.drbg.reseedCounter != 2 {
+		t.Fatalf("reseed counter is %d, want 2 after a reseed and a generate call", rng.drbg.reseedCounter)
+	}
+}
+
+// newTestRNG instantiates the RNG the way NewRNG does, but with entropy from
+// reader.
+func newTestRNG(t *testing.T, reader *countingReader) *drbgRNG {
+	t.Helper()
+
+	source, err := newEntropySource(reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	entropy, err := source.entropy(3 * securityStrength * 8 / 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &drbgRNG{
+		drbg:   newHMACDRBG(entropy, nil, []byte(personalization)),
+		source: source,
+	}
+}
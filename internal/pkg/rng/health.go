@@ -0,0 +1,104 @@
+package rng
+
+import (
+	"crypto/rand"
+	"errors"
+	"io"
+)
+
+// The operating system's generator is assessed at 2 bits of min-entropy per
+// byte, well below what it delivers, so that the health tests below do not
+// fail by chance. Their cutoffs follow NIST SP 800-90B, section 4.4, with a
+// false positive probability of 2^-20.
+const (
+	minEntropyPerByte = 2
+	// repetitionCutoff is 1 + ceil(20 / H).
+	repetitionCutoff = 11
+	// adaptiveWindow and adaptiveCutoff are those of table 2 for
+	// non-binary samples and H = 2.
+	adaptiveWindow = 512
+	adaptiveCutoff = 177
+	// startupSamples are tested and discarded before the first use
+	// (section 4.3, requirement 10).
+	startupSamples = 1024
+)
+
+var (
+	errRepetitionCount    = errors.New("repetition count test failed")
+	errAdaptiveProportion = errors.New("adaptive proportion test failed")
+)
+
+// healthTests are the continuous health tests of SP 800-90B applied to each
+// byte read from an entropy source.
+type healthTests struct {
+	// Repetition count test (section 4.4.1).
+	last     byte
+	repeated int
+	// Adaptive proportion test (section 4.4.2).
+	first   byte
+	matches int
+	seen    int
+}
+
+func (h *healthTests) sample(b byte) error {
+	if h.repeated > 0 && b == h.last {
+		h.repeated++
+		if h.repeated >= repetitionCutoff {
+			return errRepetitionCount
+		}
+	} else {
+		h.last = b
+		h.repeated = 1
+	}
+
+	if h.seen == 0 {
+		h.first = b
+		h.matches = 1
+	} else if b == h.first {
+		h.matches++
+		if h.matches >= adaptiveCutoff {
+			return errAdaptiveProportion
+		}
+	}
+	h.seen = (h.seen + 1) % adaptiveWindow
+
+	return nil
+}
+
+// entropySource reads entropy input for the DRBG and checks it as it goes.
+type entropySource struct {
+	reader io.Reader
+	tests  healthTests
+}
+
+func newEntropySource(reader io.Reader) (*entropySource, error) {
+	s := &entropySource{reader: reader}
+	if _, err := s.read(startupSamples); err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+func newSystemEntropySource() (*entropySource, error) {
+	return newEntropySource(rand.Reader)
+}
+
+// entropy returns enough input for bits of min-entropy.
+func (s *entropySource) entropy(bits int) ([]byte, error) {
+	return s.read((bits + minEntropyPerByte - 1) / minEntropyPerByte)
+}
+
+func (s *entropySource) read(n int) ([]byte, error) {
+	buf := make([]byte, n)
+	if _, err := io.ReadFull(s.reader, buf); err != nil {
+		return nil, err
+	}
+	for _, b := range buf {
+		if err := s.tests.sample(b); err != nil {
+			return nil, err
+		}
+	}
+
+	return buf, nil
+}
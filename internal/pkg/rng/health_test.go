@@ -0,0 +1,131 @@
+package rng
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+)
+
+// countingReader returns the bytes 0, 1, 2, ... which pass the health tests,
+// or only zeros once it is stuck.
+type countingReader struct {
+	next  byte
+	stuck bool
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	for i := range p {
+		if r.stuck {
+			p[i] = 0
+			continue
+		}
+		p[i] = r.next
+		r.next++
+	}
+
+	return len(p), nil
+}
+
+func TestRepetitionCountTest(t *testing.T) {
+	var tests healthTests
+	for i := 1; i < repetitionCutoff; i++ {
+		if err := tests.sample(0x5a); err != nil {
+			t.Fatalf("sample %d: %v", i, err)
+		}
+	}
+
+	if err := tests.sample(0x5a); !errors.Is(err, errRepetitionCount) {
+		t.Fatalf("sample %d returned %v, want %v", repetitionCutoff, err, errRepetitionCount)
+	}
+}
+
+func TestRepetitionCountTestResetsOnChange(t *testing.T) {
+	var tests healthTests
+	for i := range 4 * repetitionCutoff {
+		// Runs one short of the cutoff, separated by a different value.
+		b := byte(0x5a)
+		if i%repetitionCutoff == repetitionCutoff-1 {
+			b = 0xa5
+		}
+		if err := tests.sample(b); err != nil {
+			t.Fatalf("sample %d: %v", i+1, err)
+		}
+	}
+}
+
+func TestAdaptiveProportionTest(t *testing.T) {
+	var tests healthTests
+	// The first value of the window recurs every other sample, without
+	// ever repeating twice in a row.
+	var err error
+	samples := 0
+	for err == nil && samples < adaptiveWindow {
+		b := byte(samples)
+		if samples%2 == 0 {
+			b = 0
+		}
+		err = tests.sample(b)
+		samples++
+	}
+
+	if !errors.Is(err, errAdaptiveProportion) {
+		t.Fatalf("adaptive proportion test returned %v, want %v", err, errAdaptiveProportion)
+	}
+	if want := 2*adaptiveCutoff - 1; samples != want {
+		t.Fatalf("failed after %d samples, want %d", samples, want)
+	}
+}
+
+func TestAdaptiveProportionTestStartsNewWindows(t *testing.T) {
+	var tests healthTests
+	// Each window sees its first value adaptiveCutoff-1 times.
+	for window := range 4 {
+		for i := range adaptiveWindow {
+			b := byte(1 + i%250)
+			if i < 2*(adaptiveCutoff-1) && i%2 == 0 {
+				b = 0
+			}
+			if err := tests.sample(b); err != nil {
+				t.Fatalf("window %d, sample %d: %v", window, i, err)
+			}
+		}
+	}
+}
+
+func TestEntropySourceRejectsStuckSource(t *testing.T) {
+	if _, err := newEntropySource(&countingReader{stuck: true}); !errors.Is(err, errRepetitionCount) {
+		t.Fatalf("startup with a stuck source returned %v, want %v", err, errRepetitionCount)
+	}
+}
+
+func TestEntropySourceRejectsShortReads(t *testing.T) {
+	short := bytes.NewReader(make([]byte, startupSamples/2))
+	if _, err := newEntropySource(short); !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Fatalf("startup with a short source returned %v, want %v", err, io.ErrUnexpectedEOF)
+	}
+}
+
+func TestRNGFailsClosed(t *testing.T) {
+	reader := &countingReader{}
+	rng := newTestRNG(t, reader)
+	if _, err := rng.GenerateKey(NonceSize); err != nil {
+		t.Fatal(err)
+	}
+
+	reader.stuck = true
+	rng.drbg.reseedCounter = reseedInterval + 1
+	if _, err := rng.GenerateKey(NonceSize); !errors.Is(err, ErrFailed) {
+		t.Fatalf("GenerateKey with a stuck source returned %v, want %v", err, ErrFailed)
+	}
+	if !errors.Is(rng.Err(), ErrFailed) {
+		t.Fatalf("Err returned %v, want %v", rng.Err(), ErrFailed)
+	}
+
+	// The failure is latched: a source that recovers does not bring the
+	// RNG back.
+	reader.stuck = false
+	if _, err := rng.GenerateNonce(); !errors.Is(err, ErrFailed) {
+		t.Fatalf("GenerateNonce after a failure returned %v, want %v", err, ErrFailed)
+	}
+}
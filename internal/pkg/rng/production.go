@@ -0,0 +1,17 @@
+//go:build !deterministic
+
+package rng
+
+// New returns the DRBG. A seed is refused, since this build has no
+// deterministic RNG.
+func New(seed string) (RNG, error) {
+	if seed != "" {
+		return nil, errDeterministicUnavailable
+	}
+
+	return NewRNG()
+}
+
+func IsDeterministic(rng RNG) bool {
+	return false
+}
@@ -1,44 +1,117 @@
 package rng
 
 import (
-	"crypto/rand"
+	"errors"
+	"fmt"
+	"sync"
 )
 
 const (
 	KuznyechikKeySize = 32
 	NonceSize         = 16
 	IVSize            = 16
+	SessionIDSize     = 16
 )
 
-type RNG struct{}
+// personalization sets this DRBG apart from other instances seeded from the
+// same source.
+const personalization = "key-exchange rng"
 
-func NewRNG() *RNG {
-	return &RNG{}
+var (
+	// ErrFailed is returned once the RNG has failed a self-test or a health
+	// test. It stays failed until the process restarts.
+	ErrFailed                   = errors.New("rng failed closed")
+	errDeterministicUnavailable = errors.New("deterministic RNG is only available in builds with the deterministic tag")
+)
+
+// RNG is where agents and Trent get their nonces, IVs and keys from.
+type RNG interface {
+	GenerateNonce() ([]byte, error)
+	GenerateIV() ([]byte, error)
+	GenerateKey(bytes int) ([]byte, error)
+	// Err returns why the RNG stopped generating, or nil if it is healthy.
+	Err() error
+}
+
+// drbgRNG is an HMAC_DRBG seeded and reseeded from the operating system.
+type drbgRNG struct {
+	mu      sync.Mutex
+	drbg    *hmacDRBG
+	source  *entropySource
+	failure error
 }
 
-func (rng RNG) GenerateNonce() ([]byte, error) {
-	key := make([]byte, NonceSize)
-	if _, err := rand.Reader.Read(key); err != nil {
-		return nil, err
+// NewRNG runs the known-answer tests and instantiates the DRBG with entropy
+// for its security strength plus a nonce of half of it, as SP 800-90A,
+// section 8.6.7 allows to take them together.
+func NewRNG() (RNG, error) {
+	if err := selfTest(); err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrFailed, err)
 	}
 
-	return key, nil
+	source, err := newSystemEntropySource()
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrFailed, err)
+	}
+	entropy, err := source.entropy(3 * securityStrength * 8 / 2)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrFailed, err)
+	}
+
+	return &drbgRNG{
+		drbg:   newHMACDRBG(entropy, nil, []byte(personalization)),
+		source: source,
+	}, nil
 }
 
-func (rng RNG) GenerateIV() ([]byte, error) {
-	key := make([]byte, IVSize)
-	if _, err := rand.Reader.Read(key); err != nil {
-		return nil, err
-	}
+func (rng *drbgRNG) GenerateNonce() ([]byte, error) {
+	return rng.GenerateKey(NonceSize)
+}
 
-	return key, nil
+func (rng *drbgRNG) GenerateIV() ([]byte, error) {
+	return rng.GenerateKey(IVSize)
 }
 
-func (rng RNG) GenerateKey(bytes int) ([]byte, error) {
+func (rng *drbgRNG) GenerateKey(bytes int) ([]byte, error) {
+	rng.mu.Lock()
+	defer rng.mu.Unlock()
+
+	if rng.failure != nil {
+		return nil, rng.failure
+	}
+
 	key := make([]byte, bytes)
-	if _, err := rand.Reader.Read(key); err != nil {
-		return nil, err
+	for rest := key; len(rest) > 0; {
+		n := min(len(rest), maxRequestSize)
+		err := rng.drbg.generate(rest[:n], nil)
+		if errors.Is(err, errReseedRequired) {
+			if err := rng.reseed(); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		rest = rest[n:]
 	}
 
 	return key, nil
 }
+
+func (rng *drbgRNG) Err() error {
+	rng.mu.Lock()
+	defer rng.mu.Unlock()
+
+	return rng.failure
+}
+
+// reseed mixes fresh entropy into the DRBG. If the entropy source fails, the
+// RNG fails closed.
+func (rng *drbgRNG) reseed() error {
+	entropy, err := rng.source.entropy(securityStrength * 8)
+	if err != nil {
+		rng.failure = fmt.Errorf("%w: %w", ErrFailed, err)
+		return rng.failure
+	}
+	rng.drbg.reseed(entropy, nil)
+
+	return nil
+}
@@ -0,0 +1,73 @@
+package rng
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+)
+
+var errKnownAnswer = errors.New("known-answer test failed")
+
+// hmacDRBGVector is the first SHA-256 vector without prediction resistance,
+// personalization string or additional input from NIST's HMAC_DRBG test
+// vectors (CAVP drbgvectors_no_reseed, HMAC_DRBG.rsp, COUNT = 0). The
+// returned bits are those of the second generate call.
+var hmacDRBGVector = struct {
+	entropy, nonce, returned string
+}{
+	entropy: "ca851911349384bffe89de1cbdc46e6831e44d34a4fb935ee285dd14b71a7488",
+	nonce:   "659ba96c601dc69fc902940805ec0ca8",
+	returned: "e528e9abf2dece54d47c7e75e5fe302149f817ea9fb4bee6f4199697d04d5b89" +
+		"d54fbb978a15b5c443c9ec21036d2460b6f73ebad0dc2aba6e624abf07745bc1" +
+		"07694bb7547bb0995f70de25d6b29e2d3011bb19d27676c07162c8b5ccde0668" +
+		"961df86803482cb37ed6d5c0bb8d50cf1f50d476aa0458bdaba806f48be9dcb8",
+}
+
+// selfTest runs the known-answer tests of the DRBG and of the health tests
+// before the RNG is used.
+func selfTest() error {
+	entropy, _ := hex.DecodeString(hmacDRBGVector.entropy)
+	nonce, _ := hex.DecodeString(hmacDRBGVector.nonce)
+	returned, _ := hex.DecodeString(hmacDRBGVector.returned)
+
+	d := newHMACDRBG(entropy, nonce, nil)
+	out := make([]byte, len(returned))
+	for range 2 {
+		if err := d.generate(out, nil); err != nil {
+			return err
+		}
+	}
+	if !bytes.Equal(out, returned) {
+		return fmt.Errorf("%w: HMAC_DRBG", errKnownAnswer)
+	}
+
+	// A stuck source must fail the repetition count test, one that keeps
+	// returning its first value every other byte the adaptive proportion
+	// test, and a source that never repeats itself neither.
+	for _, test := range []struct {
+		name   string
+		sample func(i int) byte
+		want   error
+	}{
+		{"repetition count test", func(int) byte { return 0x5a }, errRepetitionCount},
+		{"adaptive proportion test", func(i int) byte {
+			if i%2 == 0 {
+				return 0
+			}
+			return byte(i)
+		}, errAdaptiveProportion},
+		{"health tests", func(i int) byte { return byte(i) }, nil},
+	} {
+		var tests healthTests
+		var err error
+		for i := 0; i < 4*adaptiveWindow && err == nil; i++ {
+			err = tests.sample(test.sample(i))
+		}
+		if !errors.Is(err, test.want) {
+			return fmt.Errorf("%w: %s", errKnownAnswer, test.name)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,249 @@
+// Package suite negotiates how the initiator and the acceptor turn the key
+// issued by Trent into their session key.
+//
+// The initiator offers its cipher suites in order of preference at step 3,
+// together with an ephemeral key share for each kind of secret they use. The
+// acceptor picks the first one it supports, tells Trent at step 4, and
+// answers with its own shares at step 6. Trent includes the chosen suite in
+// the session certificate it signs, unless it is RSA.
+package suite
+
+import (
+	"crypto/mlkem"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/sudeeya/key-exchange/internal/pkg/api"
+	"github.com/sudeeya/key-exchange/internal/pkg/crypto"
+)
+
+const (
+	// RSA uses the key issued by Trent as is.
+	RSA = "rsa"
+	// X25519 mixes an ephemeral X25519 secret into Trent's key, so that
+	// recorded sessions stay confidential if RSA keys leak later.
+	X25519 = "rsa-x25519"
+	// Hybrid also mixes in an ephemeral ML-KEM-768 secret, and Trent
+	// encrypts the session certificate for the acceptor under both its RSA
+	// and its ML-KEM key, so that a quantum computer breaking RSA and X25519
+	// is not enough.
+	Hybrid = "rsa-mlkem768-x25519"
+)
+
+// The labels the session key is derived with.
+const (
+	x25519Label = "agent/forward secrecy"
+	hybridLabel = "agent/hybrid"
+)
+
+var (
+	ErrUnknown     = errors.New("unknown cipher suite")
+	ErrNoCommon    = errors.New("no cipher suite in common")
+	ErrNotOffered  = errors.New("cipher suite was not offered")
+	errNoSuites    = errors.New("no cipher suites")
+	errMissingKeys = errors.New("key shares are missing")
+)
+
+// Random is where ephemeral keys and encapsulated secrets come from.
+type Random interface {
+	GenerateKey(bytes int) ([]byte, error)
+	Err() error
+}
+
+// Check validates a list of suites in order of preference.
+func Check(suites []string) error {
+	if len(suites) == 0 {
+		return errNoSuites
+	}
+	for i, s := range suites {
+		switch s {
+		case RSA, X25519, Hybrid:
+		default:
+			return fmt.Errorf("%w: %s", ErrUnknown, s)
+		}
+		if slices.Contains(suites[:i], s) {
+			return fmt.Errorf("cipher suite %s is listed twice", s)
+		}
+	}
+
+	return nil
+}
+
+// Name returns the suite s stands for: agents and requests that predate
+// suite negotiation carry none and use RSA.
+func Name(s string) string {
+	if s == "" {
+		return RSA
+	}
+
+	return s
+}
+
+func ForwardSecret(s string) bool {
+	return s == X25519 || s == Hybrid
+}
+
+func PostQuantum(s string) bool {
+	return s == Hybrid
+}
+
+// Choose returns the first of the suites offered at step 3 that is also
+// supported.
+func Choose(info api.Info, supported []string) (string, error) {
+	offered := info.Suites
+	if len(offered) == 0 {
+		offered = []string{RSA}
+	}
+
+	for _, s := range offered {
+		if slices.Contains(supported, s) {
+			return s, nil
+		}
+	}
+
+	return "", fmt.Errorf("%w: offered %s", ErrNoCommon, strings.Join(offered, ","))
+}
+
+// Offer is the initiator's side of the negotiation.
+type Offer struct {
+	suites []string
+	x25519 []byte
+	kem    *mlkem.DecapsulationKey768
+}
+
+// NewOffer generates the ephemeral keys the suites need.
+func NewOffer(suites []string, random Random) (*Offer, error) {
+	o := &Offer{suites: suites}
+
+	var err error
+	if slices.ContainsFunc(suites, ForwardSecret) {
+		o.x25519, err = random.GenerateKey(crypto.X25519KeySize)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if slices.ContainsFunc(suites, PostQuantum) {
+		seed, err := random.GenerateKey(mlkem.SeedSize)
+		if err != nil {
+			return nil, err
+		}
+		o.kem, err = mlkem.NewDecapsulationKey768(seed)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return o, nil
+}
+
+// Fill adds the offer to the step 3 message.
+func (o *Offer) Fill(info *api.Info) error {
+	info.Suites = o.suites
+
+	if o.x25519 != nil {
+		share, err := crypto.X25519PublicKey(o.x25519)
+		if err != nil {
+			return err
+		}
+		info.InitiatorShare = share
+	}
+	if o.kem != nil {
+		info.InitiatorKEMKey = o.kem.EncapsulationKey().Bytes()
+	}
+
+	return nil
+}
+
+// Accept completes the key agreement for suite on the acceptor's side. It
+// adds the acceptor's answer to the step 6 message and returns the session
+// key.
+func Accept(suite string, info api.Info, resp *api.Response, sessionKey []byte, sessionID string, random Random) ([]byte, error) {
+	resp.Suite = suite
+	if !ForwardSecret(suite) {
+		return sessionKey, nil
+	}
+
+	private, err := random.GenerateKey(crypto.X25519KeySize)
+	if err != nil {
+		return nil, err
+	}
+	resp.AcceptorShare, err = crypto.X25519PublicKey(private)
+	if err != nil {
+		return nil, err
+	}
+	secret, err := crypto.X25519(private, info.InitiatorShare)
+	if err != nil {
+		return nil, err
+	}
+
+	var kemSecret []byte
+	if PostQuantum(suite) {
+		kemKey, err := mlkem.NewEncapsulationKey768(info.InitiatorKEMKey)
+		if err != nil {
+			return nil, err
+		}
+		kemSecret, resp.AcceptorKEMCiphertext, err = crypto.Encapsulate768(kemKey, random)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return mix(suite, sessionKey, sessionID, secret, kemSecret, info, *resp)
+}
+
+// Finish completes the key agreement on the initiator's side with the
+// acceptor's answer at step 6. It returns the suite the acceptor chose and
+// the session key.
+func (o *Offer) Finish(resp api.Response, sessionKey []byte, sessionID string) (string, []byte, error) {
+	suite := Name(resp.Suite)
+	if !slices.Contains(o.suites, suite) {
+		return "", nil, fmt.Errorf("%w: %s", ErrNotOffered, suite)
+	}
+	if !ForwardSecret(suite) {
+		return suite, sessionKey, nil
+	}
+
+	secret, err := crypto.X25519(o.x25519, resp.AcceptorShare)
+	if err != nil {
+		return "", nil, err
+	}
+
+	var kemSecret []byte
+	if PostQuantum(suite) {
+		kemSecret, err = o.kem.Decapsulate(resp.AcceptorKEMCiphertext)
+		if err != nil {
+			return "", nil, err
+		}
+	}
+
+	info := api.Info{}
+	if err := o.Fill(&info); err != nil {
+		return "", nil, err
+	}
+	key, err := mix(suite, sessionKey, sessionID, secret, kemSecret, info, resp)
+	if err != nil {
+		return "", nil, err
+	}
+
+	return suite, key, nil
+}
+
+// mix derives the session key from Trent's key and the ephemeral secrets,
+// bound to the session ID and the key shares both sides sent.
+func mix(suite string, sessionKey []byte, sessionID string, secret, kemSecret []byte, info api.Info, resp api.Response) ([]byte, error) {
+	if len(info.InitiatorShare) == 0 || len(resp.AcceptorShare) == 0 {
+		return nil, errMissingKeys
+	}
+
+	label := x25519Label
+	context := slices.Concat([]byte(sessionID), info.InitiatorShare, resp.AcceptorShare)
+	if PostQuantum(suite) {
+		label = hybridLabel
+		secret = slices.Concat(secret, kemSecret)
+		context = slices.Concat(context, info.InitiatorKEMKey, resp.AcceptorKEMCiphertext)
+	}
+
+	return crypto.MixSecret(sessionKey, secret, label, context)
+}
@@ -0,0 +1,124 @@
+package tracing
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+)
+
+const defaultCollectorCapacity = 4096
+
+// FileExporter appends finished spans to a file as JSON lines.
+type FileExporter struct {
+	mu   sync.Mutex
+	file *os.File
+	enc  *json.Encoder
+}
+
+func NewFileExporter(path string) (*FileExporter, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	return &FileExporter{
+		file: file,
+		enc:  json.NewEncoder(file),
+	}, nil
+}
+
+func (e *FileExporter) Export(span SpanData) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	e.enc.Encode(span)
+}
+
+func (e *FileExporter) Close() error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	return e.file.Close()
+}
+
+// Collector keeps the most recent finished spans in memory.
+type Collector struct {
+	mu       sync.Mutex
+	capacity int
+	spans    []SpanData
+}
+
+func NewCollector(capacity int) *Collector {
+	if capacity <= 0 {
+		capacity = defaultCollectorCapacity
+	}
+
+	return &Collector{
+		capacity: capacity,
+		spans:    make([]SpanData, 0, capacity),
+	}
+}
+
+func (c *Collector) Export(span SpanData) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if len(c.spans) == c.capacity {
+		copy(c.spans, c.spans[1:])
+		c.spans = c.spans[:len(c.spans)-1]
+	}
+	c.spans = append(c.spans, span)
+}
+
+type Trace struct {
+	TraceID string     `json:"trace_id"`
+	Spans   []SpanData `json:"spans"`
+}
+
+// Traces groups collected spans by trace ID, optionally keeping only traceID.
+func (c *Collector) Traces(traceID string) []Trace {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	byID := make(map[string]*Trace)
+	order := make([]string, 0)
+	for _, span := range c.spans {
+		if traceID != "" && span.TraceID != traceID {
+			continue
+		}
+
+		trace, ok := byID[span.TraceID]
+		if !ok {
+			trace = &Trace{TraceID: span.TraceID}
+			byID[span.TraceID] = trace
+			order = append(order, span.TraceID)
+		}
+		trace.Spans = append(trace.Spans, span)
+	}
+
+	traces := make([]Trace, 0, len(order))
+	for _, id := range order {
+		trace := byID[id]
+		sort.Slice(trace.Spans, func(i, j int) bool {
+			return trace.Spans[i].Start.Before(trace.Spans[j].Start)
+		})
+		traces = append(traces, *trace)
+	}
+
+	return traces
+}
+
+func (c *Collector) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		traces := c.Traces(r.URL.Query().Get("trace_id"))
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		if err := json.NewEncoder(w).Encode(traces); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	})
+}
@@ -0,0 +1,13 @@
+package tracing
+
+import (
+	"github.com/go-resty/resty/v2"
+)
+
+// InstrumentClient makes client propagate the span found in each request's context.
+func InstrumentClient(client *resty.Client) {
+	client.OnBeforeRequest(func(_ *resty.Client, r *resty.Request) error {
+		Inject(r.Context(), r.Header)
+		return nil
+	})
+}
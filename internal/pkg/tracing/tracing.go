@@ -0,0 +1,291 @@
+package tracing
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	TraceparentHeader = "traceparent"
+
+	traceparentVersion = "00"
+	sampledFlag        = "01"
+)
+
+type TraceID [16]byte
+
+func (id TraceID) String() string {
+	return hex.EncodeToString(id[:])
+}
+
+func (id TraceID) IsValid() bool {
+	return id != TraceID{}
+}
+
+type SpanID [8]byte
+
+func (id SpanID) String() string {
+	return hex.EncodeToString(id[:])
+}
+
+func (id SpanID) IsValid() bool {
+	return id != SpanID{}
+}
+
+type SpanContext struct {
+	TraceID TraceID
+	SpanID  SpanID
+}
+
+func (sc SpanContext) IsValid() bool {
+	return sc.TraceID.IsValid() && sc.SpanID.IsValid()
+}
+
+// SpanData is the exported, immutable form of a finished span.
+type SpanData struct {
+	TraceID    string            `json:"trace_id"`
+	SpanID     string            `json:"span_id"`
+	ParentID   string            `json:"parent_id,omitempty"`
+	Service    string            `json:"service"`
+	Name       string            `json:"name"`
+	Start      time.Time         `json:"start"`
+	End        time.Time         `json:"end"`
+	Duration   time.Duration     `json:"duration_ns"`
+	Attributes map[string]string `json:"attributes,omitempty"`
+	Error      string            `json:"error,omitempty"`
+}
+
+type Exporter interface {
+	Export(span SpanData)
+}
+
+type Tracer struct {
+	service   string
+	exporters []Exporter
+}
+
+func NewTracer(service string, exporters ...Exporter) *Tracer {
+	return &Tracer{
+		service:   service,
+		exporters: exporters,
+	}
+}
+
+// Close flushes and closes every exporter that holds resources.
+func (t *Tracer) Close() error {
+	var errs []error
+	for _, exporter := range t.exporters {
+		if closer, ok := exporter.(io.Closer); ok {
+			errs = append(errs, closer.Close())
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+type Span struct {
+	tracer *Tracer
+	sc     SpanContext
+	parent SpanID
+	name   string
+	start  time.Time
+
+	mu         sync.Mutex
+	attributes map[string]string
+	err        string
+	ended      bool
+}
+
+type spanKey struct{}
+
+type remoteKey struct{}
+
+// Start begins a span that is a child of the span in ctx, or of a remote parent
+// extracted from an incoming request, or a new root span otherwise.
+func (t *Tracer) Start(ctx context.Context, name string) (context.Context, *Span) {
+	var parent SpanContext
+	if span := SpanFromContext(ctx); span != nil {
+		parent = span.sc
+	} else if remote, ok := ctx.Value(remoteKey{}).(SpanContext); ok {
+		parent = remote
+	}
+
+	sc := SpanContext{
+		TraceID: parent.TraceID,
+		SpanID:  newSpanID(),
+	}
+	if !sc.TraceID.IsValid() {
+		sc.TraceID = newTraceID()
+	}
+
+	span := &Span{
+		tracer:     t,
+		sc:         sc,
+		parent:     parent.SpanID,
+		name:       name,
+		start:      time.Now(),
+		attributes: make(map[string]string),
+	}
+
+	return context.WithValue(ctx, spanKey{}, span), span
+}
+
+// SpanFromContext returns the current span or nil. All Span methods are safe
+// to call on nil, so callers do not need to check.
+func SpanFromContext(ctx context.Context) *Span {
+	span, _ := ctx.Value(spanKey{}).(*Span)
+	return span
+}
+
+func (s *Span) Context() SpanContext {
+	if s == nil {
+		return SpanContext{}
+	}
+
+	return s.sc
+}
+
+func (s *Span) SetAttribute(key string, value any) {
+	if s == nil {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.attributes[key] = fmt.Sprint(value)
+}
+
+func (s *Span) RecordError(err error) {
+	if s == nil || err == nil {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.err = err.Error()
+}
+
+func (s *Span) End() {
+	if s == nil {
+		return
+	}
+
+	end := time.Now()
+
+	s.mu.Lock()
+	if s.ended {
+		s.mu.Unlock()
+		return
+	}
+	s.ended = true
+
+	data := SpanData{
+		TraceID:    s.sc.TraceID.String(),
+		SpanID:     s.sc.SpanID.String(),
+		Service:    s.tracer.service,
+		Name:       s.name,
+		Start:      s.start,
+		End:        end,
+		Duration:   end.Sub(s.start),
+		Attributes: make(map[string]string, len(s.attributes)),
+		Error:      s.err,
+	}
+	if s.parent.IsValid() {
+		data.ParentID = s.parent.String()
+	}
+	for k, v := range s.attributes {
+		data.Attributes[k] = v
+	}
+	s.mu.Unlock()
+
+	for _, exporter := range s.tracer.exporters {
+		exporter.Export(data)
+	}
+}
+
+// Inject writes the W3C traceparent of the span in ctx into header.
+func Inject(ctx context.Context, header http.Header) {
+	span := SpanFromContext(ctx)
+	if span == nil {
+		return
+	}
+
+	header.Set(TraceparentHeader, strings.Join([]string{
+		traceparentVersion,
+		span.sc.TraceID.String(),
+		span.sc.SpanID.String(),
+		sampledFlag,
+	}, "-"))
+}
+
+// Extract returns a context carrying the remote parent found in header, if any.
+func Extract(ctx context.Context, header http.Header) context.Context {
+	sc, ok := parseTraceparent(header.Get(TraceparentHeader))
+	if !ok {
+		return ctx
+	}
+
+	return context.WithValue(ctx, remoteKey{}, sc)
+}
+
+func parseTraceparent(value string) (SpanContext, bool) {
+	parts := strings.Split(value, "-")
+	if len(parts) != 4 || parts[0] != traceparentVersion {
+		return SpanContext{}, false
+	}
+
+	var sc SpanContext
+	traceID, err := hex.DecodeString(parts[1])
+	if err != nil || len(traceID) != len(sc.TraceID) {
+		return SpanContext{}, false
+	}
+	spanID, err := hex.DecodeString(parts[2])
+	if err != nil || len(spanID) != len(sc.SpanID) {
+		return SpanContext{}, false
+	}
+	copy(sc.TraceID[:], traceID)
+	copy(sc.SpanID[:], spanID)
+
+	return sc, sc.IsValid()
+}
+
+func newTraceID() TraceID {
+	var id TraceID
+	fillID(id[:])
+	return id
+}
+
+func newSpanID() SpanID {
+	var id SpanID
+	fillID(id[:])
+	return id
+}
+
+// idCounter keeps IDs unique if the system RNG fails.
+var idCounter atomic.Uint64
+
+// fillID fills id, 8 or 16 bytes, with random bytes. IDs only need to be
+// unique, not secret, so if the system RNG fails they are made from a counter
+// and the time instead, and tracing does not stop requests.
+func fillID(id []byte) {
+	if _, err := io.ReadFull(rand.Reader, id); err == nil {
+		return
+	}
+
+	binary.BigEndian.PutUint64(id[len(id)-8:], idCounter.Add(1))
+	if len(id) >= 16 {
+		binary.BigEndian.PutUint64(id[:8], uint64(time.Now().UnixNano()))
+	}
+}
@@ -0,0 +1,203 @@
+package tunnel
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+)
+
+const (
+	frameOpen byte = iota + 1
+	frameData
+	frameWindow
+	frameFin
+	frameReset
+)
+
+// initialWindow is how many bytes a stream may send before the receiver
+// grants more with a window update.
+const initialWindow = 256 * 1024
+
+var (
+	ErrClosed        = errors.New("tunnel closed")
+	errProtocol      = errors.New("tunnel protocol violation")
+	errOpenForbidden = errors.New("opening streams is not allowed on this side")
+)
+
+type frame struct {
+	kind    byte
+	stream  uint32
+	payload []byte
+}
+
+// AcceptFunc handles a stream opened by the remote side for service. It owns
+// the stream and must close it.
+type AcceptFunc func(s *Stream, service string)
+
+// Mux carries many independent streams over a single encrypted connection.
+// Streams are opened by the side created without an AcceptFunc and accepted
+// by the other one.
+type Mux struct {
+	conn   *recordConn
+	accept AcceptFunc
+
+	mu      sync.Mutex
+	streams map[uint32]*Stream
+	nextID  uint32
+	err     error
+	done    chan struct{}
+}
+
+func NewMux(conn io.ReadWriteCloser, sendKey, recvKey []byte, accept AcceptFunc) (*Mux, error) {
+	rc, err := newRecordConn(conn, sendKey, recvKey)
+	if err != nil {
+		return nil, err
+	}
+
+	m := &Mux{
+		conn:    rc,
+		accept:  accept,
+		streams: make(map[uint32]*Stream),
+		nextID:  1,
+		done:    make(chan struct{}),
+	}
+	go m.readLoop()
+
+	return m, nil
+}
+
+// Open starts a new stream to service on the remote side.
+func (m *Mux) Open(service string) (*Stream, error) {
+	m.mu.Lock()
+	if m.err != nil {
+		m.mu.Unlock()
+		return nil, m.err
+	}
+	s := newStream(m, m.nextID)
+	m.streams[s.id] = s
+	m.nextID++
+	m.mu.Unlock()
+
+	if err := m.conn.writeFrame(frame{kind: frameOpen, stream: s.id, payload: []byte(service)}); err != nil {
+		m.fail(err)
+		return nil, err
+	}
+
+	return s, nil
+}
+
+func (m *Mux) Close() error {
+	m.fail(ErrClosed)
+	return nil
+}
+
+// Done is closed once the underlying connection is gone.
+func (m *Mux) Done() <-chan struct{} {
+	return m.done
+}
+
+func (m *Mux) Err() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.err
+}
+
+func (m *Mux) Streams() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return len(m.streams)
+}
+
+func (m *Mux) readLoop() {
+	for {
+		f, err := m.conn.readFrame()
+		if err != nil {
+			m.fail(err)
+			return
+		}
+		if err := m.handle(f); err != nil {
+			m.fail(err)
+			return
+		}
+	}
+}
+
+func (m *Mux) handle(f frame) error {
+	if f.kind == frameOpen {
+		return m.handleOpen(f)
+	}
+
+	m.mu.Lock()
+	s, ok := m.streams[f.stream]
+	m.mu.Unlock()
+	if !ok {
+		// The stream was already closed locally.
+		return nil
+	}
+
+	switch f.kind {
+	case frameData:
+		return s.receive(f.payload)
+	case frameWindow:
+		if len(f.payload) != 4 {
+			return errProtocol
+		}
+		s.grant(int(binary.BigEndian.Uint32(f.payload)))
+	case frameFin:
+		s.remoteClose()
+	case frameReset:
+		s.reset(fmt.Errorf("stream reset by peer: %s", f.payload))
+	default:
+		return errProtocol
+	}
+
+	return nil
+}
+
+func (m *Mux) handleOpen(f frame) error {
+	if m.accept == nil {
+		return m.conn.writeFrame(frame{kind: frameReset, stream: f.stream, payload: []byte(errOpenForbidden.Error())})
+	}
+
+	m.mu.Lock()
+	if _, ok := m.streams[f.stream]; ok {
+		m.mu.Unlock()
+		return errProtocol
+	}
+	s := newStream(m, f.stream)
+	m.streams[s.id] = s
+	m.mu.Unlock()
+
+	go m.accept(s, string(f.payload))
+
+	return nil
+}
+
+func (m *Mux) remove(id uint32) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.streams, id)
+}
+
+func (m *Mux) fail(err error) {
+	m.mu.Lock()
+	if m.err != nil {
+		m.mu.Unlock()
+		return
+	}
+	m.err = err
+	streams := m.streams
+	m.streams = make(map[uint32]*Stream)
+	close(m.done)
+	m.mu.Unlock()
+
+	for _, s := range streams {
+		s.reset(err)
+	}
+	m.conn.close()
+}
@@ -0,0 +1,307 @@
+package tunnel
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+var (
+	clientKey = bytes.Repeat([]byte{1}, KeySize)
+	serverKey = bytes.Repeat([]byte{2}, KeySize)
+)
+
+func TestMuxEcho(t *testing.T) {
+	clientConn, serverConn := net.Pipe()
+	server, err := NewMux(serverConn, serverKey, clientKey, func(s *Stream, service string) {
+		defer s.Close()
+		if service != "echo" {
+			return
+		}
+		io.Copy(s, s)
+		s.CloseWrite()
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	client, err := NewMux(clientConn, clientKey, serverKey, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	// More than a window in each direction, so the echo only completes if
+	// window updates are sent.
+	data := make([]byte, 4*initialWindow+1)
+	rand.Read(data)
+
+	s, err := client.Open("echo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		s.Write(data)
+		s.CloseWrite()
+	}()
+	echoed, err := io.ReadAll(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(echoed, data) {
+		t.Fatalf("echoed %d bytes that differ from the %d sent", len(echoed), len(data))
+	}
+	s.Close()
+}
+
+func TestMuxRejectsProtocolViolations(t *testing.T) {
+	open := frame{kind: frameOpen, stream: 1, payload: []byte("echo")}
+	full := make([]frame, 0, initialWindow/maxPayload+1)
+	for range initialWindow / maxPayload {
+		full = append(full, frame{kind: frameData, stream: 1, payload: make([]byte, maxPayload)})
+	}
+
+	tests := []struct {
+		name    string
+		frames  []frame
+		wantErr error
+	}{
+		{
+			name:    "data beyond the window",
+			frames:  append(append([]frame{open}, full...), frame{kind: frameData, stream: 1, payload: []byte{0}}),
+			wantErr: errProtocol,
+		},
+		{
+			name:    "data after fin",
+			frames:  []frame{open, {kind: frameFin, stream: 1}, {kind: frameData, stream: 1, payload: []byte{0}}},
+			wantErr: errProtocol,
+		},
+		{
+			name:    "short window update",
+			frames:  []frame{open, {kind: frameWindow, stream: 1, payload: []byte{0, 1}}},
+			wantErr: errProtocol,
+		},
+		{
+			name:    "stream opened twice",
+			frames:  []frame{open, open},
+			wantErr: errProtocol,
+		},
+		{
+			name:    "unknown frame",
+			frames:  []frame{open, {kind: frameReset + 1, stream: 1}},
+			wantErr: errProtocol,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m, peer := newPeerMux(t, func(*Stream, string) {})
+			for _, f := range tt.frames {
+				if err := peer.writeFrame(f); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := waitFailed(t, m); !errors.Is(err, tt.wantErr) {
+				t.Fatalf("mux failed with %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestMuxRejectsRecords(t *testing.T) {
+	tests := []struct {
+		name   string
+		record func() []byte
+	}{
+		{
+			name: "too large",
+			record: func() []byte {
+				return binary.BigEndian.AppendUint32(nil, frameHeaderSize+maxPayload+1024)
+			},
+		},
+		{
+			name: "sealed with another key",
+			record: func() []byte {
+				var buf bytes.Buffer
+				c, err := newRecordConn(nopCloser{&buf}, bytes.Repeat([]byte{3}, KeySize), serverKey)
+				if err != nil {
+					t.Fatal(err)
+				}
+				c.writeFrame(frame{kind: frameOpen, stream: 1})
+				return buf.Bytes()
+			},
+		},
+		{
+			name: "replayed",
+			record: func() []byte {
+				var buf bytes.Buffer
+				c, err := newRecordConn(nopCloser{&buf}, clientKey, serverKey)
+				if err != nil {
+					t.Fatal(err)
+				}
+				c.writeFrame(frame{kind: frameWindow, stream: 1, payload: make([]byte, 4)})
+				return bytes.Repeat(buf.Bytes(), 2)
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m, peer := newPeerMux(t, func(*Stream, string) {})
+			if _, err := peer.conn.Write(tt.record()); err != nil {
+				t.Fatal(err)
+			}
+			if err := waitFailed(t, m); err == nil || errors.Is(err, ErrClosed) {
+				t.Fatalf("mux failed with %v, want a record error", err)
+			}
+		})
+	}
+}
+
+func TestMuxRefusesOpenWithoutAccept(t *testing.T) {
+	m, peer := newPeerMux(t, nil)
+	if err := peer.writeFrame(frame{kind: frameOpen, stream: 1, payload: []byte("echo")}); err != nil {
+		t.Fatal(err)
+	}
+
+	f := peer.next(t)
+	if f.kind != frameReset || f.stream != 1 {
+		t.Fatalf("got frame %d for stream %d, want a reset of stream 1", f.kind, f.stream)
+	}
+	if err := m.Err(); err != nil {
+		t.Fatalf("mux failed with %v", err)
+	}
+	if n := m.Streams(); n != 0 {
+		t.Fatalf("mux holds %d streams", n)
+	}
+}
+
+func TestStreamWaitsForWindow(t *testing.T) {
+	m, peer := newPeerMux(t, nil)
+	s, err := m.Open("echo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f := peer.next(t); f.kind != frameOpen {
+		t.Fatalf("got frame %d, want an open", f.kind)
+	}
+
+	written := make(chan error, 1)
+	go func() {
+		_, err := s.Write(make([]byte, initialWindow+100))
+		written <- err
+	}()
+
+	received := 0
+	for received < initialWindow {
+		received += len(peer.next(t).payload)
+	}
+	if received != initialWindow {
+		t.Fatalf("received %d bytes before the window was granted, want %d", received, initialWindow)
+	}
+	select {
+	case f := <-peer.frames:
+		t.Fatalf("got frame %d with %d bytes past the window", f.kind, len(f.payload))
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	if err := peer.writeFrame(frame{kind: frameWindow, stream: s.id, payload: binary.BigEndian.AppendUint32(nil, 100)}); err != nil {
+		t.Fatal(err)
+	}
+	if f := peer.next(t); len(f.payload) != 100 {
+		t.Fatalf("received %d bytes after a window of 100", len(f.payload))
+	}
+	if err := <-written; err != nil {
+		t.Fatal(err)
+	}
+
+	// A reset stream stops writing.
+	if err := peer.writeFrame(frame{kind: frameReset, stream: s.id, payload: []byte("gone")}); err != nil {
+		t.Fatal(err)
+	}
+	for s.Err() == nil {
+		time.Sleep(time.Millisecond)
+	}
+	if _, err := s.Write([]byte{0}); err == nil {
+		t.Fatal("reset stream accepted a write")
+	}
+}
+
+// testPeer is the remote side of a mux under test, speaking raw frames.
+type testPeer struct {
+	*recordConn
+	frames chan frame
+}
+
+func newPeerMux(t *testing.T, accept AcceptFunc) (*Mux, *testPeer) {
+	t.Helper()
+
+	muxConn, peerConn := net.Pipe()
+	m, err := NewMux(muxConn, serverKey, clientKey, accept)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { m.Close() })
+
+	rc, err := newRecordConn(peerConn, clientKey, serverKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { rc.close() })
+
+	peer := &testPeer{recordConn: rc, frames: make(chan frame, 64)}
+	go func() {
+		defer close(peer.frames)
+		for {
+			f, err := rc.readFrame()
+			if err != nil {
+				return
+			}
+			peer.frames <- f
+		}
+	}()
+
+	return m, peer
+}
+
+func (p *testPeer) next(t *testing.T) frame {
+	t.Helper()
+
+	select {
+	case f, ok := <-p.frames:
+		if !ok {
+			t.Fatal("mux closed the connection")
+		}
+		return f
+	case <-time.After(5 * time.Second):
+		t.Fatal("no frame from the mux")
+	}
+
+	return frame{}
+}
+
+func waitFailed(t *testing.T, m *Mux) error {
+	t.Helper()
+
+	select {
+	case <-m.Done():
+		return m.Err()
+	case <-time.After(5 * time.Second):
+		t.Fatal("mux did not fail")
+	}
+
+	return nil
+}
+
+type nopCloser struct {
+	io.ReadWriter
+}
+
+func (nopCloser) Close() error {
+	return nil
+}
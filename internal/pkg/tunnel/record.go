@@ -0,0 +1,131 @@
+package tunnel
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+)
+
+const (
+	KeySize = 32
+
+	recordHeaderSize = 4
+	frameHeaderSize  = 5
+	maxPayload       = 16 * 1024
+)
+
+var errRecordTooLarge = errors.New("tunnel record is too large")
+
+// recordConn seals every frame as a separate AEAD record. Each direction has
+// its own key, and the record sequence number is used as the nonce, so
+// records cannot be reordered, replayed or dropped without detection.
+type recordConn struct {
+	conn io.ReadWriteCloser
+
+	writeMu  sync.Mutex
+	sendAEAD cipher.AEAD
+	sendSeq  uint64
+
+	recvAEAD cipher.AEAD
+	recvSeq  uint64
+	maxSize  int
+}
+
+func newRecordConn(conn io.ReadWriteCloser, sendKey, recvKey []byte) (*recordConn, error) {
+	sendAEAD, err := newAEAD(sendKey)
+	if err != nil {
+		return nil, err
+	}
+	recvAEAD, err := newAEAD(recvKey)
+	if err != nil {
+		return nil, err
+	}
+
+	return &recordConn{
+		conn:     conn,
+		sendAEAD: sendAEAD,
+		recvAEAD: recvAEAD,
+		maxSize:  frameHeaderSize + maxPayload + recvAEAD.Overhead(),
+	}, nil
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	if len(key) != KeySize {
+		return nil, fmt.Errorf("tunnel key must be %d bytes", KeySize)
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
+
+func (c *recordConn) writeFrame(f frame) error {
+	plaintext := make([]byte, frameHeaderSize, frameHeaderSize+len(f.payload))
+	plaintext[0] = f.kind
+	binary.BigEndian.PutUint32(plaintext[1:], f.stream)
+	plaintext = append(plaintext, f.payload...)
+
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	header := make([]byte, recordHeaderSize)
+	binary.BigEndian.PutUint32(header, uint32(len(plaintext)+c.sendAEAD.Overhead()))
+
+	record := c.sendAEAD.Seal(header, sequenceNonce(c.sendAEAD, c.sendSeq), plaintext, header)
+	c.sendSeq++
+
+	_, err := c.conn.Write(record)
+	return err
+}
+
+// readFrame is only called from the mux read loop.
+func (c *recordConn) readFrame() (frame, error) {
+	header := make([]byte, recordHeaderSize)
+	if _, err := io.ReadFull(c.conn, header); err != nil {
+		return frame{}, err
+	}
+
+	size := int(binary.BigEndian.Uint32(header))
+	if size > c.maxSize {
+		return frame{}, errRecordTooLarge
+	}
+
+	ciphertext := make([]byte, size)
+	if _, err := io.ReadFull(c.conn, ciphertext); err != nil {
+		return frame{}, err
+	}
+
+	plaintext, err := c.recvAEAD.Open(ciphertext[:0], sequenceNonce(c.recvAEAD, c.recvSeq), ciphertext, header)
+	if err != nil {
+		return frame{}, err
+	}
+	c.recvSeq++
+
+	if len(plaintext) < frameHeaderSize {
+		return frame{}, errors.New("tunnel frame is too short")
+	}
+
+	return frame{
+		kind:    plaintext[0],
+		stream:  binary.BigEndian.Uint32(plaintext[1:]),
+		payload: plaintext[frameHeaderSize:],
+	}, nil
+}
+
+func (c *recordConn) close() error {
+	return c.conn.Close()
+}
+
+func sequenceNonce(aead cipher.AEAD, seq uint64) []byte {
+	nonce := make([]byte, aead.NonceSize())
+	binary.BigEndian.PutUint64(nonce[len(nonce)-8:], seq)
+
+	return nonce
+}
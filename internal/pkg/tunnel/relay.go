@@ -0,0 +1,48 @@
+package tunnel
+
+import (
+	"io"
+	"net"
+	"sync"
+)
+
+type closeWriter interface {
+	CloseWrite() error
+}
+
+// Relay copies data between a stream and a local connection in both
+// directions, half-closing each side as the other one finishes. An error in
+// either direction tears down both. It returns the number of bytes sent into
+// and received from the stream.
+func Relay(s *Stream, conn net.Conn) (sent, received int64) {
+	var wg sync.WaitGroup
+	wg.Add(2)
+
+	go func() {
+		defer wg.Done()
+		var err error
+		sent, err = io.Copy(s, conn)
+		if err != nil {
+			s.Close()
+			return
+		}
+		s.CloseWrite()
+	}()
+
+	go func() {
+		defer wg.Done()
+		var err error
+		received, err = io.Copy(conn, s)
+		if cw, ok := conn.(closeWriter); ok && err == nil {
+			cw.CloseWrite()
+			return
+		}
+		conn.Close()
+	}()
+
+	wg.Wait()
+	s.Close()
+	conn.Close()
+
+	return sent, received
+}
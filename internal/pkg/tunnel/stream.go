@@ -0,0 +1,214 @@
+package tunnel
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"sync"
+)
+
+var errStreamClosed = errors.New("stream closed")
+
+// Stream is one forwarded connection inside a Mux. Its send side is limited
+// by the window the receiver has granted, so a slow reader throttles the
+// writer instead of growing buffers without bound.
+type Stream struct {
+	mux *Mux
+	id  uint32
+
+	mu         sync.Mutex
+	cond       *sync.Cond
+	buf        bytes.Buffer
+	sendWindow int
+	consumed   int
+	localFin   bool
+	remoteFin  bool
+	closed     bool
+	err        error
+}
+
+func newStream(m *Mux, id uint32) *Stream {
+	s := &Stream{
+		mux:        m,
+		id:         id,
+		sendWindow: initialWindow,
+	}
+	s.cond = sync.NewCond(&s.mu)
+
+	return s
+}
+
+func (s *Stream) Read(p []byte) (int, error) {
+	s.mu.Lock()
+	for s.buf.Len() == 0 && !s.remoteFin && !s.closed && s.err == nil {
+		s.cond.Wait()
+	}
+
+	switch {
+	case s.buf.Len() > 0:
+	case s.err != nil:
+		err := s.err
+		s.mu.Unlock()
+		return 0, err
+	case s.closed:
+		s.mu.Unlock()
+		return 0, errStreamClosed
+	default:
+		s.mu.Unlock()
+		return 0, io.EOF
+	}
+
+	n, _ := s.buf.Read(p)
+	s.consumed += n
+	var increment int
+	if s.consumed >= initialWindow/2 {
+		increment = s.consumed
+		s.consumed = 0
+	}
+	s.mu.Unlock()
+
+	if increment > 0 {
+		payload := binary.BigEndian.AppendUint32(nil, uint32(increment))
+		if err := s.mux.conn.writeFrame(frame{kind: frameWindow, stream: s.id, payload: payload}); err != nil {
+			s.mux.fail(err)
+		}
+	}
+
+	return n, nil
+}
+
+func (s *Stream) Write(p []byte) (int, error) {
+	var written int
+	for len(p) > 0 {
+		s.mu.Lock()
+		for s.sendWindow == 0 && !s.localFin && !s.closed && s.err == nil {
+			s.cond.Wait()
+		}
+
+		switch {
+		case s.err != nil:
+			err := s.err
+			s.mu.Unlock()
+			return written, err
+		case s.localFin, s.closed:
+			s.mu.Unlock()
+			return written, errStreamClosed
+		}
+
+		n := min(len(p), s.sendWindow, maxPayload)
+		s.sendWindow -= n
+		s.mu.Unlock()
+
+		if err := s.mux.conn.writeFrame(frame{kind: frameData, stream: s.id, payload: p[:n]}); err != nil {
+			s.mux.fail(err)
+			return written, err
+		}
+		written += n
+		p = p[n:]
+	}
+
+	return written, nil
+}
+
+// CloseWrite tells the remote side that no more data will be sent, while
+// still allowing data to be read.
+func (s *Stream) CloseWrite() error {
+	s.mu.Lock()
+	if s.localFin || s.err != nil {
+		s.mu.Unlock()
+		return nil
+	}
+	s.localFin = true
+	done := s.remoteFin
+	s.cond.Broadcast()
+	s.mu.Unlock()
+
+	err := s.mux.conn.writeFrame(frame{kind: frameFin, stream: s.id})
+	if done {
+		s.mux.remove(s.id)
+	}
+
+	return err
+}
+
+// Close finishes the stream. If the remote side has not finished sending,
+// the stream is reset so that it stops.
+func (s *Stream) Close() error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return nil
+	}
+	s.closed = true
+	graceful := s.remoteFin && s.err == nil
+	s.buf.Reset()
+	s.cond.Broadcast()
+	s.mu.Unlock()
+
+	if graceful {
+		return s.CloseWrite()
+	}
+
+	s.mux.remove(s.id)
+	if s.Err() != nil {
+		return nil
+	}
+
+	return s.mux.conn.writeFrame(frame{kind: frameReset, stream: s.id, payload: []byte(errStreamClosed.Error())})
+}
+
+func (s *Stream) Err() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.err
+}
+
+func (s *Stream) receive(data []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed || s.err != nil {
+		return nil
+	}
+	if s.remoteFin || s.buf.Len()+s.consumed+len(data) > initialWindow {
+		return errProtocol
+	}
+
+	s.buf.Write(data)
+	s.cond.Broadcast()
+
+	return nil
+}
+
+func (s *Stream) grant(increment int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.sendWindow += increment
+	s.cond.Broadcast()
+}
+
+func (s *Stream) remoteClose() {
+	s.mu.Lock()
+	s.remoteFin = true
+	done := s.localFin
+	s.cond.Broadcast()
+	s.mu.Unlock()
+
+	if done {
+		s.mux.remove(s.id)
+	}
+}
+
+func (s *Stream) reset(err error) {
+	s.mu.Lock()
+	if s.err == nil {
+		s.err = err
+	}
+	s.cond.Broadcast()
+	s.mu.Unlock()
+
+	s.mux.remove(s.id)
+}
@@ -1,24 +1,113 @@
 package trent
 
 import (
+	"crypto/mlkem"
+	"crypto/rsa"
+	"encoding/json"
+	"fmt"
+
+	"github.com/sudeeya/key-exchange/internal/pkg/api"
+	"github.com/sudeeya/key-exchange/internal/pkg/crypto"
 	"github.com/sudeeya/key-exchange/internal/pkg/pem"
 )
 
 type agent struct {
 	PublicKey []byte
+	key       *rsa.PublicKey
+	// kemKey is the agent's ML-KEM key for post-quantum cipher suites, if
+	// it has one.
+	kemKey *mlkem.EncapsulationKey768
+	// The certificates of the agent's public key do not change until the key
+	// does, so they are signed once, when the agent list is formed: as the
+	// acceptor's key at step 2 and as the initiator's key at step 5.
+	acceptorCert  api.Cert
+	initiatorCert api.Cert
 }
 
 type agents map[string]agent
 
-func newAgents(ids, keys []string) (agents, error) {
+func newAgents(ids, keys, kemKeys []string, signingKey *rsa.PrivateKey) (agents, error) {
+	if len(ids) != len(keys) {
+		return nil, fmt.Errorf("%d agent IDs but %d public keys", len(ids), len(keys))
+	}
+	if len(kemKeys) > 0 && len(ids) != len(kemKeys) {
+		return nil, fmt.Errorf("%d agent IDs but %d ML-KEM keys", len(ids), len(kemKeys))
+	}
+
 	clientsList := make(agents, len(ids))
 	for i, id := range ids {
 		publicKey, err := pem.ExtractRSAPublicKey(keys[i])
 		if err != nil {
 			return nil, err
 		}
-		clientsList[id] = agent{PublicKey: publicKey}
+		key, err := pem.ParseRSAPublicKey(publicKey)
+		if err != nil {
+			return nil, fmt.Errorf("agent %s: %w", id, err)
+		}
+
+		var kemKey *mlkem.EncapsulationKey768
+		if len(kemKeys) > 0 && kemKeys[i] != "" {
+			kemPublicKey, err := pem.ExtractMLKEMPublicKey(kemKeys[i])
+			if err != nil {
+				return nil, err
+			}
+			kemKey, err = pem.ParseMLKEMPublicKey(kemPublicKey)
+			if err != nil {
+				return nil, fmt.Errorf("agent %s: %w", id, err)
+			}
+		}
+
+		acceptorCert, err := signCert(api.Info{AcceptorKey: publicKey}, signingKey)
+		if err != nil {
+			return nil, err
+		}
+		initiatorCert, err := signCert(api.Info{InitiatorKey: publicKey}, signingKey)
+		if err != nil {
+			return nil, err
+		}
+
+		clientsList[id] = agent{
+			PublicKey:     publicKey,
+			key:           key,
+			kemKey:        kemKey,
+			acceptorCert:  acceptorCert,
+			initiatorCert: initiatorCert,
+		}
 	}
 
 	return clientsList, nil
 }
+
+func signCert(info api.Info, signingKey *rsa.PrivateKey) (api.Cert, error) {
+	infoJSON, err := json.Marshal(info)
+	if err != nil {
+		return api.Cert{}, err
+	}
+
+	return api.Cert{
+		Information: info,
+		Signature:   crypto.SignRSAKey(infoJSON, signingKey),
+	}, nil
+}
+
+func (a agents) known(ids ...string) []string {
+	result := make([]string, 0, len(ids))
+	for _, id := range ids {
+		if _, ok := a[id]; ok {
+			result = append(result, id)
+		}
+	}
+
+	return result
+}
+
+// unknown returns the first of ids that is not registered, or "" if all are.
+func (a agents) unknown(ids ...string) string {
+	for _, id := range ids {
+		if _, ok := a[id]; !ok {
+			return id
+		}
+	}
+
+	return ""
+}
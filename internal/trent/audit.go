@@ -0,0 +1,311 @@
+package trent
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/sudeeya/key-exchange/internal/pkg/crypto"
+)
+
+const (
+	issueRecord      = "issue"
+	checkpointRecord = "checkpoint"
+	// A truncated record notes that Trent cut off a torn record at the
+	// end of the log, left by a crash while it was written.
+	truncatedRecord = "truncated"
+)
+
+var errEmptyAudit = errors.New("audit log is empty")
+
+// auditRecord is a line of the audit log. Hash covers the record without
+// Hash and Signature, and Prev is the hash of the record before it, so that
+// changing, removing or reordering a record breaks the chain. Checkpoint
+// records sign the hash of the chain up to them.
+type auditRecord struct {
+	Seq            uint64    `json:"seq"`
+	Type           string    `json:"type"`
+	Time           time.Time `json:"time"`
+	Initiator      string    `json:"initiator,omitempty"`
+	Acceptor       string    `json:"acceptor,omitempty"`
+	SessionID      string    `json:"session_id,omitempty"`
+	KeyFingerprint string    `json:"key_fingerprint,omitempty"`
+	Suite          string    `json:"suite,omitempty"`
+	RequesterAddr  string    `json:"requester_addr,omitempty"`
+	TruncatedBytes int       `json:"truncated_bytes,omitempty"`
+	Prev           string    `json:"prev"`
+	Hash           string    `json:"hash"`
+	Signature      []byte    `json:"signature,omitempty"`
+}
+
+func (r auditRecord) digest() (string, error) {
+	r.Hash = ""
+	r.Signature = nil
+
+	data, err := json.Marshal(r)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(data)
+
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// keyFingerprint identifies a session key in the audit log without
+// revealing it.
+func keyFingerprint(key []byte) string {
+	sum := sha256.Sum256(key)
+	return "SHA256:" + base64.RawStdEncoding.EncodeToString(sum[:])
+}
+
+// auditSummary is what verifying an audit log found.
+type auditSummary struct {
+	Records    int
+	Issued     int
+	Truncated  int
+	LastSeq    uint64
+	LastHash   string
+	LastSigned uint64
+	Unsigned   int
+}
+
+// verifyAudit checks every record of the log in r against the chain and
+// every checkpoint signature against Trent's public key.
+func verifyAudit(r io.Reader, publicKey *rsa.PublicKey) (auditSummary, error) {
+	var summary auditSummary
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := scanner.Bytes()
+		n := summary.Records + 1
+
+		var record auditRecord
+		dec := json.NewDecoder(bytes.NewReader(line))
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(&record); err != nil {
+			return summary, fmt.Errorf("record %d: %w", n, err)
+		}
+
+		switch {
+		case record.Seq != summary.LastSeq+1:
+			return summary, fmt.Errorf("record %d: sequence number is %d, expected %d", n, record.Seq, summary.LastSeq+1)
+		case record.Prev != summary.LastHash:
+			return summary, fmt.Errorf("record %d: does not follow the previous record", n)
+		}
+
+		hash, err := record.digest()
+		if err != nil {
+			return summary, fmt.Errorf("record %d: %w", n, err)
+		}
+		if record.Hash != hash {
+			return summary, fmt.Errorf("record %d: contents do not match its hash", n)
+		}
+
+		switch record.Type {
+		case issueRecord:
+			summary.Issued++
+			summary.Unsigned++
+		case truncatedRecord:
+			summary.Truncated++
+			summary.Unsigned++
+		case checkpointRecord:
+			if !crypto.VerifyRSAKey([]byte(record.Hash), record.Signature, publicKey) {
+				return summary, fmt.Errorf("record %d: invalid checkpoint signature", n)
+			}
+			summary.LastSigned = record.Seq
+			summary.Unsigned = 0
+		default:
+			return summary, fmt.Errorf("record %d: unknown type %q", n, record.Type)
+		}
+
+		summary.Records = n
+		summary.LastSeq = record.Seq
+		summary.LastHash = record.Hash
+	}
+	if err := scanner.Err(); err != nil {
+		return summary, err
+	}
+	if summary.Records == 0 {
+		return summary, errEmptyAudit
+	}
+
+	return summary, nil
+}
+
+// splitTornTail splits the records of an audit log from the torn record at
+// its end, if any. Every record ends with a new line, so anything after the
+// last one was cut off while it was written.
+func splitTornTail(data []byte) (records, torn []byte) {
+	end := bytes.LastIndexByte(data, '\n') + 1
+
+	return data[:end], data[end:]
+}
+
+// auditLog appends a record for every session key Trent issues. It does
+// nothing if no audit file is configured.
+type auditLog struct {
+	interval   int
+	privateKey *rsa.PrivateKey
+	logger     *zap.Logger
+
+	mu       sync.Mutex
+	file     *os.File
+	size     int64
+	seq      uint64
+	last     string
+	unsigned int
+}
+
+// openAuditLog verifies the existing log, if any, and continues its chain. A
+// torn record at the end is cut off, and a record noting it is appended.
+func openAuditLog(path string, interval int, privateKey *rsa.PrivateKey, logger *zap.Logger) (*auditLog, error) {
+	l := &auditLog{
+		interval:   interval,
+		privateKey: privateKey,
+		logger:     logger,
+	}
+	if path == "" {
+		return l, nil
+	}
+
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := io.ReadAll(file)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	records, torn := splitTornTail(data)
+
+	summary, err := verifyAudit(bytes.NewReader(records), &privateKey.PublicKey)
+	if err != nil && !errors.Is(err, errEmptyAudit) {
+		file.Close()
+		return nil, fmt.Errorf("audit log %s: %w", path, err)
+	}
+	l.file = file
+	l.size = int64(len(records))
+	l.seq = summary.LastSeq
+	l.last = summary.LastHash
+	l.unsigned = summary.Unsigned
+
+	if len(torn) > 0 {
+		if err := file.Truncate(l.size); err != nil {
+			file.Close()
+			return nil, err
+		}
+		logger.Warn("Truncated a torn record at the end of the audit log", zap.Int("bytes", len(torn)))
+		if err := l.append(auditRecord{Type: truncatedRecord, TruncatedBytes: len(torn)}); err != nil {
+			file.Close()
+			return nil, err
+		}
+		l.unsigned++
+	}
+
+	return l, nil
+}
+
+// issued records a session key and signs the chain once interval keys have
+// been recorded since the last checkpoint.
+func (l *auditLog) issued(record auditRecord) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.file == nil {
+		return nil
+	}
+
+	record.Type = issueRecord
+	if err := l.append(record); err != nil {
+		return err
+	}
+	l.unsigned++
+
+	if l.unsigned >= l.interval {
+		return l.checkpoint()
+	}
+
+	return nil
+}
+
+func (l *auditLog) checkpoint() error {
+	if err := l.append(auditRecord{Type: checkpointRecord}); err != nil {
+		return err
+	}
+	l.unsigned = 0
+
+	// The checkpoints in Trent's own log let a truncated audit log be
+	// recognised even if it still ends with a valid signature.
+	l.logger.Info("Audit log checkpoint", zap.Uint64("seq", l.seq), zap.String("hash", l.last))
+
+	return nil
+}
+
+func (l *auditLog) append(record auditRecord) error {
+	record.Seq = l.seq + 1
+	record.Time = time.Now().UTC()
+	record.Prev = l.last
+
+	hash, err := record.digest()
+	if err != nil {
+		return err
+	}
+	record.Hash = hash
+	if record.Type == checkpointRecord {
+		record.Signature = crypto.SignRSAKey([]byte(hash), l.privateKey)
+	}
+
+	line, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+	if _, err := l.file.Write(line); err != nil {
+		// A record written in part would break the chain for the ones
+		// after it.
+		return errors.Join(err, l.file.Truncate(l.size))
+	}
+	if err := l.file.Sync(); err != nil {
+		return err
+	}
+
+	l.size += int64(len(line))
+	l.seq = record.Seq
+	l.last = record.Hash
+
+	return nil
+}
+
+// close signs the records written since the last checkpoint, so that a log
+// left by a clean shutdown ends with a signature.
+func (l *auditLog) close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.file == nil {
+		return nil
+	}
+
+	var err error
+	if l.unsigned > 0 {
+		err = l.checkpoint()
+	}
+	err = errors.Join(err, l.file.Close())
+	l.file = nil
+
+	return err
+}
@@ -0,0 +1,113 @@
+package trent
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"go.uber.org/zap"
+)
+
+func TestOpenAuditLog(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		// damage changes the contents of a closed log with three keys
+		// issued.
+		damage    func(data []byte) []byte
+		wantErr   bool
+		truncated int
+	}{
+		{
+			name:   "intact",
+			damage: func(data []byte) []byte { return data },
+		},
+		{
+			name: "torn record at the end",
+			damage: func(data []byte) []byte {
+				return append(data, []byte(`{"type":"issue","seq":5,"initia`)...)
+			},
+			truncated: 1,
+		},
+		{
+			name: "modified record",
+			damage: func(data []byte) []byte {
+				return bytes.Replace(data, []byte(`"alice"`), []byte(`"mallory"`), 1)
+			},
+			wantErr: true,
+		},
+		{
+			name: "removed record",
+			damage: func(data []byte) []byte {
+				lines := bytes.SplitAfter(data, []byte("\n"))
+				return bytes.Join(append(lines[:1], lines[2:]...), nil)
+			},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "audit")
+			l, err := openAuditLog(path, 100, key, zap.NewNop())
+			if err != nil {
+				t.Fatal(err)
+			}
+			for range 3 {
+				if err := l.issued(auditRecord{Initiator: "alice", Acceptor: "bob"}); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := l.close(); err != nil {
+				t.Fatal(err)
+			}
+
+			data, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(path, tt.damage(data), 0600); err != nil {
+				t.Fatal(err)
+			}
+
+			l, err = openAuditLog(path, 100, key, zap.NewNop())
+			if tt.wantErr {
+				if err == nil {
+					l.close()
+					t.Fatal("damaged audit log was opened")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			// The chain continues after the recovered log.
+			if err := l.issued(auditRecord{Initiator: "alice", Acceptor: "bob"}); err != nil {
+				t.Fatal(err)
+			}
+			if err := l.close(); err != nil {
+				t.Fatal(err)
+			}
+
+			file, err := os.Open(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer file.Close()
+			summary, err := verifyAudit(file, &key.PublicKey)
+			if err != nil {
+				t.Fatalf("reopened audit log is invalid: %v", err)
+			}
+			if summary.Issued != 4 || summary.Truncated != tt.truncated || summary.Unsigned != 0 {
+				t.Fatalf("audit log holds %d keys and %d truncated records, %d unsigned", summary.Issued, summary.Truncated, summary.Unsigned)
+			}
+		})
+	}
+}
@@ -0,0 +1,149 @@
+package trent
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/sudeeya/key-exchange/internal/pkg/api"
+	"github.com/sudeeya/key-exchange/internal/pkg/middleware"
+)
+
+var (
+	errUnsignedRequest  = errors.New("request is not signed")
+	errRequesterMatch   = errors.New("requester does not match the request")
+	errUnknownRequester = errors.New("unknown requester")
+	errStaleRequest     = errors.New("request timestamp is outside the allowed window")
+	errReplayedRequest  = errors.New("request nonce has already been used")
+	errRequestSignature = errors.New("invalid request signature")
+)
+
+// replayCache remembers the nonces of recently accepted requests. A nonce
+// only has to be remembered for as long as its timestamp is acceptable.
+type replayCache struct {
+	window time.Duration
+
+	mu   sync.Mutex
+	seen map[string]time.Time
+	// order holds the keys in the order they were added, so that expired
+	// ones are dropped from the front without scanning the whole cache.
+	order []replayEntry
+}
+
+type replayEntry struct {
+	key   string
+	added time.Time
+}
+
+func newReplayCache(window time.Duration) *replayCache {
+	return &replayCache{
+		window: window,
+		seen:   make(map[string]time.Time),
+	}
+}
+
+func (c *replayCache) used(key string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	_, ok := c.seen[key]
+
+	return ok
+}
+
+// add records key and reports whether it was new.
+func (c *replayCache) add(key string, now time.Time) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for len(c.order) > 0 && now.Sub(c.order[0].added) > c.window {
+		delete(c.seen, c.order[0].key)
+		c.order = c.order[1:]
+	}
+
+	if _, ok := c.seen[key]; ok {
+		return false
+	}
+	c.seen[key] = now
+	c.order = append(c.order, replayEntry{key: key, added: now})
+
+	return true
+}
+
+// authenticate checks that req was signed by party, the agent it claims to
+// come from at this step, and that it is fresh. The cheap checks come first,
+// so that forged requests are turned away before any RSA work is done.
+func (t *Trent) authenticate(w http.ResponseWriter, r *http.Request, step, endpoint, party string, req api.Request) bool {
+	status, err := t.checkRequest(r.Context(), endpoint, party, req)
+	if err == nil {
+		return true
+	}
+
+	t.metrics.verificationFailures.Inc(step, "authentication")
+	t.audit.Info("Request authentication failed",
+		zap.String("step", step),
+		zap.String("requester", req.Requester),
+		zap.String("initiator", req.Initiator),
+		zap.String("acceptor", req.Acceptor),
+		zap.Error(err),
+	)
+	http.Error(w, err.Error(), status)
+
+	return false
+}
+
+func (t *Trent) checkRequest(ctx context.Context, endpoint, party string, req api.Request) (int, error) {
+	if req.Requester == "" || len(req.Signature) == 0 || len(req.Nonce) == 0 {
+		return http.StatusUnauthorized, errUnsignedRequest
+	}
+	if req.Requester != party {
+		return http.StatusForbidden, fmt.Errorf("%w: %s cannot send this request for %s", errRequesterMatch, req.Requester, party)
+	}
+
+	requester, ok := t.registry()[req.Requester]
+	if !ok {
+		return http.StatusUnauthorized, fmt.Errorf("%w: %s", errUnknownRequester, req.Requester)
+	}
+
+	now := time.Now()
+	skew := now.Sub(time.UnixMilli(req.Timestamp)).Abs()
+	if skew > t.cfg.RequestMaxSkew {
+		return http.StatusUnauthorized, fmt.Errorf("%w: off by %s", errStaleRequest, skew.Round(time.Millisecond))
+	}
+
+	replayKey := req.Requester + ":" + hex.EncodeToString(req.Nonce)
+	if t.nonces.used(replayKey) {
+		return http.StatusUnauthorized, errReplayedRequest
+	}
+
+	data, err := req.SignedData(endpoint)
+	if err != nil {
+		return http.StatusBadRequest, err
+	}
+	if !t.verifyRSA(ctx, data, req.Signature, requester) {
+		return http.StatusUnauthorized, errRequestSignature
+	}
+
+	if !t.nonces.add(replayKey, now) {
+		return http.StatusUnauthorized, errReplayedRequest
+	}
+
+	return http.StatusOK, nil
+}
+
+// allowAgent applies the per-agent rate limit to an authenticated requester.
+func (t *Trent) allowAgent(w http.ResponseWriter, step, requester string) bool {
+	ok, retryAfter := t.agentRate.Allow(requester)
+	if !ok {
+		t.metrics.verificationFailures.Inc(step, "rate_limit")
+		middleware.Reject(w, http.StatusTooManyRequests, retryAfter, "too many requests from "+requester)
+	}
+
+	return ok
+}
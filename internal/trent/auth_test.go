@@ -0,0 +1,39 @@
+package trent
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestReplayCacheRejectsReplaysWithinWindow(t *testing.T) {
+	c := newReplayCache(time.Minute)
+	start := time.Now()
+
+	if !c.add("a", start) {
+		t.Fatal("first use of a nonce was rejected")
+	}
+	if c.add("a", start.Add(30*time.Second)) {
+		t.Fatal("replayed nonce was accepted within the window")
+	}
+	if !c.used("a") {
+		t.Fatal("nonce is not reported as used")
+	}
+	if !c.add("a", start.Add(2*time.Minute)) {
+		t.Fatal("nonce was still rejected after the window")
+	}
+}
+
+func TestReplayCacheDropsExpiredNonces(t *testing.T) {
+	c := newReplayCache(time.Minute)
+	start := time.Now()
+
+	for i := range 1000 {
+		c.add(fmt.Sprint(i), start.Add(time.Duration(i)*time.Millisecond))
+	}
+	c.add("late", start.Add(2*time.Minute))
+
+	if len(c.seen) != 1 || len(c.order) != 1 {
+		t.Fatalf("cache holds %d nonces and %d entries, want 1", len(c.seen), len(c.order))
+	}
+}
@@ -0,0 +1,101 @@
+package trent
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/caarlos0/env"
+
+	"github.com/sudeeya/key-exchange/internal/pkg/pem"
+)
+
+const cliUsage = `usage:
+  trent [-e env]                        run Trent
+  trent [-e env] audit verify [-live] [-min-seq n] [file]
+                                        verify the key issuance audit log`
+
+var errUsage = errors.New(cliUsage)
+
+type cliConfig struct {
+	PublicKey string `env:"PUBLIC_KEY,required"`
+	AuditFile string `env:"AUDIT_FILE"`
+}
+
+// RunCommand executes an offline maintenance command.
+func RunCommand(args []string, out io.Writer) error {
+	var cfg cliConfig
+	if err := env.Parse(&cfg); err != nil {
+		return err
+	}
+
+	switch {
+	case len(args) >= 2 && args[0] == "audit" && args[1] == "verify":
+		return verifyAuditCommand(&cfg, args[2:], out)
+	default:
+		return errUsage
+	}
+}
+
+func verifyAuditCommand(cfg *cliConfig, args []string, out io.Writer) error {
+	fs := flag.NewFlagSet("audit verify", flag.ContinueOnError)
+	live := fs.Bool("live", false, "Accept unsigned records at the end of the log, as written by a running Trent")
+	minSeq := fs.Uint64("min-seq", 0, "Sequence number the log must reach, e.g. from the last checkpoint in Trent's log")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	path := cfg.AuditFile
+	switch fs.NArg() {
+	case 0:
+	case 1:
+		path = fs.Arg(0)
+	default:
+		return errUsage
+	}
+	if path == "" {
+		return errors.New("no audit log given and AUDIT_FILE is not set")
+	}
+
+	publicKeyPEM, err := pem.ExtractRSAPublicKey(cfg.PublicKey)
+	if err != nil {
+		return err
+	}
+	publicKey, err := pem.ParseRSAPublicKey(publicKeyPEM)
+	if err != nil {
+		return err
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	records, torn := splitTornTail(data)
+
+	summary, err := verifyAudit(bytes.NewReader(records), publicKey)
+	if err != nil {
+		return fmt.Errorf("audit log %s is invalid: %w", path, err)
+	}
+
+	fmt.Fprintf(out, "%d records, %d keys issued, signed up to record %d\n", summary.Records, summary.Issued, summary.LastSigned)
+	fmt.Fprintf(out, "last record %d, hash %s\n", summary.LastSeq, summary.LastHash)
+	if summary.Truncated > 0 {
+		fmt.Fprintf(out, "%d torn record(s) were truncated by Trent\n", summary.Truncated)
+	}
+
+	switch {
+	case len(torn) > 0 && !*live:
+		return fmt.Errorf("audit log %s ends with a torn record of %d bytes: Trent stopped while writing it, and truncates it on its next start", path, len(torn))
+	case summary.LastSeq < *minSeq:
+		return fmt.Errorf("audit log %s ends at record %d, expected at least %d: it has been truncated", path, summary.LastSeq, *minSeq)
+	case summary.Unsigned > 0 && !*live:
+		return fmt.Errorf("audit log %s ends with %d unsigned record(s): it may have been truncated, or Trent did not shut down cleanly", path, summary.Unsigned)
+	}
+
+	fmt.Fprintln(out, "audit log is intact")
+
+	return nil
+}
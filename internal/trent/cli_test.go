@@ -0,0 +1,207 @@
+package trent
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"go.uber.org/zap"
+
+	"github.com/sudeeya/key-exchange/internal/pkg/pem"
+)
+
+func TestVerifyAuditCommand(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	publicKey, otherPublicKey := filepath.Join(dir, "trent.pub.pem"), filepath.Join(dir, "other.pub.pem")
+	if err := pem.SaveRSAPublicKey(&key.PublicKey, publicKey); err != nil {
+		t.Fatal(err)
+	}
+	if err := pem.SaveRSAPublicKey(&otherKey.PublicKey, otherPublicKey); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		// running leaves the log as a running Trent would, without the
+		// signature written on shutdown.
+		running   bool
+		damage    func(data []byte) []byte
+		publicKey string
+		// args are the command's arguments; the log's path is added unless
+		// it is read from AUDIT_FILE.
+		args    []string
+		fromEnv bool
+		// noLog passes the log neither way.
+		noLog     bool
+		wantOut   string
+		wantErr   string
+		wantUsage bool
+	}{
+		{
+			name:    "intact",
+			wantOut: "audit log is intact",
+		},
+		{
+			name:    "path from AUDIT_FILE",
+			fromEnv: true,
+			wantOut: "4 records, 3 keys issued, signed up to record 4",
+		},
+		{
+			name:    "reaches the checkpoint",
+			args:    []string{"-min-seq", "4"},
+			wantOut: "audit log is intact",
+		},
+		{
+			name:    "ends before the checkpoint",
+			args:    []string{"-min-seq", "5"},
+			wantErr: "ends at record 4, expected at least 5",
+		},
+		{
+			name:    "unsigned records",
+			running: true,
+			wantErr: "ends with 3 unsigned record(s)",
+		},
+		{
+			name:    "unsigned records of a running Trent",
+			running: true,
+			args:    []string{"-live"},
+			wantOut: "audit log is intact",
+		},
+		{
+			name: "torn record",
+			damage: func(data []byte) []byte {
+				return append(data, `{"type":"issue","seq":5`...)
+			},
+			wantErr: "ends with a torn record of 23 bytes",
+		},
+		{
+			name: "torn record of a running Trent",
+			damage: func(data []byte) []byte {
+				return append(data, `{"type":"issue","seq":5`...)
+			},
+			args:    []string{"-live"},
+			wantOut: "audit log is intact",
+		},
+		{
+			name: "torn record before the checkpoint",
+			damage: func(data []byte) []byte {
+				return append(data, `{"type":"issue","seq":5`...)
+			},
+			args:    []string{"-live", "-min-seq", "5"},
+			wantErr: "ends at record 4, expected at least 5",
+		},
+		{
+			name: "modified record",
+			damage: func(data []byte) []byte {
+				return bytes.Replace(data, []byte(`"alice"`), []byte(`"mallory"`), 1)
+			},
+			wantErr: "is invalid",
+		},
+		{
+			name: "removed record",
+			damage: func(data []byte) []byte {
+				lines := bytes.SplitAfter(data, []byte("\n"))
+				return bytes.Join(append(lines[:1], lines[2:]...), nil)
+			},
+			wantErr: "is invalid",
+		},
+		{
+			name:      "signed by another key",
+			publicKey: otherPublicKey,
+			wantErr:   "is invalid",
+		},
+		{
+			name:    "no log",
+			noLog:   true,
+			wantErr: "no audit log given",
+		},
+		{
+			name:      "two logs",
+			args:      []string{"audit.1"},
+			wantUsage: true,
+		},
+		{
+			name:    "unknown flag",
+			args:    []string{"-since", "4"},
+			wantErr: "flag provided but not defined",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "audit")
+			l, err := openAuditLog(path, 100, key, zap.NewNop())
+			if err != nil {
+				t.Fatal(err)
+			}
+			for range 3 {
+				if err := l.issued(auditRecord{Initiator: "alice", Acceptor: "bob"}); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if tt.running {
+				err = l.file.Close()
+			} else {
+				err = l.close()
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			cfg := &cliConfig{PublicKey: publicKey}
+			if tt.publicKey != "" {
+				cfg.PublicKey = tt.publicKey
+			}
+			args := tt.args
+			switch {
+			case tt.noLog:
+			case tt.fromEnv:
+				cfg.AuditFile = path
+			default:
+				args = append(args, path)
+			}
+			if tt.damage != nil {
+				data, err := os.ReadFile(path)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if err := os.WriteFile(path, tt.damage(data), 0600); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			var out strings.Builder
+			err = verifyAuditCommand(cfg, args, &out)
+			switch {
+			case tt.wantUsage:
+				if !errors.Is(err, errUsage) {
+					t.Fatalf("returned %v, want the usage", err)
+				}
+			case tt.wantErr != "":
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("returned %v, want an error with %q", err, tt.wantErr)
+				}
+			default:
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !strings.Contains(out.String(), tt.wantOut) {
+					t.Fatalf("output does not contain %q:\n%s", tt.wantOut, out.String())
+				}
+			}
+		})
+	}
+}
@@ -1,6 +1,8 @@
 package trent
 
 import (
+	"time"
+
 	"github.com/caarlos0/env"
 )
 
@@ -11,8 +13,39 @@ type config struct {
 
 	AgentIDs        []string `env:"AGENT_IDS,required"`
 	AgentPublicKeys []string `env:"AGENT_PUBLIC_KEYS,required"`
+	// AgentMLKEMKeys lists the agents' ML-KEM public keys in the order of
+	// AgentIDs, with empty entries for agents without one.
+	AgentMLKEMKeys []string `env:"AGENT_MLKEM_KEYS"`
+
+	LogFile   string `env:"LOG_FILE,required"`
+	TraceFile string `env:"TRACE_FILE"`
+	// DebugAddr is the loopback address the collected traces are served on.
+	// They are not served at all if it is empty.
+	DebugAddr string `env:"DEBUG_ADDR"`
+
+	PolicyFile     string        `env:"POLICY_FILE"`
+	RequestMaxSkew time.Duration `env:"REQUEST_MAX_SKEW" envDefault:"30s"`
+
+	AuditFile               string `env:"AUDIT_FILE"`
+	AuditCheckpointInterval int    `env:"AUDIT_CHECKPOINT_INTERVAL" envDefault:"100"`
+
+	// CacheKeys can be turned off to parse keys from PEM and sign public key
+	// certificates on every request, as Trent once did, so that benchmarks
+	// can show what the caches save.
+	CacheKeys bool `env:"CACHE_KEYS" envDefault:"true"`
+
+	MaxBodyBytes          int64   `env:"MAX_BODY_BYTES" envDefault:"65536"`
+	IPRateLimit           float64 `env:"IP_RATE_LIMIT" envDefault:"20"`
+	IPRateBurst           int     `env:"IP_RATE_BURST" envDefault:"40"`
+	AgentRateLimit        float64 `env:"AGENT_RATE_LIMIT" envDefault:"5"`
+	AgentRateBurst        int     `env:"AGENT_RATE_BURST" envDefault:"10"`
+	MaxConcurrentRequests int     `env:"MAX_CONCURRENT_REQUESTS" envDefault:"16"`
 
-	LogFile string `env:"LOG_FILE,required"`
+	ReadHeaderTimeout time.Duration `env:"READ_HEADER_TIMEOUT" envDefault:"5s"`
+	ReadTimeout       time.Duration `env:"READ_TIMEOUT" envDefault:"10s"`
+	WriteTimeout      time.Duration `env:"WRITE_TIMEOUT" envDefault:"30s"`
+	IdleTimeout       time.Duration `env:"IDLE_TIMEOUT" envDefault:"2m"`
+	ShutdownTimeout   time.Duration `env:"SHUTDOWN_TIMEOUT" envDefault:"10s"`
 }
 
 func newConfig() (*config, error) {
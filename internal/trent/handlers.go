@@ -1,12 +1,16 @@
 package trent
 
 import (
+	"encoding/hex"
 	"encoding/json"
 	"net/http"
 
+	"go.uber.org/zap"
+
 	"github.com/sudeeya/key-exchange/internal/pkg/api"
-	"github.com/sudeeya/key-exchange/internal/pkg/crypto"
 	"github.com/sudeeya/key-exchange/internal/pkg/rng"
+	"github.com/sudeeya/key-exchange/internal/pkg/suite"
+	"github.com/sudeeya/key-exchange/internal/pkg/tracing"
 )
 
 // Step 2
@@ -18,24 +22,32 @@ func step2Handler(t *Trent) http.HandlerFunc {
 			return
 		}
 
-		acceptorKey := t.agentList[req.Acceptor].PublicKey
+		span := tracing.SpanFromContext(r.Context())
+		span.SetAttribute("initiator", req.Initiator)
+		span.SetAttribute("acceptor", req.Acceptor)
 
-		info := api.Info{
-			AcceptorKey: acceptorKey,
+		if !t.authenticate(w, r, "2", api.Step2Endpoint, req.Initiator, req) {
+			return
+		}
+		if !t.allowAgent(w, "2", req.Requester) {
+			return
+		}
+		// Only authenticated requests mark agents as active, so that forged
+		// ones cannot inflate the gauge.
+		t.metrics.seen(t.registry().known(req.Initiator, req.Acceptor)...)
+		if !t.authorize(w, "2", req.Initiator, req.Acceptor, false) {
+			return
 		}
-		infoJSON, err := json.Marshal(info)
+
+		cert, err := t.publicKeyCert(r.Context(), t.registry()[req.Acceptor].acceptorCert)
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
-
-		signature := crypto.SignRSA(infoJSON, t.privateKey)
+		t.metrics.certificatesIssued.Inc("2", "public_key")
 
 		resp := api.Response{
-			Certificate: api.Cert{
-				Information: info,
-				Signature:   signature,
-			},
+			Certificate: cert,
 		}
 
 		w.Header().Set("Content-Type", "application/json")
@@ -56,19 +68,43 @@ func step5Handler(t *Trent) http.HandlerFunc {
 			return
 		}
 
-		initiatorKey := t.agentList[req.Initiator].PublicKey
-		info := api.Info{
-			InitiatorKey: initiatorKey,
+		span := tracing.SpanFromContext(r.Context())
+		span.SetAttribute("initiator", req.Initiator)
+		span.SetAttribute("acceptor", req.Acceptor)
+
+		if !t.authenticate(w, r, "5", api.Step5Endpoint, req.Acceptor, req) {
+			return
 		}
-		infoJSON, err := json.Marshal(info)
-		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+		if !t.allowAgent(w, "5", req.Requester) {
+			return
+		}
+		// Only authenticated requests mark agents as active, so that forged
+		// ones cannot inflate the gauge.
+		t.metrics.seen(t.registry().known(req.Initiator, req.Acceptor)...)
+		if !t.authorize(w, "5", req.Initiator, req.Acceptor, true) {
 			return
 		}
 
-		signature := crypto.SignRSA(infoJSON, t.privateKey)
+		agentList := t.registry()
+		initiator, acceptor := agentList[req.Initiator], agentList[req.Acceptor]
 
-		initiatorNonce := crypto.DecryptRSA(req.Ciphertext, t.privateKey)
+		cipherSuite := suite.Name(req.Suite)
+		span.SetAttribute("suite", cipherSuite)
+		if err := suite.Check([]string{cipherSuite}); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if suite.PostQuantum(cipherSuite) && acceptor.kemKey == nil {
+			http.Error(w, "no ML-KEM key is registered for "+req.Acceptor, http.StatusBadRequest)
+			return
+		}
+
+		initiatorNonce := t.decryptRSA(r.Context(), req.Ciphertext)
+		if len(initiatorNonce) == 0 {
+			t.metrics.verificationFailures.Inc("5", "nonce_decryption")
+			http.Error(w, "nonce decryption failed", http.StatusBadRequest)
+			return
+		}
 
 		sessionKey, err := t.rng.GenerateKey(rng.KuznyechikKeySize)
 		if err != nil {
@@ -76,11 +112,36 @@ func step5Handler(t *Trent) http.HandlerFunc {
 			return
 		}
 
+		rawSessionID, err := t.rng.GenerateKey(rng.SessionIDSize)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		sessionID := hex.EncodeToString(rawSessionID)
+		span.SetAttribute("session_id", sessionID)
+
+		// A key is only handed out once its issuance is on record.
+		err = t.auditLog.issued(auditRecord{
+			Initiator:      req.Initiator,
+			Acceptor:       req.Acceptor,
+			SessionID:      sessionID,
+			KeyFingerprint: keyFingerprint(sessionKey),
+			Suite:          cipherSuite,
+			RequesterAddr:  r.RemoteAddr,
+		})
+		if err != nil {
+			t.logger.Error("Failed to write audit log", zap.Error(err))
+			http.Error(w, "audit log unavailable", http.StatusInternalServerError)
+			return
+		}
+
 		infoToEncrypt := api.Info{
 			InitiatorNonce: initiatorNonce,
 			SessionKey:     sessionKey,
+			SessionID:      sessionID,
 			Initiator:      req.Initiator,
 			Acceptor:       req.Acceptor,
+			Suite:          certSuite(cipherSuite),
 		}
 		infoToEncryptJSON, err := json.Marshal(infoToEncrypt)
 		if err != nil {
@@ -88,7 +149,7 @@ func step5Handler(t *Trent) http.HandlerFunc {
 			return
 		}
 
-		signatureToEncrypt := crypto.SignRSA(infoToEncryptJSON, t.privateKey)
+		signatureToEncrypt := t.signRSA(r.Context(), infoToEncryptJSON)
 
 		certToEncrypt := api.Cert{
 			Information: infoToEncrypt,
@@ -100,17 +161,31 @@ func step5Handler(t *Trent) http.HandlerFunc {
 			return
 		}
 
-		acceptorKey := t.agentList[req.Acceptor].PublicKey
-		ciphertext := crypto.EncryptRSA(certToEncryptJSON, acceptorKey)
+		var ciphertext []byte
+		if suite.PostQuantum(cipherSuite) {
+			ciphertext, err = t.encryptHybrid(r.Context(), certToEncryptJSON, acceptor)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+		} else {
+			ciphertext = t.encryptRSA(r.Context(), certToEncryptJSON, acceptor)
+		}
+
+		cert, err := t.publicKeyCert(r.Context(), initiator.initiatorCert)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
 
 		resp := api.Response{
-			Certificate: api.Cert{
-				Information: info,
-				Signature:   signature,
-			},
-			Ciphertext: ciphertext,
+			Certificate: cert,
+			Ciphertext:  ciphertext,
 		}
 
+		t.metrics.certificatesIssued.Inc("5", "public_key")
+		t.metrics.certificatesIssued.Inc("5", "session_key")
+
 		w.Header().Set("Content-Type", "application/json")
 		w.WriteHeader(http.StatusOK)
 		if err := json.NewEncoder(w).Encode(resp); err != nil {
@@ -119,3 +194,14 @@ func step5Handler(t *Trent) http.HandlerFunc {
 		}
 	}
 }
+
+// certSuite is the suite named in a session certificate. Agents verify
+// certificates over the fields they know, so RSA sessions name none and
+// agents that predate suite negotiation can still verify theirs.
+func certSuite(s string) string {
+	if s == suite.RSA {
+		return ""
+	}
+
+	return s
+}
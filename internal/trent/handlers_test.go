@@ -0,0 +1,159 @@
+package trent
+
+import (
+	"bytes"
+	"crypto/mlkem"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/sudeeya/key-exchange/internal/pkg/api"
+	"github.com/sudeeya/key-exchange/internal/pkg/crypto"
+	"github.com/sudeeya/key-exchange/internal/pkg/pem"
+	"github.com/sudeeya/key-exchange/internal/pkg/rng"
+	"github.com/sudeeya/key-exchange/internal/pkg/suite"
+)
+
+const testKeySize = 2048
+
+type testAgent struct {
+	id  string
+	key *rsa.PrivateKey
+}
+
+// newTestTrent sets up Trent for alice and bob, who has an ML-KEM key, with
+// limits that stay out of the way of benchmarks.
+func newTestTrent(tb testing.TB) (*Trent, testAgent, testAgent) {
+	tb.Helper()
+
+	dir := tb.TempDir()
+	saveRSA := func(name string) (*rsa.PrivateKey, string, string) {
+		key, err := rsa.GenerateKey(rand.Reader, testKeySize)
+		if err != nil {
+			tb.Fatal(err)
+		}
+		private, public := filepath.Join(dir, name+".pem"), filepath.Join(dir, name+".pub.pem")
+		if err := pem.SaveRSAPrivateKey(key, private); err != nil {
+			tb.Fatal(err)
+		}
+		if err := pem.SaveRSAPublicKey(&key.PublicKey, public); err != nil {
+			tb.Fatal(err)
+		}
+		return key, private, public
+	}
+
+	_, trentPrivate, trentPublic := saveRSA("trent")
+	aliceKey, _, alicePublic := saveRSA("alice")
+	bobKey, _, bobPublic := saveRSA("bob")
+
+	kemKey, err := mlkem.GenerateKey768()
+	if err != nil {
+		tb.Fatal(err)
+	}
+	bobKEM := filepath.Join(dir, "bob.mlkem.pub.pem")
+	if err := pem.SaveMLKEMPublicKey(kemKey.EncapsulationKey(), bobKEM); err != nil {
+		tb.Fatal(err)
+	}
+
+	random, err := rng.NewRNG()
+	if err != nil {
+		tb.Fatal(err)
+	}
+
+	t := newTrent(&config{
+		Addr:                    "localhost:0",
+		PublicKey:               trentPublic,
+		PrivateKey:              trentPrivate,
+		AgentIDs:                []string{"alice", "bob"},
+		AgentPublicKeys:         []string{alicePublic, bobPublic},
+		AgentMLKEMKeys:          []string{"", bobKEM},
+		LogFile:                 filepath.Join(dir, "trent.log"),
+		RequestMaxSkew:          time.Hour,
+		AuditCheckpointInterval: 100,
+		AgentRateLimit:          1e9,
+		AgentRateBurst:          1e9,
+		CacheKeys:               true,
+	}, random)
+	tb.Cleanup(func() { t.tracer.Close() })
+
+	return t, testAgent{"alice", aliceKey}, testAgent{"bob", bobKey}
+}
+
+// signedRequests returns n requests for endpoint signed by requester, each
+// with its own nonce, as agents send them.
+func signedRequests(tb testing.TB, n int, endpoint string, requester testAgent, req api.Request) [][]byte {
+	tb.Helper()
+
+	bodies := make([][]byte, n)
+	for i := range bodies {
+		req.Requester = requester.id
+		req.Timestamp = time.Now().UnixMilli()
+		req.Nonce = []byte(rand.Text())
+		data, err := req.SignedData(endpoint)
+		if err != nil {
+			tb.Fatal(err)
+		}
+		req.Signature = crypto.SignRSAKey(data, requester.key)
+
+		bodies[i], err = json.Marshal(req)
+		if err != nil {
+			tb.Fatal(err)
+		}
+	}
+
+	return bodies
+}
+
+func serve(tb testing.TB, handler http.HandlerFunc, endpoint string, body []byte) {
+	rec := httptest.NewRecorder()
+	handler(rec, httptest.NewRequest(http.MethodPost, endpoint, bytes.NewReader(body)))
+	if rec.Code != http.StatusOK {
+		tb.Fatalf("status code is %d: %s", rec.Code, rec.Body)
+	}
+}
+
+// BenchmarkStep2 measures Trent's work at step 2: checking the initiator's
+// signed request and handing out the acceptor's pre-signed certificate.
+func BenchmarkStep2(b *testing.B) {
+	t, alice, _ := newTestTrent(b)
+	handler := step2Handler(t)
+	bodies := signedRequests(b, b.N, api.Step2Endpoint, alice, api.Request{
+		Initiator: "alice",
+		Acceptor:  "bob",
+	})
+
+	b.ResetTimer()
+	for i := range b.N {
+		serve(b, handler, api.Step2Endpoint, bodies[i])
+	}
+}
+
+// BenchmarkStep5 measures Trent's work at step 5 for each suite: checking
+// the acceptor's signed request, decrypting N_A, and issuing and encrypting
+// the session certificate.
+func BenchmarkStep5(b *testing.B) {
+	t, _, bob := newTestTrent(b)
+	handler := step5Handler(t)
+	nonce := crypto.EncryptRSAKey(make([]byte, rng.NonceSize), &t.privateKey.PublicKey, t.rng)
+
+	for _, cipherSuite := range []string{suite.RSA, suite.X25519, suite.Hybrid} {
+		b.Run(cipherSuite, func(b *testing.B) {
+			bodies := signedRequests(b, b.N, api.Step5Endpoint, bob, api.Request{
+				Initiator:  "alice",
+				Acceptor:   "bob",
+				Ciphertext: nonce,
+				Suite:      cipherSuite,
+			})
+
+			b.ResetTimer()
+			for i := range b.N {
+				serve(b, handler, api.Step5Endpoint, bodies[i])
+			}
+		})
+	}
+}
@@ -0,0 +1,60 @@
+package trent
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/sudeeya/key-exchange/internal/pkg/health"
+	"github.com/sudeeya/key-exchange/internal/pkg/pem"
+)
+
+const readinessTimeout = 2 * time.Second
+
+func (t *Trent) readinessChecks() []health.Check {
+	return []health.Check{
+		{Name: "keys", Run: t.checkKeys},
+		{Name: "rng", Run: t.checkRNG},
+		{Name: "agents", Run: t.checkAgents},
+		{Name: "shutdown", Run: t.checkDraining},
+	}
+}
+
+func (t *Trent) checkKeys(_ context.Context) error {
+	if err := t.privateKey.Validate(); err != nil {
+		return fmt.Errorf("private key: %w", err)
+	}
+	if _, err := pem.ParseRSAPublicKey(t.publicKey); err != nil {
+		return fmt.Errorf("public key: %w", err)
+	}
+
+	return nil
+}
+
+func (t *Trent) checkRNG(_ context.Context) error {
+	return t.rng.Err()
+}
+
+func (t *Trent) checkAgents(_ context.Context) error {
+	agentList := t.registry()
+	if len(agentList) == 0 {
+		return errors.New("no agents registered")
+	}
+
+	for id, agent := range agentList {
+		if _, err := pem.ParseRSAPublicKey(agent.PublicKey); err != nil {
+			return fmt.Errorf("agent %s: %w", id, err)
+		}
+	}
+
+	return nil
+}
+
+func (t *Trent) checkDraining(_ context.Context) error {
+	if t.draining.Load() {
+		return errors.New("draining connections")
+	}
+
+	return nil
+}
@@ -0,0 +1,110 @@
+package trent
+
+import (
+	"sync"
+	"time"
+
+	"github.com/sudeeya/key-exchange/internal/pkg/metrics"
+	"github.com/sudeeya/key-exchange/internal/pkg/middleware"
+)
+
+const (
+	metricsNamespace = "trent"
+	activeWindow     = 5 * time.Minute
+)
+
+const (
+	rsaSign    = "sign"
+	rsaEncrypt = "encrypt"
+	rsaDecrypt = "decrypt"
+	rsaVerify  = "verify"
+)
+
+type trentMetrics struct {
+	registry             *metrics.Registry
+	http                 *middleware.HTTPMetrics
+	certificatesIssued   *metrics.Counter
+	verificationFailures *metrics.Counter
+	policyDecisions      *metrics.Counter
+	registeredAgents     *metrics.Gauge
+	rsaDuration          *metrics.Histogram
+
+	mu       sync.Mutex
+	lastSeen map[string]time.Time
+}
+
+func newTrentMetrics() *trentMetrics {
+	registry := metrics.NewRegistry()
+
+	m := &trentMetrics{
+		registry: registry,
+		http:     middleware.NewHTTPMetrics(registry, metricsNamespace),
+		certificatesIssued: registry.NewCounter(
+			"trent_certificates_issued_total",
+			"Total number of signed certificates issued by step and kind.",
+			"step", "kind",
+		),
+		verificationFailures: registry.NewCounter(
+			"trent_verification_failures_total",
+			"Total number of requests rejected because of failed checks.",
+			"step", "reason",
+		),
+		policyDecisions: registry.NewCounter(
+			"trent_policy_decisions_total",
+			"Total number of access policy decisions by step and result.",
+			"step", "decision",
+		),
+		rsaDuration: registry.NewHistogram(
+			"trent_rsa_operation_duration_seconds",
+			"Latency of RSA operations performed by Trent.",
+			metrics.DefaultBuckets,
+			"operation",
+		),
+		lastSeen: make(map[string]time.Time),
+	}
+
+	m.registeredAgents = registry.NewGauge(
+		"trent_agents_registered",
+		"Number of agents known to Trent.",
+	)
+	registry.NewGaugeFunc(
+		"trent_agents_active",
+		"Number of agents that took part in a handshake within the activity window.",
+		func() []metrics.Sample {
+			return []metrics.Sample{{Value: float64(m.activeAgents())}}
+		},
+	)
+
+	return m
+}
+
+func (m *trentMetrics) seen(ids ...string) {
+	now := time.Now()
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, id := range ids {
+		m.lastSeen[id] = now
+	}
+}
+
+func (m *trentMetrics) activeAgents() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	active := 0
+	for id, t := range m.lastSeen {
+		if time.Since(t) > activeWindow {
+			delete(m.lastSeen, id)
+			continue
+		}
+		active++
+	}
+
+	return active
+}
+
+func (m *trentMetrics) observeRSA(operation string, start time.Time) {
+	m.rsaDuration.Observe(time.Since(start).Seconds(), operation)
+}
@@ -0,0 +1,365 @@
+package trent
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/sudeeya/key-exchange/internal/pkg/middleware"
+)
+
+const (
+	policyAllow = "allow"
+	policyDeny  = "deny"
+
+	groupPrefix = "group:"
+	anyAgent    = "*"
+)
+
+const (
+	decisionAllowed = "allowed"
+	decisionDenied  = "denied"
+	decisionLimited = "limited"
+	decisionUnknown = "unknown"
+)
+
+var errUnknownAgent = errors.New("unknown agent")
+
+// policyFile is the JSON policy format. Rules are checked in order and the
+// first one that applies decides; Default is used when none does.
+type policyFile struct {
+	Default string              `json:"default"`
+	Groups  map[string][]string `json:"groups"`
+	Rules   []policyRuleFile    `json:"rules"`
+}
+
+type policyRuleFile struct {
+	Name   string   `json:"name"`
+	Effect string   `json:"effect"`
+	From   []string `json:"from"`
+	To     []string `json:"to"`
+	Hours  string   `json:"hours"`
+	Rate   string   `json:"rate"`
+}
+
+// policy decides which pairs of agents Trent issues certificates and
+// session keys for.
+type policy struct {
+	allow  bool
+	groups map[string][]string
+	rules  []*policyRule
+}
+
+type policyRule struct {
+	name  string
+	allow bool
+	from  []string
+	to    []string
+	hours *hoursWindow
+	rate  *rateLimit
+}
+
+type decision struct {
+	allowed    bool
+	status     int
+	result     string
+	rule       string
+	reason     string
+	retryAfter time.Duration
+}
+
+// allowAll is the policy used when no policy file is configured.
+func allowAll() *policy {
+	return &policy{allow: true}
+}
+
+func loadPolicy(file string) (*policy, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	var pf policyFile
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&pf); err != nil {
+		return nil, fmt.Errorf("policy %s: %w", file, err)
+	}
+
+	p := &policy{
+		groups: pf.Groups,
+		rules:  make([]*policyRule, 0, len(pf.Rules)),
+	}
+
+	switch pf.Default {
+	case policyAllow:
+		p.allow = true
+	case policyDeny, "":
+	default:
+		return nil, fmt.Errorf("policy %s: default must be %s or %s, got %q", file, policyAllow, policyDeny, pf.Default)
+	}
+
+	for i, rf := range pf.Rules {
+		rule, err := p.newRule(i, rf)
+		if err != nil {
+			return nil, fmt.Errorf("policy %s: %w", file, err)
+		}
+		p.rules = append(p.rules, rule)
+	}
+
+	return p, nil
+}
+
+func (p *policy) newRule(i int, rf policyRuleFile) (*policyRule, error) {
+	rule := &policyRule{
+		name: rf.Name,
+		from: rf.From,
+		to:   rf.To,
+	}
+	if rule.name == "" {
+		rule.name = "rule " + strconv.Itoa(i+1)
+	}
+
+	switch rf.Effect {
+	case policyAllow:
+		rule.allow = true
+	case policyDeny:
+	default:
+		return nil, fmt.Errorf("%s: effect must be %s or %s, got %q", rule.name, policyAllow, policyDeny, rf.Effect)
+	}
+
+	if len(rule.from) == 0 || len(rule.to) == 0 {
+		return nil, fmt.Errorf("%s: from and to must not be empty", rule.name)
+	}
+	for _, ref := range slices.Concat(rule.from, rule.to) {
+		group, ok := strings.CutPrefix(ref, groupPrefix)
+		if _, defined := p.groups[group]; ok && !defined {
+			return nil, fmt.Errorf("%s: undefined group %q", rule.name, group)
+		}
+	}
+
+	var err error
+	if rf.Hours != "" {
+		if rule.hours, err = parseHours(rf.Hours); err != nil {
+			return nil, fmt.Errorf("%s: %w", rule.name, err)
+		}
+	}
+	if rf.Rate != "" {
+		if rule.rate, err = parseRate(rf.Rate); err != nil {
+			return nil, fmt.Errorf("%s: %w", rule.name, err)
+		}
+	}
+
+	return rule, nil
+}
+
+func (p *policy) refers(refs []string, id string) bool {
+	for _, ref := range refs {
+		if ref == anyAgent || ref == id {
+			return true
+		}
+		if group, ok := strings.CutPrefix(ref, groupPrefix); ok && slices.Contains(p.groups[group], id) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// decide returns whether initiator may establish a session with acceptor at
+// now. Rate limits are charged only when issue is set, that is when Trent
+// hands out a session key.
+func (p *policy) decide(initiator, acceptor string, now time.Time, issue bool) decision {
+	outside := ""
+	for _, rule := range p.rules {
+		if !p.refers(rule.from, initiator) || !p.refers(rule.to, acceptor) {
+			continue
+		}
+		if rule.hours != nil && !rule.hours.contains(now) {
+			outside = rule.name
+			continue
+		}
+
+		if !rule.allow {
+			return decision{status: http.StatusForbidden, result: decisionDenied, rule: rule.name, reason: "denied by " + rule.name}
+		}
+		if rule.rate != nil {
+			if ok, retryAfter := rule.rate.take(initiator+"\x00"+acceptor, now, issue); !ok {
+				return decision{status: http.StatusTooManyRequests, result: decisionLimited, rule: rule.name, reason: "rate limit of " + rule.name + " exceeded", retryAfter: retryAfter}
+			}
+		}
+
+		return decision{allowed: true, status: http.StatusOK, result: decisionAllowed, rule: rule.name}
+	}
+
+	if p.allow {
+		return decision{allowed: true, status: http.StatusOK, result: decisionAllowed, rule: "default"}
+	}
+
+	reason := "no rule allows this pair"
+	if outside != "" {
+		reason = "outside the hours of " + outside
+	}
+
+	return decision{status: http.StatusForbidden, result: decisionDenied, rule: "default", reason: reason}
+}
+
+// hoursWindow is a daily time window in Trent's local time. It wraps around
+// midnight if it ends before it starts.
+type hoursWindow struct {
+	start time.Duration
+	end   time.Duration
+}
+
+func parseHours(s string) (*hoursWindow, error) {
+	from, to, ok := strings.Cut(s, "-")
+	if !ok {
+		return nil, fmt.Errorf("hours must look like 09:00-18:00, got %q", s)
+	}
+
+	start, err := parseClock(from)
+	if err != nil {
+		return nil, err
+	}
+	end, err := parseClock(to)
+	if err != nil {
+		return nil, err
+	}
+
+	return &hoursWindow{start: start, end: end}, nil
+}
+
+func parseClock(s string) (time.Duration, error) {
+	t, err := time.Parse("15:04", strings.TrimSpace(s))
+	if err != nil {
+		return 0, fmt.Errorf("invalid time of day %q", s)
+	}
+
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
+
+func (h *hoursWindow) contains(now time.Time) bool {
+	clock := time.Duration(now.Hour())*time.Hour + time.Duration(now.Minute())*time.Minute
+	if h.start <= h.end {
+		return clock >= h.start && clock < h.end
+	}
+
+	return clock >= h.start || clock < h.end
+}
+
+// rateLimit allows a number of session keys per pair of agents within a
+// sliding window.
+type rateLimit struct {
+	limit  int
+	window time.Duration
+
+	mu     sync.Mutex
+	issued map[string][]time.Time
+}
+
+func parseRate(s string) (*rateLimit, error) {
+	count, per, ok := strings.Cut(s, "/")
+	if !ok {
+		return nil, fmt.Errorf("rate must look like 10/1h, got %q", s)
+	}
+
+	limit, err := strconv.Atoi(count)
+	if err != nil || limit <= 0 {
+		return nil, fmt.Errorf("invalid rate count %q", count)
+	}
+	window, err := time.ParseDuration(per)
+	if err != nil || window <= 0 {
+		return nil, fmt.Errorf("invalid rate window %q", per)
+	}
+
+	return &rateLimit{
+		limit:  limit,
+		window: window,
+		issued: make(map[string][]time.Time),
+	}, nil
+}
+
+// take reports whether pair may have another session key and, if not, when
+// the oldest one leaves the window.
+func (r *rateLimit) take(pair string, now time.Time, issue bool) (bool, time.Duration) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	issued := slices.DeleteFunc(r.issued[pair], func(t time.Time) bool {
+		return now.Sub(t) >= r.window
+	})
+	if len(issued) >= r.limit {
+		r.issued[pair] = issued
+		return false, r.window - now.Sub(issued[0])
+	}
+
+	if issue {
+		issued = append(issued, now)
+	}
+	if len(issued) == 0 {
+		delete(r.issued, pair)
+	} else {
+		r.issued[pair] = issued
+	}
+
+	return true, 0
+}
+
+// reloadPolicy reads the policy file again. The current policy is kept if
+// the new one is invalid.
+func (t *Trent) reloadPolicy() error {
+	if t.cfg.PolicyFile == "" {
+		return errors.New("no policy file configured")
+	}
+
+	p, err := loadPolicy(t.cfg.PolicyFile)
+	if err != nil {
+		return err
+	}
+	t.policy.Store(p)
+
+	return nil
+}
+
+// authorize checks that both agents are registered and that the policy
+// allows them to talk, writing the error response if not. Every decision
+// is written to the audit log.
+func (t *Trent) authorize(w http.ResponseWriter, step, initiator, acceptor string, issue bool) bool {
+	var d decision
+	if missing := t.registry().unknown(initiator, acceptor); missing != "" {
+		err := fmt.Errorf("%w: %q", errUnknownAgent, missing)
+		d = decision{status: http.StatusNotFound, result: decisionUnknown, reason: err.Error()}
+	} else {
+		d = t.policy.Load().decide(initiator, acceptor, time.Now(), issue)
+	}
+
+	t.metrics.policyDecisions.Inc(step, d.result)
+	t.audit.Info("Policy decision",
+		zap.String("step", step),
+		zap.String("initiator", initiator),
+		zap.String("acceptor", acceptor),
+		zap.String("decision", d.result),
+		zap.String("rule", d.rule),
+		zap.String("reason", d.reason),
+	)
+
+	switch {
+	case d.allowed:
+	case d.retryAfter > 0:
+		middleware.Reject(w, d.status, d.retryAfter, d.reason)
+	default:
+		http.Error(w, d.reason, d.status)
+	}
+
+	return d.allowed
+}
@@ -0,0 +1,141 @@
+package trent
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testPolicy = `{
+	"default": "deny",
+	"groups": {"ops": ["carol", "dave"]},
+	"rules": [
+		{"name": "no mallory", "effect": "deny", "from": ["mallory"], "to": ["*"]},
+		{"name": "office hours", "effect": "allow", "from": ["alice"], "to": ["bob"], "hours": "09:00-18:00"},
+		{"name": "night shift", "effect": "allow", "from": ["group:ops"], "to": ["*"], "hours": "22:00-06:00"},
+		{"name": "limited", "effect": "allow", "from": ["erin"], "to": ["bob"], "rate": "2/1h"},
+		{"effect": "allow", "from": ["*"], "to": ["group:ops"]}
+	]
+}`
+
+func TestPolicyDecide(t *testing.T) {
+	p := loadTestPolicy(t, testPolicy)
+
+	tests := []struct {
+		name      string
+		initiator string
+		acceptor  string
+		clock     string
+		status    int
+		rule      string
+		reason    string
+	}{
+		{"within hours", "alice", "bob", "10:00", http.StatusOK, "office hours", ""},
+		{"at the end of the hours", "alice", "bob", "18:00", http.StatusForbidden, "default", "outside the hours of office hours"},
+		{"denied before a later allow", "mallory", "carol", "10:00", http.StatusForbidden, "no mallory", "denied by no mallory"},
+		{"unnamed rule", "alice", "carol", "10:00", http.StatusOK, "rule 5", ""},
+		{"group before midnight", "carol", "bob", "23:00", http.StatusOK, "night shift", ""},
+		{"group after midnight", "dave", "bob", "05:59", http.StatusOK, "night shift", ""},
+		{"group outside the hours", "carol", "bob", "12:00", http.StatusForbidden, "default", "outside the hours of night shift"},
+		{"no rule", "bob", "alice", "10:00", http.StatusForbidden, "default", "no rule allows this pair"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := p.decide(tt.initiator, tt.acceptor, testClock(t, tt.clock), true)
+			if d.status != tt.status || d.allowed != (tt.status == http.StatusOK) || d.rule != tt.rule || d.reason != tt.reason {
+				t.Fatalf("decided %d by %q (%q), want %d by %q (%q)", d.status, d.rule, d.reason, tt.status, tt.rule, tt.reason)
+			}
+		})
+	}
+}
+
+func TestPolicyRate(t *testing.T) {
+	p := loadTestPolicy(t, testPolicy)
+	now := testClock(t, "10:00")
+
+	// Certificates alone do not count against the rate.
+	for range 5 {
+		if d := p.decide("erin", "bob", now, false); !d.allowed {
+			t.Fatalf("certificate was refused: %s", d.reason)
+		}
+	}
+	for i := range 2 {
+		if d := p.decide("erin", "bob", now.Add(time.Duration(i)*time.Minute), true); !d.allowed {
+			t.Fatalf("session key %d was refused: %s", i+1, d.reason)
+		}
+	}
+
+	d := p.decide("erin", "bob", now.Add(10*time.Minute), false)
+	if d.allowed || d.status != http.StatusTooManyRequests || d.retryAfter != 50*time.Minute {
+		t.Fatalf("third session was decided %d, retry after %s; want %d, retry after 50m", d.status, d.retryAfter, http.StatusTooManyRequests)
+	}
+	if d := p.decide("alice", "carol", now, true); !d.allowed {
+		t.Fatalf("rate of another pair was charged: %s", d.reason)
+	}
+	if d := p.decide("erin", "bob", now.Add(time.Hour), true); !d.allowed {
+		t.Fatalf("session key was refused after the window: %s", d.reason)
+	}
+}
+
+func TestLoadPolicyRejects(t *testing.T) {
+	tests := []struct {
+		name   string
+		policy string
+		want   string
+	}{
+		{"invalid JSON", `{"default": "deny"`, "unexpected EOF"},
+		{"unknown field", `{"default": "deny", "rulez": []}`, "unknown field"},
+		{"default", `{"default": "maybe"}`, "default must be allow or deny"},
+		{"effect", `{"rules": [{"effect": "permit", "from": ["*"], "to": ["*"]}]}`, "rule 1: effect must be allow or deny"},
+		{"empty from", `{"rules": [{"effect": "allow", "to": ["*"]}]}`, "from and to must not be empty"},
+		{"undefined group", `{"rules": [{"name": "ops", "effect": "allow", "from": ["group:ops"], "to": ["*"]}]}`, `ops: undefined group "ops"`},
+		{"hours", `{"rules": [{"effect": "allow", "from": ["*"], "to": ["*"], "hours": "9-18"}]}`, "invalid time of day"},
+		{"hours without end", `{"rules": [{"effect": "allow", "from": ["*"], "to": ["*"], "hours": "09:00"}]}`, "hours must look like"},
+		{"rate count", `{"rules": [{"effect": "allow", "from": ["*"], "to": ["*"], "rate": "0/1h"}]}`, "invalid rate count"},
+		{"rate window", `{"rules": [{"effect": "allow", "from": ["*"], "to": ["*"], "rate": "10/hour"}]}`, "invalid rate window"},
+		{"rate without window", `{"rules": [{"effect": "allow", "from": ["*"], "to": ["*"], "rate": "10"}]}`, "rate must look like"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "policy.json")
+			if err := os.WriteFile(path, []byte(tt.policy), 0600); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := loadPolicy(path); err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Fatalf("loadPolicy returned %v, want an error with %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func loadTestPolicy(t *testing.T, policy string) *policy {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "policy.json")
+	if err := os.WriteFile(path, []byte(policy), 0600); err != nil {
+		t.Fatal(err)
+	}
+	p, err := loadPolicy(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return p
+}
+
+// testClock returns the time clock, like 09:30, on a fixed day in local time.
+func testClock(t *testing.T, clock string) time.Time {
+	t.Helper()
+
+	c, err := time.Parse("15:04", clock)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return time.Date(2026, time.March, 2, c.Hour(), c.Minute(), 0, 0, time.Local)
+}
@@ -1,37 +1,70 @@
 package trent
 
 import (
+	"context"
+	"crypto/rsa"
+	"encoding/json"
+	"errors"
 	"log"
 	"net/http"
 	"os"
 	"os/signal"
+	"sync/atomic"
 	"syscall"
+	"time"
 
 	"github.com/go-chi/chi/v5"
 	"go.uber.org/zap"
 
 	"github.com/sudeeya/key-exchange/internal/pkg/api"
+	"github.com/sudeeya/key-exchange/internal/pkg/crypto"
+	"github.com/sudeeya/key-exchange/internal/pkg/health"
 	"github.com/sudeeya/key-exchange/internal/pkg/middleware"
 	"github.com/sudeeya/key-exchange/internal/pkg/pem"
 	"github.com/sudeeya/key-exchange/internal/pkg/rng"
+	"github.com/sudeeya/key-exchange/internal/pkg/tracing"
+)
+
+const (
+	serviceName    = "trent"
+	busyRetryAfter = time.Second
 )
 
 type Trent struct {
 	cfg        *config
 	logger     *zap.Logger
-	agentList  agents
+	audit      *zap.Logger
+	agentList  atomic.Pointer[agents]
+	policy     atomic.Pointer[policy]
+	nonces     *replayCache
+	auditLog   *auditLog
+	agentRate  *middleware.RateLimiter
 	mux        *chi.Mux
-	rng        *rng.RNG
-	privateKey []byte
-	publicKey  []byte
+	rng        rng.RNG
+	metrics    *trentMetrics
+	tracer     *tracing.Tracer
+	traces     *tracing.Collector
+	server     *http.Server
+	debug      *http.Server
+	draining   atomic.Bool
+	privateKey *rsa.PrivateKey
+	// privateKeyPEM is parsed on every use if keys are not cached.
+	privateKeyPEM []byte
+	publicKey     []byte
 }
 
-func NewTrent() *Trent {
+// NewTrent sets up Trent from the environment. random is where its session
+// keys and IDs come from.
+func NewTrent(random rng.RNG) *Trent {
 	cfg, err := newConfig()
 	if err != nil {
 		log.Fatal(err)
 	}
 
+	return newTrent(cfg, random)
+}
+
+func newTrent(cfg *config, random rng.RNG) *Trent {
 	loggerCfg := zap.NewDevelopmentConfig()
 	loggerCfg.OutputPaths = []string{
 		cfg.LogFile,
@@ -41,8 +74,18 @@ func NewTrent() *Trent {
 		log.Fatal(err)
 	}
 
+	if cfg.DebugAddr != "" {
+		if err := api.CheckLoopback(cfg.DebugAddr); err != nil {
+			logger.Fatal(err.Error())
+		}
+	}
+
 	logger.Info("Extracting RSA private key")
-	privateKey, err := pem.ExtractRSAPrivateKey(cfg.PrivateKey)
+	privateKeyPEM, err := pem.ExtractRSAPrivateKey(cfg.PrivateKey)
+	if err != nil {
+		logger.Fatal(err.Error())
+	}
+	privateKey, err := pem.ParseRSAPrivateKey(privateKeyPEM)
 	if err != nil {
 		logger.Fatal(err.Error())
 	}
@@ -53,59 +96,304 @@ func NewTrent() *Trent {
 	}
 
 	logger.Info("Forming agent list")
-	agentList, err := newAgents(cfg.AgentIDs, cfg.AgentPublicKeys)
+	agentList, err := newAgents(cfg.AgentIDs, cfg.AgentPublicKeys, cfg.AgentMLKEMKeys, privateKey)
+	if err != nil {
+		logger.Fatal(err.Error())
+	}
+
+	logger.Info("Loading access policy")
+	accessPolicy := allowAll()
+	if cfg.PolicyFile != "" {
+		accessPolicy, err = loadPolicy(cfg.PolicyFile)
+		if err != nil {
+			logger.Fatal(err.Error())
+		}
+	}
+
+	logger.Info("Opening audit log")
+	if cfg.AuditCheckpointInterval <= 0 {
+		logger.Fatal("AUDIT_CHECKPOINT_INTERVAL must be positive")
+	}
+	auditLog, err := openAuditLog(cfg.AuditFile, cfg.AuditCheckpointInterval, privateKey, logger.Named("audit"))
 	if err != nil {
 		logger.Fatal(err.Error())
 	}
 
+	logger.Info("Initializing metrics")
+	metrics := newTrentMetrics()
+	metrics.registeredAgents.Set(float64(len(agentList)))
+
+	logger.Info("Initializing tracer")
+	traces := tracing.NewCollector(0)
+	exporters := []tracing.Exporter{traces}
+	if cfg.TraceFile != "" {
+		fileExporter, err := tracing.NewFileExporter(cfg.TraceFile)
+		if err != nil {
+			logger.Fatal(err.Error())
+		}
+		exporters = append(exporters, fileExporter)
+	}
+	tracer := tracing.NewTracer(serviceName, exporters...)
+
 	logger.Info("Initializing router")
 	mux := chi.NewRouter()
 
 	logger.Info("Initializing middleware")
+	mux.Use(middleware.WithTracing(tracer))
+	mux.Use(middleware.WithMetrics(metrics.http))
+	mux.Use(middleware.WithBodyLimit(cfg.MaxBodyBytes))
 	mux.Use(middleware.WithLogging(logger))
 
-	logger.Info("Initializing RNG")
-	rng := rng.NewRNG()
+	if rng.IsDeterministic(random) {
+		logger.Warn("Using a deterministic RNG: session keys are predictable from the seed")
+	}
 
-	return &Trent{
-		cfg:        cfg,
-		logger:     logger,
-		agentList:  agentList,
-		mux:        mux,
-		rng:        rng,
-		privateKey: privateKey,
-		publicKey:  publicKey,
+	t := &Trent{
+		cfg:           cfg,
+		logger:        logger,
+		audit:         logger.Named("audit"),
+		nonces:        newReplayCache(2 * cfg.RequestMaxSkew),
+		auditLog:      auditLog,
+		agentRate:     middleware.NewRateLimiter(cfg.AgentRateLimit, cfg.AgentRateBurst),
+		mux:           mux,
+		rng:           random,
+		metrics:       metrics,
+		tracer:        tracer,
+		traces:        traces,
+		privateKey:    privateKey,
+		privateKeyPEM: privateKeyPEM,
+		publicKey:     publicKey,
 	}
-}
+	t.policy.Store(accessPolicy)
+	t.agentList.Store(&agentList)
 
-func (t Trent) Run() {
-	t.logger.Info("Initializing endpoints")
+	logger.Info("Initializing endpoints")
 	t.addRoutes()
 
-	sigCh := make(chan os.Signal, 1)
-	signal.Notify(sigCh, syscall.SIGTERM, syscall.SIGINT, syscall.SIGQUIT)
+	return t
+}
 
-	t.logger.Info("Server is running")
+// Handler serves Trent's endpoints, for running Trent on a listener other
+// than its own, such as in tests.
+func (t *Trent) Handler() http.Handler {
+	return t.mux
+}
+
+func (t *Trent) Run() {
+	t.server = &http.Server{
+		Addr:              t.cfg.Addr,
+		Handler:           t.mux,
+		ReadHeaderTimeout: t.cfg.ReadHeaderTimeout,
+		ReadTimeout:       t.cfg.ReadTimeout,
+		WriteTimeout:      t.cfg.WriteTimeout,
+		IdleTimeout:       t.cfg.IdleTimeout,
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, syscall.SIGINT, syscall.SIGQUIT)
+	defer stop()
+
+	reload := make(chan os.Signal, 1)
+	signal.Notify(reload, syscall.SIGHUP)
+	defer signal.Stop(reload)
+
+	errCh := make(chan error, 2)
 	go func() {
-		<-sigCh
-		t.logger.Info("Trent is shutting down")
-		t.Shutdown()
+		errCh <- t.server.ListenAndServe()
 	}()
 
-	if err := http.ListenAndServe(t.cfg.Addr, t.mux); err != nil {
-		t.logger.Fatal(err.Error())
+	if t.cfg.DebugAddr != "" {
+		debugMux := chi.NewRouter()
+		debugMux.Method(http.MethodGet, api.TracesEndpoint, t.traces.Handler())
+		t.debug = &http.Server{
+			Addr:              t.cfg.DebugAddr,
+			Handler:           debugMux,
+			ReadHeaderTimeout: t.cfg.ReadHeaderTimeout,
+		}
+		go func() {
+			errCh <- t.debug.ListenAndServe()
+		}()
 	}
+
+	t.logger.Info("Server is running")
+loop:
+	for {
+		select {
+		case <-reload:
+			if err := t.reloadAgents(); err != nil {
+				t.logger.Error("Failed to reload agent keys", zap.Error(err))
+			} else {
+				t.logger.Info("Agent keys reloaded")
+			}
+			if t.cfg.PolicyFile == "" {
+				continue
+			}
+			if err := t.reloadPolicy(); err != nil {
+				t.logger.Error("Failed to reload access policy", zap.Error(err))
+				continue
+			}
+			t.logger.Info("Access policy reloaded", zap.String("file", t.cfg.PolicyFile))
+		case <-ctx.Done():
+			t.logger.Info("Trent is shutting down")
+			break loop
+		case err := <-errCh:
+			if !errors.Is(err, http.ErrServerClosed) {
+				t.logger.Error("Server failed", zap.Error(err))
+			}
+			break loop
+		}
+	}
+
+	t.Shutdown()
 }
 
-func (t Trent) Shutdown() {
+// Shutdown stops accepting new requests and waits for in-flight ones
+// to finish within the configured drain timeout.
+func (t *Trent) Shutdown() {
+	t.draining.Store(true)
+
+	ctx, cancel := context.WithTimeout(context.Background(), t.cfg.ShutdownTimeout)
+	defer cancel()
+
+	for _, server := range []*http.Server{t.server, t.debug} {
+		if server == nil {
+			continue
+		}
+		if err := server.Shutdown(ctx); err != nil {
+			t.logger.Error("Failed to drain connections", zap.String("addr", server.Addr), zap.Error(err))
+		}
+	}
+
+	if err := t.auditLog.close(); err != nil {
+		t.logger.Error("Failed to close audit log", zap.Error(err))
+	}
+
+	if err := t.tracer.Close(); err != nil {
+		t.logger.Error("Failed to close tracer", zap.Error(err))
+	}
+
+	t.logger.Info("Trent stopped")
 	if err := t.logger.Sync(); err != nil {
 		t.logger.Sugar().Fatalf("failed to sync logger: %v", err)
 	}
-
-	os.Exit(0)
 }
 
 func (t *Trent) addRoutes() {
-	t.mux.Post(api.Step2Endpoint, step2Handler(t))
-	t.mux.Post(api.Step5Endpoint, step5Handler(t))
+	// The steps make Trent do RSA work, so they are rate limited per
+	// client address and only a few are served at a time.
+	t.mux.Group(func(r chi.Router) {
+		r.Use(middleware.WithRateLimit(middleware.NewRateLimiter(t.cfg.IPRateLimit, t.cfg.IPRateBurst)))
+		r.Use(middleware.WithConcurrencyLimit(t.cfg.MaxConcurrentRequests, busyRetryAfter))
+		r.Post(api.Step2Endpoint, step2Handler(t))
+		r.Post(api.Step5Endpoint, step5Handler(t))
+	})
+	t.mux.Method(http.MethodGet, api.MetricsEndpoint, t.metrics.registry.Handler())
+	t.mux.Method(http.MethodGet, api.HealthEndpoint, health.LivenessHandler())
+	t.mux.Method(http.MethodGet, api.ReadyEndpoint, health.ReadinessHandler(readinessTimeout, t.readinessChecks()...))
+}
+
+// registry returns the agents Trent currently knows.
+func (t *Trent) registry() agents {
+	return *t.agentList.Load()
+}
+
+// reloadAgents reads the agents' public keys again, so that a rotated key
+// takes effect without a restart. The certificates signed for the old keys
+// are dropped with them.
+func (t *Trent) reloadAgents() error {
+	agentList, err := newAgents(t.cfg.AgentIDs, t.cfg.AgentPublicKeys, t.cfg.AgentMLKEMKeys, t.privateKey)
+	if err != nil {
+		return err
+	}
+	t.agentList.Store(&agentList)
+	t.metrics.registeredAgents.Set(float64(len(agentList)))
+
+	return nil
+}
+
+// rsaKey returns Trent's private key, parsed again unless keys are cached.
+// It returns nil if the key cannot be parsed.
+func (t *Trent) rsaKey() *rsa.PrivateKey {
+	if t.cfg.CacheKeys {
+		return t.privateKey
+	}
+
+	key, err := pem.ParseRSAPrivateKey(t.privateKeyPEM)
+	if err != nil {
+		return nil
+	}
+
+	return key
+}
+
+// agentKey returns a's public key, parsed again unless keys are cached. It
+// returns nil if the key cannot be parsed.
+func (t *Trent) agentKey(a agent) *rsa.PublicKey {
+	if t.cfg.CacheKeys {
+		return a.key
+	}
+
+	key, err := pem.ParseRSAPublicKey(a.PublicKey)
+	if err != nil {
+		return nil
+	}
+
+	return key
+}
+
+// publicKeyCert returns cert, one of the certificates signed for an agent's
+// public key, or signs it again if keys are not cached.
+func (t *Trent) publicKeyCert(ctx context.Context, cert api.Cert) (api.Cert, error) {
+	if t.cfg.CacheKeys {
+		return cert, nil
+	}
+
+	infoJSON, err := json.Marshal(cert.Information)
+	if err != nil {
+		return api.Cert{}, err
+	}
+	cert.Signature = t.signRSA(ctx, infoJSON)
+
+	return cert, nil
+}
+
+func (t *Trent) signRSA(ctx context.Context, message []byte) []byte {
+	_, span := t.tracer.Start(ctx, "rsa.sign")
+	defer span.End()
+	defer t.metrics.observeRSA(rsaSign, time.Now())
+
+	return crypto.SignRSAKey(message, t.rsaKey())
+}
+
+func (t *Trent) encryptRSA(ctx context.Context, plaintext []byte, a agent) []byte {
+	_, span := t.tracer.Start(ctx, "rsa.encrypt")
+	defer span.End()
+	defer t.metrics.observeRSA(rsaEncrypt, time.Now())
+
+	return crypto.EncryptRSAKey(plaintext, t.agentKey(a), t.rng)
+}
+
+func (t *Trent) encryptHybrid(ctx context.Context, plaintext []byte, a agent) ([]byte, error) {
+	_, span := t.tracer.Start(ctx, "hybrid.encrypt")
+	defer span.End()
+
+	return crypto.EncryptHybrid(plaintext, t.agentKey(a), a.kemKey, t.rng)
+}
+
+func (t *Trent) decryptRSA(ctx context.Context, ciphertext []byte) []byte {
+	_, span := t.tracer.Start(ctx, "rsa.decrypt")
+	defer span.End()
+	defer t.metrics.observeRSA(rsaDecrypt, time.Now())
+
+	return crypto.DecryptRSAKey(ciphertext, t.rsaKey())
+}
+
+func (t *Trent) verifyRSA(ctx context.Context, message, signature []byte, a agent) bool {
+	_, span := t.tracer.Start(ctx, "rsa.verify")
+	defer span.End()
+	defer t.metrics.observeRSA(rsaVerify, time.Now())
+
+	ok := crypto.VerifyRSAKey(message, signature, t.agentKey(a))
+	span.SetAttribute("valid", ok)
+
+	return ok
 }